@@ -0,0 +1,69 @@
+package user_handlers
+
+import (
+	"net/http"
+	"star-fire/internal/models"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuctionHandler struct {
+	server *models.Server
+}
+
+func NewAuctionHandler(server *models.Server) *AuctionHandler {
+	return &AuctionHandler{server: server}
+}
+
+// ClearingPrices returns bid, ask and clearing price statistics of auction-matched requests.
+// Defaults to the last 7 days; model is optional.
+// GET /api/market/clearing-prices?model=xxx&start_date=2006-01-02&end_date=2006-01-02
+func (h *AuctionHandler) ClearingPrices(c *gin.Context) {
+	endTime := time.Now()
+	startTime := endTime.AddDate(0, 0, -7)
+	if startDate := c.Query("start_date"); startDate != "" {
+		if t, err := time.Parse("2006-01-02", startDate); err == nil {
+			startTime = t
+		}
+	}
+	if endDate := c.Query("end_date"); endDate != "" {
+		if t, err := time.Parse("2006-01-02", endDate); err == nil {
+			endTime = t.Add(24 * time.Hour)
+		}
+	}
+
+	stats, err := h.server.TokenUsageDB.GetClearingStats(c.Query("model"), startTime, endTime)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query clearing prices failed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rule": h.server.AuctionRule(), "stats": stats})
+}
+
+// GetAuctionConfig returns the current auction clearing rule.
+// GET /admin/auction-config
+func (h *AuctionHandler) GetAuctionConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"rule": h.server.AuctionRule()})
+}
+
+// SetAuctionConfig sets the auction clearing rule: pay-as-bid or second-price.
+// PUT /admin/auction-config
+func (h *AuctionHandler) SetAuctionConfig(c *gin.Context) {
+	var req struct {
+		Rule string `json:"rule" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if !models.ValidAuctionRule(req.Rule) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rule must be " + models.AuctionPayAsBid + " or " + models.AuctionSecondPrice})
+		return
+	}
+	if err := h.server.SystemConfigDB.Set(models.ConfigKeyAuctionRule, req.Rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save config: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rule": req.Rule})
+}
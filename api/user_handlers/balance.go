@@ -39,9 +39,17 @@ func (h *BalanceHandler) GetBalance(c *gin.Context) {
 		return
 	}
 
+	// 当前订阅周期的套餐额度使用情况，无订阅时为 null
+	subscription, err := h.server.SubscriptionDB.GetStatus(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取订阅信息失败"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"balance":     balance,
-		"total_spent": totalSpent,
+		"balance":      balance,
+		"total_spent":  totalSpent,
+		"subscription": subscription,
 	})
 }
 
@@ -137,7 +145,7 @@ func (h *BalanceHandler) ConfirmRecharge(c *gin.Context) {
 	}
 
 	// Add balance to user
-	if err := h.server.UserDB.AddBalance(userIDStr, order.Amount); err != nil {
+	if _, err := h.server.BalanceHistoryDB.Grant(userIDStr, order.Amount, models.BalanceTypeRecharge, orderID, order.PaymentMethod); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "充值失败"})
 		return
 	}
@@ -189,3 +197,23 @@ func (h *BalanceHandler) GetRechargeHistory(c *gin.Context) {
 		"total":  total,
 	})
 }
+
+// GetBalanceHistory returns user's balance change records (recharge, bonus, promo, coupon, referral)
+func (h *BalanceHandler) GetBalanceHistory(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	page, size := parsePageParams(c)
+
+	records, total, err := h.server.BalanceHistoryDB.GetUserHistory(userIDStr, c.Query("type"), page, size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询余额记录失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"records": records,
+		"total":   total,
+	})
+}
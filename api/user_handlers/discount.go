@@ -0,0 +1,234 @@
+package user_handlers
+
+import (
+	"errors"
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DiscountHandler struct {
+	server *models.Server
+}
+
+func NewDiscountHandler(server *models.Server) *DiscountHandler {
+	return &DiscountHandler{server: server}
+}
+
+// discountRateRequest is the request body for updating a discount rule's rate.
+type discountRateRequest struct {
+	Rate float64 `json:"rate" binding:"required,gt=0,lt=1"`
+}
+
+func (h *DiscountHandler) writeDiscountError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrDiscountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrInvalidDiscountRate):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存折扣失败"})
+	}
+}
+
+func parseDiscountID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid discount id"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// ==================== provider 折扣 ====================
+
+// ListMyDiscounts lists the discounts the current user offers on their own clients.
+// GET /api/user/discounts
+func (h *DiscountHandler) ListMyDiscounts(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	rules, err := h.server.DiscountDB.ListDiscounts(models.DiscountScopeProvider, userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询折扣失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"discounts": rules})
+}
+
+// SaveMyDiscount creates or updates a discount for a consumer on the current user's clients.
+// POST /api/user/discounts
+func (h *DiscountHandler) SaveMyDiscount(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Username string  `json:"username" binding:"required"`
+		Model    string  `json:"model"`
+		Rate     float64 `json:"rate" binding:"required,gt=0,lt=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	consumer, err := h.server.UserDB.GetUser(strings.TrimSpace(req.Username))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if consumer.ID == userIDStr {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot set a discount for yourself"})
+		return
+	}
+
+	rule, err := h.server.DiscountDB.SaveDiscount(&models.ModelPrice{
+		Scope:            models.DiscountScopeProvider,
+		ProviderID:       userIDStr,
+		UserID:           consumer.ID,
+		ModelName:        h.server.CanonicalRuleModel(req.Model),
+		UserDiscountRate: req.Rate,
+	})
+	if err != nil {
+		h.writeDiscountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"discount": rule})
+}
+
+// UpdateMyDiscount changes the rate of one of the current user's discounts.
+// PUT /api/user/discounts/:id
+func (h *DiscountHandler) UpdateMyDiscount(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	id, ok := parseDiscountID(c)
+	if !ok {
+		return
+	}
+	var req discountRateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	rule, err := h.server.DiscountDB.UpdateDiscountRate(id, models.DiscountScopeProvider, userIDStr, req.Rate)
+	if err != nil {
+		h.writeDiscountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"discount": rule})
+}
+
+// DeleteMyDiscount removes one of the current user's discounts.
+// DELETE /api/user/discounts/:id
+func (h *DiscountHandler) DeleteMyDiscount(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	id, ok := parseDiscountID(c)
+	if !ok {
+		return
+	}
+	if err := h.server.DiscountDB.DeleteDiscount(id, models.DiscountScopeProvider, userIDStr); err != nil {
+		h.writeDiscountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "discount deleted"})
+}
+
+// ==================== 等级折扣（管理员） ====================
+
+// ListTierDiscounts lists the global discounts for user tiers.
+// GET /admin/discounts
+func (h *DiscountHandler) ListTierDiscounts(c *gin.Context) {
+	rules, err := h.server.DiscountDB.ListDiscounts(models.DiscountScopeTier, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询折扣失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"discounts": rules})
+}
+
+// SaveTierDiscount creates or updates a global discount for a user tier.
+// POST /admin/discounts
+func (h *DiscountHandler) SaveTierDiscount(c *gin.Context) {
+	var req struct {
+		Tier  string  `json:"tier" binding:"required"`
+		Model string  `json:"model"`
+		Rate  float64 `json:"rate" binding:"required,gt=0,lt=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	rule, err := h.server.DiscountDB.SaveDiscount(&models.ModelPrice{
+		Scope:            models.DiscountScopeTier,
+		Tier:             strings.TrimSpace(req.Tier),
+		ModelName:        h.server.CanonicalRuleModel(req.Model),
+		UserDiscountRate: req.Rate,
+	})
+	if err != nil {
+		h.writeDiscountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"discount": rule})
+}
+
+// UpdateTierDiscount changes the rate of a tier discount.
+// PUT /admin/discounts/:id
+func (h *DiscountHandler) UpdateTierDiscount(c *gin.Context) {
+	id, ok := parseDiscountID(c)
+	if !ok {
+		return
+	}
+	var req discountRateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	rule, err := h.server.DiscountDB.UpdateDiscountRate(id, models.DiscountScopeTier, "", req.Rate)
+	if err != nil {
+		h.writeDiscountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"discount": rule})
+}
+
+// DeleteTierDiscount removes a tier discount.
+// DELETE /admin/discounts/:id
+func (h *DiscountHandler) DeleteTierDiscount(c *gin.Context) {
+	id, ok := parseDiscountID(c)
+	if !ok {
+		return
+	}
+	if err := h.server.DiscountDB.DeleteDiscount(id, models.DiscountScopeTier, ""); err != nil {
+		h.writeDiscountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "discount deleted"})
+}
+
+// SetUserTier assigns a user to a tier; an empty tier resets the user to the default.
+// PUT /admin/users/:id/tier
+func (h *DiscountHandler) SetUserTier(c *gin.Context) {
+	var req struct {
+		Tier string `json:"tier"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	tier := strings.TrimSpace(req.Tier)
+	if err := h.server.UserDB.SetTier(c.Param("id"), tier); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	h.server.DiscountDB.InvalidateTier(c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"user_id": c.Param("id"), "tier": tier})
+}
@@ -0,0 +1,115 @@
+package user_handlers
+
+import (
+	"errors"
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DisputeHandler struct {
+	server *models.Server
+}
+
+func NewDisputeHandler(server *models.Server) *DisputeHandler {
+	return &DisputeHandler{server: server}
+}
+
+// CreateDispute files a billing dispute for one of the current user's requests.
+// POST /api/user/disputes
+func (h *DisputeHandler) CreateDispute(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		RequestID string `json:"request_id" binding:"required"`
+		Reason    string `json:"reason" binding:"required,max=1000"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请提供请求ID和申诉原因"})
+		return
+	}
+
+	dispute, err := h.server.RefundDB.CreateDispute(userIDStr, req.RequestID, req.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrUsageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, models.ErrAlreadyRefunded), errors.Is(err, models.ErrDisputeExists):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "提交申诉失败"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, dispute)
+}
+
+// ListMyDisputes lists the current user's disputes.
+// GET /api/user/disputes
+func (h *DisputeHandler) ListMyDisputes(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	page, size := parsePageParams(c)
+	disputes, total, err := h.server.RefundDB.ListDisputes(userIDStr, c.Query("status"), page, size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询申诉失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"disputes": disputes, "total": total})
+}
+
+// ListDisputes lists all disputes, optionally filtered by status.
+// GET /admin/disputes
+func (h *DisputeHandler) ListDisputes(c *gin.Context) {
+	page, size := parsePageParams(c)
+	disputes, total, err := h.server.RefundDB.ListDisputes(c.Query("user_id"), c.Query("status"), page, size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list disputes: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"disputes": disputes, "total": total})
+}
+
+// ResolveDispute approves (refunding refund_ratio of the charge, default 1) or rejects a dispute.
+// PUT /admin/disputes/:id
+func (h *DisputeHandler) ResolveDispute(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dispute id"})
+		return
+	}
+	var req struct {
+		Approve     bool    `json:"approve"`
+		RefundRatio float64 `json:"refund_ratio" binding:"min=0,max=1"`
+		Resolution  string  `json:"resolution"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if req.RefundRatio == 0 {
+		req.RefundRatio = 1
+	}
+
+	adminID, _ := c.Get("user_id")
+	adminIDStr, _ := adminID.(string)
+	dispute, err := h.server.RefundDB.ResolveDispute(uint(id), req.Approve, req.RefundRatio, req.Resolution, adminIDStr)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrDisputeNotFound), errors.Is(err, models.ErrUsageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, models.ErrDisputeResolved), errors.Is(err, models.ErrAlreadyRefunded):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resolve dispute: " + err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, dispute)
+}
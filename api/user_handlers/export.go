@@ -0,0 +1,205 @@
+package user_handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportFlushEvery 每写出多少行刷新一次响应，保证大导出边读边发、内存占用恒定
+const exportFlushEvery = 500
+
+// exportWriter 将行以 CSV 或 JSONL 格式直接写入响应流
+type exportWriter struct {
+	c       *gin.Context
+	csv     *csv.Writer
+	json    *json.Encoder
+	columns []string
+	rows    int
+}
+
+// newExportWriter 根据 format 参数设置响应头并返回写入器；format 非法时返回 nil 并写入 400
+func newExportWriter(c *gin.Context, name string, columns []string) *exportWriter {
+	format := c.DefaultQuery("format", "csv")
+	filename := fmt.Sprintf("%s_%s.%s", name, time.Now().Format("20060102150405"), format)
+
+	w := &exportWriter{c: c, columns: columns}
+	switch format {
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w.csv = csv.NewWriter(c.Writer)
+	case "jsonl":
+		c.Header("Content-Type", "application/x-ndjson")
+		w.json = json.NewEncoder(c.Writer)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or jsonl"})
+		return nil
+	}
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Status(http.StatusOK)
+	if w.csv != nil {
+		_ = w.csv.Write(columns)
+	}
+	return w
+}
+
+// write 写出一行，values 与 columns 一一对应
+func (w *exportWriter) write(values []interface{}) error {
+	if w.csv != nil {
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = formatExportValue(v)
+		}
+		if err := w.csv.Write(record); err != nil {
+			return err
+		}
+	} else {
+		obj := make(map[string]interface{}, len(values))
+		for i, v := range values {
+			obj[w.columns[i]] = v
+		}
+		if err := w.json.Encode(obj); err != nil {
+			return err
+		}
+	}
+	w.rows++
+	if w.rows%exportFlushEvery == 0 {
+		w.flush()
+	}
+	return nil
+}
+
+func (w *exportWriter) flush() {
+	if w.csv != nil {
+		w.csv.Flush()
+	}
+	w.c.Writer.Flush()
+}
+
+func formatExportValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case int:
+		return strconv.Itoa(val)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+var usageExportColumns = []string{
+	"timestamp", "request_id", "api_key", "model", "request_type", "outcome",
+	"input_tokens", "cached_tokens", "output_tokens", "total_tokens", "plan_tokens",
+	"ippm", "cippm", "oppm", "cost", "refunded",
+}
+
+var incomeExportColumns = []string{
+	"timestamp", "request_id", "client_id", "model", "request_type", "outcome",
+	"input_tokens", "cached_tokens", "output_tokens", "total_tokens",
+	"ippm", "cippm", "oppm", "income", "chargeback",
+}
+
+// ExportUserUsage 流式导出用户使用详单（CSV/JSONL）
+// GET /api/user/usage/export?format=csv|jsonl&start_date=&end_date=
+func (h *TokenUsageHandler) ExportUserUsage(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	startTime, endTime, err := parseTimeRange(c, 30)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	w := newExportWriter(c, "usage", usageExportColumns)
+	if w == nil {
+		return
+	}
+	err = h.server.TokenUsageDB.StreamUserUsage(userIDStr, startTime, endTime, func(u *models.TokenUsage) error {
+		return w.write([]interface{}{
+			u.Timestamp, u.RequestID, u.APIKey, u.Model, u.RequestType, u.Outcome,
+			u.InputTokens, u.CachedTokens, u.OutputTokens, u.TotalTokens, u.PlanTokens,
+			u.IPPM, u.CIPPM, u.OPPM, u.Cost, u.Refunded,
+		})
+	})
+	if err != nil {
+		// 响应头已发送，只能中断输出
+		_ = c.Error(err)
+	}
+	w.flush()
+}
+
+// ExportUserIncome 流式导出用户名下所有 client 的收益详单（CSV/JSONL），不包含调用方信息
+// GET /api/user/income/export?format=csv|jsonl&start_date=&end_date=
+func (h *TokenUsageHandler) ExportUserIncome(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	startTime, endTime, err := parseTimeRange(c, 30)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userClients, _ := h.server.ClientDB.GetClientsByUserID(userIDStr)
+	clientIDs := make([]string, 0, len(userClients))
+	for _, client := range userClients {
+		clientIDs = append(clientIDs, client.ID)
+	}
+
+	w := newExportWriter(c, "income", incomeExportColumns)
+	if w == nil {
+		return
+	}
+	if len(clientIDs) > 0 {
+		err = h.server.TokenUsageDB.StreamIncomeUsage(clientIDs, startTime, endTime, func(u *models.TokenUsage) error {
+			return w.write([]interface{}{
+				u.Timestamp, u.RequestID, u.ClientID, u.Model, u.RequestType, u.Outcome,
+				u.InputTokens, u.CachedTokens, u.OutputTokens, u.TotalTokens,
+				u.IPPM, u.CIPPM, u.OPPM, u.GrossIncome() - u.Chargeback, u.Chargeback,
+			})
+		})
+		if err != nil {
+			_ = c.Error(err)
+		}
+	}
+	w.flush()
+}
+
+// GetUserUsageKeys 获取用户按 API Key 聚合的使用统计
+// GET /api/user/usage/keys
+func (h *TokenUsageHandler) GetUserUsageKeys(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+
+	startTime, endTime, err := parseTimeRange(c, 30)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stats, err := h.server.TokenUsageDB.GetUsageStatsByAPIKey(userIDStr, startTime, endTime)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query usage key stats failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total": len(stats),
+		"data":  stats,
+	})
+}
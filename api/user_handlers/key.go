@@ -91,6 +91,72 @@ func (h *APIKeyHandler) RevokeAPIKey(c *gin.Context) {
 	})
 }
 
+// SetMaxBid sets the default max bid of an API key; requests made with the key are matched
+// by auction unless they carry their own bid header.
+// PUT /api/user/keys/:id/bid
+func (h *APIKeyHandler) SetMaxBid(c *gin.Context) {
+	var req service.SetMaxBidRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	if err := h.apiKeyService.SetMaxBid(userID.(string), c.Param("id"), &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"max_bid_ippm": req.MaxBidIPPM,
+		"max_bid_oppm": req.MaxBidOPPM,
+	})
+}
+
+// SetRouting sets the default load-balance strategy of an API key; a request can still override
+// it with the X-Starfire-LB-Strategy header.
+// PUT /api/user/keys/:id/routing
+func (h *APIKeyHandler) SetRouting(c *gin.Context) {
+	var req service.SetRoutingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "Unauthorized",
+		})
+		return
+	}
+
+	if err := h.apiKeyService.SetRouting(userID.(string), c.Param("id"), &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"strategy":          req.Strategy,
+		"latency_budget_ms": req.LatencyBudgetMs,
+	})
+}
+
 // deleteAPIKey handles the deletion of an API key
 func (h *APIKeyHandler) DeleteAPIKey(c *gin.Context) {
 	keyID := c.Param("id")
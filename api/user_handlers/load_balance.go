@@ -0,0 +1,53 @@
+package user_handlers
+
+import (
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LoadBalanceHandler struct {
+	server *models.Server
+}
+
+func NewLoadBalanceHandler(server *models.Server) *LoadBalanceHandler {
+	return &LoadBalanceHandler{server: server}
+}
+
+// GetScoreWeights returns the weights used by the weighted load-balance algorithm.
+// GET /admin/lb-weights
+func (h *LoadBalanceHandler) GetScoreWeights(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"algorithm": h.server.LoadBalanceAlgorithm,
+		"weights":   h.server.ScoreWeights(),
+	})
+}
+
+// SetScoreWeights updates some or all of the scoring weights, e.g. {"errors": 3, "price": 0.5}.
+// PUT /admin/lb-weights
+func (h *LoadBalanceHandler) SetScoreWeights(c *gin.Context) {
+	var req map[string]float64
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	for metric, w := range req {
+		if _, ok := models.DefaultScoreWeights[metric]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown metric: " + metric})
+			return
+		}
+		if w < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "weights must be non-negative"})
+			return
+		}
+	}
+	for metric, w := range req {
+		if err := h.server.SystemConfigDB.Set(models.ConfigKeyLBWeightPrefix+metric, strconv.FormatFloat(w, 'f', -1, 64)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save config: " + err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"weights": h.server.ScoreWeights()})
+}
@@ -63,6 +63,49 @@ func (h *MarketHandler) ModelStatsHandler(c *gin.Context) {
 	c.JSON(200, stats)
 }
 
+// PriceHistoryHandler returns the price chart of a model for the market page.
+// interval: hour (default range 7 days) or day (default range 90 days).
+// GET /api/market/price-history?model=xxx&interval=hour&start_date=2006-01-02&end_date=2006-01-02
+func (h *MarketHandler) PriceHistoryHandler(c *gin.Context) {
+	model := c.Query("model")
+	if model == "" {
+		c.JSON(400, gin.H{"error": "model is required"})
+		return
+	}
+
+	interval := time.Hour
+	days := 7
+	switch c.DefaultQuery("interval", "hour") {
+	case "hour":
+	case "day":
+		interval = 24 * time.Hour
+		days = 90
+	default:
+		c.JSON(400, gin.H{"error": "interval must be hour or day"})
+		return
+	}
+
+	endTime := time.Now().Truncate(interval)
+	startTime := endTime.Add(-time.Duration(days) * 24 * time.Hour)
+	if startDate := c.Query("start_date"); startDate != "" {
+		if t, err := time.Parse("2006-01-02", startDate); err == nil {
+			startTime = t
+		}
+	}
+	if endDate := c.Query("end_date"); endDate != "" {
+		if t, err := time.Parse("2006-01-02", endDate); err == nil {
+			endTime = t.Add(24*time.Hour - time.Second)
+		}
+	}
+
+	points, err := h.server.PriceHistoryDB.GetPriceChart(model, startTime, endTime, interval)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"model": model, "interval": c.DefaultQuery("interval", "hour"), "points": points})
+}
+
 // get trends
 func (h *MarketHandler) TrendsHandler(c *gin.Context) {
 	// For test: curl -X GET "http://localhost:8080/api/market/trends?start_date=2025-01-01&end_date=2025-01-31&page=1&size=10"
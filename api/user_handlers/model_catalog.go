@@ -0,0 +1,65 @@
+package user_handlers
+
+import (
+	"net/http"
+	"star-fire/internal/models"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ModelCatalogHandler struct {
+	server *models.Server
+}
+
+func NewModelCatalogHandler(server *models.Server) *ModelCatalogHandler {
+	return &ModelCatalogHandler{server: server}
+}
+
+// ListModelAliases lists the admin alias rules that map engine-specific names to canonical model IDs.
+// GET /admin/model-aliases
+func (h *ModelCatalogHandler) ListModelAliases(c *gin.Context) {
+	aliases, err := h.server.ModelCatalogDB.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询模型别名失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"aliases": aliases})
+}
+
+// SaveModelAlias creates or updates an alias rule, e.g.
+// {"alias": "Qwen/Qwen3-8B-AWQ", "canonical": "qwen3-8b", "quantization": "awq"}.
+// Online clients pick up the new canonical ID on their next heartbeat.
+// PUT /admin/model-aliases
+func (h *ModelCatalogHandler) SaveModelAlias(c *gin.Context) {
+	var req struct {
+		Alias        string `json:"alias" binding:"required"`
+		Canonical    string `json:"canonical" binding:"required"`
+		Quantization string `json:"quantization"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	alias := &models.ModelAlias{Alias: req.Alias, Canonical: req.Canonical, Quantization: req.Quantization}
+	if err := h.server.ModelCatalogDB.Save(alias); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "保存模型别名失败: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"alias": alias})
+}
+
+// DeleteModelAlias removes an alias rule so the name falls back to the built-in canonicalization.
+// DELETE /admin/model-aliases/*alias (别名可以包含 "/"，如 Qwen/Qwen3-8B)
+func (h *ModelCatalogHandler) DeleteModelAlias(c *gin.Context) {
+	existed, err := h.server.ModelCatalogDB.Delete(strings.TrimPrefix(c.Param("alias"), "/"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除模型别名失败"})
+		return
+	}
+	if !existed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "model alias not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "model alias deleted"})
+}
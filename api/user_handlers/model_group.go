@@ -0,0 +1,133 @@
+package user_handlers
+
+import (
+	"net/http"
+	"star-fire/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ModelGroupHandler struct {
+	server *models.Server
+}
+
+func NewModelGroupHandler(server *models.Server) *ModelGroupHandler {
+	return &ModelGroupHandler{server: server}
+}
+
+// modelGroupRequest is the request body for creating or updating a routing group: either an
+// ordered fallback list in models, or a capability query.
+type modelGroupRequest struct {
+	Models             []string `json:"models"`
+	MinParams          float64  `json:"min_params"`
+	MaxParams          float64  `json:"max_params"`
+	NameContains       string   `json:"name_contains"`
+	MaxIPPM            float64  `json:"max_ippm"`
+	MaxOPPM            float64  `json:"max_oppm"`
+	RequireTools       bool     `json:"require_tools"`
+	RequireVision      bool     `json:"require_vision"`
+	RequireJSONSchema  bool     `json:"require_json_schema"`
+	RequireReasoning   bool     `json:"require_reasoning"`
+	RequireContextSize int      `json:"require_context_size"`
+}
+
+func (h *ModelGroupHandler) listGroups(c *gin.Context, userID string) {
+	groups, err := h.server.ModelGroupDB.List(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询路由分组失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": groups})
+}
+
+func (h *ModelGroupHandler) saveGroup(c *gin.Context, userID string) {
+	var req modelGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	group := &models.ModelGroup{
+		UserID:             userID,
+		Name:               c.Param("name"),
+		Models:             req.Models,
+		MinParams:          req.MinParams,
+		MaxParams:          req.MaxParams,
+		NameContains:       req.NameContains,
+		MaxIPPM:            req.MaxIPPM,
+		MaxOPPM:            req.MaxOPPM,
+		RequireTools:       req.RequireTools,
+		RequireVision:      req.RequireVision,
+		RequireJSONSchema:  req.RequireJSONSchema,
+		RequireReasoning:   req.RequireReasoning,
+		RequireContextSize: req.RequireContextSize,
+	}
+	if err := h.server.ModelGroupDB.Save(group); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "保存路由分组失败: " + err.Error()})
+		return
+	}
+	candidates, _ := h.server.ModelCandidates(userID, group.Name)
+	c.JSON(http.StatusOK, gin.H{"group": group, "candidates": candidates})
+}
+
+func (h *ModelGroupHandler) deleteGroup(c *gin.Context, userID string) {
+	existed, err := h.server.ModelGroupDB.Delete(userID, c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除路由分组失败"})
+		return
+	}
+	if !existed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "model group not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "model group deleted"})
+}
+
+// ListMyModelGroups lists the routing groups defined by the current user.
+// GET /api/user/model-groups
+func (h *ModelGroupHandler) ListMyModelGroups(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	h.listGroups(c, userIDStr)
+}
+
+// SaveMyModelGroup creates or updates one of the current user's routing groups. The group
+// shadows an admin-defined group with the same name for this user only.
+// PUT /api/user/model-groups/:name
+func (h *ModelGroupHandler) SaveMyModelGroup(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	h.saveGroup(c, userIDStr)
+}
+
+// DeleteMyModelGroup deletes one of the current user's routing groups.
+// DELETE /api/user/model-groups/:name
+func (h *ModelGroupHandler) DeleteMyModelGroup(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	h.deleteGroup(c, userIDStr)
+}
+
+// ListModelGroups lists the routing groups available to every user.
+// GET /admin/model-groups
+func (h *ModelGroupHandler) ListModelGroups(c *gin.Context) {
+	h.listGroups(c, "")
+}
+
+// SaveModelGroup creates or updates a routing group available to every user, e.g.
+// {"models": ["gpt-oss-20b", "qwen3-14b"]} or {"min_params": 7, "max_params": 9, "name_contains": "instruct", "max_oppm": 2}.
+// PUT /admin/model-groups/:name
+func (h *ModelGroupHandler) SaveModelGroup(c *gin.Context) {
+	h.saveGroup(c, "")
+}
+
+// DeleteModelGroup deletes a routing group available to every user.
+// DELETE /admin/model-groups/:name
+func (h *ModelGroupHandler) DeleteModelGroup(c *gin.Context) {
+	h.deleteGroup(c, "")
+}
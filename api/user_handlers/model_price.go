@@ -3,6 +3,7 @@ package user_handlers
 import (
 	"net/http"
 	"star-fire/internal/models"
+	"star-fire/pkg/public"
 
 	"github.com/gin-gonic/gin"
 )
@@ -44,16 +45,29 @@ func (h *ModelPriceHandler) UpdateModelPrice(c *gin.Context) {
 	}
 
 	var req struct {
-		IPPM  float64 `json:"ippm" binding:"min=0"`
-		OPPM  float64 `json:"oppm" binding:"min=0"`
-		CIPPM float64 `json:"cippm" binding:"min=0"`
+		IPPM  float64            `json:"ippm" binding:"min=0"`
+		OPPM  float64            `json:"oppm" binding:"min=0"`
+		CIPPM float64            `json:"cippm" binding:"min=0"`
+		RPPM  float64            `json:"rppm" binding:"min=0"` // 推理tokens价格，0 表示按 oppm 计费
+		PPI   float64            `json:"ppi" binding:"min=0"`  // 每张输入图片价格
+		Tiers []public.PriceTier `json:"price_tiers"`          // 长上下文阶梯价格
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
 		return
 	}
+	seen := make(map[int]bool, len(req.Tiers))
+	for _, t := range req.Tiers {
+		if t.MinPromptTokens <= 0 || t.IPPM < 0 || t.OPPM < 0 || t.CIPPM < 0 || seen[t.MinPromptTokens] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid price tier: min_prompt_tokens must be positive and unique, prices non-negative"})
+			return
+		}
+		seen[t.MinPromptTokens] = true
+	}
 
-	count, err := h.server.UpdateModelPrice(userID.(string), model, req.IPPM, req.OPPM, req.CIPPM)
+	// 超过平台上限的价格会被下调，返回实际生效的价格
+	price := &public.Model{Name: model, IPPM: req.IPPM, OPPM: req.OPPM, CIPPM: req.CIPPM, RPPM: req.RPPM, PPI: req.PPI, PriceTiers: req.Tiers}
+	count, clamped, err := h.server.UpdateModelPrice(userID.(string), price)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
@@ -62,5 +76,12 @@ func (h *ModelPriceHandler) UpdateModelPrice(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{
 		"message":         "price updated",
 		"updated_clients": count,
+		"ippm":            price.IPPM,
+		"oppm":            price.OPPM,
+		"cippm":           price.CIPPM,
+		"rppm":            price.RPPM,
+		"ppi":             price.PPI,
+		"price_tiers":     price.PriceTiers,
+		"clamped":         clamped,
 	})
 }
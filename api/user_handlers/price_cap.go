@@ -8,11 +8,12 @@ import (
 )
 
 type PriceCapHandler struct {
-	db *models.UserPriceCapDB
+	server *models.Server
+	db     *models.UserPriceCapDB
 }
 
-func NewPriceCapHandler(db *models.UserPriceCapDB) *PriceCapHandler {
-	return &PriceCapHandler{db: db}
+func NewPriceCapHandler(server *models.Server) *PriceCapHandler {
+	return &PriceCapHandler{server: server, db: server.UserPriceCapDB}
 }
 
 // ListPriceCaps returns all price caps configured for the current user.
@@ -33,7 +34,7 @@ func (h *PriceCapHandler) ListPriceCaps(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"price_caps": caps})
 }
 
-// UpsertPriceCap creates or updates the price cap for a specific model.
+// UpsertPriceCap creates or updates the price cap for a specific model, stored under its canonical ID.
 // PUT /api/user/price-caps/:model
 func (h *PriceCapHandler) UpsertPriceCap(c *gin.Context) {
 	userID, exists := c.Get("user_id")
@@ -42,7 +43,7 @@ func (h *PriceCapHandler) UpsertPriceCap(c *gin.Context) {
 		return
 	}
 
-	model := c.Param("model")
+	model := h.server.CanonicalRuleModel(c.Param("model"))
 	if model == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "model name is required"})
 		return
@@ -76,7 +77,7 @@ func (h *PriceCapHandler) DeletePriceCap(c *gin.Context) {
 		return
 	}
 
-	model := c.Param("model")
+	model := h.server.CanonicalRuleModel(c.Param("model"))
 	if model == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "model name is required"})
 		return
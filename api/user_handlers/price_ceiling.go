@@ -0,0 +1,85 @@
+package user_handlers
+
+import (
+	"net/http"
+	"star-fire/internal/models"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PriceCeilingHandler struct {
+	server *models.Server
+}
+
+func NewPriceCeilingHandler(server *models.Server) *PriceCeilingHandler {
+	return &PriceCeilingHandler{server: server}
+}
+
+// ListPriceCeilings lists the per-model price ceilings and the environment defaults.
+// GET /admin/price-ceilings
+func (h *PriceCeilingHandler) ListPriceCeilings(c *gin.Context) {
+	ceilings, err := h.server.SystemConfigDB.ListPriceCeilings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询价格上限失败"})
+		return
+	}
+	defaults := gin.H{}
+	if h.server.Conf != nil {
+		defaults = gin.H{
+			"max_ippm":  h.server.Conf.AllModelInputMaxPrice,
+			"max_oppm":  h.server.Conf.AllModelOutPutMaxPrice,
+			"max_cippm": h.server.Conf.AllModelCachedInputMaxPrice,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"ceilings": ceilings, "defaults": defaults})
+}
+
+// SetPriceCeiling sets the price ceiling for a model ("*" for all models); 0 falls back to the
+// global ceiling. Online clients above the new ceiling are clamped on their next heartbeat.
+// PUT /admin/price-ceilings/:model
+func (h *PriceCeilingHandler) SetPriceCeiling(c *gin.Context) {
+	model := strings.TrimSpace(c.Param("model"))
+	if model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model name is required"})
+		return
+	}
+	model = h.server.CanonicalRuleModel(model)
+	var req struct {
+		MaxIPPM  float64 `json:"max_ippm" binding:"min=0"`
+		MaxOPPM  float64 `json:"max_oppm" binding:"min=0"`
+		MaxCIPPM float64 `json:"max_cippm" binding:"min=0"`
+		MaxRPPM  float64 `json:"max_rppm" binding:"min=0"`
+		MaxPPI   float64 `json:"max_ppi" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	ceiling := models.PriceCeiling{Model: model, MaxIPPM: req.MaxIPPM, MaxOPPM: req.MaxOPPM, MaxCIPPM: req.MaxCIPPM,
+		MaxRPPM: req.MaxRPPM, MaxPPI: req.MaxPPI}
+	if err := h.server.SystemConfigDB.SetPriceCeiling(ceiling); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存价格上限失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ceiling": ceiling, "effective": h.server.PriceCeiling(model)})
+}
+
+// DeletePriceCeiling removes a model's price ceiling so it falls back to the global ceiling.
+// DELETE /admin/price-ceilings/:model
+func (h *PriceCeilingHandler) DeletePriceCeiling(c *gin.Context) {
+	model := c.Param("model")
+	existed, err := h.server.SystemConfigDB.DeletePriceCeiling(model)
+	if canonical, _ := h.server.CanonicalModel(model); err == nil && !existed && model != "*" && canonical != model {
+		existed, err = h.server.SystemConfigDB.DeletePriceCeiling(canonical)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除价格上限失败"})
+		return
+	}
+	if !existed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "price ceiling not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "price ceiling deleted"})
+}
@@ -0,0 +1,216 @@
+package user_handlers
+
+import (
+	"errors"
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PromoHandler struct {
+	server *models.Server
+}
+
+func NewPromoHandler(server *models.Server) *PromoHandler {
+	return &PromoHandler{server: server}
+}
+
+// promoCodeRequest is the admin request body for creating or updating a promo code.
+type promoCodeRequest struct {
+	Code           string     `json:"code"`
+	Type           string     `json:"type" binding:"omitempty,oneof=fixed percentage"`
+	Amount         float64    `json:"amount" binding:"required,gt=0"`
+	MaxDiscount    float64    `json:"max_discount" binding:"min=0"`
+	Models         []string   `json:"models"`
+	MaxRedemptions int        `json:"max_redemptions" binding:"min=0"`
+	PerUserLimit   int        `json:"per_user_limit" binding:"min=0"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	Active         *bool      `json:"active"`
+	Note           string     `json:"note"`
+}
+
+// validate checks type-specific constraints that binding tags cannot express.
+func (r *promoCodeRequest) validate() error {
+	if r.Type == models.PromoTypePercentage {
+		if r.Amount > 100 {
+			return errors.New("percentage amount must be in (0, 100]")
+		}
+		if r.MaxDiscount <= 0 {
+			return errors.New("percentage promo code requires max_discount > 0")
+		}
+	}
+	return nil
+}
+
+func joinModels(ms []string) string {
+	cleaned := make([]string, 0, len(ms))
+	for _, m := range ms {
+		if m = strings.TrimSpace(m); m != "" {
+			cleaned = append(cleaned, m)
+		}
+	}
+	return strings.Join(cleaned, ",")
+}
+
+// CreatePromoCode creates a promo code.
+// POST /admin/promo-codes
+func (h *PromoHandler) CreatePromoCode(c *gin.Context) {
+	var req promoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if req.Type == "" {
+		req.Type = models.PromoTypeFixed
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Code) == "" {
+		req.Code = "SF" + strconv.FormatInt(time.Now().UnixNano()%1e10, 36)
+	}
+
+	adminID, _ := c.Get("user_id")
+	adminIDStr, _ := adminID.(string)
+	promo := &models.PromoCode{
+		Code:           req.Code,
+		Type:           req.Type,
+		Amount:         req.Amount,
+		MaxDiscount:    req.MaxDiscount,
+		Models:         joinModels(req.Models),
+		MaxRedemptions: req.MaxRedemptions,
+		PerUserLimit:   req.PerUserLimit,
+		ExpiresAt:      req.ExpiresAt,
+		Active:         req.Active == nil || *req.Active,
+		CreatedBy:      adminIDStr,
+		Note:           req.Note,
+	}
+	if err := h.server.PromoCodeDB.CreatePromoCode(promo); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "failed to create promo code: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, promo)
+}
+
+// ListPromoCodes lists promo codes with pagination.
+// GET /admin/promo-codes
+func (h *PromoHandler) ListPromoCodes(c *gin.Context) {
+	page, size := parsePageParams(c)
+	codes, total, err := h.server.PromoCodeDB.ListPromoCodes(page, size)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list promo codes: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "page": page, "size": size, "data": codes})
+}
+
+// UpdatePromoCode updates the editable fields of a promo code.
+// PUT /admin/promo-codes/:code
+func (h *PromoHandler) UpdatePromoCode(c *gin.Context) {
+	promo, err := h.server.PromoCodeDB.GetPromoCode(c.Param("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrPromoCodeNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req promoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	req.Type = promo.Type
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	promo.Amount = req.Amount
+	promo.MaxDiscount = req.MaxDiscount
+	promo.Models = joinModels(req.Models)
+	promo.MaxRedemptions = req.MaxRedemptions
+	if req.PerUserLimit > 0 {
+		promo.PerUserLimit = req.PerUserLimit
+	}
+	promo.ExpiresAt = req.ExpiresAt
+	if req.Active != nil {
+		promo.Active = *req.Active
+	}
+	promo.Note = req.Note
+	if err := h.server.PromoCodeDB.UpdatePromoCode(promo); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update promo code: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, promo)
+}
+
+// DeactivatePromoCode disables a promo code; existing coupons stay valid.
+// DELETE /admin/promo-codes/:code
+func (h *PromoHandler) DeactivatePromoCode(c *gin.Context) {
+	if err := h.server.PromoCodeDB.DeactivatePromoCode(c.Param("code")); err != nil {
+		if errors.Is(err, models.ErrPromoCodeNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RedeemPromoCode redeems a promo code for the current user.
+// POST /api/user/promo-codes/redeem
+func (h *PromoHandler) RedeemPromoCode(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少兑换码"})
+		return
+	}
+
+	result, err := h.server.PromoCodeDB.Redeem(userIDStr, req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrPromoCodeNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, models.ErrPromoCodeInactive),
+			errors.Is(err, models.ErrPromoCodeExpired),
+			errors.Is(err, models.ErrPromoCodeExhausted),
+			errors.Is(err, models.ErrPromoCodeUserLimit):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "兑换失败: " + err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// ListCoupons returns the current user's usable coupons.
+// GET /api/user/coupons
+func (h *PromoHandler) ListCoupons(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	coupons, err := h.server.PromoCodeDB.GetUserCoupons(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询优惠券失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"coupons": coupons})
+}
@@ -0,0 +1,77 @@
+package user_handlers
+
+import (
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReferralHandler struct {
+	server *models.Server
+}
+
+func NewReferralHandler(server *models.Server) *ReferralHandler {
+	return &ReferralHandler{server: server}
+}
+
+// GetReferral returns the current user's referral code, link and invited users.
+// GET /api/user/referral
+func (h *ReferralHandler) GetReferral(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+
+	code, err := h.server.ReferralDB.GetOrCreateCode(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取邀请码失败"})
+		return
+	}
+	referrals, err := h.server.ReferralDB.GetByReferrer(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询邀请记录失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":            code,
+		"link":            "/register?ref=" + code,
+		"referrals":       referrals,
+		"min_amount":      h.server.SystemConfigDB.GetFloat(models.ConfigKeyReferralMinAmount, 0),
+		"referrer_reward": h.server.SystemConfigDB.GetFloat(models.ConfigKeyReferralReferrerReward, 0),
+		"referee_reward":  h.server.SystemConfigDB.GetFloat(models.ConfigKeyReferralRefereeReward, 0),
+	})
+}
+
+// SetReferralConfig updates the referral reward rules.
+// PUT /admin/referral-config
+func (h *ReferralHandler) SetReferralConfig(c *gin.Context) {
+	var req struct {
+		MinAmount      float64 `json:"min_amount" binding:"min=0"`
+		ReferrerReward float64 `json:"referrer_reward" binding:"min=0"`
+		RefereeReward  float64 `json:"referee_reward" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+
+	values := map[string]float64{
+		models.ConfigKeyReferralMinAmount:      req.MinAmount,
+		models.ConfigKeyReferralReferrerReward: req.ReferrerReward,
+		models.ConfigKeyReferralRefereeReward:  req.RefereeReward,
+	}
+	for key, v := range values {
+		if err := h.server.SystemConfigDB.Set(key, strconv.FormatFloat(v, 'f', -1, 64)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save config: " + err.Error()})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"min_amount":      req.MinAmount,
+		"referrer_reward": req.ReferrerReward,
+		"referee_reward":  req.RefereeReward,
+	})
+}
@@ -0,0 +1,188 @@
+package user_handlers
+
+import (
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ReservationHandler struct {
+	server *models.Server
+}
+
+func NewReservationHandler(server *models.Server) *ReservationHandler {
+	return &ReservationHandler{server: server}
+}
+
+type createReservationRequest struct {
+	ClientID      string    `json:"client_id" binding:"required"`
+	Model         string    `json:"model" binding:"required"`
+	Slots         int       `json:"slots"`
+	StartAt       time.Time `json:"start_at" binding:"required"`
+	EndAt         time.Time `json:"end_at" binding:"required"`
+	PricingType   string    `json:"pricing_type" binding:"required"`
+	HourlyRate    float64   `json:"hourly_rate"`
+	IPPM          float64   `json:"ippm"`
+	OPPM          float64   `json:"oppm"`
+	MinCommitment float64   `json:"min_commitment"`
+}
+
+func parseReservationID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid reservation id"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// CreateReservation requests capacity on a provider's client for a time window; the provider
+// must accept it before it takes effect.
+// POST /api/user/reservations
+func (h *ReservationHandler) CreateReservation(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var req createReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if req.Slots == 0 {
+		req.Slots = 1
+	}
+	req.Model, _ = h.server.CanonicalModel(req.Model)
+
+	client, err := h.server.ClientDB.GetClient(req.ClientID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "client not found"})
+		return
+	}
+	if client.UserID == userIDStr {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot reserve your own client"})
+		return
+	}
+	offered := false
+	for _, m := range client.Models {
+		// 旧记录中的模型可能仍是引擎本地名称
+		if canonical, _ := h.server.CanonicalModel(m.Name); canonical == req.Model {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "client does not provide model " + req.Model})
+		return
+	}
+
+	res := &models.Reservation{
+		UserID:        userIDStr,
+		ProviderID:    client.UserID,
+		ClientID:      req.ClientID,
+		Model:         req.Model,
+		Slots:         req.Slots,
+		StartAt:       req.StartAt,
+		EndAt:         req.EndAt,
+		PricingType:   req.PricingType,
+		HourlyRate:    req.HourlyRate,
+		IPPM:          req.IPPM,
+		OPPM:          req.OPPM,
+		MinCommitment: req.MinCommitment,
+	}
+	if err := res.Validate(time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.server.ReservationDB.Create(res); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建预留失败"})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// ListMyReservations lists the reservations made by the current user.
+// GET /api/user/reservations
+func (h *ReservationHandler) ListMyReservations(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	list, err := h.server.ReservationDB.ListByUser(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询预留失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reservations": list})
+}
+
+// CancelReservation cancels a pending or accepted reservation before its window starts.
+// DELETE /api/user/reservations/:id
+func (h *ReservationHandler) CancelReservation(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	id, ok := parseReservationID(c)
+	if !ok {
+		return
+	}
+	if err := h.server.ReservationDB.Cancel(userIDStr, id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "reservation cancelled"})
+}
+
+// ListIncomingReservations lists the reservations on the current user's clients.
+// GET /api/user/reservations/incoming
+func (h *ReservationHandler) ListIncomingReservations(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	list, err := h.server.ReservationDB.ListByProvider(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询预留失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reservations": list})
+}
+
+// RespondReservation accepts or declines a pending reservation on one of the current user's
+// clients. Accepting prepays the reservation from the requester's balance and fails when the
+// balance is short or overlapping reservations would exceed the client's capacity.
+// PUT /api/user/reservations/:id/respond
+func (h *ReservationHandler) RespondReservation(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	id, ok := parseReservationID(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Accept bool `json:"accept"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+
+	capacity := 1
+	if pending, err := h.server.ReservationDB.Get(id); err == nil {
+		if client := h.server.GetClientByModel(pending.Model, pending.ClientID); client != nil {
+			capacity = client.Capacity()
+		}
+	}
+	res, err := h.server.ReservationDB.Respond(userIDStr, id, req.Accept, capacity)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
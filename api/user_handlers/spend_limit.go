@@ -0,0 +1,102 @@
+package user_handlers
+
+import (
+	"net/http"
+	"net/url"
+	"star-fire/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SpendLimitHandler struct {
+	server *models.Server
+}
+
+func NewSpendLimitHandler(server *models.Server) *SpendLimitHandler {
+	return &SpendLimitHandler{server: server}
+}
+
+// GetSpendLimit returns the user's spend limits, alert thresholds and current spend.
+// GET /api/user/spend-limits
+func (h *SpendLimitHandler) GetSpendLimit(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	limit, err := h.server.SpendLimitDB.GetLimit(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询花费上限失败"})
+		return
+	}
+	if limit == nil {
+		limit = &models.SpendLimit{UserID: userIDStr}
+	}
+	daily, monthly, err := h.server.SpendLimitDB.GetSpend(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询花费失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"limits":        limit,
+		"daily_spent":   daily,
+		"monthly_spent": monthly,
+	})
+}
+
+// UpdateSpendLimit sets the user's spend limits and alert thresholds; 0 disables a limit.
+// PUT /api/user/spend-limits
+func (h *SpendLimitHandler) UpdateSpendLimit(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		DailyLimit   float64 `json:"daily_limit" binding:"min=0"`
+		MonthlyLimit float64 `json:"monthly_limit" binding:"min=0"`
+		DailyAlert   float64 `json:"daily_alert" binding:"min=0"`
+		MonthlyAlert float64 `json:"monthly_alert" binding:"min=0"`
+		AlertEmail   bool    `json:"alert_email"`
+		WebhookURL   string  `json:"webhook_url"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	if req.WebhookURL != "" {
+		u, err := url.Parse(req.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "webhook_url must be an http(s) URL"})
+			return
+		}
+	}
+
+	limit := &models.SpendLimit{
+		UserID:       userIDStr,
+		DailyLimit:   req.DailyLimit,
+		MonthlyLimit: req.MonthlyLimit,
+		DailyAlert:   req.DailyAlert,
+		MonthlyAlert: req.MonthlyAlert,
+		AlertEmail:   req.AlertEmail,
+		WebhookURL:   req.WebhookURL,
+	}
+	if err := h.server.SpendLimitDB.SaveLimit(limit); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存花费上限失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"limits": limit})
+}
+
+// ListSpendAlerts returns the user's most recent spend alerts.
+// GET /api/user/spend-limits/alerts
+func (h *SpendLimitHandler) ListSpendAlerts(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	alerts, err := h.server.SpendLimitDB.GetAlerts(userIDStr, 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询告警记录失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": alerts})
+}
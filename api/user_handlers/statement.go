@@ -0,0 +1,174 @@
+package user_handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type StatementHandler struct {
+	server *models.Server
+}
+
+func NewStatementHandler(server *models.Server) *StatementHandler {
+	return &StatementHandler{server: server}
+}
+
+// ListStatements lists the current user's monthly statements.
+// GET /api/user/statements?kind=billing|earnings
+func (h *StatementHandler) ListStatements(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	statements, err := h.server.StatementDB.GetUserStatements(userIDStr, c.Query("kind"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询对账单失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"statements": statements})
+}
+
+// GetStatement returns one statement as JSON, CSV or a printable HTML document.
+// GET /api/user/statements/:id?format=json|csv|html
+func (h *StatementHandler) GetStatement(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid statement id"})
+		return
+	}
+	st, err := h.server.StatementDB.GetUserStatement(userIDStr, uint(id))
+	if err != nil {
+		if errors.Is(err, models.ErrStatementNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询对账单失败"})
+		return
+	}
+
+	filename := fmt.Sprintf("statement_%s_%s", st.Kind, st.Period)
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(http.StatusOK, st)
+	case "csv":
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Header("Content-Disposition", "attachment; filename="+filename+".csv")
+		writeStatementCSV(c, st)
+	case "html":
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := statementTemplate.Execute(c.Writer, st); err != nil {
+			_ = c.Error(err)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, csv or html"})
+	}
+}
+
+// CloseStatements generates statements for a finished month; existing statements are kept as-is.
+// POST /admin/statements/close?period=2026-09
+func (h *StatementHandler) CloseStatements(c *gin.Context) {
+	period := c.Query("period")
+	if _, err := time.Parse(models.StatementPeriodLayout, period); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be YYYY-MM"})
+		return
+	}
+	failed, err := h.server.StatementDB.ClosePeriod(period)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to close period: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"period": period, "failed_users": failed})
+}
+
+func formatMoney(v float64) string {
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
+
+func writeStatementCSV(c *gin.Context, st *models.Statement) {
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"item", "value"})
+	_ = w.Write([]string{"user_id", st.UserID})
+	_ = w.Write([]string{"period", st.Period})
+	_ = w.Write([]string{"kind", st.Kind})
+	if st.Kind == models.StatementKindBilling {
+		_ = w.Write([]string{"opening_balance", formatMoney(st.OpeningBalance)})
+		_ = w.Write([]string{"recharges", formatMoney(st.Recharges)})
+		_ = w.Write([]string{"bonuses", formatMoney(st.Bonuses)})
+		_ = w.Write([]string{"coupon_credits", formatMoney(st.CouponCredits)})
+		_ = w.Write([]string{"refunds", formatMoney(st.Refunds)})
+		_ = w.Write([]string{"subscription_fees", formatMoney(st.SubscriptionFees)})
+		_ = w.Write([]string{"reservations", formatMoney(st.Reservations)})
+		_ = w.Write([]string{"usage_spend", formatMoney(st.UsageSpend)})
+		_ = w.Write([]string{"closing_balance", formatMoney(st.ClosingBalance)})
+	} else {
+		_ = w.Write([]string{"gross_earnings", formatMoney(st.GrossEarnings)})
+		_ = w.Write([]string{"chargebacks", formatMoney(st.Chargebacks)})
+		_ = w.Write([]string{"earnings", formatMoney(st.Earnings)})
+	}
+	_ = w.Write(nil)
+	_ = w.Write([]string{"model", "calls", "input_tokens", "output_tokens", "total_tokens", "amount"})
+	for _, l := range st.Lines {
+		_ = w.Write([]string{
+			l.Model,
+			strconv.FormatInt(l.Calls, 10),
+			strconv.FormatInt(l.InputTokens, 10),
+			strconv.FormatInt(l.OutputTokens, 10),
+			strconv.FormatInt(l.TotalTokens, 10),
+			formatMoney(l.Amount),
+		})
+	}
+	w.Flush()
+}
+
+// statementTemplate 可打印的对账单页面，浏览器“打印为 PDF”即可得到 PDF 版本
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"money": formatMoney,
+	// debit 支出项取反显示，预留容量的结算退还（负支出）显示为正数
+	"debit": func(v float64) string { return formatMoney(0 - v) },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Star Fire {{.Kind}} statement {{.Period}}</title>
+<style>
+body{font-family:sans-serif;max-width:800px;margin:2em auto;color:#222}
+table{border-collapse:collapse;width:100%;margin-bottom:1.5em}
+th,td{border:1px solid #ccc;padding:4px 8px;text-align:right}
+th:first-child,td:first-child{text-align:left}
+@media print{body{margin:0}}
+</style></head><body>
+<h1>Star Fire {{if eq .Kind "billing"}}Billing{{else}}Earnings{{end}} Statement</h1>
+<p>User: {{.UserID}}<br>Period: {{.Period}} ({{.PeriodStart.Format "2006-01-02"}} – {{.PeriodEnd.Format "2006-01-02"}})<br>Issued: {{.CreatedAt.Format "2006-01-02 15:04"}}</p>
+<table>
+{{if eq .Kind "billing"}}
+<tr><td>Opening balance</td><td>{{money .OpeningBalance}}</td></tr>
+<tr><td>Recharges</td><td>{{money .Recharges}}</td></tr>
+<tr><td>Bonuses</td><td>{{money .Bonuses}}</td></tr>
+<tr><td>Coupon credits</td><td>{{money .CouponCredits}}</td></tr>
+<tr><td>Refunds</td><td>{{money .Refunds}}</td></tr>
+<tr><td>Subscription fees</td><td>-{{money .SubscriptionFees}}</td></tr>
+<tr><td>Reservations</td><td>{{debit .Reservations}}</td></tr>
+<tr><td>Usage</td><td>-{{money .UsageSpend}}</td></tr>
+<tr><th>Closing balance</th><th>{{money .ClosingBalance}}</th></tr>
+{{else}}
+<tr><td>Gross earnings</td><td>{{money .GrossEarnings}}</td></tr>
+<tr><td>Chargebacks</td><td>-{{money .Chargebacks}}</td></tr>
+<tr><th>Net earnings</th><th>{{money .Earnings}}</th></tr>
+{{end}}
+</table>
+<table>
+<tr><th>Model</th><th>Calls</th><th>Input tokens</th><th>Output tokens</th><th>Total tokens</th><th>Amount</th></tr>
+{{range .Lines}}<tr><td>{{.Model}}</td><td>{{.Calls}}</td><td>{{.InputTokens}}</td><td>{{.OutputTokens}}</td><td>{{.TotalTokens}}</td><td>{{money .Amount}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
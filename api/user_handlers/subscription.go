@@ -0,0 +1,208 @@
+package user_handlers
+
+import (
+	"errors"
+	"net/http"
+	"star-fire/internal/models"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SubscriptionHandler struct {
+	server *models.Server
+}
+
+func NewSubscriptionHandler(server *models.Server) *SubscriptionHandler {
+	return &SubscriptionHandler{server: server}
+}
+
+// planRequest is the admin request body for creating or updating a plan.
+type planRequest struct {
+	Name        string  `json:"name" binding:"required"`
+	Description string  `json:"description"`
+	MonthlyFee  float64 `json:"monthly_fee" binding:"min=0"`
+	OverageRate float64 `json:"overage_rate" binding:"min=0"`
+	Active      *bool   `json:"active"`
+	Quotas      []struct {
+		ID     uint   `json:"id"`
+		Model  string `json:"model" binding:"required"`
+		Tokens int64  `json:"tokens" binding:"required,gt=0"`
+	} `json:"quotas" binding:"required,min=1,dive"`
+}
+
+func (r *planRequest) toPlan() *models.Plan {
+	plan := &models.Plan{
+		Name:        strings.TrimSpace(r.Name),
+		Description: r.Description,
+		MonthlyFee:  r.MonthlyFee,
+		OverageRate: r.OverageRate,
+		Active:      r.Active == nil || *r.Active,
+	}
+	if plan.OverageRate == 0 {
+		plan.OverageRate = 1
+	}
+	for _, q := range r.Quotas {
+		plan.Quotas = append(plan.Quotas, models.PlanQuota{
+			ID:     q.ID,
+			Model:  strings.TrimSpace(q.Model),
+			Tokens: q.Tokens,
+		})
+	}
+	return plan
+}
+
+// CreatePlan creates a subscription plan.
+// POST /admin/plans
+func (h *SubscriptionHandler) CreatePlan(c *gin.Context) {
+	var req planRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	plan := req.toPlan()
+	for i := range plan.Quotas {
+		plan.Quotas[i].ID = 0
+	}
+	if err := h.server.SubscriptionDB.CreatePlan(plan); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "failed to create plan: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// ListAllPlans lists all plans including inactive ones.
+// GET /admin/plans
+func (h *SubscriptionHandler) ListAllPlans(c *gin.Context) {
+	plans, err := h.server.SubscriptionDB.ListPlans(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list plans: " + err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
+
+// UpdatePlan updates a plan and replaces its quota list.
+// Quotas that keep their id keep the current period usage.
+// PUT /admin/plans/:id
+func (h *SubscriptionHandler) UpdatePlan(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid plan id"})
+		return
+	}
+	existing, err := h.server.SubscriptionDB.GetPlan(uint(id))
+	if err != nil {
+		if errors.Is(err, models.ErrPlanNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req planRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request: " + err.Error()})
+		return
+	}
+	plan := req.toPlan()
+	plan.ID = existing.ID
+	if req.Active == nil {
+		plan.Active = existing.Active
+	}
+	// 只允许保留本套餐自己的额度 ID
+	owned := make(map[uint]bool, len(existing.Quotas))
+	for _, q := range existing.Quotas {
+		owned[q.ID] = true
+	}
+	for i := range plan.Quotas {
+		if !owned[plan.Quotas[i].ID] {
+			plan.Quotas[i].ID = 0
+		}
+	}
+
+	if err := h.server.SubscriptionDB.UpdatePlan(plan); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update plan: " + err.Error()})
+		return
+	}
+	updated, _ := h.server.SubscriptionDB.GetPlan(plan.ID)
+	c.JSON(http.StatusOK, updated)
+}
+
+// ListPlans lists plans available for subscription.
+// GET /api/user/plans
+func (h *SubscriptionHandler) ListPlans(c *gin.Context) {
+	plans, err := h.server.SubscriptionDB.ListPlans(true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询套餐失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"plans": plans})
+}
+
+// GetSubscription returns the current subscription and period usage.
+// GET /api/user/subscription
+func (h *SubscriptionHandler) GetSubscription(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	status, err := h.server.SubscriptionDB.GetStatus(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "查询订阅失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription": status})
+}
+
+// Subscribe subscribes the current user to a plan, charging the first month from balance.
+// POST /api/user/subscription
+func (h *SubscriptionHandler) Subscribe(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		PlanID uint `json:"plan_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少套餐ID"})
+		return
+	}
+
+	sub, err := h.server.SubscriptionDB.Subscribe(userIDStr, req.PlanID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrPlanNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, models.ErrInsufficientBalance):
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "余额不足，请先充值"})
+		case errors.Is(err, models.ErrPlanInactive), errors.Is(err, models.ErrAlreadySubscribed):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "订阅失败: " + err.Error()})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, sub)
+}
+
+// CancelSubscription turns off auto renewal; the plan stays usable until the period ends.
+// DELETE /api/user/subscription
+func (h *SubscriptionHandler) CancelSubscription(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	if err := h.server.SubscriptionDB.CancelAutoRenew(userIDStr); err != nil {
+		if errors.Is(err, models.ErrSubscriptionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "取消订阅失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已取消自动续费，当前周期结束后失效"})
+}
@@ -1,6 +1,7 @@
 package user_handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"star-fire/internal/models"
@@ -422,3 +423,65 @@ func (h *TokenUsageHandler) GetUserIncomeModels(c *gin.Context) {
 		"data":  stats,
 	})
 }
+
+// ==================== 单次请求查询 ====================
+
+// GetRequest 按请求 ID 查询单次请求的完整记录：耗时、首 token 耗时、服务方、费用和结果
+// GET /v1/requests/:id
+func (h *TokenUsageHandler) GetRequest(c *gin.Context) {
+	userIDStr, ok := getUserIDFromContext(c)
+	if !ok {
+		return
+	}
+
+	usage, err := h.server.TokenUsageDB.GetUserRequest(userIDStr, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, models.ErrUsageNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "query request failed"})
+		return
+	}
+
+	resp := gin.H{
+		"id":               usage.RequestID,
+		"object":           "starfire.request",
+		"model":            usage.Model,
+		"request_type":     usage.RequestType,
+		"outcome":          usage.Outcome,
+		"provider":         usage.ClientID,
+		"input_tokens":     usage.InputTokens,
+		"cached_tokens":    usage.CachedTokens,
+		"output_tokens":    usage.OutputTokens,
+		"reasoning_tokens": usage.ReasoningTokens,
+		"image_count":      usage.ImageCount,
+		"total_tokens":     usage.TotalTokens,
+		"plan_tokens":      usage.PlanTokens,
+		"price": gin.H{
+			"ippm":  usage.IPPM,
+			"cippm": usage.CIPPM,
+			"oppm":  usage.OPPM,
+			"rppm":  usage.RPPM,
+			"ppi":   usage.PPI,
+		},
+		"cost":       usage.Cost,
+		"refunded":   usage.Refunded,
+		"net_cost":   usage.NetCost(),
+		"latency_ms": usage.LatencyMs,
+		"ttft_ms":    usage.TTFTMs,
+		"created":    usage.Timestamp.Unix(),
+	}
+	if usage.AuctionRule != "" {
+		resp["auction"] = gin.H{
+			"rule":       usage.AuctionRule,
+			"bid_ippm":   usage.BidIPPM,
+			"bid_oppm":   usage.BidOPPM,
+			"ask_ippm":   usage.AskIPPM,
+			"ask_oppm":   usage.AskOPPM,
+			"clear_ippm": usage.ListIPPM,
+			"clear_oppm": usage.ListOPPM,
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -79,6 +79,8 @@ func (uh *UserHandler) Register(c *gin.Context, server *models.Server) {
 		Username string `json:"username" binding:"required"`
 		Password string `json:"password" binding:"required,min=6"`
 		Code     string `json:"code" binding:"required"`
+		// ReferralCode 可选，邀请人的邀请码
+		ReferralCode string `json:"referral_code"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -142,10 +144,17 @@ func (uh *UserHandler) Register(c *gin.Context, server *models.Server) {
 	// 新注册会员赠送余额（从数据库动态读取，无需重启）
 	bonus := server.SystemConfigDB.GetFloat(models.ConfigKeyRegisterBonus, 0)
 	if bonus > 0 {
-		if err := server.UserDB.AddBalance(user.ID, bonus); err != nil {
+		if _, err := server.BalanceHistoryDB.Grant(user.ID, bonus, models.BalanceTypeRegisterBonus, "", ""); err != nil {
 			log.Printf("赠送注册余额失败 user=%s: %v", user.ID, err)
 		}
 	}
 
+	// 绑定邀请关系，奖励在被邀请人达到消费门槛后发放
+	if req.ReferralCode != "" {
+		if err := server.ReferralDB.Bind(user.ID, req.ReferralCode); err != nil {
+			log.Printf("绑定邀请关系失败 user=%s code=%s: %v", user.ID, req.ReferralCode, err)
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "注册成功"})
 }
@@ -33,6 +33,10 @@ type Client struct {
 	joinToken       string
 	Models          []*public.Model `json:"models"`
 	modelsMu        sync.RWMutex
+	aliases         map[string]string // 服务器推送的 规范 ID -> 本地模型名称
+	versionMu       sync.Mutex
+	modelsVersion   uint64            // 上报的模型集合版本，模型列表（含价格）变化时加一
+	modelsDigest    [sha256.Size]byte // 上次上报的模型列表摘要
 	ctx             context.Context
 	cancel          context.CancelFunc
 	cfg             *config.Config
@@ -43,8 +47,22 @@ type Client struct {
 	}
 	AppClient net.Conn
 	wsMu      sync.Mutex // 保护 WebSocket 并发写入
+	mux       *streamMux // 当前控制连接上复用的响应流，由 wsMu 保护
 	routingMu sync.Mutex
 	routingRR map[string]int
+
+	loadMu   sync.Mutex
+	received map[string]int // model -> 已接收、尚未处理完的请求数
+	cpuIdle  uint64         // 上次心跳采样的累计 CPU 时间
+	cpuTotal uint64
+
+	InferenceEngine EngineInfo `json:"inference_engine"`
+}
+
+// EngineInfo 注册时上报的推理引擎信息，服务器按 NumParallel 计算空闲并发
+type EngineInfo struct {
+	Name        string `json:"name"`
+	NumParallel int    `json:"num_parallel"`
 }
 
 func NewClient(cfg *config.Config) (*Client, error) {
@@ -58,6 +76,10 @@ func NewClient(cfg *config.Config) (*Client, error) {
 		Models:       []*public.Model{},
 		routingRR:    make(map[string]int),
 		cfg:          cfg,
+		InferenceEngine: EngineInfo{
+			Name:        cfg.LocalInferenceType,
+			NumParallel: cfg.NumParallel,
+		},
 		ModelPriceScope: make(map[string]struct {
 			inputPriceMax       float64
 			outputPriceMax      float64
@@ -284,10 +306,16 @@ func mergeModelPrices(existing, discovered []*public.Model, cfg *config.Config)
 			model.IPPM = price.InputPrice
 			model.OPPM = price.OutputPrice
 			model.CIPPM = price.CachedInputPrice
+			model.RPPM = price.ReasoningPrice
+			model.PPI = price.ImagePrice
+			model.PriceTiers = price.PriceTiers
 		} else if current, ok := existingModels[model.Name]; ok {
 			model.IPPM = current.IPPM
 			model.OPPM = current.OPPM
 			model.CIPPM = current.CIPPM
+			model.RPPM = current.RPPM
+			model.PPI = current.PPI
+			model.PriceTiers = current.PriceTiers
 		} else {
 			model.IPPM = cfg.InputTokenPricePerMillion
 			model.OPPM = cfg.OutputTokenPricePerMillion
@@ -309,6 +337,20 @@ func (c *Client) modelsSnapshot() []*public.Model {
 	return models
 }
 
+// versionedModels 返回模型列表快照及其版本，列表与上次上报的不同时版本加一
+func (c *Client) versionedModels() ([]*public.Model, uint64) {
+	models := c.modelsSnapshot()
+	data, _ := json.Marshal(models)
+	digest := sha256.Sum256(data)
+	c.versionMu.Lock()
+	defer c.versionMu.Unlock()
+	if c.modelsVersion == 0 || digest != c.modelsDigest {
+		c.modelsVersion++
+		c.modelsDigest = digest
+	}
+	return models, c.modelsVersion
+}
+
 // isEmbeddingModel 检查模型名称是否为embedding模型
 func (c *Client) isEmbeddingModel(modelName string) bool {
 	embeddingModels := []string{
@@ -571,6 +613,9 @@ func (c *Client) SetModelPrice(engine string, inputTokenPrice float64, outputTok
 				InputPrice:       c.Models[i].IPPM,
 				OutputPrice:      c.Models[i].OPPM,
 				CachedInputPrice: c.Models[i].CIPPM,
+				ReasoningPrice:   c.Models[i].RPPM,
+				ImagePrice:       c.Models[i].PPI,
+				PriceTiers:       c.Models[i].PriceTiers,
 			}
 			break
 		}
@@ -603,11 +648,13 @@ func (c *Client) pushModelUpdate() {
 		return
 	}
 
-	models := c.modelsSnapshot()
+	models, version := c.versionedModels()
 	pong := public.PPMessage{
 		Type:            public.PONG,
 		Timestamp:       strconv.FormatInt(time.Now().UnixMilli(), 10),
 		AvailableModels: models,
+		Load:            c.loadSnapshot(models),
+		ModelsVersion:   version,
 	}
 	response := public.WSMessage{
 		Type:    public.KEEPALIVE,
@@ -3,6 +3,7 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"star-fire/client/internal/config"
 	"star-fire/pkg/public"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sashabaranov/go-openai"
@@ -76,8 +78,11 @@ func RegisterClient(c *Client, host, token string) error {
 func (c *Client) HandleMessages() {
 	c.wsMu.Lock()
 	conn := c.controlConn
+	mux := newStreamMux(conn, &c.wsMu)
+	c.mux = mux
 	c.wsMu.Unlock()
 	defer func() {
+		mux.close(errors.New("control connection closed"))
 		c.wsMu.Lock()
 		_ = conn.Close()
 		c.wsMu.Unlock()
@@ -87,6 +92,20 @@ func (c *Client) HandleMessages() {
 	messageCh := make(chan public.WSMessage, 1)
 	errorCh := make(chan error, 1)
 
+	// 超过 HEARTBEAT_TIMEOUT 未收到 server 的任何帧（消息或 WebSocket ping）时读取超时，
+	// 退出后由调用方重连
+	timeout := public.HEARTBEAT_TIMEOUT * time.Second
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPingHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		// WriteControl 可与其他写入并发调用，不需要 wsMu；原样带回 ping 的发送时间供 server 测量延迟
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		return err
+	})
+
 	// 启动消息读取 goroutine
 	go func() {
 		for {
@@ -96,6 +115,7 @@ func (c *Client) HandleMessages() {
 				errorCh <- err
 				return
 			}
+			_ = conn.SetReadDeadline(time.Now().Add(timeout))
 			messageCh <- message
 		}
 	}()
@@ -124,6 +144,10 @@ func (c *Client) HandleMessages() {
 				c.handleIncome(message)
 			case public.MODEL_PRICE_UPDATE:
 				c.handleModelPriceUpdate(message)
+			case public.MODEL_ALIASES:
+				c.handleModelAliases(message)
+			case public.STREAM_WINDOW:
+				mux.grant(message.FingerPrint, message.Window)
 			case public.CLOSE:
 				if message.Content == public.ABORT {
 					c.handleAbort(message.FingerPrint)
@@ -139,18 +163,22 @@ func (c *Client) HandleMessages() {
 }
 
 func (c *Client) handleKeepAlive(message public.WSMessage) {
-	log.Printf("recieve pong")
-	_ = c.refreshModels()
-	// for test update model price
-	log.Println("update model price...")
-	models := c.modelsSnapshot()
-	for _, model := range models {
-		fmt.Println("model:", model.Name, "price:", model.OPPM, "inputPrice:", model.IPPM)
+	var ping public.PPMessage
+	if data, err := json.Marshal(message.Content); err == nil {
+		_ = json.Unmarshal(data, &ping)
 	}
+	_ = c.refreshModels()
+	models, version := c.versionedModels()
 	pong := public.PPMessage{
-		Type:            public.PONG,
-		Timestamp:       message.Content.(map[string]interface{})["timestamp"].(string),
-		AvailableModels: models,
+		Type:          public.PONG,
+		Timestamp:     ping.Timestamp,
+		Load:          c.loadSnapshot(models),
+		ModelsVersion: version,
+	}
+	// server 已有当前版本的模型列表时只回复负载；旧版本 server 不带版本，每次都回复完整列表
+	if ping.ModelsVersion != version {
+		pong.AvailableModels = models
+		log.Printf("send models version %d (%d models)", version, len(models))
 	}
 	response := public.WSMessage{
 		Type:    public.KEEPALIVE,
@@ -163,7 +191,6 @@ func (c *Client) handleKeepAlive(message public.WSMessage) {
 	if err != nil {
 		log.Printf("send pong error: %v", err)
 	}
-	fmt.Println("pong message is:", response)
 }
 
 func (c *Client) handleReconnect(message public.WSMessage) {
@@ -174,6 +201,34 @@ func (c *Client) handleReconnect(message public.WSMessage) {
 	}
 }
 
+// handleModelAliases 保存服务器推送的 规范 ID -> 本地名称 映射，派发的请求按规范 ID 指定模型
+func (c *Client) handleModelAliases(message public.WSMessage) {
+	data, err := json.Marshal(message.Content)
+	if err != nil {
+		log.Printf("marshal model aliases error: %v", err)
+		return
+	}
+	var aliases map[string]string
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		log.Printf("invalid model aliases: %v", err)
+		return
+	}
+	c.modelsMu.Lock()
+	c.aliases = aliases
+	c.modelsMu.Unlock()
+	log.Printf("model aliases updated by server: %v", aliases)
+}
+
+// localModelName 把服务器使用的规范 ID 改回推理引擎的本地名称，没有映射时原样返回
+func (c *Client) localModelName(name string) string {
+	c.modelsMu.RLock()
+	defer c.modelsMu.RUnlock()
+	if local, ok := c.aliases[name]; ok {
+		return local
+	}
+	return name
+}
+
 func (c *Client) handleModelPriceUpdate(message public.WSMessage) {
 	data, err := json.Marshal(message.Content)
 	if err != nil {
@@ -186,6 +241,7 @@ func (c *Client) handleModelPriceUpdate(message public.WSMessage) {
 		log.Printf("invalid model price update: %v", err)
 		return
 	}
+	update.Model = c.localModelName(update.Model)
 
 	c.modelsMu.Lock()
 	defer c.modelsMu.Unlock()
@@ -194,6 +250,9 @@ func (c *Client) handleModelPriceUpdate(message public.WSMessage) {
 			model.IPPM = update.IPPM
 			model.OPPM = update.OPPM
 			model.CIPPM = update.CIPPM
+			model.RPPM = update.RPPM
+			model.PPI = update.PPI
+			model.PriceTiers = update.Tiers
 		}
 	}
 	if c.cfg.ModelPrices == nil {
@@ -203,6 +262,9 @@ func (c *Client) handleModelPriceUpdate(message public.WSMessage) {
 		InputPrice:       update.IPPM,
 		OutputPrice:      update.OPPM,
 		CachedInputPrice: update.CIPPM,
+		ReasoningPrice:   update.RPPM,
+		ImagePrice:       update.PPI,
+		PriceTiers:       update.Tiers,
 	}
 	log.Printf("model price updated by server: %s %.6f/%.6f/%.6f", update.Model, update.IPPM, update.OPPM, update.CIPPM)
 }
@@ -212,6 +274,9 @@ func (c *Client) handleAbort(fingerprint string) {
 	if cancel, ok := requestCancels.LoadAndDelete(fingerprint); ok {
 		cancel.(context.CancelFunc)()
 	}
+	if mux := c.responseMux(); mux != nil {
+		mux.abort(fingerprint)
+	}
 }
 
 func (c *Client) handleChatMessage(message public.WSMessage) {
@@ -224,12 +289,16 @@ func (c *Client) handleChatMessage(message public.WSMessage) {
 		return
 	}
 
+	openaiReq.Model = c.localModelName(openaiReq.Model)
+
 	// 为每个请求创建独立的可取消 context，便于按 fingerprint 单独取消
 	ctx, cancel := context.WithCancel(c.ctx)
 	requestCancels.Store(message.FingerPrint, cancel)
 
+	done := c.trackRequest(openaiReq.Model)
 	go func() {
 		defer func() {
+			done()
 			cancel()
 			requestCancels.Delete(message.FingerPrint)
 		}()
@@ -240,7 +309,7 @@ func (c *Client) handleChatMessage(message public.WSMessage) {
 			return
 		}
 
-		responseConn, err := openResponseConn(c.starFireHost, message.FingerPrint)
+		responseConn, err := c.openResponseStream(message)
 		if err != nil {
 			log.Printf("open response connection error: %v", err)
 			return
@@ -261,15 +330,18 @@ func (c *Client) handleEmbeddingMessage(message public.WSMessage) {
 		log.Printf("parse embedding request error: %v", err)
 		return
 	}
+	openaiReq.Model = openai.EmbeddingModel(c.localModelName(string(openaiReq.Model)))
 
+	done := c.trackRequest(string(openaiReq.Model))
 	go func() {
+		defer done()
 		engine, err := c.findEngineForModel(string(openaiReq.Model))
 		if err != nil {
 			log.Printf("not found support model %s engine: %v", openaiReq.Model, err)
 			return
 		}
 
-		responseConn, err := openResponseConn(c.starFireHost, message.FingerPrint)
+		responseConn, err := c.openResponseStream(message)
 		if err != nil {
 			log.Printf("open response connection error: %v", err)
 			return
@@ -281,6 +353,29 @@ func (c *Client) handleEmbeddingMessage(message public.WSMessage) {
 	}()
 }
 
+func (c *Client) responseMux() *streamMux {
+	c.wsMu.Lock()
+	defer c.wsMu.Unlock()
+	return c.mux
+}
+
+// openResponseStream server 在派发的请求中声明了发送窗口时在控制连接上复用响应流，
+// 否则（旧版本 server）为请求建立 /response 连接
+func (c *Client) openResponseStream(message public.WSMessage) (responseStream, error) {
+	if mux := c.responseMux(); mux != nil && message.Window > 0 {
+		stream, err := mux.open(message.FingerPrint, message.Window)
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+	conn, err := openResponseConn(c.starFireHost, message.FingerPrint)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
 func openResponseConn(host, fingerprint string) (*websocket.Conn, error) {
 	wsScheme, wsHost, err := parseHost(host)
 	if err != nil {
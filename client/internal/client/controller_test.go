@@ -64,10 +64,10 @@ func (engine *fakeEngine) SupportsModel(modelName string, _ *config.Config) bool
 	}
 	return false
 }
-func (engine *fakeEngine) HandleChat(context.Context, string, *public.ExtendedChatRequest, *websocket.Conn) error {
+func (engine *fakeEngine) HandleChat(context.Context, string, *public.ExtendedChatRequest, inference.ResponseWriter) error {
 	return nil
 }
-func (engine *fakeEngine) HandleEmbedding(context.Context, string, *openaiapi.EmbeddingRequest, *websocket.Conn) error {
+func (engine *fakeEngine) HandleEmbedding(context.Context, string, *openaiapi.EmbeddingRequest, inference.ResponseWriter) error {
 	return nil
 }
 func (engine *fakeEngine) SupportsEmbedding(string) bool { return false }
@@ -351,3 +351,129 @@ func TestApplyProxyBackendsSkipsUnchangedConfiguration(t *testing.T) {
 		t.Fatalf("unchanged configuration rebuilt engines: %+v", client.engines)
 	}
 }
+
+type loadedFakeEngine struct {
+	fakeEngine
+	loaded map[string]int64
+}
+
+func (engine *loadedFakeEngine) LoadedModels() map[string]int64 { return engine.loaded }
+
+func TestLoadSnapshotReportsQueueAndLoadedModels(t *testing.T) {
+	local := &loadedFakeEngine{fakeEngine: fakeEngine{name: "ollama"}, loaded: map[string]int64{"llama": 1 << 30}}
+	client := &Client{engines: []inference.Engine{local, &fakeEngine{name: "openai"}}}
+	client.InferenceEngine.NumParallel = 2
+
+	done := make([]func(), 0, 3)
+	for i := 0; i < 3; i++ {
+		done = append(done, client.trackRequest("llama"))
+	}
+	models := []*public.Model{
+		{Name: "llama", Engine: "ollama"},
+		{Name: "nomic-embed", Engine: "ollama"},
+		{Name: "gpt", Engine: "openai"},
+	}
+	load := client.loadSnapshot(models)
+	if load.MaxParallel != 2 || load.Active != 2 || load.Queued != 1 {
+		t.Fatalf("load = %+v, want max_parallel 2, active 2, queued 1", load)
+	}
+	if ml, _ := load.Model("llama"); !ml.Loaded || ml.SizeVRAM != 1<<30 {
+		t.Fatalf("llama load = %+v, want loaded with vram", ml)
+	}
+	if ml, _ := load.Model("nomic-embed"); ml.Loaded {
+		t.Fatal("model missing from /api/ps reported as loaded")
+	}
+	if ml, _ := load.Model("gpt"); !ml.Loaded {
+		t.Fatal("remote API model should always be reported as loaded")
+	}
+
+	for _, release := range done {
+		release()
+	}
+	if load := client.loadSnapshot(models); load.Active != 0 || load.Queued != 0 {
+		t.Fatalf("load after release = %+v, want idle", load)
+	}
+}
+
+func TestModelAliasesRewriteCanonicalNames(t *testing.T) {
+	cfg := &config.Config{ModelPrices: map[string]config.ModelPrice{}}
+	client := &Client{cfg: cfg, Models: []*public.Model{{Name: "qwen3:8b", Engine: "ollama", IPPM: 1}}}
+	client.handleModelAliases(public.WSMessage{Content: map[string]string{"qwen3-8b": "qwen3:8b"}})
+
+	if got := client.localModelName("qwen3-8b"); got != "qwen3:8b" {
+		t.Fatalf("local name = %q, want qwen3:8b", got)
+	}
+	if got := client.localModelName("llama3"); got != "llama3" {
+		t.Fatalf("unmapped name = %q, want unchanged", got)
+	}
+
+	client.handleModelPriceUpdate(public.WSMessage{
+		Content: public.ModelPriceUpdate{Model: "qwen3-8b", IPPM: 2, OPPM: 4},
+	})
+	if client.modelsSnapshot()[0].IPPM != 2 || cfg.ModelPrices["qwen3:8b"].InputPrice != 2 {
+		t.Fatalf("price update by canonical name not applied to local model: %+v", cfg.ModelPrices)
+	}
+}
+
+func TestKeepAliveSendsModelsOnlyWhenVersionChanges(t *testing.T) {
+	engine := &fakeEngine{name: "ollama", models: []*public.Model{{Name: "qwen3:8b", Engine: "ollama"}}}
+	cfg := &config.Config{RegisteredModels: []string{"qwen3:8b", "llama3"}, ModelPrices: map[string]config.ModelPrice{}}
+	upgrader := websocket.Upgrader{}
+	pongs := make(chan public.PPMessage, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		conn, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			t.Errorf("upgrade websocket: %v", err)
+			return
+		}
+		defer conn.Close()
+		var known uint64
+		for i := 0; i < 3; i++ {
+			if i == 2 {
+				engine.models = append(engine.models, &public.Model{Name: "llama3", Engine: "ollama"})
+			}
+			if err := conn.WriteJSON(public.WSMessage{Type: public.KEEPALIVE, Content: public.PPMessage{
+				Type: public.PING, Timestamp: "1", ModelsVersion: known,
+			}}); err != nil {
+				t.Errorf("write ping: %v", err)
+				return
+			}
+			var message public.WSMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				t.Errorf("read pong: %v", err)
+				return
+			}
+			data, _ := json.Marshal(message.Content)
+			var pong public.PPMessage
+			if err := json.Unmarshal(data, &pong); err != nil {
+				t.Errorf("unmarshal pong: %v", err)
+				return
+			}
+			known = pong.ModelsVersion
+			pongs <- pong
+		}
+		_ = conn.WriteJSON(public.WSMessage{Type: public.CLOSE, Content: "test complete"})
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	client := &Client{
+		controlConn: conn, ctx: context.Background(), cfg: cfg,
+		engines: []inference.Engine{engine}, routingRR: map[string]int{},
+	}
+	client.HandleMessages()
+
+	first, second, third := <-pongs, <-pongs, <-pongs
+	if len(first.AvailableModels) != 1 || first.ModelsVersion == 0 {
+		t.Fatalf("first pong = %+v, want full snapshot", first)
+	}
+	if second.AvailableModels != nil || second.ModelsVersion != first.ModelsVersion || second.Load == nil {
+		t.Fatalf("second pong = %+v, want load only", second)
+	}
+	if len(third.AvailableModels) != 2 || third.ModelsVersion <= second.ModelsVersion {
+		t.Fatalf("third pong = %+v, want new snapshot after model set changed", third)
+	}
+}
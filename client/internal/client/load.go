@@ -0,0 +1,73 @@
+package client
+
+import (
+	"star-fire/client/internal/inference"
+	"star-fire/pkg/public"
+)
+
+// trackRequest 记录一个已接收的 model 请求，返回的函数在请求处理结束时调用
+func (c *Client) trackRequest(model string) func() {
+	c.loadMu.Lock()
+	if c.received == nil {
+		c.received = make(map[string]int)
+	}
+	c.received[model]++
+	c.loadMu.Unlock()
+	return func() {
+		c.loadMu.Lock()
+		if c.received[model]--; c.received[model] <= 0 {
+			delete(c.received, model)
+		}
+		c.loadMu.Unlock()
+	}
+}
+
+// loadSnapshot 汇总心跳上报的负载。推理引擎每个模型同时处理 NumParallel 个请求，
+// 超出的部分在引擎内排队，按 queued 上报。
+func (c *Client) loadSnapshot(models []*public.Model) *public.ClientLoad {
+	maxParallel := max(c.InferenceEngine.NumParallel, 1)
+
+	c.enginesMu.RLock()
+	loaded := make(map[string]map[string]int64)
+	for _, engine := range c.engines {
+		if reporter, ok := engine.(inference.LoadReporter); ok {
+			loaded[engine.Name()] = reporter.LoadedModels()
+		}
+	}
+	c.enginesMu.RUnlock()
+
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+	load := &public.ClientLoad{MaxParallel: maxParallel}
+	load.CPUPercent = c.cpuPercentLocked()
+	load.MemPercent = memPercent()
+	for _, m := range models {
+		ml := public.ModelLoad{Model: m.Name, Loaded: true}
+		if n := c.received[m.Name]; n > 0 {
+			ml.Active = min(n, maxParallel)
+			ml.Queued = n - ml.Active
+		}
+		if running, ok := loaded[m.Engine]; ok {
+			ml.SizeVRAM, ml.Loaded = running[m.Name]
+		}
+		load.Active += ml.Active
+		load.Queued += ml.Queued
+		load.Models = append(load.Models, ml)
+	}
+	return load
+}
+
+// cpuPercentLocked 返回距上次采样以来的 CPU 使用率，第一次采样或无法获取时返回 0
+func (c *Client) cpuPercentLocked() float64 {
+	idle, total, ok := cpuTimes()
+	if !ok {
+		return 0
+	}
+	prevIdle, prevTotal := c.cpuIdle, c.cpuTotal
+	c.cpuIdle, c.cpuTotal = idle, total
+	if prevTotal == 0 || total <= prevTotal {
+		return 0
+	}
+	busy := float64((total - prevTotal) - (idle - prevIdle))
+	return busy / float64(total-prevTotal) * 100
+}
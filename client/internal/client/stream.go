@@ -0,0 +1,184 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"star-fire/pkg/public"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errStreamAborted = errors.New("response stream aborted by server")
+	errStreamClosed  = errors.New("response stream closed")
+)
+
+// responseStream 一个请求的响应写入端：控制连接上复用的流，或旧版本 server 下为请求建立的 /response 连接
+type responseStream interface {
+	WriteJSON(v interface{}) error
+	Close() error
+}
+
+// streamMux 在控制连接上复用请求的响应流。每个流有独立的发送窗口，用完后等待 server 追加；
+// 发送 goroutine 轮流从有待发送消息的流中各取一条写入，长响应不会阻塞其他流。
+type streamMux struct {
+	conn    *websocket.Conn
+	wsMu    *sync.Mutex // 与其他控制消息共用的写锁
+	mu      sync.Mutex
+	cond    *sync.Cond
+	streams map[string]*muxStream
+	ready   []*muxStream // 有待发送消息的流，按轮转顺序
+	err     error        // 控制连接已断开
+}
+
+type muxStream struct {
+	mux         *streamMux
+	fingerprint string
+	window      int                // 剩余发送窗口（帧）
+	pending     []public.WSMessage // 待发送的消息，由 mux.mu 保护
+	err         error              // 被 server 中止或控制连接断开
+	closed      bool
+}
+
+func newStreamMux(conn *websocket.Conn, wsMu *sync.Mutex) *streamMux {
+	m := &streamMux{conn: conn, wsMu: wsMu, streams: make(map[string]*muxStream)}
+	m.cond = sync.NewCond(&m.mu)
+	go m.run()
+	return m
+}
+
+// open 开始 fingerprint 的响应流，window 为 server 声明的初始发送窗口
+func (m *streamMux) open(fingerprint string, window int) (*muxStream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	s := &muxStream{mux: m, fingerprint: fingerprint, window: window}
+	m.streams[fingerprint] = s
+	m.enqueue(s, public.WSMessage{Type: public.STREAM_OPEN, FingerPrint: fingerprint})
+	return s, nil
+}
+
+func (m *streamMux) enqueue(s *muxStream, msg public.WSMessage) {
+	s.pending = append(s.pending, msg)
+	if len(s.pending) == 1 {
+		m.ready = append(m.ready, s)
+		m.cond.Broadcast()
+	}
+}
+
+// grant server 消费帧后为流追加发送窗口
+func (m *streamMux) grant(fingerprint string, window int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.streams[fingerprint]; s != nil {
+		s.window += window
+		m.cond.Broadcast()
+	}
+}
+
+// abort server 放弃请求：丢弃未发送的消息，之后的写入返回错误
+func (m *streamMux) abort(fingerprint string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.streams[fingerprint]; s != nil {
+		s.err, s.pending = errStreamAborted, nil
+		delete(m.streams, fingerprint)
+		m.cond.Broadcast()
+	}
+}
+
+// close 控制连接断开时结束所有流
+func (m *streamMux) close(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fail(err)
+}
+
+func (m *streamMux) fail(err error) {
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	for _, s := range m.streams {
+		s.err, s.pending = err, nil
+	}
+	m.streams, m.ready = map[string]*muxStream{}, nil
+	m.cond.Broadcast()
+}
+
+func (m *streamMux) run() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		for len(m.ready) == 0 && m.err == nil {
+			m.cond.Wait()
+		}
+		if m.err != nil {
+			return
+		}
+		s := m.ready[0]
+		m.ready = m.ready[1:]
+		if len(s.pending) == 0 {
+			continue // 已中止的流
+		}
+		msg := s.pending[0]
+		s.pending = s.pending[1:]
+		if len(s.pending) > 0 {
+			m.ready = append(m.ready, s) // 每个流每轮只发送一条
+		}
+		if msg.Type == public.STREAM_END {
+			delete(m.streams, s.fingerprint)
+		}
+
+		m.mu.Unlock()
+		m.wsMu.Lock()
+		err := m.conn.WriteJSON(msg)
+		m.wsMu.Unlock()
+		m.mu.Lock()
+		if err != nil {
+			m.fail(err)
+		}
+	}
+}
+
+// WriteJSON 把一帧放入发送队列，发送窗口用完时等待 server 追加窗口
+func (s *muxStream) WriteJSON(v interface{}) error {
+	frame, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m := s.mux
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for s.window <= 0 && s.err == nil && !s.closed {
+		m.cond.Wait()
+	}
+	switch {
+	case s.err != nil:
+		return s.err
+	case s.closed:
+		return errStreamClosed
+	}
+	s.window--
+	m.enqueue(s, public.WSMessage{Type: public.STREAM_FRAME, FingerPrint: s.fingerprint, Frame: frame})
+	return nil
+}
+
+// Close 结束响应流，已排队的帧发送完后通知 server
+func (s *muxStream) Close() error {
+	m := s.mux
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.err == nil {
+		m.enqueue(s, public.WSMessage{Type: public.STREAM_END, FingerPrint: s.fingerprint})
+	}
+	m.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"star-fire/client/internal/config"
+	"star-fire/client/internal/inference"
+	"star-fire/pkg/public"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamPeer 启动一个 WebSocket 对端，把收到的消息依次放入 received，并通过 send 向 client 发送消息
+func streamPeer(t *testing.T) (conn *websocket.Conn, received chan public.WSMessage, send chan public.WSMessage) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	received = make(chan public.WSMessage, 64)
+	send = make(chan public.WSMessage, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		peer, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			t.Errorf("upgrade websocket: %v", err)
+			return
+		}
+		defer peer.Close()
+		go func() {
+			for message := range send {
+				_ = peer.WriteJSON(message)
+			}
+		}()
+		for {
+			var message public.WSMessage
+			if err := peer.ReadJSON(&message); err != nil {
+				return
+			}
+			received <- message
+		}
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, received, send
+}
+
+func TestStreamMuxWaitsForWindowAndAlternatesStreams(t *testing.T) {
+	conn, received, _ := streamPeer(t)
+	var wsMu sync.Mutex
+	mux := newStreamMux(conn, &wsMu)
+	defer mux.close(errors.New("test complete"))
+
+	// 写锁被占用期间两个流都排好队，发送时轮流各发一条
+	wsMu.Lock()
+	long, _ := mux.open("long", 10)
+	for i := 0; i < 10; i++ {
+		if err := long.WriteJSON(public.WSMessage{Type: public.MESSAGE_STREAM}); err != nil {
+			t.Fatalf("write long stream: %v", err)
+		}
+	}
+	short, _ := mux.open("short", 1)
+	_ = short.WriteJSON(public.WSMessage{Type: public.MESSAGE})
+	_ = short.Close()
+	wsMu.Unlock()
+
+	longFrames := 0
+	for {
+		message := <-received
+		if message.FingerPrint == "long" && message.Type == public.STREAM_FRAME {
+			longFrames++
+		}
+		if message.FingerPrint == "short" && message.Type == public.STREAM_END {
+			break
+		}
+	}
+	if longFrames > 3 {
+		t.Fatalf("short stream waited for %d frames of the long stream", longFrames)
+	}
+
+	// 窗口用完后等待 server 追加
+	written := make(chan error, 1)
+	blocked, _ := mux.open("blocked", 0)
+	go func() { written <- blocked.WriteJSON(public.WSMessage{Type: public.MESSAGE}) }()
+	select {
+	case <-written:
+		t.Fatal("write with an exhausted window did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mux.grant("blocked", 1)
+	if err := <-written; err != nil {
+		t.Fatalf("write after window update: %v", err)
+	}
+
+	// server 中止后等待窗口的写入立即返回
+	aborted, _ := mux.open("aborted", 0)
+	go func() { written <- aborted.WriteJSON(public.WSMessage{Type: public.MESSAGE}) }()
+	mux.abort("aborted")
+	if err := <-written; !errors.Is(err, errStreamAborted) {
+		t.Fatalf("write after abort = %v", err)
+	}
+}
+
+type streamingFakeEngine struct {
+	fakeEngine
+}
+
+func (engine *streamingFakeEngine) HandleChat(_ context.Context, fingerprint string, _ *public.ExtendedChatRequest, responseConn inference.ResponseWriter) error {
+	return responseConn.WriteJSON(public.WSMessage{Type: public.MESSAGE, Content: "done", FingerPrint: fingerprint})
+}
+
+func TestChatResponseMultiplexedOverControlConnection(t *testing.T) {
+	conn, received, send := streamPeer(t)
+	engine := &streamingFakeEngine{fakeEngine{name: "ollama", models: []*public.Model{{Name: "qwen3:8b"}}}}
+	client := &Client{
+		controlConn: conn, ctx: context.Background(), cfg: &config.Config{},
+		engines: []inference.Engine{engine}, routingRR: map[string]int{},
+	}
+	handled := make(chan struct{})
+	go func() {
+		client.HandleMessages()
+		close(handled)
+	}()
+
+	request := public.ExtendedChatRequest{}
+	request.Model = "qwen3:8b"
+	send <- public.WSMessage{Type: public.MESSAGE, Content: request, FingerPrint: "fp", Window: 4}
+
+	var types []string
+	for len(types) < 3 {
+		message := <-received
+		if message.FingerPrint != "fp" {
+			t.Fatalf("unexpected message %+v", message)
+		}
+		types = append(types, message.Type)
+		if message.Type == public.STREAM_FRAME {
+			var frame public.WSMessage
+			if err := json.Unmarshal(message.Frame, &frame); err != nil || frame.Type != public.MESSAGE || frame.Content != "done" {
+				t.Fatalf("frame = %s, err = %v", message.Frame, err)
+			}
+		}
+	}
+	if strings.Join(types, ",") != public.STREAM_OPEN+","+public.STREAM_FRAME+","+public.STREAM_END {
+		t.Fatalf("stream messages = %v", types)
+	}
+
+	send <- public.WSMessage{Type: public.CLOSE, Content: "test complete"}
+	close(send)
+	<-handled
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package client
+
+// cpuTimes 非 Linux 平台暂不采集 CPU 使用率
+func cpuTimes() (idle, total uint64, ok bool) {
+	return 0, 0, false
+}
+
+// memPercent 非 Linux 平台暂不采集内存使用率
+func memPercent() float64 {
+	return 0
+}
@@ -8,6 +8,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+
+	"star-fire/pkg/public"
 )
 
 const IPPM_MAX = 3.99
@@ -18,10 +20,13 @@ const CIPPM_MAX = 1.99
 // 价格字段在 JSON 中可能是字符串（如 "2.99"），因此使用自定义反序列化
 // 支持字符串或数字两种格式
 type ModelPrice struct {
-	Engine           string  `json:"engine"`
-	InputPrice       float64 `json:"-"`
-	OutputPrice      float64 `json:"-"`
-	CachedInputPrice float64 `json:"-"`
+	Engine           string             `json:"engine"`
+	InputPrice       float64            `json:"-"`
+	OutputPrice      float64            `json:"-"`
+	CachedInputPrice float64            `json:"-"`
+	ReasoningPrice   float64            `json:"-"`
+	ImagePrice       float64            `json:"-"`
+	PriceTiers       []public.PriceTier `json:"-"`
 }
 
 type ProxyBackend struct {
@@ -106,6 +111,7 @@ type Config struct {
 	RegisteredModels                []string
 	ConfigFile                      string
 	ProxyBackends                   []ProxyBackend
+	NumParallel                     int // 推理引擎可同时处理的请求数，注册时上报给服务器
 }
 
 func LoadConfig() *Config {
@@ -118,6 +124,7 @@ func LoadConfig() *Config {
 		OPPMMax:                         20.0, // 平台输出价格上限
 		CIPPMMax:                        2.0,  // 平台缓存输入价格上限
 		ModelPrices:                     map[string]ModelPrice{},
+		NumParallel:                     1,
 	}
 
 	var showHelp bool
@@ -135,6 +142,7 @@ func LoadConfig() *Config {
 	flag.BoolVar(&cfg.Deamon, "daemon", false, "以守护进程方式运行")
 	flag.IntVar(&cfg.APPPort, "port", 19527, "服务端口 (默认:19527)")
 	flag.BoolVar(&cfg.OpenAIOnly, "openai-only", false, "仅使用 OpenAI 引擎，不注册本地引擎模型到服务器")
+	flag.IntVar(&cfg.NumParallel, "num-parallel", cfg.NumParallel, "推理引擎可同时处理的请求数 (默认: 1)")
 	flag.StringVar(&cfg.ConfigFile, "config", "starfire_config.json", "配置文件路径 (默认: starfire_config.json)")
 
 	flag.Usage = func() {
@@ -149,6 +157,7 @@ func LoadConfig() *Config {
 		_, _ = fmt.Fprintf(os.Stderr, "  STARFIRE_TOKEN        StarFire 连接令牌\n")
 		_, _ = fmt.Fprintf(os.Stderr, "  STARFIRE_ENGINE       本地推理引擎类型\n")
 		_, _ = fmt.Fprintf(os.Stderr, "  OLLAMA_HOST           Ollama API 服务器地址\n")
+		_, _ = fmt.Fprintf(os.Stderr, "  OLLAMA_NUM_PARALLEL   推理引擎可同时处理的请求数\n")
 		_, _ = fmt.Fprintf(os.Stderr, "  OPENAI_API_KEY        OpenAI API 密钥\n")
 		_, _ = fmt.Fprintf(os.Stderr, "  OPENAI_API_BASE       OpenAI API 基础URL\n")
 		_, _ = fmt.Fprintf(os.Stderr, "  STARFIRE_PRICE_PER_M  每百万tokens定价\n")
@@ -183,6 +192,11 @@ func LoadConfig() *Config {
 	if ollamaHost := os.Getenv("OLLAMA_HOST"); ollamaHost != "" && !explicitFlags["ollama-host"] {
 		cfg.OllamaHost = ollamaHost
 	}
+	if numParallel := os.Getenv("OLLAMA_NUM_PARALLEL"); numParallel != "" && !explicitFlags["num-parallel"] {
+		if n, err := strconv.Atoi(numParallel); err == nil && n > 0 {
+			cfg.NumParallel = n
+		}
+	}
 	if openaiKey := os.Getenv("OPENAI_API_KEY"); openaiKey != "" && !explicitFlags["openai-key"] {
 		cfg.OpenAIKey = openaiKey
 	}
@@ -298,6 +312,7 @@ func loadConfigFile(cfg *Config, explicitFlags map[string]bool) {
 		CIPPM            interface{}           `json:"cippm"`
 		ModelPrices      map[string]ModelPrice `json:"model_prices"`
 		RegisteredModels []string              `json:"registered_models"`
+		NumParallel      int                   `json:"num_parallel"`
 	}
 	if err := json.Unmarshal(data, &fileCfg); err != nil {
 		return // 格式错误，静默忽略
@@ -345,6 +360,9 @@ func loadConfigFile(cfg *Config, explicitFlags map[string]bool) {
 		cfg.APPPort = fileCfg.APPPort
 	}
 	cfg.RegisteredModels = append([]string(nil), fileCfg.RegisteredModels...)
+	if fileCfg.NumParallel > 0 && canUseFile("num-parallel", "OLLAMA_NUM_PARALLEL") {
+		cfg.NumParallel = fileCfg.NumParallel
+	}
 
 	// 顶层默认价格（仅当命令行和环境变量未显式指定时使用）
 	if fileCfg.IPPM != nil && canUseFile("ippm", "STAR_FIRE_INPUT_TOKEN_PRICE_PER_M") {
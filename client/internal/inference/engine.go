@@ -6,10 +6,14 @@ import (
 	"star-fire/client/internal/config"
 	"star-fire/pkg/public"
 
-	"github.com/gorilla/websocket"
 	"github.com/sashabaranov/go-openai"
 )
 
+// ResponseWriter 请求响应的写入端：为请求单独建立的 /response 连接，或控制连接上按 fingerprint 复用的响应流
+type ResponseWriter interface {
+	WriteJSON(v interface{}) error
+}
+
 type Engine interface {
 	Name() string
 	Initialize(ctx context.Context, conf *config.Config) error
@@ -17,10 +21,16 @@ type Engine interface {
 	SupportsModel(modelName string, conf *config.Config) bool
 	HandleChat(ctx context.Context, fingerprint string,
 		request *public.ExtendedChatRequest,
-		responseConn *websocket.Conn) error
+		responseConn ResponseWriter) error
 	// 添加embedding支持
 	HandleEmbedding(ctx context.Context, fingerprint string,
 		request *openai.EmbeddingRequest,
-		responseConn *websocket.Conn) error
+		responseConn ResponseWriter) error
 	SupportsEmbedding(modelName string) bool
 }
+
+// LoadReporter 由能够报告模型是否已加载到内存的引擎实现（如 Ollama /api/ps），
+// 返回已加载模型名到显存占用的映射
+type LoadReporter interface {
+	LoadedModels() map[string]int64
+}
@@ -9,13 +9,14 @@ import (
 	"net/http"
 	"net/url"
 	"star-fire/client/internal/config"
+	"star-fire/client/internal/inference"
 	"star-fire/pkg/public"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/ollama/ollama/api"
+	ollamatypes "github.com/ollama/ollama/types/model"
 	"github.com/sashabaranov/go-openai"
 )
 
@@ -23,6 +24,9 @@ type Engine struct {
 	client    *api.Client
 	models    map[string]api.ProcessModelResponse
 	modelsMu  sync.RWMutex
+	loaded    map[string]int64                // 正在运行（已加载到内存）的模型 -> 显存占用
+	caps      map[string]*public.Capabilities // digest -> /api/show 声明的能力
+	capsMu    sync.Mutex
 	ollamaURL string
 
 	thinkingStarted map[string]bool // fingerprint -> 是否已经开始思考
@@ -88,9 +92,11 @@ func (e *Engine) ListModels(ctx context.Context, conf *config.Config) ([]*public
 
 	// 创建运行中模型的映射，用于快速查找
 	runningModels := make(map[string]api.ProcessModelResponse)
+	loaded := make(map[string]int64)
 	if runningResp != nil {
 		for _, model := range runningResp.Models {
 			runningModels[model.Name] = model
+			loaded[model.Name] = model.SizeVRAM
 		}
 	}
 
@@ -130,11 +136,12 @@ func (e *Engine) ListModels(ctx context.Context, conf *config.Config) ([]*public
 		// 5. embedding/reranker 模型无需启动；其他模型必须正在运行
 		if shouldRegisterOllamaModel(model.Name, isRunning) {
 			publicModel := &public.Model{
-				Name:   model.Name,
-				Type:   modelType,
-				Size:   fmt.Sprintf("%d", model.Size),
-				Engine: "ollama",
-				Arch:   model.Details.QuantizationLevel,
+				Name:         model.Name,
+				Type:         modelType,
+				Size:         fmt.Sprintf("%d", model.Size),
+				Engine:       "ollama",
+				Arch:         model.Details.QuantizationLevel,
+				Capabilities: e.capabilities(ctx, model.Name, model.Digest, runningModels[model.Name].ContextLength),
 			}
 			allModels = append(allModels, publicModel)
 		}
@@ -142,6 +149,9 @@ func (e *Engine) ListModels(ctx context.Context, conf *config.Config) ([]*public
 
 	e.modelsMu.Lock()
 	e.models = modelsSnapshot
+	if runningResp != nil {
+		e.loaded = loaded
+	}
 	e.modelsMu.Unlock()
 
 	log.Printf("Ollama registered %d models (%d embedding models)",
@@ -149,6 +159,70 @@ func (e *Engine) ListModels(ctx context.Context, conf *config.Config) ([]*public
 	return allModels, nil
 }
 
+// capabilities 通过 /api/show 读取模型能力，按 digest 缓存。已加载的模型使用运行时的
+// context_length（即实际生效的 num_ctx），否则使用模型本身的最大上下文。获取失败时返回 nil（未声明）。
+func (e *Engine) capabilities(ctx context.Context, name, digest string, runningContext int) *public.Capabilities {
+	e.capsMu.Lock()
+	cached, ok := e.caps[digest]
+	e.capsMu.Unlock()
+	if !ok {
+		resp, err := e.client.Show(ctx, &api.ShowRequest{Model: name})
+		if err != nil {
+			log.Printf("show ollama model %s error: %v", name, err)
+			return nil
+		}
+		cached = capabilitiesFromShow(resp)
+		e.capsMu.Lock()
+		if e.caps == nil {
+			e.caps = make(map[string]*public.Capabilities)
+		}
+		e.caps[digest] = cached
+		e.capsMu.Unlock()
+	}
+	caps := *cached
+	if runningContext > 0 {
+		caps.MaxContext = runningContext
+	}
+	return &caps
+}
+
+// capabilitiesFromShow 把 /api/show 的 capabilities 与 model_info 中的 <arch>.context_length
+// 转换为声明的能力。Ollama 的 format 参数对所有生成模型都可用，因此 json_schema 随 completion。
+func capabilitiesFromShow(resp *api.ShowResponse) *public.Capabilities {
+	caps := &public.Capabilities{}
+	for _, c := range resp.Capabilities {
+		switch c {
+		case ollamatypes.CapabilityTools:
+			caps.Tools = true
+		case ollamatypes.CapabilityVision:
+			caps.Vision = true
+		case ollamatypes.CapabilityThinking:
+			caps.Reasoning = true
+		case ollamatypes.CapabilityCompletion:
+			caps.JSONSchema = true
+		}
+	}
+	for key, v := range resp.ModelInfo {
+		if strings.HasSuffix(key, ".context_length") {
+			if n, ok := v.(float64); ok {
+				caps.MaxContext = int(n)
+			}
+		}
+	}
+	return caps
+}
+
+// LoadedModels 返回最近一次 /api/ps 中已加载到内存的模型及其显存占用
+func (e *Engine) LoadedModels() map[string]int64 {
+	e.modelsMu.RLock()
+	defer e.modelsMu.RUnlock()
+	loaded := make(map[string]int64, len(e.loaded))
+	for name, vram := range e.loaded {
+		loaded[name] = vram
+	}
+	return loaded
+}
+
 func shouldRegisterOllamaModel(modelName string, isRunning bool) bool {
 	return isRunning || isOllamaEmbeddingModel(modelName)
 }
@@ -343,7 +417,7 @@ func convertOpenAIToolToOllama(openaiTool openai.Tool) (api.Tool, error) {
 }
 
 func (e *Engine) HandleChat(ctx context.Context, fingerprint string,
-	request *public.ExtendedChatRequest, responseConn *websocket.Conn) error {
+	request *public.ExtendedChatRequest, responseConn inference.ResponseWriter) error {
 	// think 开关
 	think := &api.ThinkValue{}
 	if strings.Index(request.Model, "qwen") >= 0 || strings.Index(request.Model, "DeepSeek v3.1") >= 0 || strings.Index(request.Model, "DeepSeek v3.2-exp") >= 0 {
@@ -688,7 +762,7 @@ func convertToOpenAIResponse(resp *api.ChatResponse, fingerprint string) openai.
 }
 
 func (e *Engine) HandleEmbedding(ctx context.Context, fingerprint string,
-	request *openai.EmbeddingRequest, responseConn *websocket.Conn) error {
+	request *openai.EmbeddingRequest, responseConn inference.ResponseWriter) error {
 	log.Printf("handle embedding request [%s]: model=%s, input=%v", fingerprint, request.Model, request.Input)
 
 	// 使用Ollama的embedding API
@@ -1,6 +1,11 @@
 package ollama
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+)
 
 func TestShouldRegisterOllamaModel(t *testing.T) {
 	tests := []struct {
@@ -23,3 +28,17 @@ func TestShouldRegisterOllamaModel(t *testing.T) {
 		})
 	}
 }
+
+func TestCapabilitiesFromShow(t *testing.T) {
+	var resp api.ShowResponse
+	if err := json.Unmarshal([]byte(`{
+		"capabilities": ["completion", "tools", "thinking"],
+		"model_info": {"general.architecture": "qwen3", "qwen3.context_length": 40960}
+	}`), &resp); err != nil {
+		t.Fatalf("decode show response: %v", err)
+	}
+	caps := capabilitiesFromShow(&resp)
+	if !caps.Tools || !caps.Reasoning || !caps.JSONSchema || caps.Vision || caps.MaxContext != 40960 {
+		t.Fatalf("capabilities = %+v", caps)
+	}
+}
@@ -0,0 +1,114 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"star-fire/pkg/public"
+)
+
+// capabilitiesTTL 代理模型元数据的缓存时间，避免每次心跳都请求 /models
+const capabilitiesTTL = 10 * time.Minute
+
+// modelMetadata /models 列表中 go-openai 未解析的元数据。不同代理字段不同：
+// OpenRouter 提供 context_length、supported_parameters 与 architecture.input_modalities，
+// vLLM 提供 max_model_len，自定义代理可以直接返回 capabilities。
+type modelMetadata struct {
+	ID                  string               `json:"id"`
+	Capabilities        *public.Capabilities `json:"capabilities"`
+	ContextLength       int                  `json:"context_length"`
+	MaxModelLen         int                  `json:"max_model_len"`
+	SupportedParameters []string             `json:"supported_parameters"`
+	Architecture        struct {
+		InputModalities []string `json:"input_modalities"`
+	} `json:"architecture"`
+}
+
+// capabilities 转换为声明的能力。只知道上下文长度时其它能力按支持处理，什么都不知道时返回 nil（未声明）。
+func (m *modelMetadata) capabilities() *public.Capabilities {
+	maxContext := max(m.ContextLength, m.MaxModelLen)
+	if m.Capabilities != nil {
+		caps := *m.Capabilities
+		if caps.MaxContext == 0 {
+			caps.MaxContext = maxContext
+		}
+		return &caps
+	}
+	if m.SupportedParameters != nil {
+		has := func(names ...string) bool {
+			for _, name := range names {
+				if slices.Contains(m.SupportedParameters, name) {
+					return true
+				}
+			}
+			return false
+		}
+		return &public.Capabilities{
+			Tools:      has("tools"),
+			Vision:     slices.Contains(m.Architecture.InputModalities, "image"),
+			JSONSchema: has("response_format", "structured_outputs"),
+			Reasoning:  has("reasoning", "include_reasoning"),
+			MaxContext: maxContext,
+		}
+	}
+	if maxContext > 0 {
+		return &public.Capabilities{Tools: true, Vision: true, JSONSchema: true, Reasoning: true, MaxContext: maxContext}
+	}
+	return nil
+}
+
+// modelCapabilities 返回代理 /models 元数据中声明的各模型能力，按 capabilitiesTTL 缓存。
+// 请求失败时沿用上次的结果。
+func (e *Engine) modelCapabilities(ctx context.Context) map[string]*public.Capabilities {
+	e.capsMu.Lock()
+	defer e.capsMu.Unlock()
+	if e.caps != nil && time.Since(e.capsAt) < capabilitiesTTL {
+		return e.caps
+	}
+	caps, err := e.fetchCapabilities(ctx)
+	if err != nil {
+		return e.caps
+	}
+	e.caps, e.capsAt = caps, time.Now()
+	return caps
+}
+
+func (e *Engine) fetchCapabilities(ctx context.Context) (map[string]*public.Capabilities, error) {
+	baseURL := e.baseURL
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+e.apiKey)
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("list models status %d", resp.StatusCode)
+	}
+	var body struct {
+		Data []modelMetadata `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	caps := make(map[string]*public.Capabilities, len(body.Data))
+	for i := range body.Data {
+		if c := body.Data[i].capabilities(); c != nil {
+			caps[body.Data[i].ID] = c
+		}
+	}
+	return caps, nil
+}
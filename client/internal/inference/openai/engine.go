@@ -9,13 +9,14 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 
 	"log"
 	"star-fire/client/internal/config"
+	"star-fire/client/internal/inference"
 	"star-fire/pkg/public"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/sashabaranov/go-openai"
 )
 
@@ -24,6 +25,10 @@ type Engine struct {
 	baseURL   string
 	apiKey    string
 	modelList []openai.Model
+
+	capsMu sync.Mutex
+	caps   map[string]*public.Capabilities // 代理元数据声明的模型能力
+	capsAt time.Time
 }
 
 func NewEngine(ctx context.Context, apiKey, baseURL string, conf *config.Config) (*Engine, error) {
@@ -68,15 +73,17 @@ func (e *Engine) ListModels(ctx context.Context, conf *config.Config) ([]*public
 	}
 	e.modelList = models.Models
 
+	caps := e.modelCapabilities(ctx)
 	publicModels := make([]*public.Model, 0)
 	for _, model := range e.modelList {
 		publicModel := &public.Model{
-			Name:        model.ID,
-			Type:        model.Root,
-			Size:        "unknown",
-			Arch:        model.Object,
-			Engine:      "openai",
-			OpenAIModel: model,
+			Name:         model.ID,
+			Type:         model.Root,
+			Size:         "unknown",
+			Arch:         model.Object,
+			Engine:       "openai",
+			OpenAIModel:  model,
+			Capabilities: caps[model.ID],
 		}
 		publicModels = append(publicModels, publicModel)
 	}
@@ -94,7 +101,7 @@ func (e *Engine) SupportsModel(modelName string, conf *config.Config) bool {
 
 func (e *Engine) HandleChat(ctx context.Context, fingerprint string,
 	request *public.ExtendedChatRequest,
-	responseConn *websocket.Conn) error {
+	responseConn inference.ResponseWriter) error {
 	log.Printf("handle chat request [%s]: modle=%s, strem=%v, API BASE URL=%s",
 		fingerprint, request.Model, request.Stream, e.baseURL)
 
@@ -306,7 +313,7 @@ func (e *Engine) HandleChat(ctx context.Context, fingerprint string,
 // （如 thinking / enable_thinking）能透传给后端；响应侧按 map 原样转发，
 // 因此后端返回的 reasoning 等非标准字段也不会被丢弃。
 func (e *Engine) handleChatRaw(ctx context.Context, fingerprint string,
-	request *public.ExtendedChatRequest, responseConn *websocket.Conn) error {
+	request *public.ExtendedChatRequest, responseConn inference.ResponseWriter) error {
 
 	// 流式确保带上 usage，便于服务端计费与正常结束
 	if request.Stream {
@@ -440,7 +447,7 @@ func (e *Engine) handleChatRaw(ctx context.Context, fingerprint string,
 
 // handleStreamWithRawSSE 直接处理 SSE 流以保留完整的 JSON 数据（包括 Kimi 的 usage）
 func (e *Engine) handleStreamWithRawSSE(ctx context.Context, fingerprint string,
-	request *public.ExtendedChatRequest, responseConn *websocket.Conn) error {
+	request *public.ExtendedChatRequest, responseConn inference.ResponseWriter) error {
 
 	// 构造请求（叠加 go-openai 未覆盖的扩展字段，如 thinking）
 	reqBody, err := request.BuildRequestBody()
@@ -581,7 +588,7 @@ func (e *Engine) handleStreamWithRawSSE(ctx context.Context, fingerprint string,
 }
 
 func (e *Engine) HandleEmbedding(ctx context.Context, fingerprint string,
-	request *openai.EmbeddingRequest, responseConn *websocket.Conn) error {
+	request *openai.EmbeddingRequest, responseConn inference.ResponseWriter) error {
 	log.Printf("handle embedding request [%s]: model=%s, input=%v, API BASE URL=%s",
 		fingerprint, request.Model, request.Input, e.baseURL)
 
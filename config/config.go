@@ -17,6 +17,8 @@ type Configuration struct {
 	MaxAPIKeysPerUser int
 	DefaultKeyExpiry  int
 	LBA               string
+	LBDebug           bool // 输出 weighted 负载均衡每次请求的评分明细
+	LBLatencyBudget   int  // cheapest-within-latency-budget 默认的延迟预算（毫秒）
 	EmailHost         string
 	EmailPort         int
 	EmailUser         string
@@ -28,8 +30,9 @@ type Configuration struct {
 	SupportedEmbeddingModels     []string
 
 	// 设置所有模型价格上限，提示用户设置超过这个值，将会被重置为这个值
-	AllModelOutPutMaxPrice float64
-	AllModelInputMaxPrice  float64
+	AllModelOutPutMaxPrice      float64
+	AllModelInputMaxPrice       float64
+	AllModelCachedInputMaxPrice float64
 }
 
 var Config = loadConfig()
@@ -45,6 +48,8 @@ func loadConfig() Configuration {
 	maxAPIKeysPerUser, _ := strconv.Atoi(getEnv("MAX_API_KEYS_PER_USER", "3"))
 	defaultKeyExpiry, _ := strconv.Atoi(getEnv("DEFAULT_KEY_EXPIRY", "30"))
 	lba := getEnv("LBA", "round-robin")
+	lbDebug, _ := strconv.ParseBool(getEnv("LB_DEBUG", "false"))
+	lbLatencyBudget, _ := strconv.Atoi(getEnv("LB_LATENCY_BUDGET_MS", "1000"))
 	emailHost := getEnv("EMAIL_HOST", "")
 	emailPort, _ := strconv.Atoi(getEnv("EMAIL_PORT", "587"))
 	emailUser := getEnv("EMAIL_USER", "")
@@ -61,6 +66,7 @@ func loadConfig() Configuration {
 	// 设置共享到平台的所有模型的输入输出token价格的上限
 	allModelInputMaxPrice, _ := strconv.ParseFloat(getEnv("INPUT_TOKEN_PRICE_PER_MAX", "10.0"), 64)
 	allModelOutputMaxPrice, _ := strconv.ParseFloat(getEnv("OUTPUT_TOKEN_PRICE_PER_MAX", "20.0"), 64)
+	allModelCachedInputMaxPrice, _ := strconv.ParseFloat(getEnv("CACHED_INPUT_TOKEN_PRICE_PER_MAX", "10.0"), 64)
 
 	// 解析支持的embedding模型列表
 	embeddingModelsStr := getEnv("SUPPORTED_EMBEDDING_MODELS", "text-embedding-ada-002,text-embedding-3-small,text-embedding-3-large")
@@ -86,6 +92,8 @@ func loadConfig() Configuration {
 		MaxAPIKeysPerUser:            maxAPIKeysPerUser,
 		DefaultKeyExpiry:             defaultKeyExpiry,
 		LBA:                          lba,
+		LBDebug:                      lbDebug,
+		LBLatencyBudget:              lbLatencyBudget,
 		EmailHost:                    emailHost,
 		EmailPort:                    emailPort,
 		EmailUser:                    emailUser,
@@ -95,8 +103,9 @@ func loadConfig() Configuration {
 		EmbeddingInputTokenPricePerM: embeddingInputPrice,
 		SupportedEmbeddingModels:     supportedEmbeddingModels,
 
-		AllModelInputMaxPrice:  allModelInputMaxPrice,
-		AllModelOutPutMaxPrice: allModelOutputMaxPrice,
+		AllModelInputMaxPrice:       allModelInputMaxPrice,
+		AllModelOutPutMaxPrice:      allModelOutputMaxPrice,
+		AllModelCachedInputMaxPrice: allModelCachedInputMaxPrice,
 	}
 }
 
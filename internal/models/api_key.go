@@ -18,6 +18,14 @@ type APIKey struct {
 	CreatedAt time.Time `gorm:"not null"`
 	ExpiresAt time.Time `gorm:"not null"`
 	Revoked   bool      `gorm:"default:false;not null"`
+
+	// 使用该 Key 的请求默认的最高出价（每百万 tokens），0 表示不参与拍卖撮合
+	MaxBidIPPM float64 `gorm:"column:max_bid_ippm;not null;default:0"`
+	MaxBidOPPM float64 `gorm:"column:max_bid_oppm;not null;default:0"`
+
+	// 使用该 Key 的请求默认的负载均衡算法与延迟预算（毫秒），空/0 表示使用平台默认
+	LBStrategy      string `gorm:"column:lb_strategy;not null;default:''"`
+	LatencyBudgetMs int    `gorm:"not null;default:0"`
 }
 
 type APIKeyDB struct {
@@ -114,6 +122,34 @@ func (kdb *APIKeyDB) RevokeAPIKey(userID string, keyID string) error {
 	return nil
 }
 
+// SetMaxBid 设置 Key 的默认最高出价，两项都为 0 时取消拍卖撮合
+func (kdb *APIKeyDB) SetMaxBid(userID, keyID string, ippm, oppm float64) error {
+	result := kdb.db.Model(&APIKey{}).
+		Where("id = ? AND user_id = ?", keyID, userID).
+		Updates(map[string]interface{}{"max_bid_ippm": ippm, "max_bid_oppm": oppm})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("API key not found or not authorized")
+	}
+	return nil
+}
+
+// SetRouting 设置 Key 默认的负载均衡算法与延迟预算
+func (kdb *APIKeyDB) SetRouting(userID, keyID, strategy string, latencyBudgetMs int) error {
+	result := kdb.db.Model(&APIKey{}).
+		Where("id = ? AND user_id = ?", keyID, userID).
+		Updates(map[string]interface{}{"lb_strategy": strategy, "latency_budget_ms": latencyBudgetMs})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("API key not found or not authorized")
+	}
+	return nil
+}
+
 func (kdb *APIKeyDB) CountUserAPIKeys(userID string) (int, error) {
 	var count int64
 	result := kdb.db.Model(&APIKey{}).
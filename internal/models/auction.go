@@ -0,0 +1,220 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 拍卖撮合的成交规则
+const (
+	// AuctionPayAsBid 按用户出价成交
+	AuctionPayAsBid = "pay-as-bid"
+	// AuctionSecondPrice 按次优报价成交：不低于中标方报价，不高于用户出价
+	AuctionSecondPrice = "second-price"
+)
+
+// DefaultExpectedOutputTokens 请求未设置 max_tokens 时，撮合和按价格选择 client 使用的预估输出长度
+const DefaultExpectedOutputTokens = 1024
+
+// Bid 用户对每百万 tokens 的最高出价
+type Bid struct {
+	IPPM float64 `json:"max_bid_ippm"`
+	OPPM float64 `json:"max_bid_oppm"`
+}
+
+// ParseBid 解析 "ippm,oppm" 格式的出价，两项都必须为正数
+func ParseBid(s string) (Bid, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return Bid{}, errors.New("bid must be in the form <ippm>,<oppm>")
+	}
+	ippm, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return Bid{}, errors.New("invalid bid ippm")
+	}
+	oppm, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return Bid{}, errors.New("invalid bid oppm")
+	}
+	bid := Bid{IPPM: ippm, OPPM: oppm}
+	if !bid.Valid() {
+		return Bid{}, errors.New("bid prices must be positive")
+	}
+	return bid, nil
+}
+
+// Valid 出价的输入、输出价格都为正数时有效
+func (b Bid) Valid() bool {
+	return b.IPPM > 0 && b.OPPM > 0
+}
+
+// ValidAuctionRule 判断是否为支持的成交规则
+func ValidAuctionRule(rule string) bool {
+	return rule == AuctionPayAsBid || rule == AuctionSecondPrice
+}
+
+// AuctionRule 返回当前配置的成交规则，未配置时默认 second-price
+func (s *Server) AuctionRule() string {
+	if s.SystemConfigDB == nil {
+		return AuctionSecondPrice
+	}
+	rule := s.SystemConfigDB.GetString(ConfigKeyAuctionRule, AuctionSecondPrice)
+	if !ValidAuctionRule(rule) {
+		return AuctionSecondPrice
+	}
+	return rule
+}
+
+// AuctionResult 一次撮合的结果：中标 client、双方价格与成交价
+type AuctionResult struct {
+	Client    *Client
+	Rule      string
+	Bid       Bid
+	AskIPPM   float64 // 中标 client 在该提示长度下的报价
+	AskOPPM   float64
+	ClearIPPM float64 // 成交价
+	ClearOPPM float64
+	Surplus   float64 // 按预估 tokens 计算的剩余（出价与报价之差）
+}
+
+type auctionOffer struct {
+	client     *Client
+	ippm, oppm float64
+	surplus    float64
+}
+
+// MatchAuction 在通过健康与价格上限过滤的 client 中，选出报价不高于出价且剩余最大的 client，
+// 并按 rule 计算成交价。剩余相同的 client 之间按负载均衡算法选择。没有可成交的报价时返回 nil。
+// 只有具备 opts.Requires 所需能力、报价在 opts 价格上限以内的 client 参与撮合。
+func (s *Server) MatchAuction(model, userID string, promptTokens, outputTokens int, bid Bid, rule string, excludeIDs map[string]bool, opts RouteOptions) *AuctionResult {
+	eligible, dead := s.eligibleClients(model, userID, promptTokens, excludeIDs, opts)
+	for _, id := range dead {
+		s.RemoveClient(model, id)
+	}
+	if outputTokens <= 0 {
+		outputTokens = DefaultExpectedOutputTokens
+	}
+
+	offers := make([]auctionOffer, 0, len(eligible))
+	for _, c := range eligible {
+		m, ok := c.ModelInfo(model)
+		if !ok {
+			continue
+		}
+		ippm, oppm, _ := m.PriceFor(promptTokens)
+		if ippm <= bid.IPPM && oppm <= bid.OPPM {
+			offers = append(offers, auctionOffer{
+				client:  c,
+				ippm:    ippm,
+				oppm:    oppm,
+				surplus: ((bid.IPPM-ippm)*float64(promptTokens) + (bid.OPPM-oppm)*float64(outputTokens)) / 1000000,
+			})
+		}
+	}
+	if len(offers) == 0 {
+		log.Println("no ask within bid for model:", model)
+		return nil
+	}
+	sort.SliceStable(offers, func(i, j int) bool { return offers[i].surplus > offers[j].surplus })
+
+	// 剩余最大的 client 可能不止一个，交给负载均衡算法在它们之间选择
+	tied := []*Client{offers[0].client}
+	for _, o := range offers[1:] {
+		if o.surplus < offers[0].surplus {
+			break
+		}
+		tied = append(tied, o.client)
+	}
+	winner := 0
+	if len(tied) > 1 {
+		picked, _ := s.pickScored(model, userID, promptTokens, s.LoadBalanceAlgorithm, tied, RouteOptions{OutputTokens: outputTokens})
+		if picked != nil {
+			for i, o := range offers {
+				if o.client == picked {
+					winner = i
+					break
+				}
+			}
+		}
+	}
+
+	var runnerUp *auctionOffer
+	for i := range offers {
+		if i != winner {
+			runnerUp = &offers[i]
+			break
+		}
+	}
+	w := offers[winner]
+	clearIPPM, clearOPPM := clearingPrice(rule, bid, w, runnerUp)
+	return &AuctionResult{
+		Client:    w.client,
+		Rule:      rule,
+		Bid:       bid,
+		AskIPPM:   w.ippm,
+		AskOPPM:   w.oppm,
+		ClearIPPM: clearIPPM,
+		ClearOPPM: clearOPPM,
+		Surplus:   w.surplus,
+	}
+}
+
+// clearingPrice 计算成交价。second-price 下每个维度取次优报价，但不低于中标报价、不高于出价；
+// 没有其它报价时按出价成交。
+func clearingPrice(rule string, bid Bid, winner auctionOffer, runnerUp *auctionOffer) (float64, float64) {
+	if rule != AuctionSecondPrice || runnerUp == nil {
+		return bid.IPPM, bid.OPPM
+	}
+	return max(winner.ippm, min(bid.IPPM, runnerUp.ippm)), max(winner.oppm, min(bid.OPPM, runnerUp.oppm))
+}
+
+// Cleared 返回按成交价计价的快照：成交价已按提示长度确定，不再应用阶梯价格，
+// 缓存命中价格不高于成交输入价，未单独设置的推理价格随成交输出价
+func (p PriceSnapshot) Cleared(ippm, oppm float64) PriceSnapshot {
+	p.tiers = nil
+	p.IPPM, p.OPPM = ippm, oppm
+	p.CIPPM = min(p.CIPPM, ippm)
+	if p.rppmFromOPPM {
+		p.RPPM = oppm
+	}
+	return p
+}
+
+// ClearingStat 某个模型在一段时间内拍卖成交价的统计
+type ClearingStat struct {
+	Model        string  `json:"model"`
+	Rule         string  `json:"rule"`
+	Requests     int64   `json:"requests"`
+	AvgBidIPPM   float64 `gorm:"column:avg_bid_ippm" json:"avg_bid_ippm"`
+	AvgAskIPPM   float64 `gorm:"column:avg_ask_ippm" json:"avg_ask_ippm"`
+	AvgClearIPPM float64 `gorm:"column:avg_clear_ippm" json:"avg_clear_ippm"`
+	MinClearIPPM float64 `gorm:"column:min_clear_ippm" json:"min_clear_ippm"`
+	MaxClearIPPM float64 `gorm:"column:max_clear_ippm" json:"max_clear_ippm"`
+	AvgBidOPPM   float64 `json:"avg_bid_oppm"`
+	AvgAskOPPM   float64 `json:"avg_ask_oppm"`
+	AvgClearOPPM float64 `json:"avg_clear_oppm"`
+	MinClearOPPM float64 `json:"min_clear_oppm"`
+	MaxClearOPPM float64 `json:"max_clear_oppm"`
+}
+
+// GetClearingStats 统计 [start, end) 内按拍卖撮合的请求的出价、报价与成交价（成交价即折扣前价格），
+// model 为空时统计所有模型
+func (t *TokenUsageDB) GetClearingStats(model string, start, end time.Time) ([]*ClearingStat, error) {
+	query := t.db.Model(&TokenUsage{}).
+		Select(`model, auction_rule AS rule, COUNT(*) AS requests,
+			AVG(bid_ippm) AS avg_bid_ippm, AVG(ask_ippm) AS avg_ask_ippm,
+			AVG(list_ippm) AS avg_clear_ippm, MIN(list_ippm) AS min_clear_ippm, MAX(list_ippm) AS max_clear_ippm,
+			AVG(bid_oppm) AS avg_bid_oppm, AVG(ask_oppm) AS avg_ask_oppm,
+			AVG(list_oppm) AS avg_clear_oppm, MIN(list_oppm) AS min_clear_oppm, MAX(list_oppm) AS max_clear_oppm`).
+		Where("auction_rule <> '' AND timestamp >= ? AND timestamp < ?", start, end)
+	if model != "" {
+		query = query.Where("model = ?", model)
+	}
+	var stats []*ClearingStat
+	err := query.Group("model, auction_rule").Order("model, auction_rule").Scan(&stats).Error
+	return stats, err
+}
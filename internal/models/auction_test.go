@@ -0,0 +1,121 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"star-fire/pkg/public"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+func TestMatchAuctionMaximizesSurplusAndClears(t *testing.T) {
+	server := &Server{LoadBalanceAlgorithm: "round-robin", clientRoundRobinIndex: map[string]int{}}
+	clients := map[string]*Client{}
+	for id, price := range map[string][2]float64{"cheap-in": {1, 8}, "cheap-out": {3, 4}, "pricey": {9, 9}} {
+		clients[id] = &Client{
+			ID: id, Status: "online", ControlConn: &websocket.Conn{},
+			Models: []*public.Model{{Name: "model-a", IPPM: price[0], OPPM: price[1]}},
+		}
+	}
+	server.clients.replace(map[string]map[string]*Client{"model-a": clients})
+	bid := Bid{IPPM: 5, OPPM: 8}
+
+	// 长提示下输入价格占主导：cheap-in 剩余 (4*100000+0*1000)，cheap-out 剩余 (2*100000+4*1000)
+	match := server.MatchAuction("model-a", "", 100000, 1000, bid, AuctionSecondPrice, nil, RouteOptions{})
+	if match == nil || match.Client.ID != "cheap-in" {
+		t.Fatalf("match = %+v, want cheap-in", match)
+	}
+	// 次优报价 cheap-out (3, 4)：输入按 3 成交，输出不低于中标报价 8
+	if match.ClearIPPM != 3 || match.ClearOPPM != 8 {
+		t.Fatalf("second-price clearing = (%v, %v), want (3, 8)", match.ClearIPPM, match.ClearOPPM)
+	}
+
+	// 长输出下输出价格占主导
+	match = server.MatchAuction("model-a", "", 1000, 100000, bid, AuctionPayAsBid, nil, RouteOptions{})
+	if match == nil || match.Client.ID != "cheap-out" {
+		t.Fatalf("match = %+v, want cheap-out", match)
+	}
+	if match.ClearIPPM != 5 || match.ClearOPPM != 8 {
+		t.Fatalf("pay-as-bid clearing = (%v, %v), want the bid", match.ClearIPPM, match.ClearOPPM)
+	}
+
+	// 没有其它报价时 second-price 按出价成交
+	match = server.MatchAuction("model-a", "", 1000, 100000, bid, AuctionSecondPrice, map[string]bool{"cheap-in": true}, RouteOptions{})
+	if match == nil || match.ClearIPPM != 5 || match.ClearOPPM != 8 {
+		t.Fatalf("lone offer clearing = %+v, want the bid", match)
+	}
+
+	if match := server.MatchAuction("model-a", "", 1000, 1000, Bid{IPPM: 0.5, OPPM: 0.5}, AuctionSecondPrice, nil, RouteOptions{}); match != nil {
+		t.Fatalf("match = %+v, want nil when every ask exceeds the bid", match)
+	}
+}
+
+func TestClearingStatsAggregateAuctionRequests(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	usageDB := NewTokenUsageDB(db)
+	now := time.Now()
+	for _, u := range []*TokenUsage{
+		{RequestID: "r1", UserID: "u", Model: "model-a", AuctionRule: AuctionSecondPrice, BidIPPM: 5, AskIPPM: 1, ListIPPM: 3, ListOPPM: 8, Timestamp: now},
+		{RequestID: "r2", UserID: "u", Model: "model-a", AuctionRule: AuctionSecondPrice, BidIPPM: 5, AskIPPM: 2, ListIPPM: 4, ListOPPM: 6, Timestamp: now},
+		{RequestID: "r3", UserID: "u", Model: "model-a", ListIPPM: 9, Timestamp: now},
+	} {
+		if err := usageDB.SaveTokenUsage(u); err != nil {
+			t.Fatalf("save usage: %v", err)
+		}
+	}
+
+	stats, err := usageDB.GetClearingStats("model-a", now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("clearing stats: %v", err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("stats = %d rows, want 1", len(stats))
+	}
+	if s := stats[0]; s.Requests != 2 || s.AvgClearIPPM != 3.5 || s.MinClearIPPM != 3 || s.MaxClearOPPM != 8 || s.AvgAskIPPM != 1.5 {
+		t.Fatalf("stats = %+v", s)
+	}
+}
+
+func TestClearedSnapshotCapsCachedPrice(t *testing.T) {
+	client := &Client{Models: []*public.Model{{Name: "model-a", IPPM: 2, OPPM: 4, CIPPM: 1.5,
+		PriceTiers: []public.PriceTier{{MinPromptTokens: 1000, IPPM: 10}}}}}
+	price, _ := client.PriceSnapshot("model-a")
+	cleared := price.Cleared(1, 3).ForPrompt(5000)
+	if cleared.IPPM != 1 || cleared.OPPM != 3 || cleared.CIPPM != 1 || cleared.RPPM != 3 {
+		t.Fatalf("cleared snapshot = %+v", cleared)
+	}
+}
+
+func TestMatchAuctionBreaksTiesByCallerEffectiveCost(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	NewUserDB(db)
+	server := &Server{LoadBalanceAlgorithm: LBCheapest, DiscountDB: NewDiscountDB(db)}
+	clients := map[string]*Client{}
+	for _, id := range []string{"a", "b"} {
+		clients[id] = &Client{
+			ID: id, UserID: "provider-" + id, Status: "online", ControlConn: &websocket.Conn{},
+			Models: []*public.Model{{Name: "model-a", IPPM: 2, OPPM: 2}},
+		}
+	}
+	server.clients.replace(map[string]map[string]*Client{"model-a": clients})
+	if _, err := server.DiscountDB.SaveDiscount(&ModelPrice{Scope: DiscountScopeProvider, ProviderID: "provider-b", UserID: "user-1", UserDiscountRate: 0.5}); err != nil {
+		t.Fatalf("save discount: %v", err)
+	}
+
+	// 两个报价的剩余相同，cheapest 按调用方折扣后的费用选择
+	for i := 0; i < 5; i++ {
+		match := server.MatchAuction("model-a", "user-1", 1000, 1000, Bid{IPPM: 5, OPPM: 5}, AuctionPayAsBid, nil, RouteOptions{})
+		if match == nil || match.Client.ID != "b" {
+			t.Fatalf("match = %+v, want the discounted client b", match)
+		}
+	}
+}
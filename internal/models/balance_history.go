@@ -0,0 +1,179 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrInsufficientBalance 余额不足
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// 余额流水类型
+const (
+	BalanceTypeRecharge      = "recharge"       // 充值到账
+	BalanceTypeRegisterBonus = "register_bonus" // 注册赠送
+	BalanceTypePromo         = "promo"          // 兑换码赠送
+	BalanceTypeCoupon        = "coupon"         // 优惠券抵扣（消费时由平台补贴的部分）
+	BalanceTypeReferral      = "referral"       // 邀请奖励
+	BalanceTypeSubscription  = "subscription"   // 套餐月费（负数）
+	BalanceTypeRefund        = "refund"         // 失败请求退款
+)
+
+// BalanceRecord 余额变动流水。每一笔非消费类的余额变动（充值、赠送、奖励、抵扣）都记录一条，
+// 便于用户核对和后续对账。
+type BalanceRecord struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	UserID       string    `gorm:"index:idx_balance_records_user_created;not null" json:"user_id"`
+	Type         string    `gorm:"index;not null" json:"type"`
+	Amount       float64   `gorm:"not null" json:"amount"`        // 变动金额（元），正数为增加
+	BalanceAfter float64   `gorm:"not null" json:"balance_after"` // 变动后余额（元）
+	RefID        string    `gorm:"index" json:"ref_id"`           // 关联单号：充值订单号 / 兑换码 / 请求ID 等
+	Note         string    `json:"note"`
+	CreatedAt    time.Time `gorm:"index:idx_balance_records_user_created;autoCreateTime" json:"created_at"`
+}
+
+// BalanceHistoryDB 提供余额流水的读写方法
+type BalanceHistoryDB struct {
+	db *gorm.DB
+}
+
+// NewBalanceHistoryDB 初始化 BalanceHistoryDB
+func NewBalanceHistoryDB(db *gorm.DB) *BalanceHistoryDB {
+	db.AutoMigrate(&BalanceRecord{})
+	return &BalanceHistoryDB{db: db}
+}
+
+// grantBalanceTx 在事务 tx 中给用户加余额并写入一条流水，供各业务模块复用。
+func grantBalanceTx(tx *gorm.DB, userID string, amount float64, kind, refID, note string) (*BalanceRecord, error) {
+	if amount != 0 {
+		if err := tx.Model(&User{}).Where("id = ?", userID).
+			Update("balance", gorm.Expr("balance + ?", amount)).Error; err != nil {
+			return nil, err
+		}
+	}
+	return insertBalanceRecordTx(tx, userID, amount, kind, refID, note)
+}
+
+// insertBalanceRecordTx 读取变动后的余额并写入流水，余额本身须已由调用方更新
+func insertBalanceRecordTx(tx *gorm.DB, userID string, amount float64, kind, refID, note string) (*BalanceRecord, error) {
+	var user User
+	if err := tx.Select("balance").Where("id = ?", userID).First(&user).Error; err != nil {
+		return nil, err
+	}
+	record := &BalanceRecord{
+		UserID:       userID,
+		Type:         kind,
+		Amount:       amount,
+		BalanceAfter: user.Balance,
+		RefID:        refID,
+		Note:         note,
+	}
+	if err := tx.Create(record).Error; err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// chargeBalanceTx 在事务 tx 中扣减用户余额（计入累计消费）并写入一条负数流水。
+// 余额不足时返回 ErrInsufficientBalance，不允许扣成负数。
+func chargeBalanceTx(tx *gorm.DB, userID string, amount float64, kind, refID, note string) (*BalanceRecord, error) {
+	result := tx.Model(&User{}).Where("id = ? AND balance >= ?", userID, amount).
+		Updates(map[string]interface{}{
+			"balance":     gorm.Expr("balance - ?", amount),
+			"total_spent": gorm.Expr("total_spent + ?", amount),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInsufficientBalance
+	}
+	return insertBalanceRecordTx(tx, userID, -amount, kind, refID, note)
+}
+
+// CashSpent 用户由充值资金支付的累计消费：累计消费先扣除非现金来源的余额（赠送、兑换码、
+// 优惠券补贴、邀请奖励、退款），且不超过累计充值金额
+func (h *BalanceHistoryDB) CashSpent(userID string, totalSpent float64) (float64, error) {
+	var sums []struct {
+		Type  string
+		Total float64
+	}
+	if err := h.db.Model(&BalanceRecord{}).Select("type, SUM(amount) AS total").
+		Where("user_id = ? AND amount > 0", userID).Group("type").Scan(&sums).Error; err != nil {
+		return 0, err
+	}
+	var recharged, free float64
+	for _, s := range sums {
+		switch s.Type {
+		case BalanceTypeRecharge:
+			recharged += s.Total
+		case BalanceTypeRegisterBonus, BalanceTypePromo, BalanceTypeCoupon, BalanceTypeReferral, BalanceTypeRefund:
+			free += s.Total
+		}
+	}
+	return max(0, min(recharged, totalSpent-free)), nil
+}
+
+// Grant 给用户加余额并记录流水（同一事务内完成）
+func (h *BalanceHistoryDB) Grant(userID string, amount float64, kind, refID, note string) (*BalanceRecord, error) {
+	var record *BalanceRecord
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		record, err = grantBalanceTx(tx, userID, amount, kind, refID, note)
+		return err
+	})
+	return record, err
+}
+
+// Record 仅记录一条流水，不改动余额（用于余额已由其他路径扣减/增加的场景）
+func (h *BalanceHistoryDB) Record(record *BalanceRecord) error {
+	return h.db.Create(record).Error
+}
+
+// GetUserHistory 分页获取用户余额流水，kind 为空表示不过滤类型
+func (h *BalanceHistoryDB) GetUserHistory(userID, kind string, page, size int) ([]*BalanceRecord, int64, error) {
+	var records []*BalanceRecord
+	var total int64
+
+	query := h.db.Model(&BalanceRecord{}).Where("user_id = ?", userID)
+	if kind != "" {
+		query = query.Where("type = ?", kind)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	offset := (page - 1) * size
+	result := query.Order("created_at DESC").Offset(offset).Limit(size).Find(&records)
+	return records, total, result.Error
+}
+
+// ChargeUsage 为一次请求扣费：先消耗套餐额度（额度覆盖的 tokens 不计费，剩余部分按超额倍率计费），
+// 再用优惠券抵扣，最后从余额扣除应付金额。三步在同一事务中完成，扣费失败时额度和优惠券都不会被消耗。
+// tokens 为 0 时不使用套餐额度。返回额度覆盖的 tokens 和应付金额（优惠券抵扣前）。
+func (s *Server) ChargeUsage(userID, model, requestID string, tokens int, cost float64) (int, float64, error) {
+	covered := 0
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if tokens > 0 {
+			var rate float64
+			var err error
+			if covered, rate, err = consumeAllowanceTx(tx, userID, model, tokens); err != nil {
+				return err
+			}
+			cost = cost * float64(tokens-covered) / float64(tokens) * rate
+		}
+		if cost <= 0 {
+			return nil
+		}
+		if _, err := s.PromoCodeDB.applyCouponsTx(tx, userID, model, requestID, cost); err != nil {
+			return err
+		}
+		return deductBalanceTx(tx, userID, cost)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return covered, cost, nil
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"log"
+	"star-fire/pkg/public"
+)
+
+// capable returns a Predicate that passes only clients whose model declares every capability
+// the request needs. Models without declared capabilities pass.
+func capable(req public.Requirements) Predicate {
+	return func(c *Client, model string) bool {
+		m, ok := c.ModelInfo(model)
+		return ok && len(m.Missing(req)) == 0
+	}
+}
+
+// servesChat 排除 client 标记为 embedding 的模型
+func servesChat(c *Client, model string) bool {
+	m, ok := c.ModelInfo(model)
+	return ok && m.Type != "embedding"
+}
+
+// MissingCapabilities 检查在线 client 中是否有能满足 req 的 model。有可用 client 或没有任何在线
+// client 时返回 nil；否则返回最接近的 client 缺少的能力，用于向调用方说明原因。
+func (s *Server) MissingCapabilities(model string, req public.Requirements) []string {
+	var closest []string
+	found := false
+	for _, c := range s.clients.get(model) {
+		if !clientHealthy(c, model) {
+			continue
+		}
+		m, ok := c.ModelInfo(model)
+		if !ok {
+			continue
+		}
+		missing := m.Missing(req)
+		if len(missing) == 0 {
+			return nil
+		}
+		if !found || len(missing) < len(closest) {
+			closest, found = missing, true
+		}
+	}
+	if found {
+		log.Printf("no client of model %s supports %v", model, closest)
+	}
+	return closest
+}
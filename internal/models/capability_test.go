@@ -0,0 +1,57 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"star-fire/pkg/public"
+
+	"github.com/gorilla/websocket"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCapabilityAwareRouting(t *testing.T) {
+	server := &Server{LoadBalanceAlgorithm: "random"}
+	basic := &Client{ID: "basic", Status: "online", ControlConn: &websocket.Conn{},
+		Models: []*public.Model{{Name: "model-a", Capabilities: &public.Capabilities{JSONSchema: true, MaxContext: 8192}}}}
+	vision := &Client{ID: "vision", Status: "online", ControlConn: &websocket.Conn{},
+		Models: []*public.Model{{Name: "model-a", Capabilities: &public.Capabilities{Tools: true, Vision: true, MaxContext: 32768}}}}
+	server.clients.replace(map[string]map[string]*Client{"model-a": {"basic": basic, "vision": vision}})
+
+	request := public.ExtendedChatRequest{ChatCompletionRequest: openai.ChatCompletionRequest{
+		Model: "model-a",
+		Tools: []openai.Tool{{Type: openai.ToolTypeFunction, Function: &openai.FunctionDefinition{Name: "f"}}},
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/a.png"}},
+		}}},
+	}}
+	req := request.Requirements(100)
+	if !req.Tools || !req.Vision || req.JSONSchema || req.Reasoning {
+		t.Fatalf("requirements = %+v, want tools and vision", req)
+	}
+	for i := 0; i < 20; i++ {
+		if c, _ := server.LoadBalanceScored("model-a", "", 100, nil, RouteOptions{Requires: req}); c != vision {
+			t.Fatalf("picked %v, want the vision client", c)
+		}
+	}
+	if missing := server.MissingCapabilities("model-a", req); missing != nil {
+		t.Fatalf("missing = %v, want none", missing)
+	}
+
+	// 没有 client 同时支持 JSON 格式和 16k 上下文
+	req = public.Requirements{JSONSchema: true, ContextTokens: 16000}
+	if c, _ := server.LoadBalanceScored("model-a", "", 0, nil, RouteOptions{Requires: req}); c != nil {
+		t.Fatalf("picked %v, want none", c.ID)
+	}
+	if missing := server.MissingCapabilities("model-a", req); !reflect.DeepEqual(missing, []string{public.CapabilityContext}) &&
+		!reflect.DeepEqual(missing, []string{public.CapabilityJSONSchema}) {
+		t.Fatalf("missing = %v", missing)
+	}
+
+	// 未声明能力的旧版本 client 视为全部支持
+	legacy := &Client{ID: "legacy", Status: "online", ControlConn: &websocket.Conn{}, Models: []*public.Model{{Name: "model-a"}}}
+	server.clients.replace(map[string]map[string]*Client{"model-a": {"basic": basic, "legacy": legacy}})
+	if c, _ := server.LoadBalanceScored("model-a", "", 0, nil, RouteOptions{Requires: req}); c != legacy {
+		t.Fatalf("picked %v, want the legacy client", c)
+	}
+}
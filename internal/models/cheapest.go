@@ -0,0 +1,97 @@
+package models
+
+import (
+	"sort"
+	"star-fire/pkg/public"
+	"time"
+)
+
+// 负载均衡算法
+const (
+	LBRoundRobin         = "round-robin"
+	LBRandom             = "random"
+	LBMinConn            = "min-conn"
+	LBWeighted           = "weighted"
+	LBCheapest           = "cheapest"                       // 调用方有效费用最低
+	LBCheapestWithBudget = "cheapest-within-latency-budget" // 延迟在预算内的 client 中有效费用最低
+)
+
+// LoadBalanceAlgorithms 支持的负载均衡算法
+var LoadBalanceAlgorithms = []string{LBRoundRobin, LBRandom, LBMinConn, LBWeighted, LBCheapest, LBCheapestWithBudget}
+
+// ValidLoadBalanceAlgorithm 判断是否为支持的负载均衡算法
+func ValidLoadBalanceAlgorithm(algorithm string) bool {
+	for _, a := range LoadBalanceAlgorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteOptions 单次请求的路由偏好，零值表示使用服务器默认配置
+type RouteOptions struct {
+	Algorithm     string              // 覆盖默认负载均衡算法
+	LatencyBudget time.Duration       // cheapest-within-latency-budget 的延迟上限
+	OutputTokens  int                 // 预估输出长度，用于计算有效费用
+	Requires      public.Requirements // 请求需要的模型能力，只派发给具备这些能力的 client
+	MaxIPPM       float64             // 路由分组的价格上限，与用户的价格上限同时生效，0 表示不限制
+	MaxOPPM       float64
+}
+
+type clientCost struct {
+	client  *Client
+	cost    float64
+	latency int
+}
+
+// pickCheapest 按调用方的有效费用（阶梯价格、折扣后，按预估的输入输出长度计算）选择最便宜的 client，
+// 费用相同时选延迟更低的。budget > 0 时只在延迟不超过 budget 的 client 中选择，都超出预算时选延迟最低的。
+func (s *Server) pickCheapest(model, userID string, promptTokens, outputTokens int, eligible []*Client, budget time.Duration) *Client {
+	if outputTokens <= 0 {
+		outputTokens = DefaultExpectedOutputTokens
+	}
+	discounts := make(map[string]float64) // 折扣按 provider 计算，同一 provider 的 client 只查一次
+	costs := make([]clientCost, 0, len(eligible))
+	for _, c := range eligible {
+		price, ok := c.PriceSnapshot(model)
+		if !ok {
+			continue
+		}
+		discount, seen := discounts[c.UserID]
+		if !seen && s.DiscountDB != nil && userID != "" {
+			discount = s.DiscountDB.GetDiscountRate(userID, c.UserID, model)
+			discounts[c.UserID] = discount
+		}
+		price = price.ForPrompt(promptTokens).Discounted(discount)
+		costs = append(costs, clientCost{
+			client:  c,
+			cost:    price.Cost(promptTokens, 0, outputTokens, 0, 0),
+			latency: c.GetLatency(),
+		})
+	}
+	if len(costs) == 0 {
+		return nil
+	}
+
+	if budget > 0 {
+		within := costs[:0:0]
+		for _, cc := range costs {
+			if time.Duration(cc.latency)*time.Millisecond <= budget {
+				within = append(within, cc)
+			}
+		}
+		if len(within) == 0 {
+			sort.Slice(costs, func(i, j int) bool { return costs[i].latency < costs[j].latency })
+			return costs[0].client
+		}
+		costs = within
+	}
+	sort.Slice(costs, func(i, j int) bool {
+		if costs[i].cost != costs[j].cost {
+			return costs[i].cost < costs[j].cost
+		}
+		return costs[i].latency < costs[j].latency
+	})
+	return costs[0].client
+}
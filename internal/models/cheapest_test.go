@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"star-fire/pkg/public"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCheapestAlgorithmsPreferLowestCost(t *testing.T) {
+	server := &Server{LoadBalanceAlgorithm: LBRoundRobin, clientRoundRobinIndex: map[string]int{}}
+	newClient := func(id string, latency int, ippm, oppm float64) *Client {
+		return &Client{ID: id, Status: "online", ControlConn: &websocket.Conn{}, Latency: latency,
+			Models: []*public.Model{{Name: "model-a", IPPM: ippm, OPPM: oppm}}}
+	}
+	clients := map[string]*Client{
+		"cheap-slow":  newClient("cheap-slow", 3000, 1, 1),
+		"cheap-fast":  newClient("cheap-fast", 200, 1, 1),
+		"pricey-fast": newClient("pricey-fast", 50, 5, 5),
+		"mid-fast":    newClient("mid-fast", 100, 2, 2),
+	}
+	server.clients.replace(map[string]map[string]*Client{"model-a": clients})
+
+	// 费用相同时选延迟更低的
+	for i := 0; i < 3; i++ {
+		c, _ := server.LoadBalanceScored("model-a", "", 1000, nil, RouteOptions{Algorithm: LBCheapest})
+		if c == nil || c.ID != "cheap-fast" {
+			t.Fatalf("cheapest picked %v, want cheap-fast", c)
+		}
+	}
+
+	exclude := map[string]bool{"cheap-fast": true}
+	c, _ := server.LoadBalanceScored("model-a", "", 1000, exclude, RouteOptions{Algorithm: LBCheapest})
+	if c == nil || c.ID != "cheap-slow" {
+		t.Fatalf("cheapest picked %v, want cheap-slow", c)
+	}
+	c, _ = server.LoadBalanceScored("model-a", "", 1000, exclude, RouteOptions{Algorithm: LBCheapestWithBudget, LatencyBudget: time.Second})
+	if c == nil || c.ID != "mid-fast" {
+		t.Fatalf("cheapest within budget picked %v, want mid-fast", c)
+	}
+	// 没有 client 在预算内时选延迟最低的
+	c, _ = server.LoadBalanceScored("model-a", "", 1000, exclude, RouteOptions{Algorithm: LBCheapestWithBudget, LatencyBudget: 10 * time.Millisecond})
+	if c == nil || c.ID != "pricey-fast" {
+		t.Fatalf("cheapest within tiny budget picked %v, want pricey-fast", c)
+	}
+}
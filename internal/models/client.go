@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"star-fire/pkg/public"
@@ -40,12 +41,65 @@ type Client struct {
 	ControlConn      *websocket.Conn          `json:"-" gorm:"-"`
 	ControlConnMutex sync.Mutex               `json:"-" gorm:"-"`
 	LatencyMutex     sync.RWMutex             `json:"-" gorm:"-"`
-	LastPingTime     int64                    `json:"-" gorm:"-"`
+	ModelsVersion    uint64                   `json:"-" gorm:"-"` // 已收到的模型集合版本，只在心跳 goroutine 中读写
 	MessageChan      chan *api.ChatResponse   `json:"-" gorm:"-"`
 	PongChan         chan *public.PPMessage   `json:"-" gorm:"-"`
 	ErrChan          chan error               `json:"-" gorm:"-"`
 	User             *User                    `json:"user" gorm:"-"`
 	InferenceEngine  InferenceEngine          `json:"inference_engine" gorm:"-"`
+	loadMu           sync.RWMutex
+	load             *public.ClientLoad // 心跳上报的负载
+	pushedAliases    map[string]string  // 最近一次推送给 client 的 规范 ID -> 本地名称 映射，由 ControlConnMutex 保护
+	registryMu       sync.Mutex
+	registered       map[string]bool // 已登记到 Server 的模型，心跳上报的模型集合不变时跳过登记
+	modelsMu         sync.RWMutex    // 保护 Models 的替换和报价修改，派发请求时读取报价需要加锁
+}
+
+// SetModels 替换 client 的模型列表（心跳快照、注册）
+func (c *Client) SetModels(models []*public.Model) {
+	c.modelsMu.Lock()
+	c.Models = models
+	c.modelsMu.Unlock()
+}
+
+// ModelInfo 返回 client 上 model 的副本；报价可能被 UpdateModelPrice 并发修改，派发路径通过副本读取
+func (c *Client) ModelInfo(model string) (public.Model, bool) {
+	c.modelsMu.RLock()
+	defer c.modelsMu.RUnlock()
+	for _, m := range c.Models {
+		if m.Name == model {
+			return *m, true
+		}
+	}
+	return public.Model{}, false
+}
+
+// ModelsSnapshot 返回 client 模型列表的副本
+func (c *Client) ModelsSnapshot() []public.Model {
+	c.modelsMu.RLock()
+	defer c.modelsMu.RUnlock()
+	models := make([]public.Model, 0, len(c.Models))
+	for _, m := range c.Models {
+		models = append(models, *m)
+	}
+	return models
+}
+
+// forgetModel 登记表中的 model 已被移除，下次心跳（无论是否携带模型列表）时重新登记
+func (c *Client) forgetModel(model string) {
+	c.registryMu.Lock()
+	delete(c.registered, model)
+	c.registryMu.Unlock()
+}
+
+// WriteMessage 线程安全地向控制连接写入一条消息。
+func (c *Client) WriteMessage(msg public.WSMessage) error {
+	c.ControlConnMutex.Lock()
+	defer c.ControlConnMutex.Unlock()
+	if c.ControlConn == nil {
+		return errors.New("control connection closed")
+	}
+	return c.ControlConn.WriteJSON(msg)
 }
 
 // SetLatency 线程安全地更新客户端延迟（毫秒）。
@@ -68,6 +122,8 @@ type ConnectionResult struct {
 }
 
 func (c *Client) BeforeSave(tx *gorm.DB) error {
+	c.modelsMu.RLock()
+	defer c.modelsMu.RUnlock()
 	if c.Models != nil {
 		data, err := json.Marshal(c.Models)
 		if err != nil {
@@ -110,6 +166,15 @@ func (cdb *ClientDB) SaveClient(client *Client) error {
 	return cdb.db.Save(client).Error
 }
 
+// SaveModels 只更新 client 的模型列表，不回写在线 client 的其他字段
+func (cdb *ClientDB) SaveModels(id string, models []public.Model) error {
+	data, err := json.Marshal(models)
+	if err != nil {
+		return err
+	}
+	return cdb.db.Model(&Client{}).Where("id = ?", id).Update("models", string(data)).Error
+}
+
 func (cdb *ClientDB) UpdateStatus(id, status string) error {
 	return cdb.db.Model(&Client{}).Where("id = ?", id).Update("status", status).Error
 }
@@ -0,0 +1,38 @@
+package models
+
+import "star-fire/pkg/public"
+
+// SetLoad 保存 client 在心跳中上报的负载
+func (c *Client) SetLoad(load *public.ClientLoad) {
+	c.loadMu.Lock()
+	c.load = load
+	c.loadMu.Unlock()
+}
+
+// Load 返回 client 最近一次上报的负载，未上报（旧版本 client）时返回 nil。返回值只读。
+func (c *Client) Load() *public.ClientLoad {
+	c.loadMu.RLock()
+	defer c.loadMu.RUnlock()
+	return c.load
+}
+
+// ModelLoad 返回 client 上报的 model 负载
+func (c *Client) ModelLoad(model string) (public.ModelLoad, bool) {
+	if load := c.Load(); load != nil {
+		return load.Model(model)
+	}
+	return public.ModelLoad{}, false
+}
+
+// Saturated 判断 client 上报的 model 排队请求是否已达到一整批并发，未上报时返回 false
+func (c *Client) Saturated(model string) bool {
+	ml, ok := c.ModelLoad(model)
+	return ok && ml.Queued >= c.Capacity()
+}
+
+// notSaturated returns a Predicate that keeps clients whose reported queue for the model is
+// shorter than one full batch. eligibleClients falls back to saturated clients when no other
+// client is eligible.
+func notSaturated(c *Client, model string) bool {
+	return !c.Saturated(model)
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"testing"
+
+	"star-fire/pkg/public"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReportedLoadDrivesCapacityAndEligibility(t *testing.T) {
+	server := &Server{LoadBalanceAlgorithm: "min-conn"}
+	busy := &Client{ID: "busy", Status: "online", ControlConn: &websocket.Conn{},
+		Models: []*public.Model{{Name: "model-a"}}}
+	other := &Client{ID: "other", Status: "online", ControlConn: &websocket.Conn{},
+		Models: []*public.Model{{Name: "model-a"}}}
+	server.clients.replace(map[string]map[string]*Client{"model-a": {"busy": busy, "other": other}})
+
+	// busy 上报 4 个并发、全部占用并有 4 个排队：不经过本服务器的请求也计入占用
+	busy.SetLoad(&public.ClientLoad{MaxParallel: 4, Active: 4, Queued: 4,
+		Models: []public.ModelLoad{{Model: "model-a", Active: 4, Queued: 4, Loaded: true}}})
+	if busy.Capacity() != 4 || server.FreeSlots(busy) != -4 {
+		t.Fatalf("capacity / free = %d / %d, want 4 / -4", busy.Capacity(), server.FreeSlots(busy))
+	}
+	if !busy.Saturated("model-a") || busy.Saturated("model-b") {
+		t.Fatal("saturation should follow the reported per-model queue")
+	}
+	for i := 0; i < 20; i++ {
+		if got := server.LoadBalance("model-a", ""); got != other {
+			t.Fatalf("picked %v, want the unsaturated client", got)
+		}
+	}
+
+	// 所有 client 都排满时仍然派发
+	other.SetLoad(&public.ClientLoad{MaxParallel: 1,
+		Models: []public.ModelLoad{{Model: "model-a", Active: 1, Queued: 1}}})
+	if got := server.LoadBalance("model-a", ""); got == nil {
+		t.Fatal("saturated clients should still be picked when no other client is eligible")
+	}
+
+	if infos := server.GetUserModels(""); len(infos) != 2 || infos[0].Load == nil {
+		t.Fatalf("dashboard should expose reported load: %+v", infos)
+	}
+}
@@ -0,0 +1,232 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 折扣范围
+const (
+	DiscountScopeProvider = "provider" // provider 为指定用户设置的折扣（好友、内部团队等）
+	DiscountScopeTier     = "tier"     // 管理员为用户等级设置的全局折扣
+)
+
+// DiscountAllModels 表示折扣适用于所有模型
+const DiscountAllModels = "*"
+
+var (
+	ErrDiscountNotFound    = errors.New("discount not found")
+	ErrInvalidDiscountRate = errors.New("discount rate must be in (0, 1)")
+)
+
+// ModelPrice 模型折扣规则。UserDiscountRate 为折扣率，0.2 表示按标价 8 折成交。
+// provider 范围：ProviderID 名下 client 服务 UserID 的请求时生效，由 provider 让利；
+// tier 范围：Tier 等级的用户的所有请求生效，由平台让利，只降低用户的扣费，不降低 provider 的收益。
+// 用户扣费时多条规则同时命中取折扣最大的一条，不叠加。
+type ModelPrice struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	Scope            string    `gorm:"uniqueIndex:idx_model_price_rule;not null" json:"scope"`
+	ProviderID       string    `gorm:"uniqueIndex:idx_model_price_rule;not null;default:''" json:"provider_id,omitempty"`
+	UserID           string    `gorm:"uniqueIndex:idx_model_price_rule;not null;default:''" json:"user_id,omitempty"` // 享受折扣的用户ID
+	Tier             string    `gorm:"uniqueIndex:idx_model_price_rule;not null;default:''" json:"tier,omitempty"`
+	ModelName        string    `gorm:"uniqueIndex:idx_model_price_rule;not null" json:"model_name"` // "*" 表示所有模型
+	UserDiscountRate float64   `gorm:"not null" json:"user_discount_rate"`                          // 用户折扣率
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// tierCacheTTL 用户等级缓存的有效期；管理员修改等级时通过 InvalidateTier 立即失效
+const tierCacheTTL = 60 * time.Second
+
+type tierCacheEntry struct {
+	tier      string
+	expiresAt time.Time
+}
+
+// DiscountDB 提供折扣规则的读写与匹配。规则全部缓存在内存中，写入后重新加载；
+// 用户等级按用户缓存
+type DiscountDB struct {
+	db     *gorm.DB
+	mu     sync.RWMutex
+	rules  []ModelPrice
+	loaded bool     // false 表示规则缓存需要重新加载
+	tiers  sync.Map // userID → *tierCacheEntry
+}
+
+// NewDiscountDB 初始化 DiscountDB。
+// 旧版 model_prices 表以 model_name 为主键且从未被使用，检测到旧表时改名保留，再按新结构建表。
+func NewDiscountDB(db *gorm.DB) *DiscountDB {
+	m := db.Migrator()
+	if m.HasTable(&ModelPrice{}) && !m.HasColumn(&ModelPrice{}, "scope") {
+		if err := m.RenameTable("model_prices", "model_prices_legacy"); err != nil {
+			return nil
+		}
+	}
+	db.AutoMigrate(&ModelPrice{})
+	return &DiscountDB{db: db}
+}
+
+// SaveDiscount 创建或更新折扣规则（按范围 + 对象 + 模型唯一）
+func (d *DiscountDB) SaveDiscount(rule *ModelPrice) (*ModelPrice, error) {
+	if rule.UserDiscountRate <= 0 || rule.UserDiscountRate >= 1 {
+		return nil, ErrInvalidDiscountRate
+	}
+	if rule.ModelName == "" {
+		rule.ModelName = DiscountAllModels
+	}
+	var existing ModelPrice
+	err := d.db.Where("scope = ? AND provider_id = ? AND user_id = ? AND tier = ? AND model_name = ?",
+		rule.Scope, rule.ProviderID, rule.UserID, rule.Tier, rule.ModelName).First(&existing).Error
+	if err == nil {
+		existing.UserDiscountRate = rule.UserDiscountRate
+		defer d.invalidateRules()
+		return &existing, d.db.Save(&existing).Error
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	defer d.invalidateRules()
+	return rule, d.db.Create(rule).Error
+}
+
+// ListDiscounts 查询折扣规则，providerID 为空表示不过滤
+func (d *DiscountDB) ListDiscounts(scope, providerID string) ([]*ModelPrice, error) {
+	var rules []*ModelPrice
+	query := d.db.Where("scope = ?", scope)
+	if providerID != "" {
+		query = query.Where("provider_id = ?", providerID)
+	}
+	err := query.Order("model_name, id").Find(&rules).Error
+	return rules, err
+}
+
+// UpdateDiscountRate 修改折扣率；providerID 非空时只能修改该 provider 自己的规则
+func (d *DiscountDB) UpdateDiscountRate(id uint, scope, providerID string, rate float64) (*ModelPrice, error) {
+	if rate <= 0 || rate >= 1 {
+		return nil, ErrInvalidDiscountRate
+	}
+	var rule ModelPrice
+	query := d.db.Where("id = ? AND scope = ?", id, scope)
+	if providerID != "" {
+		query = query.Where("provider_id = ?", providerID)
+	}
+	if err := query.First(&rule).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDiscountNotFound
+		}
+		return nil, err
+	}
+	rule.UserDiscountRate = rate
+	defer d.invalidateRules()
+	return &rule, d.db.Save(&rule).Error
+}
+
+// DeleteDiscount 删除折扣规则；providerID 非空时只能删除该 provider 自己的规则
+func (d *DiscountDB) DeleteDiscount(id uint, scope, providerID string) error {
+	query := d.db.Where("id = ? AND scope = ?", id, scope)
+	if providerID != "" {
+		query = query.Where("provider_id = ?", providerID)
+	}
+	result := query.Delete(&ModelPrice{})
+	d.invalidateRules()
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrDiscountNotFound
+	}
+	return nil
+}
+
+func (d *DiscountDB) invalidateRules() {
+	d.mu.Lock()
+	d.rules, d.loaded = nil, false
+	d.mu.Unlock()
+}
+
+// cachedRules 返回缓存的全部规则，缓存失效时从数据库重新加载
+func (d *DiscountDB) cachedRules() []ModelPrice {
+	d.mu.RLock()
+	rules, loaded := d.rules, d.loaded
+	d.mu.RUnlock()
+	if loaded {
+		return rules
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.loaded {
+		return d.rules
+	}
+	if err := d.db.Find(&rules).Error; err != nil {
+		log.Printf("load discount rules failed: %v", err)
+		return nil
+	}
+	d.rules, d.loaded = rules, true
+	return rules
+}
+
+// userTier 返回用户等级（带缓存）
+func (d *DiscountDB) userTier(userID string) string {
+	if v, ok := d.tiers.Load(userID); ok {
+		entry := v.(*tierCacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			return entry.tier
+		}
+	}
+	var tier string
+	if err := d.db.Model(&User{}).Select("tier").Where("id = ?", userID).Scan(&tier).Error; err != nil {
+		return ""
+	}
+	d.tiers.Store(userID, &tierCacheEntry{tier: tier, expiresAt: time.Now().Add(tierCacheTTL)})
+	return tier
+}
+
+// InvalidateTier 修改用户等级后使缓存失效
+func (d *DiscountDB) InvalidateTier(userID string) {
+	d.tiers.Delete(userID)
+}
+
+// GetDiscountRates 分别返回 userID 通过 providerID 名下 client 调用 model 时适用的 provider 折扣率和等级折扣率，
+// 无折扣时为 0
+func (d *DiscountDB) GetDiscountRates(userID, providerID, model string) (provider, tier float64) {
+	userTier := d.userTier(userID)
+	for _, rule := range d.cachedRules() {
+		if rule.ModelName != model && rule.ModelName != DiscountAllModels {
+			continue
+		}
+		switch {
+		case rule.Scope == DiscountScopeProvider && rule.ProviderID == providerID && rule.UserID == userID:
+			provider = max(provider, rule.UserDiscountRate)
+		case rule.Scope == DiscountScopeTier && userTier != "" && rule.Tier == userTier:
+			tier = max(tier, rule.UserDiscountRate)
+		}
+	}
+	return provider, tier
+}
+
+// GetDiscountRate 返回 userID 通过 providerID 名下 client 调用 model 时用户适用的最大折扣率，无折扣时返回 0
+func (d *DiscountDB) GetDiscountRate(userID, providerID, model string) float64 {
+	provider, tier := d.GetDiscountRates(userID, providerID, model)
+	return max(provider, tier)
+}
+
+// DiscountRates 返回用户调用 clientID 上的 model 时 provider 结算适用的折扣率和用户扣费适用的折扣率；
+// 等级折扣由平台承担，只计入后者。client 已下线时从数据库查询其所有者
+func (s *Server) DiscountRates(userID, model, clientID string) (provider, consumer float64) {
+	if s.DiscountDB == nil {
+		return 0, 0
+	}
+	providerID := ""
+	if c := s.GetClientByModel(model, clientID); c != nil {
+		providerID = c.UserID
+	} else if c, err := s.ClientDB.GetClient(clientID); err == nil {
+		providerID = c.UserID
+	}
+	provider, tier := s.DiscountDB.GetDiscountRates(userID, providerID, model)
+	return provider, max(provider, tier)
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestDiscountRateTakesBestMatchingRule(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	// 旧版 model_prices 表应被改名保留
+	if err := db.Exec("CREATE TABLE model_prices (model_name TEXT PRIMARY KEY, user_id TEXT)").Error; err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+	userDB := NewUserDB(db)
+	discountDB := NewDiscountDB(db)
+	if !db.Migrator().HasTable("model_prices_legacy") || !db.Migrator().HasColumn(&ModelPrice{}, "scope") {
+		t.Fatal("legacy model_prices table not migrated")
+	}
+	if err := db.Create(&User{ID: "user-1", Username: "alice", Password: "x"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	if rate := discountDB.GetDiscountRate("user-1", "provider-1", "model-a"); rate != 0 {
+		t.Fatalf("rate without rules = %v, want 0", rate)
+	}
+
+	if _, err := discountDB.SaveDiscount(&ModelPrice{Scope: DiscountScopeProvider, ProviderID: "provider-1", UserID: "user-1", UserDiscountRate: 0.1}); err != nil {
+		t.Fatalf("save provider discount: %v", err)
+	}
+	if _, err := discountDB.SaveDiscount(&ModelPrice{Scope: DiscountScopeTier, Tier: "vip", ModelName: "model-a", UserDiscountRate: 0.3}); err != nil {
+		t.Fatalf("save tier discount: %v", err)
+	}
+	if _, err := discountDB.SaveDiscount(&ModelPrice{Scope: DiscountScopeTier, Tier: "vip", UserDiscountRate: 1}); err != ErrInvalidDiscountRate {
+		t.Fatalf("rate 1 accepted: %v", err)
+	}
+
+	if rate := discountDB.GetDiscountRate("user-1", "provider-1", "model-a"); rate != 0.1 {
+		t.Fatalf("provider rate = %v, want 0.1", rate)
+	}
+	if rate := discountDB.GetDiscountRate("user-1", "provider-2", "model-a"); rate != 0 {
+		t.Fatalf("other provider rate = %v, want 0", rate)
+	}
+
+	if err := userDB.SetTier("user-1", "vip"); err != nil {
+		t.Fatalf("set tier: %v", err)
+	}
+	discountDB.InvalidateTier("user-1")
+	if rate := discountDB.GetDiscountRate("user-1", "provider-1", "model-a"); rate != 0.3 {
+		t.Fatalf("vip rate = %v, want 0.3", rate)
+	}
+	if rate := discountDB.GetDiscountRate("user-1", "provider-1", "model-b"); rate != 0.1 {
+		t.Fatalf("vip rate on other model = %v, want 0.1", rate)
+	}
+	// 等级折扣只降低用户扣费，provider 按自己的折扣结算
+	if provider, tier := discountDB.GetDiscountRates("user-1", "provider-1", "model-a"); provider != 0.1 || tier != 0.3 {
+		t.Fatalf("rates = %v/%v, want 0.1/0.3", provider, tier)
+	}
+}
@@ -0,0 +1,41 @@
+package models
+
+import "sort"
+
+// CostEstimate 按当前在线 client 的报价估算一次请求的费用（元），不包含套餐额度与优惠券抵扣
+type CostEstimate struct {
+	Model           string  `json:"model"`
+	PromptTokens    int     `json:"prompt_tokens"`
+	OutputTokens    int     `json:"output_tokens"`
+	EligibleClients int     `json:"eligible_clients"`
+	MinCost         float64 `json:"min_cost"`
+	MedianCost      float64 `json:"median_cost"`
+	MaxCost         float64 `json:"max_cost"`
+}
+
+// EstimateCost 对 model 的所有可用 client（已应用用户价格上限与阶梯价格）计算费用，返回最小、中位数和最大值
+func (s *Server) EstimateCost(model, userID string, promptTokens, outputTokens int) *CostEstimate {
+	est := &CostEstimate{Model: model, PromptTokens: promptTokens, OutputTokens: outputTokens}
+
+	var costs []float64
+	for _, c := range s.EligibleClients(model, userID, promptTokens) {
+		if m, ok := c.ModelInfo(model); ok {
+			ippm, oppm, _ := m.PriceFor(promptTokens)
+			costs = append(costs, (float64(promptTokens)*ippm+float64(outputTokens)*oppm)/1000000)
+		}
+	}
+	est.EligibleClients = len(costs)
+	if len(costs) == 0 {
+		return est
+	}
+
+	sort.Float64s(costs)
+	est.MinCost = costs[0]
+	est.MaxCost = costs[len(costs)-1]
+	if mid := len(costs) / 2; len(costs)%2 == 1 {
+		est.MedianCost = costs[mid]
+	} else {
+		est.MedianCost = (costs[mid-1] + costs[mid]) / 2
+	}
+	return est
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"testing"
+
+	"star-fire/pkg/public"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+func TestEstimateCostAppliesPriceCap(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	capDB := NewUserPriceCapDB(db)
+	server := &Server{UserPriceCapDB: capDB}
+
+	clients := map[string]*Client{}
+	for id, ippm := range map[string]float64{"c1": 1, "c2": 2, "c3": 4, "c4": 10} {
+		clients[id] = &Client{
+			ID: id, Status: "online", ControlConn: &websocket.Conn{},
+			Models: []*public.Model{{Name: "model-a", IPPM: ippm, OPPM: 2 * ippm}},
+		}
+	}
+	server.clients.replace(map[string]map[string]*Client{"model-a": clients})
+
+	est := server.EstimateCost("model-a", "user-1", 1000000, 500000)
+	if est.EligibleClients != 4 || est.MinCost != 2 || est.MedianCost != 6 || est.MaxCost != 20 {
+		t.Fatalf("unexpected estimate: %+v", est)
+	}
+
+	if _, err := capDB.Upsert("user-1", "model-a", 4, 8, 0); err != nil {
+		t.Fatalf("upsert cap: %v", err)
+	}
+	est = server.EstimateCost("model-a", "user-1", 1000000, 500000)
+	if est.EligibleClients != 3 || est.MedianCost != 4 || est.MaxCost != 8 {
+		t.Fatalf("unexpected capped estimate: %+v", est)
+	}
+}
+
+func TestPriceTiersApplyByPromptLength(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	capDB := NewUserPriceCapDB(db)
+	server := &Server{UserPriceCapDB: capDB}
+
+	tiered := &Client{
+		ID: "tiered", Status: "online", ControlConn: &websocket.Conn{},
+		Models: []*public.Model{{Name: "model-a", IPPM: 1, OPPM: 2, PriceTiers: []public.PriceTier{
+			{MinPromptTokens: 128000, IPPM: 6, OPPM: 12},
+			{MinPromptTokens: 32000, IPPM: 3},
+		}}},
+	}
+	server.clients.replace(map[string]map[string]*Client{"model-a": {"tiered": tiered}})
+
+	for _, tc := range []struct {
+		prompt     int
+		ippm, oppm float64
+	}{{1000, 1, 2}, {32000, 3, 2}, {200000, 6, 12}} {
+		ippm, oppm, _ := tiered.Models[0].PriceFor(tc.prompt)
+		if ippm != tc.ippm || oppm != tc.oppm {
+			t.Fatalf("PriceFor(%d) = %v/%v, want %v/%v", tc.prompt, ippm, oppm, tc.ippm, tc.oppm)
+		}
+	}
+
+	// 计费按实际提示长度匹配阶梯，推理价格未设置时随输出阶梯价格变化
+	snapshot, _ := tiered.PriceSnapshot("model-a")
+	if p := snapshot.ForPrompt(200000); p.IPPM != 6 || p.OPPM != 12 || p.RPPM != 12 {
+		t.Fatalf("tier snapshot = %+v", p)
+	}
+
+	if est := server.EstimateCost("model-a", "user-1", 100000, 0); est.MinCost != 0.3 {
+		t.Fatalf("long-context estimate = %+v, want cost 0.3", est)
+	}
+
+	// 用户价格上限按匹配的阶梯过滤
+	if _, err := capDB.Upsert("user-1", "model-a", 4, 8, 0); err != nil {
+		t.Fatalf("upsert cap: %v", err)
+	}
+	if n := len(server.EligibleClients("model-a", "user-1", 64000)); n != 1 {
+		t.Fatalf("eligible at 64k = %d, want 1", n)
+	}
+	if n := len(server.EligibleClients("model-a", "user-1", 200000)); n != 0 {
+		t.Fatalf("eligible at 200k = %d, want 0", n)
+	}
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// inflightCounter 一个 client 正在处理的请求数，按模型细分
+type inflightCounter struct {
+	total  atomic.Int64
+	models sync.Map // model -> *atomic.Int64
+}
+
+func (ic *inflightCounter) model(name string) *atomic.Int64 {
+	if v, ok := ic.models.Load(name); ok {
+		return v.(*atomic.Int64)
+	}
+	v, _ := ic.models.LoadOrStore(name, new(atomic.Int64))
+	return v.(*atomic.Int64)
+}
+
+func (s *Server) inflightOf(clientID string) *inflightCounter {
+	if v, ok := s.inflight.Load(clientID); ok {
+		return v.(*inflightCounter)
+	}
+	v, _ := s.inflight.LoadOrStore(clientID, &inflightCounter{})
+	return v.(*inflightCounter)
+}
+
+// AcquireSlot 记录派发给 client 的一个 model 请求，返回的 release 在请求结束时调用，重复调用只生效一次
+func (s *Server) AcquireSlot(clientID, model string) (release func()) {
+	ic := s.inflightOf(clientID)
+	m := ic.model(model)
+	ic.total.Add(1)
+	m.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.Add(-1)
+			ic.total.Add(-1)
+		})
+	}
+}
+
+// InFlight 返回 client 正在处理的请求数
+func (s *Server) InFlight(clientID string) int {
+	if v, ok := s.inflight.Load(clientID); ok {
+		return int(v.(*inflightCounter).total.Load())
+	}
+	return 0
+}
+
+// InFlightModel 返回 client 正在处理的 model 请求数
+func (s *Server) InFlightModel(clientID, model string) int {
+	if v, ok := s.inflight.Load(clientID); ok {
+		if m, ok := v.(*inflightCounter).models.Load(model); ok {
+			return int(m.(*atomic.Int64).Load())
+		}
+	}
+	return 0
+}
+
+// FreeSlots client 剩余可用的并发数，可能为负（超额派发）。client 上报的负载包含
+// 不经过本服务器的请求，取两者中较大的占用数。
+func (s *Server) FreeSlots(c *Client) int {
+	busy := s.InFlight(c.ID)
+	if load := c.Load(); load != nil {
+		busy = max(busy, load.Active+load.Queued)
+	}
+	return c.Capacity() - busy
+}
+
+// pickMinConn 选择空闲并发最多的 client，空闲数相同时随机选择
+func (s *Server) pickMinConn(eligible []*Client) *Client {
+	var best []*Client
+	bestFree := 0
+	for _, c := range eligible {
+		free := s.FreeSlots(c)
+		switch {
+		case len(best) == 0 || free > bestFree:
+			best, bestFree = []*Client{c}, free
+		case free == bestFree:
+			best = append(best, c)
+		}
+	}
+	if len(best) == 0 {
+		return nil
+	}
+	return best[rand.Intn(len(best))]
+}
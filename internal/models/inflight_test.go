@@ -0,0 +1,118 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"star-fire/pkg/public"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+func TestMinConnPicksByFreeSlots(t *testing.T) {
+	server := &Server{LoadBalanceAlgorithm: "min-conn"}
+	busy := &Client{ID: "busy", Status: "online", ControlConn: &websocket.Conn{},
+		InferenceEngine: InferenceEngine{NumParallel: 4}, Models: []*public.Model{{Name: "model-a"}}}
+	idle := &Client{ID: "idle", Status: "online", ControlConn: &websocket.Conn{},
+		Models: []*public.Model{{Name: "model-a"}}}
+	server.clients.replace(map[string]map[string]*Client{"model-a": {"busy": busy, "idle": idle}})
+
+	// busy 有 4 个并发、占用 2 个，空闲 2；idle 未上报并发数按 1 计，没有进行中的请求
+	r1 := server.AcquireSlot("busy", "model-a")
+	r2 := server.AcquireSlot("busy", "model-b")
+	if got := server.LoadBalance("model-a", ""); got != busy {
+		t.Fatalf("picked %v, want busy (2 free slots)", got)
+	}
+	if server.InFlight("busy") != 2 || server.InFlightModel("busy", "model-a") != 1 {
+		t.Fatalf("in-flight = %d / %d, want 2 / 1", server.InFlight("busy"), server.InFlightModel("busy", "model-a"))
+	}
+
+	// 空闲数相同（1 vs 1）时两者都会被选中，之前从未派发过的 client 也在其中
+	r3 := server.AcquireSlot("busy", "model-a")
+	picks := map[string]int{}
+	for i := 0; i < 200; i++ {
+		picks[server.LoadBalance("model-a", "").ID]++
+	}
+	if picks["busy"] == 0 || picks["idle"] == 0 {
+		t.Fatalf("tied clients not both picked: %v", picks)
+	}
+
+	// release 重复调用只生效一次
+	r1()
+	r1()
+	r2()
+	r3()
+	if server.InFlight("busy") != 0 || server.InFlightModel("busy", "model-a") != 0 {
+		t.Fatalf("in-flight after release = %d, want 0", server.InFlight("busy"))
+	}
+}
+
+func TestAcquireSlotConcurrent(t *testing.T) {
+	server := &Server{}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := server.AcquireSlot("c1", "model-a")
+			release()
+		}()
+	}
+	wg.Wait()
+	if n := server.InFlight("c1"); n != 0 {
+		t.Fatalf("in-flight = %d, want 0", n)
+	}
+}
+
+const benchClients = 50
+
+func benchEligible() []*Client {
+	eligible := make([]*Client, benchClients)
+	for i := range eligible {
+		eligible[i] = &Client{ID: fmt.Sprintf("client-%d", i), InferenceEngine: InferenceEngine{NumParallel: 4}}
+	}
+	return eligible
+}
+
+// BenchmarkMinConnDB 旧实现：每次选择都对 client_fingerprints 做一次 GROUP BY
+func BenchmarkMinConnDB(b *testing.B) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		b.Fatalf("open test database: %v", err)
+	}
+	fdb := NewClientFingerprintDB(db)
+	eligible := benchEligible()
+	ids := make([]string, len(eligible))
+	for i, c := range eligible {
+		ids[i] = c.ID
+		for j := 0; j < i%4; j++ {
+			fdb.SaveFingerprint(fmt.Sprintf("%s-%d", c.ID, j), c.ID, "transmitting")
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fdb.GetClientChatConnections(ids); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMinConnInMemory 按内存计数器选择空闲并发最多的 client
+func BenchmarkMinConnInMemory(b *testing.B) {
+	server := &Server{}
+	eligible := benchEligible()
+	for i, c := range eligible {
+		for j := 0; j < i%4; j++ {
+			server.AcquireSlot(c.ID, "model-a")
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if server.pickMinConn(eligible) == nil {
+			b.Fatal("no client picked")
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"star-fire/pkg/public"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ModelAlias 管理员配置的别名规则：把引擎特有的模型名映射到规范 ID，
+// 同一权重的不同量化版本映射到同一个规范 ID，并记录量化版本
+type ModelAlias struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Alias        string    `gorm:"uniqueIndex;not null" json:"alias"` // 小写，可以是原始名称或内置规则规范化后的名称
+	Canonical    string    `gorm:"not null" json:"canonical"`
+	Quantization string    `json:"quantization"` // 为空时沿用内置规则识别出的量化后缀
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ModelCatalogDB 提供别名规则的读写方法，规则在内存中缓存一份供注册和派发时查找
+type ModelCatalogDB struct {
+	db      *gorm.DB
+	mu      sync.RWMutex
+	aliases map[string]ModelAlias
+}
+
+// NewModelCatalogDB 初始化 ModelCatalogDB 并加载别名规则
+func NewModelCatalogDB(db *gorm.DB) *ModelCatalogDB {
+	db.AutoMigrate(&ModelAlias{})
+	m := &ModelCatalogDB{db: db, aliases: make(map[string]ModelAlias)}
+	var list []ModelAlias
+	if err := db.Find(&list).Error; err != nil {
+		log.Printf("load model aliases failed: %v", err)
+	}
+	for _, a := range list {
+		m.aliases[a.Alias] = a
+	}
+	return m
+}
+
+// List 列出所有别名规则
+func (m *ModelCatalogDB) List() ([]*ModelAlias, error) {
+	var list []*ModelAlias
+	err := m.db.Order("canonical, alias").Find(&list).Error
+	return list, err
+}
+
+// Save 新增或更新别名规则
+func (m *ModelCatalogDB) Save(alias *ModelAlias) error {
+	alias.Alias = strings.ToLower(strings.TrimSpace(alias.Alias))
+	alias.Canonical = strings.ToLower(strings.TrimSpace(alias.Canonical))
+	alias.Quantization = strings.ToLower(strings.TrimSpace(alias.Quantization))
+	if alias.Alias == "" || alias.Canonical == "" {
+		return errors.New("alias and canonical are required")
+	}
+	var existing ModelAlias
+	err := m.db.Where("alias = ?", alias.Alias).First(&existing).Error
+	switch {
+	case err == nil:
+		alias.ID, alias.CreatedAt = existing.ID, existing.CreatedAt
+		err = m.db.Save(alias).Error
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		err = m.db.Create(alias).Error
+	}
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.aliases[alias.Alias] = *alias
+	m.mu.Unlock()
+	return nil
+}
+
+// Delete 删除别名规则，返回规则是否存在
+func (m *ModelCatalogDB) Delete(alias string) (bool, error) {
+	alias = strings.ToLower(strings.TrimSpace(alias))
+	result := m.db.Where("alias = ?", alias).Delete(&ModelAlias{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	m.mu.Lock()
+	delete(m.aliases, alias)
+	m.mu.Unlock()
+	return result.RowsAffected > 0, nil
+}
+
+// Lookup 按别名查找规则
+func (m *ModelCatalogDB) Lookup(alias string) (ModelAlias, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.aliases[alias]
+	return a, ok
+}
+
+// quantizationToken 常见的量化后缀：GGUF 的 q4_k_m、iq3_xs，浮点精度，以及 awq/gptq 等
+var quantizationToken = regexp.MustCompile(`^(i?q\d(_[0-9a-z]+)*|fp\d+|bf16|f16|f32|int\d|w\d+a\d+|awq|gptq|gguf|mlx|\d+bit)$`)
+
+// CanonicalModelName 内置的规范化规则：转为小写，去掉组织前缀（Qwen/）和 :latest，
+// 标签中的 ":" 换成 "-"，并拆出末尾的量化后缀。
+// 例如 qwen3:8b、Qwen/Qwen3-8B、qwen3-8b 都规范化为 qwen3-8b，qwen3:8b-q4_K_M 的量化版本为 q4_k_m。
+func CanonicalModelName(name string) (canonical, quantization string) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSuffix(name, ":latest")
+	parts := strings.Split(strings.ReplaceAll(name, ":", "-"), "-")
+	end := len(parts)
+	for end > 1 && quantizationToken.MatchString(parts[end-1]) {
+		end--
+	}
+	return strings.Join(parts[:end], "-"), strings.Join(parts[end:], "-")
+}
+
+// CanonicalModel 返回 name 的规范 ID 与量化版本。优先按原始名称、其次按内置规则规范化后的名称
+// 查找管理员配置的别名规则，都没有时使用内置规则的结果。
+func (s *Server) CanonicalModel(name string) (string, string) {
+	canonical, quantization := CanonicalModelName(name)
+	if canonical == "" {
+		return name, ""
+	}
+	if s.ModelCatalogDB != nil {
+		for _, key := range []string{strings.ToLower(strings.TrimSpace(name)), canonical} {
+			if a, ok := s.ModelCatalogDB.Lookup(key); ok {
+				if a.Quantization != "" {
+					quantization = a.Quantization
+				}
+				return a.Canonical, quantization
+			}
+		}
+	}
+	return canonical, quantization
+}
+
+// CanonicalRuleModel 返回价格上限、折扣等规则中模型名的规范 ID，"*"（所有模型）和空值保持不变
+func (s *Server) CanonicalRuleModel(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "*" {
+		return name
+	}
+	canonical, _ := s.CanonicalModel(name)
+	return canonical
+}
+
+// migrateCanonicalRuleModels 一次性把引入规范 ID 之前保存的价格上限、折扣和价格上限配置中的
+// 原始模型名改写为规范 ID。规范 ID 已有规则时保留已有规则，丢弃原始名称的那条。
+func (s *Server) migrateCanonicalRuleModels() {
+	if s.SystemConfigDB.GetString(ConfigKeyCanonicalRulesMigrated, "") != "" {
+		return
+	}
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var caps []UserModelPriceCap
+		if err := tx.Find(&caps).Error; err != nil {
+			return err
+		}
+		for _, c := range caps {
+			canonical := s.CanonicalRuleModel(c.Model)
+			if canonical == c.Model {
+				continue
+			}
+			var n int64
+			if err := tx.Model(&UserModelPriceCap{}).Where("user_id = ? AND model = ?", c.UserID, canonical).Count(&n).Error; err != nil {
+				return err
+			}
+			q := tx.Model(&UserModelPriceCap{}).Where("id = ?", c.ID)
+			if n > 0 {
+				q = q.Delete(&UserModelPriceCap{})
+			} else {
+				q = q.Update("model", canonical)
+			}
+			if q.Error != nil {
+				return q.Error
+			}
+		}
+
+		var rules []ModelPrice
+		if err := tx.Find(&rules).Error; err != nil {
+			return err
+		}
+		for _, r := range rules {
+			canonical := s.CanonicalRuleModel(r.ModelName)
+			if canonical == r.ModelName {
+				continue
+			}
+			var n int64
+			if err := tx.Model(&ModelPrice{}).Where("scope = ? AND provider_id = ? AND user_id = ? AND tier = ? AND model_name = ?",
+				r.Scope, r.ProviderID, r.UserID, r.Tier, canonical).Count(&n).Error; err != nil {
+				return err
+			}
+			q := tx.Model(&ModelPrice{}).Where("id = ?", r.ID)
+			if n > 0 {
+				q = q.Delete(&ModelPrice{})
+			} else {
+				q = q.Update("model_name", canonical)
+			}
+			if q.Error != nil {
+				return q.Error
+			}
+		}
+
+		var cfgs []SystemConfig
+		if err := tx.Where("substr(key, 1, ?) = ?", len(configKeyPriceCeilingPrefix), configKeyPriceCeilingPrefix).Find(&cfgs).Error; err != nil {
+			return err
+		}
+		existing := make(map[string]bool, len(cfgs))
+		for _, cfg := range cfgs {
+			existing[cfg.Key] = true
+		}
+		for _, cfg := range cfgs {
+			model := strings.TrimPrefix(cfg.Key, configKeyPriceCeilingPrefix)
+			key := configKeyPriceCeilingPrefix + s.CanonicalRuleModel(model)
+			if key == cfg.Key {
+				continue
+			}
+			if !existing[key] {
+				if err := tx.Create(&SystemConfig{Key: key, Value: cfg.Value}).Error; err != nil {
+					return err
+				}
+				existing[key] = true
+			}
+			if err := tx.Where("key = ?", cfg.Key).Delete(&SystemConfig{}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("migrate canonical model names failed: %v", err)
+		return
+	}
+	s.DiscountDB.invalidateRules()
+	s.SystemConfigDB.invalidate(configKeyPriceCeilingPrefix)
+	if err := s.SystemConfigDB.Set(ConfigKeyCanonicalRulesMigrated, time.Now().Format(time.RFC3339)); err != nil {
+		log.Printf("mark canonical model names migrated failed: %v", err)
+	}
+}
+
+// CanonicalizeModels 把 client 上报的模型改为以规范 ID 命名，原名称记入 LocalName，
+// 返回 规范 ID -> 本地名称 的映射。同一 client 的不同本地名称映射到同一规范 ID 时只保留第一个。
+func (s *Server) CanonicalizeModels(models []*public.Model) ([]*public.Model, map[string]string) {
+	local := make(map[string]string, len(models))
+	result := make([]*public.Model, 0, len(models))
+	for _, m := range models {
+		if m.LocalName == "" {
+			m.LocalName = m.Name
+		}
+		canonical, quantization := s.CanonicalModel(m.LocalName)
+		if prev, dup := local[canonical]; dup && prev != m.LocalName {
+			log.Printf("model %s duplicates %s as %s, skipped", m.LocalName, local[canonical], canonical)
+			continue
+		}
+		local[canonical] = m.LocalName
+		m.Name, m.Quantization = canonical, quantization
+		result = append(result, m)
+	}
+	return result, local
+}
+
+// PushModelAliases 把 规范 ID -> 本地名称 映射推送给 client，映射与上次推送的相同时跳过。
+// client 收到派发的请求后按映射改回本地名称再调用推理引擎。
+func PushModelAliases(client *Client, local map[string]string) {
+	client.ControlConnMutex.Lock()
+	defer client.ControlConnMutex.Unlock()
+	if client.ControlConn == nil || sameAliases(client.pushedAliases, local) {
+		return
+	}
+	if err := client.ControlConn.WriteJSON(public.WSMessage{
+		Type:    public.MODEL_ALIASES,
+		Content: local,
+	}); err != nil {
+		log.Printf("push model aliases to client %s failed: %v", client.ID, err)
+		return
+	}
+	client.pushedAliases = local
+}
+
+// CanonicalizeLoad 把 client 按本地名称上报的模型负载改为按规范 ID 记录。
+// models 为已规范化的模型列表，只带负载的心跳也能按上次收到的模型列表换算。
+func CanonicalizeLoad(load *public.ClientLoad, models []*public.Model) *public.ClientLoad {
+	canonical := make(map[string]string, len(models))
+	for _, m := range models {
+		if m.LocalName != "" {
+			canonical[m.LocalName] = m.Name
+		}
+	}
+	for i := range load.Models {
+		if c, ok := canonical[load.Models[i].Model]; ok {
+			load.Models[i].Model = c
+		}
+	}
+	return load
+}
+
+func sameAliases(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
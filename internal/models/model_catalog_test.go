@@ -0,0 +1,145 @@
+package models
+
+import (
+	"testing"
+
+	"star-fire/pkg/public"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestCanonicalModelName(t *testing.T) {
+	tests := []struct {
+		name, canonical, quantization string
+	}{
+		{"qwen3:8b", "qwen3-8b", ""},
+		{"Qwen/Qwen3-8B", "qwen3-8b", ""},
+		{"qwen3-8b", "qwen3-8b", ""},
+		{"qwen3:8b-q4_K_M", "qwen3-8b", "q4_k_m"},
+		{"Qwen/Qwen3-8B-AWQ", "qwen3-8b", "awq"},
+		{"llama3.1:latest", "llama3.1", ""},
+		{"nomic-embed-text:v1.5-fp16", "nomic-embed-text-v1.5", "fp16"},
+	}
+	for _, tt := range tests {
+		canonical, quantization := CanonicalModelName(tt.name)
+		if canonical != tt.canonical || quantization != tt.quantization {
+			t.Errorf("CanonicalModelName(%q) = %q, %q; want %q, %q", tt.name, canonical, quantization, tt.canonical, tt.quantization)
+		}
+	}
+}
+
+func TestModelAliasesOverrideBuiltinRule(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	server := &Server{ModelCatalogDB: NewModelCatalogDB(db)}
+	if err := server.ModelCatalogDB.Save(&ModelAlias{Alias: "Qwen/Qwen3-8B-Instruct", Canonical: "qwen3-8b", Quantization: "bf16"}); err != nil {
+		t.Fatalf("save alias: %v", err)
+	}
+	if err := server.ModelCatalogDB.Save(&ModelAlias{Alias: "qwen3-8b-gguf-custom", Canonical: "qwen3-8b"}); err != nil {
+		t.Fatalf("save alias: %v", err)
+	}
+
+	if c, q := server.CanonicalModel("Qwen/Qwen3-8B-Instruct"); c != "qwen3-8b" || q != "bf16" {
+		t.Fatalf("alias by raw name = %q, %q; want qwen3-8b, bf16", c, q)
+	}
+	// 按内置规则规范化后的名称匹配
+	if c, _ := server.CanonicalModel("qwen3:8b-gguf-custom"); c != "qwen3-8b" {
+		t.Fatalf("alias by canonical form = %q, want qwen3-8b", c)
+	}
+
+	// 重启后从数据库加载规则
+	reloaded := &Server{ModelCatalogDB: NewModelCatalogDB(db)}
+	if c, _ := reloaded.CanonicalModel("qwen/qwen3-8b-instruct"); c != "qwen3-8b" {
+		t.Fatalf("reloaded alias = %q, want qwen3-8b", c)
+	}
+	if existed, err := reloaded.ModelCatalogDB.Delete("Qwen/Qwen3-8B-Instruct"); err != nil || !existed {
+		t.Fatalf("delete alias = %v, %v", existed, err)
+	}
+	if c, _ := reloaded.CanonicalModel("Qwen/Qwen3-8B-Instruct"); c != "qwen3-8b-instruct" {
+		t.Fatalf("after delete = %q, want built-in rule", c)
+	}
+}
+
+func TestCanonicalizeModelsMergesEngineNames(t *testing.T) {
+	server := &Server{}
+	models, local := server.CanonicalizeModels([]*public.Model{
+		{Name: "qwen3:8b-q4_K_M", Engine: "ollama"},
+		{Name: "Qwen/Qwen3-8B", Engine: "openai"},
+		{Name: "bge-m3", Engine: "ollama"},
+	})
+	if len(models) != 2 || models[0].Name != "qwen3-8b" || models[0].Quantization != "q4_k_m" || models[0].LocalName != "qwen3:8b-q4_K_M" {
+		t.Fatalf("models = %+v %+v", models[0], models[1])
+	}
+	if local["qwen3-8b"] != "qwen3:8b-q4_K_M" || local["bge-m3"] != "bge-m3" {
+		t.Fatalf("local names = %v", local)
+	}
+
+	// 再次上报时已规范化的模型保留 LocalName
+	again, _ := server.CanonicalizeModels(models)
+	if again[0].Name != "qwen3-8b" || again[0].LocalName != "qwen3:8b-q4_K_M" {
+		t.Fatalf("re-canonicalized = %+v", again[0])
+	}
+
+	load := CanonicalizeLoad(&public.ClientLoad{Models: []public.ModelLoad{{Model: "qwen3:8b-q4_K_M", Queued: 2}}}, models)
+	if ml, ok := load.Model("qwen3-8b"); !ok || ml.Queued != 2 {
+		t.Fatalf("load not keyed by canonical id: %+v", load.Models)
+	}
+}
+
+func TestMigrateCanonicalRuleModels(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	server := &Server{
+		DB:             db,
+		ModelCatalogDB: NewModelCatalogDB(db),
+		SystemConfigDB: NewSystemConfigDB(db),
+		UserPriceCapDB: NewUserPriceCapDB(db),
+		DiscountDB:     NewDiscountDB(db),
+	}
+	// 引入规范 ID 之前按原始名称保存的规则
+	server.UserPriceCapDB.Upsert("user-1", "Qwen/Qwen3-8B", 1, 2, 0)
+	server.UserPriceCapDB.Upsert("user-2", "qwen3:8b", 3, 4, 0)
+	server.UserPriceCapDB.Upsert("user-2", "qwen3-8b", 5, 6, 0)
+	server.DiscountDB.SaveDiscount(&ModelPrice{Scope: DiscountScopeTier, Tier: "gold", ModelName: "qwen3:8b", UserDiscountRate: 0.2})
+	server.DiscountDB.SaveDiscount(&ModelPrice{Scope: DiscountScopeTier, Tier: "gold", ModelName: "*", UserDiscountRate: 0.1})
+	server.SystemConfigDB.SetPriceCeiling(PriceCeiling{Model: "Qwen/Qwen3-8B", MaxIPPM: 7})
+
+	server.migrateCanonicalRuleModels()
+
+	if ippm, oppm, _ := server.UserPriceCapDB.GetPriceCap("user-1", "qwen3-8b"); ippm != 1 || oppm != 2 {
+		t.Fatalf("migrated price cap = %v/%v, want 1/2", ippm, oppm)
+	}
+	// 规范 ID 已有规则时保留已有规则
+	if ippm, _, _ := server.UserPriceCapDB.GetPriceCap("user-2", "qwen3-8b"); ippm != 5 {
+		t.Fatalf("existing canonical price cap = %v, want 5", ippm)
+	}
+	if caps, _ := server.UserPriceCapDB.GetByUser("user-2"); len(caps) != 1 {
+		t.Fatalf("user-2 has %d price caps after migration, want 1", len(caps))
+	}
+	rules, _ := server.DiscountDB.ListDiscounts(DiscountScopeTier, "")
+	names := map[string]bool{}
+	for _, r := range rules {
+		names[r.ModelName] = true
+	}
+	if len(rules) != 2 || !names["qwen3-8b"] || !names["*"] {
+		t.Fatalf("migrated discount models = %v, want qwen3-8b and *", names)
+	}
+	if c, ok := server.SystemConfigDB.GetPriceCeiling("qwen3-8b"); !ok || c.MaxIPPM != 7 {
+		t.Fatalf("migrated price ceiling = %+v, %v; want max_ippm 7", c, ok)
+	}
+	if _, ok := server.SystemConfigDB.GetPriceCeiling("Qwen/Qwen3-8B"); ok {
+		t.Fatal("raw price ceiling key should be removed")
+	}
+
+	// 迁移只执行一次
+	server.UserPriceCapDB.Upsert("user-3", "qwen3:8b", 1, 1, 0)
+	server.migrateCanonicalRuleModels()
+	if caps, _ := server.UserPriceCapDB.GetByUser("user-3"); len(caps) != 1 || caps[0].Model != "qwen3:8b" {
+		t.Fatalf("migration ran twice: %+v", caps)
+	}
+}
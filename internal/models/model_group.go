@@ -0,0 +1,282 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"star-fire/pkg/public"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AutoModel 内置的虚拟模型：没有同名分组时匹配所有在线模型，按报价从低到高尝试
+const AutoModel = "auto"
+
+// ModelGroup 路由分组（虚拟模型）。请求的 model 为分组名时，按有序回退列表或能力查询得到的候选模型依次尝试。
+// UserID 为空的分组由管理员定义，对所有用户可见；用户自己定义的同名分组优先。
+type ModelGroup struct {
+	ID         uint     `gorm:"primaryKey" json:"id"`
+	UserID     string   `gorm:"uniqueIndex:idx_model_group_owner_name" json:"user_id,omitempty"`
+	Name       string   `gorm:"uniqueIndex:idx_model_group_owner_name;not null" json:"name"`
+	ModelsJSON string   `gorm:"column:models;type:text" json:"-"`
+	Models     []string `gorm:"-" json:"models,omitempty"` // 按顺序回退的候选模型，非空时忽略下面的查询条件
+
+	// 能力查询：匹配所有满足条件的在线模型，按最低报价从低到高尝试
+	MinParams          float64 `json:"min_params,omitempty"`    // 参数量下限（B），按模型名中的 7b、8b 等识别
+	MaxParams          float64 `json:"max_params,omitempty"`    // 参数量上限（B）
+	NameContains       string  `json:"name_contains,omitempty"` // 模型名须包含的关键字，如 instruct
+	MaxIPPM            float64 `gorm:"column:max_ippm" json:"max_ippm,omitempty"`
+	MaxOPPM            float64 `gorm:"column:max_oppm" json:"max_oppm,omitempty"`
+	RequireTools       bool    `json:"require_tools,omitempty"`
+	RequireVision      bool    `json:"require_vision,omitempty"`
+	RequireJSONSchema  bool    `json:"require_json_schema,omitempty"`
+	RequireReasoning   bool    `json:"require_reasoning,omitempty"`
+	RequireContextSize int     `json:"require_context_size,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AfterFind 解析候选模型列表
+func (g *ModelGroup) AfterFind(tx *gorm.DB) error {
+	if g.ModelsJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(g.ModelsJSON), &g.Models)
+}
+
+func (g *ModelGroup) requirements() public.Requirements {
+	return public.Requirements{
+		Tools:         g.RequireTools,
+		Vision:        g.RequireVision,
+		JSONSchema:    g.RequireJSONSchema,
+		Reasoning:     g.RequireReasoning,
+		ContextTokens: g.RequireContextSize,
+	}
+}
+
+// Constrain 把分组的价格上限和能力要求加到 opts 上：候选模型只会派发给满足分组条件的 client，
+// 能力要求与请求本身需要的能力合并
+func (g *ModelGroup) Constrain(opts RouteOptions) RouteOptions {
+	req := g.requirements()
+	opts.Requires.Tools = opts.Requires.Tools || req.Tools
+	opts.Requires.Vision = opts.Requires.Vision || req.Vision
+	opts.Requires.JSONSchema = opts.Requires.JSONSchema || req.JSONSchema
+	opts.Requires.Reasoning = opts.Requires.Reasoning || req.Reasoning
+	opts.Requires.ContextTokens = max(opts.Requires.ContextTokens, req.ContextTokens)
+	opts.MaxIPPM, opts.MaxOPPM = g.MaxIPPM, g.MaxOPPM
+	return opts
+}
+
+// ModelGroupDB 提供路由分组的读写方法，分组在内存中缓存一份供每次请求解析
+type ModelGroupDB struct {
+	db     *gorm.DB
+	mu     sync.RWMutex
+	groups map[string]ModelGroup // userID + "/" + name -> 分组
+}
+
+// NewModelGroupDB 初始化 ModelGroupDB 并加载路由分组
+func NewModelGroupDB(db *gorm.DB) *ModelGroupDB {
+	db.AutoMigrate(&ModelGroup{})
+	m := &ModelGroupDB{db: db, groups: make(map[string]ModelGroup)}
+	var list []ModelGroup
+	if err := db.Find(&list).Error; err != nil {
+		log.Printf("load model groups failed: %v", err)
+	}
+	for _, g := range list {
+		m.groups[groupKey(g.UserID, g.Name)] = g
+	}
+	return m
+}
+
+func groupKey(userID, name string) string {
+	return userID + "/" + name
+}
+
+// List 列出 userID 定义的路由分组，userID 为空时列出管理员定义的分组
+func (m *ModelGroupDB) List(userID string) ([]*ModelGroup, error) {
+	var list []*ModelGroup
+	err := m.db.Where("user_id = ?", userID).Order("name").Find(&list).Error
+	return list, err
+}
+
+// Save 新增或更新 group.UserID 下的同名路由分组
+func (m *ModelGroupDB) Save(group *ModelGroup) error {
+	group.Name = strings.ToLower(strings.TrimSpace(group.Name))
+	if group.Name == "" {
+		return errors.New("group name is required")
+	}
+	if group.MinParams < 0 || group.MaxParams < 0 || group.MaxIPPM < 0 || group.MaxOPPM < 0 || group.RequireContextSize < 0 {
+		return errors.New("query limits must be non-negative")
+	}
+	if group.MaxParams > 0 && group.MinParams > group.MaxParams {
+		return errors.New("min_params must not exceed max_params")
+	}
+	models := make([]string, 0, len(group.Models))
+	for _, name := range group.Models {
+		if name = strings.TrimSpace(name); name != "" {
+			models = append(models, name)
+		}
+	}
+	group.Models = models
+	data, err := json.Marshal(models)
+	if err != nil {
+		return err
+	}
+	group.ModelsJSON = string(data)
+
+	var existing ModelGroup
+	err = m.db.Where("user_id = ? AND name = ?", group.UserID, group.Name).First(&existing).Error
+	switch {
+	case err == nil:
+		group.ID, group.CreatedAt = existing.ID, existing.CreatedAt
+		err = m.db.Save(group).Error
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		err = m.db.Create(group).Error
+	}
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.groups[groupKey(group.UserID, group.Name)] = *group
+	m.mu.Unlock()
+	return nil
+}
+
+// Delete 删除 userID 下的路由分组，返回分组是否存在
+func (m *ModelGroupDB) Delete(userID, name string) (bool, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	result := m.db.Where("user_id = ? AND name = ?", userID, name).Delete(&ModelGroup{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	m.mu.Lock()
+	delete(m.groups, groupKey(userID, name))
+	m.mu.Unlock()
+	return result.RowsAffected > 0, nil
+}
+
+// Resolve 查找 userID 可用的路由分组：先找用户自己定义的，再找管理员定义的
+func (m *ModelGroupDB) Resolve(userID, name string) (*ModelGroup, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if userID != "" {
+		if g, ok := m.groups[groupKey(userID, name)]; ok {
+			return &g, true
+		}
+	}
+	if g, ok := m.groups[groupKey("", name)]; ok {
+		return &g, true
+	}
+	return nil, false
+}
+
+// ModelCandidates 解析请求的 model：为路由分组（或 auto）时返回按顺序尝试的规范模型名和分组，
+// 派发时须按分组的 Constrain 过滤 client；否则返回 nil 和 nil。
+func (s *Server) ModelCandidates(userID, model string) ([]string, *ModelGroup) {
+	var group *ModelGroup
+	if s.ModelGroupDB != nil {
+		group, _ = s.ModelGroupDB.Resolve(userID, model)
+	}
+	if group == nil {
+		if !strings.EqualFold(strings.TrimSpace(model), AutoModel) {
+			return nil, nil
+		}
+		group = &ModelGroup{Name: AutoModel}
+	}
+	if len(group.Models) > 0 {
+		candidates := make([]string, 0, len(group.Models))
+		seen := make(map[string]bool, len(group.Models))
+		for _, name := range group.Models {
+			canonical, _ := s.CanonicalModel(name)
+			if !seen[canonical] {
+				seen[canonical] = true
+				candidates = append(candidates, canonical)
+			}
+		}
+		return candidates, group
+	}
+	return s.queryModels(group, userID), group
+}
+
+// paramCount 模型名中的参数量，如 qwen3-8b -> 8、gpt-oss-20b -> 20，识别不出时返回 0
+var paramCount = regexp.MustCompile(`(?:^|[-_.])(\d+(?:\.\d+)?)b(?:$|[-_.])`)
+
+func modelParams(name string) float64 {
+	m := paramCount.FindStringSubmatch(name)
+	if m == nil {
+		return 0
+	}
+	v, _ := strconv.ParseFloat(m[1], 64)
+	return v
+}
+
+// queryModels 返回满足 group 查询条件的在线对话模型，按可用 client 的最低输出报价从低到高排序。
+// 价格超出调用方价格上限的 client 不计入，embedding 模型不参与匹配。
+func (s *Server) queryModels(group *ModelGroup, userID string) []string {
+	req := group.requirements()
+	keyword := strings.ToLower(group.NameContains)
+	type candidate struct {
+		model string
+		oppm  float64
+	}
+	var matched []candidate
+	allClients := s.clients.snapshot()
+	for model, clients := range allClients {
+		if isEmbeddingModelName(model) {
+			continue
+		}
+		if keyword != "" && !strings.Contains(model, keyword) {
+			continue
+		}
+		if group.MinParams > 0 || group.MaxParams > 0 {
+			params := modelParams(model)
+			if params == 0 || params < group.MinParams || (group.MaxParams > 0 && params > group.MaxParams) {
+				continue
+			}
+		}
+		maxIPPM, maxOPPM := math.MaxFloat64, math.MaxFloat64
+		if s.UserPriceCapDB != nil && userID != "" {
+			maxIPPM, maxOPPM, _ = s.UserPriceCapDB.GetPriceCap(userID, model)
+		}
+		if group.MaxIPPM > 0 {
+			maxIPPM = min(maxIPPM, group.MaxIPPM)
+		}
+		if group.MaxOPPM > 0 {
+			maxOPPM = min(maxOPPM, group.MaxOPPM)
+		}
+		best := math.MaxFloat64
+		for _, c := range clients {
+			if !clientHealthy(c, model) || !servesChat(c, model) || !capable(req)(c, model) {
+				continue
+			}
+			price, ok := c.PriceSnapshot(model)
+			if !ok || price.IPPM > maxIPPM || price.OPPM > maxOPPM {
+				continue
+			}
+			best = min(best, price.OPPM)
+		}
+		if best < math.MaxFloat64 {
+			matched = append(matched, candidate{model, best})
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].oppm != matched[j].oppm {
+			return matched[i].oppm < matched[j].oppm
+		}
+		return matched[i].model < matched[j].model
+	})
+	candidates := make([]string, len(matched))
+	for i, m := range matched {
+		candidates[i] = m.model
+	}
+	return candidates
+}
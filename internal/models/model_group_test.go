@@ -0,0 +1,109 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"star-fire/pkg/public"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+func TestModelCandidatesFallbackAndQuery(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	server := &Server{ModelGroupDB: NewModelGroupDB(db)}
+	online := func(id string, models ...*public.Model) *Client {
+		return &Client{ID: id, Status: "online", ControlConn: &websocket.Conn{}, Models: models}
+	}
+	cheap := online("cheap", &public.Model{Name: "qwen2.5-7b-instruct", OPPM: 1})
+	pricey := online("pricey", &public.Model{Name: "llama3.1-8b-instruct", OPPM: 1.5},
+		&public.Model{Name: "qwen3-8b", OPPM: 0.5})
+	big := online("big", &public.Model{Name: "qwen3-32b-instruct", OPPM: 0.8})
+	expensive := online("expensive", &public.Model{Name: "mistral-7b-instruct", OPPM: 5},
+		&public.Model{Name: "qwen2.5-7b-instruct", OPPM: 3})
+	embedding := online("embedding", &public.Model{Name: "bge-m3", Type: "embedding", OPPM: 0.1},
+		&public.Model{Name: "text-embedding-3-small", OPPM: 0.1})
+	server.clients.replace(map[string]map[string]*Client{
+		"qwen2.5-7b-instruct":    {"cheap": cheap, "expensive": expensive},
+		"bge-m3":                 {"embedding": embedding},
+		"text-embedding-3-small": {"embedding": embedding},
+		"llama3.1-8b-instruct":   {"pricey": pricey},
+		"qwen3-8b":               {"pricey": pricey},
+		"qwen3-32b-instruct":     {"big": big},
+		"mistral-7b-instruct":    {"expensive": expensive},
+	})
+
+	// 普通模型名不是分组
+	if _, group := server.ModelCandidates("u1", "qwen3-8b"); group != nil {
+		t.Fatal("plain model resolved as a group")
+	}
+
+	// 有序回退列表，按引擎名称书写的模型也规范化
+	if err := server.ModelGroupDB.Save(&ModelGroup{Name: "Fallback", Models: []string{"gpt-oss:20b", "Qwen/Qwen3-14B", "gpt-oss-20b"}}); err != nil {
+		t.Fatalf("save group: %v", err)
+	}
+	got, group := server.ModelCandidates("u1", "fallback")
+	if want := []string{"gpt-oss-20b", "qwen3-14b"}; group == nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("fallback candidates = %v, want %v", got, want)
+	}
+
+	// 能力查询：7–9B、名称含 instruct、输出价格不超过 2，按价格从低到高
+	if err := server.ModelGroupDB.Save(&ModelGroup{Name: "small", MinParams: 7, MaxParams: 9, NameContains: "instruct", MaxOPPM: 2}); err != nil {
+		t.Fatalf("save group: %v", err)
+	}
+	got, group = server.ModelCandidates("u1", "small")
+	if want := []string{"qwen2.5-7b-instruct", "llama3.1-8b-instruct"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("query candidates = %v, want %v", got, want)
+	}
+	// 分组的价格上限同样限制派发：超出上限的 client 不会被选中
+	for i := 0; i < 4; i++ {
+		if c, _ := server.LoadBalanceScored(got[0], "u1", 0, nil, group.Constrain(RouteOptions{Algorithm: LBRandom})); c == nil || c.ID != "cheap" {
+			t.Fatalf("group candidate routed to %+v, want cheap", c)
+		}
+	}
+
+	// 用户自己定义的同名分组优先，其他用户仍使用管理员的分组
+	if err := server.ModelGroupDB.Save(&ModelGroup{UserID: "u2", Name: "small", Models: []string{"qwen3-8b"}}); err != nil {
+		t.Fatalf("save group: %v", err)
+	}
+	if got, _ := server.ModelCandidates("u2", "small"); !reflect.DeepEqual(got, []string{"qwen3-8b"}) {
+		t.Fatalf("user group candidates = %v", got)
+	}
+	if got, _ := server.ModelCandidates("u1", "small"); len(got) != 2 {
+		t.Fatalf("admin group shadowed for another user: %v", got)
+	}
+
+	// 没有同名分组时 auto 匹配所有在线模型
+	// embedding 模型不参与匹配
+	got, group = server.ModelCandidates("u1", "auto")
+	if want := []string{"qwen3-8b", "qwen3-32b-instruct", "qwen2.5-7b-instruct", "llama3.1-8b-instruct", "mistral-7b-instruct"}; group == nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("auto candidates = %v, want %v", got, want)
+	}
+
+	// 重启后从数据库加载分组
+	reloaded := &Server{ModelGroupDB: NewModelGroupDB(db)}
+	if g, ok := reloaded.ModelGroupDB.Resolve("", "fallback"); !ok || len(g.Models) != 3 {
+		t.Fatalf("reloaded group = %+v", g)
+	}
+	if existed, err := reloaded.ModelGroupDB.Delete("u2", "small"); err != nil || !existed {
+		t.Fatalf("delete group = %v, %v", existed, err)
+	}
+	if g, ok := reloaded.ModelGroupDB.Resolve("u2", "small"); !ok || g.UserID != "" {
+		t.Fatalf("after delete u2 resolves %+v, want the admin group", g)
+	}
+}
+
+func TestModelParams(t *testing.T) {
+	for name, want := range map[string]float64{
+		"qwen3-8b": 8, "gpt-oss-20b": 20, "qwen3-30b-a3b": 30, "llama3.2-3.2b-instruct": 3.2, "bge-m3": 0,
+	} {
+		if got := modelParams(name); got != want {
+			t.Errorf("modelParams(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
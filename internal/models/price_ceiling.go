@@ -0,0 +1,187 @@
+package models
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"strings"
+
+	"star-fire/pkg/public"
+)
+
+// configKeyPriceCeilingPrefix 按模型设置的价格上限配置项前缀，key 为 price_ceiling:<model>，
+// <model> 为 "*" 时覆盖所有模型的默认上限（环境变量配置）
+const configKeyPriceCeilingPrefix = "price_ceiling:"
+
+// PriceCeilingAllModels 表示对所有模型生效的上限
+const PriceCeilingAllModels = "*"
+
+// PriceCeiling 模型价格上限（每百万 tokens），0 表示该项沿用上一级（全局或环境变量）的上限
+type PriceCeiling struct {
+	Model    string  `json:"model"`
+	MaxIPPM  float64 `json:"max_ippm"`
+	MaxOPPM  float64 `json:"max_oppm"`
+	MaxCIPPM float64 `json:"max_cippm"`
+	MaxRPPM  float64 `json:"max_rppm"`
+	MaxPPI   float64 `json:"max_ppi"`
+}
+
+// merge 用 fallback 补齐未设置的上限
+func (c PriceCeiling) merge(fallback PriceCeiling) PriceCeiling {
+	if c.MaxIPPM <= 0 {
+		c.MaxIPPM = fallback.MaxIPPM
+	}
+	if c.MaxOPPM <= 0 {
+		c.MaxOPPM = fallback.MaxOPPM
+	}
+	if c.MaxCIPPM <= 0 {
+		c.MaxCIPPM = fallback.MaxCIPPM
+	}
+	if c.MaxRPPM <= 0 {
+		c.MaxRPPM = fallback.MaxRPPM
+	}
+	if c.MaxPPI <= 0 {
+		c.MaxPPI = fallback.MaxPPI
+	}
+	return c
+}
+
+// GetPriceCeiling 读取 model 单独设置的上限，未设置返回 false。上限在每次心跳时读取，使用缓存
+func (s *SystemConfigDB) GetPriceCeiling(model string) (PriceCeiling, bool) {
+	var c PriceCeiling
+	ceilings, err := s.CachedByPrefix(configKeyPriceCeilingPrefix)
+	if err != nil {
+		log.Printf("load price ceilings failed: %v", err)
+		return c, false
+	}
+	raw, ok := ceilings[model]
+	if !ok {
+		return c, false
+	}
+	if err := json.Unmarshal([]byte(raw), &c); err != nil {
+		log.Printf("invalid price ceiling config for model %s: %v", model, err)
+		return c, false
+	}
+	c.Model = model
+	return c, true
+}
+
+// SetPriceCeiling 写入 model 的价格上限
+func (s *SystemConfigDB) SetPriceCeiling(c PriceCeiling) error {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.Set(configKeyPriceCeilingPrefix+c.Model, string(raw))
+}
+
+// DeletePriceCeiling 删除 model 的价格上限，返回是否存在
+func (s *SystemConfigDB) DeletePriceCeiling(model string) (bool, error) {
+	return s.Delete(configKeyPriceCeilingPrefix + model)
+}
+
+// ListPriceCeilings 列出所有单独设置的价格上限
+func (s *SystemConfigDB) ListPriceCeilings() ([]PriceCeiling, error) {
+	cfgs, err := s.ListByPrefix(configKeyPriceCeilingPrefix)
+	if err != nil {
+		return nil, err
+	}
+	ceilings := make([]PriceCeiling, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		var c PriceCeiling
+		if err := json.Unmarshal([]byte(cfg.Value), &c); err != nil {
+			continue
+		}
+		c.Model = strings.TrimPrefix(cfg.Key, configKeyPriceCeilingPrefix)
+		ceilings = append(ceilings, c)
+	}
+	return ceilings, nil
+}
+
+// PriceCeiling 返回 model 生效的价格上限：模型配置 → "*" 配置 → 环境变量，逐项回退。
+// 没有任何配置时为 math.MaxFloat64（不限制）。
+func (s *Server) PriceCeiling(model string) PriceCeiling {
+	ceiling := PriceCeiling{Model: model}
+	if s.SystemConfigDB != nil {
+		if c, ok := s.SystemConfigDB.GetPriceCeiling(model); ok {
+			ceiling = ceiling.merge(c)
+		}
+		if c, ok := s.SystemConfigDB.GetPriceCeiling(PriceCeilingAllModels); ok {
+			ceiling = ceiling.merge(c)
+		}
+	}
+	if s.Conf != nil {
+		ceiling = ceiling.merge(PriceCeiling{
+			MaxIPPM:  s.Conf.AllModelInputMaxPrice,
+			MaxOPPM:  s.Conf.AllModelOutPutMaxPrice,
+			MaxCIPPM: s.Conf.AllModelCachedInputMaxPrice,
+		})
+	}
+	return ceiling.merge(PriceCeiling{MaxIPPM: math.MaxFloat64, MaxOPPM: math.MaxFloat64, MaxCIPPM: math.MaxFloat64,
+		MaxRPPM: math.MaxFloat64, MaxPPI: math.MaxFloat64})
+}
+
+// ClampModelPrice 将模型报价限制在平台上限以内，返回是否有价格被下调
+func (s *Server) ClampModelPrice(m *public.Model) bool {
+	ceiling := s.PriceCeiling(m.Name)
+	clamped := false
+	if m.IPPM > ceiling.MaxIPPM {
+		log.Printf("model %s IPPM %.6f exceeds platform limit %.6f, clamped", m.Name, m.IPPM, ceiling.MaxIPPM)
+		m.IPPM = ceiling.MaxIPPM
+		clamped = true
+	}
+	if m.OPPM > ceiling.MaxOPPM {
+		log.Printf("model %s OPPM %.6f exceeds platform limit %.6f, clamped", m.Name, m.OPPM, ceiling.MaxOPPM)
+		m.OPPM = ceiling.MaxOPPM
+		clamped = true
+	}
+	if m.CIPPM > ceiling.MaxCIPPM {
+		log.Printf("model %s CIPPM %.6f exceeds platform limit %.6f, clamped", m.Name, m.CIPPM, ceiling.MaxCIPPM)
+		m.CIPPM = ceiling.MaxCIPPM
+		clamped = true
+	}
+	if m.RPPM > ceiling.MaxRPPM {
+		log.Printf("model %s RPPM %.6f exceeds platform limit %.6f, clamped", m.Name, m.RPPM, ceiling.MaxRPPM)
+		m.RPPM = ceiling.MaxRPPM
+		clamped = true
+	}
+	if m.PPI > ceiling.MaxPPI {
+		log.Printf("model %s PPI %.6f exceeds platform limit %.6f, clamped", m.Name, m.PPI, ceiling.MaxPPI)
+		m.PPI = ceiling.MaxPPI
+		clamped = true
+	}
+	for i := range m.PriceTiers {
+		t := &m.PriceTiers[i]
+		if t.IPPM > ceiling.MaxIPPM || t.OPPM > ceiling.MaxOPPM || t.CIPPM > ceiling.MaxCIPPM {
+			log.Printf("model %s price tier >=%d tokens exceeds platform limit, clamped", m.Name, t.MinPromptTokens)
+			t.IPPM = min(t.IPPM, ceiling.MaxIPPM)
+			t.OPPM = min(t.OPPM, ceiling.MaxOPPM)
+			t.CIPPM = min(t.CIPPM, ceiling.MaxCIPPM)
+			clamped = true
+		}
+	}
+	return clamped
+}
+
+// PushModelPrice 将模型的当前价格推送给 client，使其本地配置与平台保持一致
+func PushModelPrice(client *Client, m *public.Model) {
+	client.ControlConnMutex.Lock()
+	defer client.ControlConnMutex.Unlock()
+	if client.ControlConn == nil {
+		return
+	}
+	if err := client.ControlConn.WriteJSON(public.WSMessage{
+		Type: public.MODEL_PRICE_UPDATE,
+		Content: public.ModelPriceUpdate{
+			Model: m.Name,
+			IPPM:  m.IPPM,
+			OPPM:  m.OPPM,
+			CIPPM: m.CIPPM,
+			RPPM:  m.RPPM,
+			PPI:   m.PPI,
+			Tiers: m.PriceTiers,
+		},
+	}); err != nil {
+		log.Printf("push model price update to client %s failed: %v", client.ID, err)
+	}
+}
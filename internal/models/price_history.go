@@ -0,0 +1,278 @@
+package models
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"star-fire/pkg/public"
+
+	"gorm.io/gorm"
+)
+
+// PriceHistory 每个 client 每个模型的价格变更记录，EffectiveAt 起生效直到下一条记录
+type PriceHistory struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	ClientID    string    `gorm:"index:idx_price_history_client_model;not null" json:"client_id"`
+	ProviderID  string    `gorm:"index" json:"provider_id"`
+	Model       string    `gorm:"index:idx_price_history_client_model;index:idx_price_history_model_time;not null" json:"model"`
+	IPPM        float64   `gorm:"column:ippm;not null" json:"ippm"`
+	OPPM        float64   `gorm:"column:oppm;not null" json:"oppm"`
+	CIPPM       float64   `gorm:"column:cippm;not null" json:"cippm"`
+	RPPM        float64   `gorm:"column:rppm;not null;default:0" json:"rppm"`
+	PPI         float64   `gorm:"column:ppi;not null;default:0" json:"ppi"`
+	Offline     bool      `gorm:"not null;default:false" json:"offline"` // client 下线，之后不再计入走势直到重新报价
+	EffectiveAt time.Time `gorm:"index:idx_price_history_model_time;not null" json:"effective_at"`
+}
+
+// PriceSnapshot 派发请求时记录的 client 报价，整个请求（包括流式响应）都按该价格计费
+type PriceSnapshot struct {
+	IPPM  float64
+	OPPM  float64
+	CIPPM float64
+	RPPM  float64 // 推理tokens价格，未单独设置时等于 OPPM
+	PPI   float64 // 每张输入图片的价格
+	At    time.Time
+
+	tiers        []public.PriceTier // 长上下文阶梯价格，提示长度在计费时才确定
+	rppmFromOPPM bool               // 推理价格未单独设置，随输出价格变化
+}
+
+// PriceSnapshot 读取 client 当前对 model 的报价
+func (c *Client) PriceSnapshot(model string) (PriceSnapshot, bool) {
+	c.modelsMu.RLock()
+	defer c.modelsMu.RUnlock()
+	for _, m := range c.Models {
+		if m.Name == model {
+			p := PriceSnapshot{IPPM: m.IPPM, OPPM: m.OPPM, CIPPM: m.CIPPM, RPPM: m.RPPM, PPI: m.PPI, At: time.Now(),
+				tiers: append([]public.PriceTier(nil), m.PriceTiers...)}
+			if p.RPPM <= 0 {
+				p.RPPM, p.rppmFromOPPM = m.OPPM, true
+			}
+			return p, true
+		}
+	}
+	return PriceSnapshot{At: time.Now()}, false
+}
+
+// ForPrompt 返回提示长度为 promptTokens 时适用阶梯的价格
+func (p PriceSnapshot) ForPrompt(promptTokens int) PriceSnapshot {
+	m := public.Model{IPPM: p.IPPM, OPPM: p.OPPM, CIPPM: p.CIPPM, PriceTiers: p.tiers}
+	p.IPPM, p.OPPM, p.CIPPM = m.PriceFor(promptTokens)
+	if p.rppmFromOPPM {
+		p.RPPM = p.OPPM
+	}
+	return p
+}
+
+// Discounted 返回按折扣率 rate 打折后的价格
+func (p PriceSnapshot) Discounted(rate float64) PriceSnapshot {
+	if rate <= 0 {
+		return p
+	}
+	p.IPPM *= 1 - rate
+	p.OPPM *= 1 - rate
+	p.CIPPM *= 1 - rate
+	p.RPPM *= 1 - rate
+	p.PPI *= 1 - rate
+	return p
+}
+
+// Cost 按快照价格计算费用。推理tokens包含在 output 中，按 RPPM 计价；图片按张额外计价。
+func (p PriceSnapshot) Cost(input, cached, output, reasoning, images int) float64 {
+	cost := (float64(input-cached)*p.IPPM + float64(cached)*p.CIPPM +
+		float64(output-reasoning)*p.OPPM + float64(reasoning)*p.RPPM) / 1000000
+	cost += float64(images) * p.PPI
+	if cost < 0 {
+		return 0
+	}
+	return cost
+}
+
+// PricePoint 价格走势图上的一个点：该时刻各 client 最近一次报价的统计
+type PricePoint struct {
+	Time     time.Time `json:"time"`
+	Clients  int       `json:"clients"`
+	MinIPPM  float64   `json:"min_ippm"`
+	AvgIPPM  float64   `json:"avg_ippm"`
+	MaxIPPM  float64   `json:"max_ippm"`
+	MinOPPM  float64   `json:"min_oppm"`
+	AvgOPPM  float64   `json:"avg_oppm"`
+	MaxOPPM  float64   `json:"max_oppm"`
+	MinCIPPM float64   `json:"min_cippm"`
+	AvgCIPPM float64   `json:"avg_cippm"`
+	MaxCIPPM float64   `json:"max_cippm"`
+}
+
+// MaxPricePoints 单次查询最多返回的点数
+const MaxPricePoints = 1000
+
+type priceKey struct {
+	clientID string
+	model    string
+}
+
+type priceValue struct {
+	ippm, oppm, cippm, rppm, ppi float64
+}
+
+// PriceHistoryDB 记录价格变更；内存中缓存每个 client/模型的最新价格，只有价格变化时才写库
+type PriceHistoryDB struct {
+	db   *gorm.DB
+	mu   sync.Mutex
+	last map[priceKey]priceValue
+}
+
+// NewPriceHistoryDB 初始化 PriceHistoryDB
+func NewPriceHistoryDB(db *gorm.DB) *PriceHistoryDB {
+	db.AutoMigrate(&PriceHistory{})
+	return &PriceHistoryDB{db: db, last: make(map[priceKey]priceValue)}
+}
+
+// Record 记录 client 对 m 的报价，与上一次不同时写入一条历史，返回是否写入
+func (p *PriceHistoryDB) Record(clientID, providerID string, m *public.Model) (bool, error) {
+	key := priceKey{clientID: clientID, model: m.Name}
+	value := priceValue{ippm: m.IPPM, oppm: m.OPPM, cippm: m.CIPPM, rppm: m.RPPM, ppi: m.PPI}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prev, ok := p.last[key]
+	if !ok {
+		var latest PriceHistory
+		err := p.db.Where("client_id = ? AND model = ?", clientID, m.Name).Order("effective_at DESC, id DESC").First(&latest).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, err
+		}
+		if err == nil && !latest.Offline {
+			prev, ok = priceValue{ippm: latest.IPPM, oppm: latest.OPPM, cippm: latest.CIPPM, rppm: latest.RPPM, ppi: latest.PPI}, true
+		}
+	}
+	if ok && prev == value {
+		p.last[key] = value
+		return false, nil
+	}
+
+	if err := p.db.Create(&PriceHistory{
+		ClientID:    clientID,
+		ProviderID:  providerID,
+		Model:       m.Name,
+		IPPM:        m.IPPM,
+		OPPM:        m.OPPM,
+		CIPPM:       m.CIPPM,
+		RPPM:        m.RPPM,
+		PPI:         m.PPI,
+		EffectiveAt: time.Now(),
+	}).Error; err != nil {
+		return false, err
+	}
+	p.last[key] = value
+	return true, nil
+}
+
+// RecordOffline 记录 client 下线，其报价从下线时刻起不再计入价格走势
+func (p *PriceHistoryDB) RecordOffline(clientID, providerID string, models []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, model := range models {
+		if err := p.db.Create(&PriceHistory{
+			ClientID: clientID, ProviderID: providerID, Model: model, Offline: true, EffectiveAt: now,
+		}).Error; err != nil {
+			return err
+		}
+		// 重新上线时即使价格未变也要写入一条记录
+		delete(p.last, priceKey{clientID: clientID, model: model})
+	}
+	return nil
+}
+
+// GetPriceChart 按 interval 采样 model 在 [start, end] 内的价格走势，
+// 每个点统计各 client 在该时刻生效的报价（最近一次变更）
+func (p *PriceHistoryDB) GetPriceChart(model string, start, end time.Time, interval time.Duration) ([]*PricePoint, error) {
+	if interval <= 0 || !end.After(start) {
+		return nil, errors.New("invalid time range or interval")
+	}
+	if int(end.Sub(start)/interval) >= MaxPricePoints {
+		return nil, errors.New("too many points, use a larger interval")
+	}
+
+	// 只读取每个 client 在 start 时生效的最后一条记录和 (start, end] 内的变更
+	latest := p.db.Model(&PriceHistory{}).Select("MAX(id)").
+		Where("model = ? AND effective_at <= ?", model, start).Group("client_id")
+	var rows []*PriceHistory
+	if err := p.db.Where("model = ? AND ((effective_at > ? AND effective_at <= ?) OR id IN (?))", model, start, end, latest).
+		Order("effective_at, id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]*PriceHistory)
+	next := 0
+	var points []*PricePoint
+	for t := start; !t.After(end); t = t.Add(interval) {
+		for next < len(rows) && !rows[next].EffectiveAt.After(t) {
+			if row := rows[next]; row.Offline {
+				delete(current, row.ClientID)
+			} else {
+				current[row.ClientID] = row
+			}
+			next++
+		}
+		points = append(points, pricePointAt(t, current))
+	}
+	return points, nil
+}
+
+func pricePointAt(t time.Time, current map[string]*PriceHistory) *PricePoint {
+	point := &PricePoint{Time: t, Clients: len(current)}
+	if len(current) == 0 {
+		return point
+	}
+	first := true
+	for _, h := range current {
+		if first {
+			point.MinIPPM, point.MaxIPPM = h.IPPM, h.IPPM
+			point.MinOPPM, point.MaxOPPM = h.OPPM, h.OPPM
+			point.MinCIPPM, point.MaxCIPPM = h.CIPPM, h.CIPPM
+			first = false
+		}
+		point.MinIPPM, point.MaxIPPM = min(point.MinIPPM, h.IPPM), max(point.MaxIPPM, h.IPPM)
+		point.MinOPPM, point.MaxOPPM = min(point.MinOPPM, h.OPPM), max(point.MaxOPPM, h.OPPM)
+		point.MinCIPPM, point.MaxCIPPM = min(point.MinCIPPM, h.CIPPM), max(point.MaxCIPPM, h.CIPPM)
+		point.AvgIPPM += h.IPPM
+		point.AvgOPPM += h.OPPM
+		point.AvgCIPPM += h.CIPPM
+	}
+	n := float64(len(current))
+	point.AvgIPPM /= n
+	point.AvgOPPM /= n
+	point.AvgCIPPM /= n
+	return point
+}
+
+// recordPrice 记录 client 上报的模型价格（失败只记录日志，不影响注册）
+func (s *Server) recordPrice(m *public.Model, client *Client) {
+	if s.PriceHistoryDB == nil {
+		return
+	}
+	if _, err := s.PriceHistoryDB.Record(client.ID, client.UserID, m); err != nil {
+		log.Printf("record price history for client %s model %s failed: %v", client.ID, m.Name, err)
+	}
+}
+
+// recordOffline 记录 client 下线（失败只记录日志）
+func (s *Server) recordOffline(client *Client) {
+	if s.PriceHistoryDB == nil {
+		return
+	}
+	client.modelsMu.RLock()
+	names := make([]string, 0, len(client.Models))
+	for _, m := range client.Models {
+		names = append(names, m.Name)
+	}
+	client.modelsMu.RUnlock()
+	if err := s.PriceHistoryDB.RecordOffline(client.ID, client.UserID, names); err != nil {
+		log.Printf("record offline price history for client %s failed: %v", client.ID, err)
+	}
+}
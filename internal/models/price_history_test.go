@@ -0,0 +1,111 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"star-fire/pkg/public"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestPriceHistoryRecordsChangesAndBuildsChart(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	historyDB := NewPriceHistoryDB(db)
+
+	if written, err := historyDB.Record("client-1", "provider-1", &public.Model{Name: "model-a", IPPM: 1, OPPM: 2, CIPPM: 0.5}); err != nil || !written {
+		t.Fatalf("first record written=%v err=%v, want true", written, err)
+	}
+	if written, _ := historyDB.Record("client-1", "provider-1", &public.Model{Name: "model-a", IPPM: 1, OPPM: 2, CIPPM: 0.5}); written {
+		t.Fatal("unchanged price recorded again")
+	}
+	// 重启后缓存为空，应从数据库读取最近价格判断是否变化
+	if written, _ := NewPriceHistoryDB(db).Record("client-1", "provider-1", &public.Model{Name: "model-a", IPPM: 1, OPPM: 2, CIPPM: 0.5}); written {
+		t.Fatal("unchanged price recorded again after restart")
+	}
+
+	// 构造确定的生效时间
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.Model(&PriceHistory{}).Where("client_id = ?", "client-1").Update("effective_at", base)
+	if _, err := historyDB.Record("client-2", "provider-2", &public.Model{Name: "model-a", IPPM: 3, OPPM: 4, CIPPM: 1}); err != nil {
+		t.Fatalf("record client-2: %v", err)
+	}
+	db.Model(&PriceHistory{}).Where("client_id = ?", "client-2").Update("effective_at", base.Add(2*time.Hour))
+	if written, _ := historyDB.Record("client-1", "provider-1", &public.Model{Name: "model-a", IPPM: 2, OPPM: 2, CIPPM: 0.5}); !written {
+		t.Fatal("price change not recorded")
+	}
+	db.Model(&PriceHistory{}).Where("client_id = ? AND ippm = ?", "client-1", 2).Update("effective_at", base.Add(3*time.Hour))
+
+	points, err := historyDB.GetPriceChart("model-a", base.Add(time.Hour), base.Add(3*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatalf("get chart: %v", err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("points = %d, want 3", len(points))
+	}
+	if p := points[0]; p.Clients != 1 || p.MinIPPM != 1 || p.MaxIPPM != 1 {
+		t.Fatalf("point 0 = %+v, want only client-1 at 1", p)
+	}
+	if p := points[1]; p.Clients != 2 || p.MinIPPM != 1 || p.MaxIPPM != 3 || p.AvgIPPM != 2 {
+		t.Fatalf("point 1 = %+v, want ippm 1..3 avg 2", p)
+	}
+	if p := points[2]; p.MinIPPM != 2 || p.MaxOPPM != 4 || p.AvgCIPPM != 0.75 {
+		t.Fatalf("point 2 = %+v, want client-1 repriced to 2", p)
+	}
+
+	if _, err := historyDB.GetPriceChart("model-a", base, base.Add(24*time.Hour), time.Second); err == nil {
+		t.Fatal("expected error for too many points")
+	}
+
+	// 下线的 client 不再计入走势，重新上线时即使价格未变也重新记录
+	if err := historyDB.RecordOffline("client-2", "provider-2", []string{"model-a"}); err != nil {
+		t.Fatalf("record offline: %v", err)
+	}
+	db.Model(&PriceHistory{}).Where("client_id = ? AND offline = ?", "client-2", true).Update("effective_at", base.Add(4*time.Hour))
+	points, err = historyDB.GetPriceChart("model-a", base.Add(3*time.Hour), base.Add(4*time.Hour), time.Hour)
+	if err != nil {
+		t.Fatalf("get chart after offline: %v", err)
+	}
+	if points[0].Clients != 2 || points[1].Clients != 1 || points[1].MaxIPPM != 2 {
+		t.Fatalf("points after offline = %+v, %+v, want client-2 dropped", points[0], points[1])
+	}
+	if written, _ := historyDB.Record("client-2", "provider-2", &public.Model{Name: "model-a", IPPM: 3, OPPM: 4, CIPPM: 1}); !written {
+		t.Fatal("price after reconnect not recorded")
+	}
+}
+
+func TestPriceSnapshotBillsReasoningAndImages(t *testing.T) {
+	client := &Client{Models: []*public.Model{
+		{Name: "reasoner", IPPM: 1, OPPM: 2, CIPPM: 0.5, RPPM: 8, PPI: 0.01},
+		{Name: "plain", IPPM: 1, OPPM: 2},
+	}}
+
+	price, ok := client.PriceSnapshot("reasoner")
+	if !ok {
+		t.Fatal("snapshot for reasoner not found")
+	}
+	// 1000 输入（200 缓存）、500 输出（其中 300 推理）、2 张图片
+	want := (800*1+200*0.5+200*2+300*8)/1e6 + 2*0.01
+	if got := price.Cost(1000, 200, 500, 300, 2); math.Abs(got-want) > 1e-12 {
+		t.Fatalf("cost = %v, want %v", got, want)
+	}
+	if got := price.Discounted(0.5).Cost(1000, 200, 500, 300, 2); math.Abs(got-want/2) > 1e-12 {
+		t.Fatalf("discounted cost = %v, want %v", got, want/2)
+	}
+
+	// 未设置推理价格时推理tokens按输出价格计费
+	plain, _ := client.PriceSnapshot("plain")
+	if plain.RPPM != 2 {
+		t.Fatalf("plain RPPM = %v, want fallback to OPPM 2", plain.RPPM)
+	}
+	usage := TokenUsage{InputTokens: 1000, CachedTokens: 200, OutputTokens: 500, ReasoningTokens: 300, ImageCount: 2,
+		IPPM: price.IPPM, CIPPM: price.CIPPM, OPPM: price.OPPM, RPPM: price.RPPM, PPI: price.PPI}
+	if got := usage.GrossIncome(); math.Abs(got-want) > 1e-12 {
+		t.Fatalf("gross income = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,347 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 兑换码类型
+const (
+	PromoTypeFixed      = "fixed"      // 固定金额
+	PromoTypePercentage = "percentage" // 按消费比例抵扣
+)
+
+var (
+	ErrPromoCodeNotFound  = errors.New("promo code not found")
+	ErrPromoCodeInactive  = errors.New("promo code is inactive")
+	ErrPromoCodeExpired   = errors.New("promo code has expired")
+	ErrPromoCodeExhausted = errors.New("promo code has been fully redeemed")
+	ErrPromoCodeUserLimit = errors.New("promo code redemption limit reached for this user")
+)
+
+// PromoCode 管理员创建的兑换码。
+//   - fixed：Amount 为赠送金额（元）。不限模型时兑换即到账；限定模型时发放为只能抵扣这些模型消费的优惠券。
+//   - percentage：Amount 为抵扣比例（0-100），MaxDiscount 为单次兑换可抵扣的总上限（元），发放为优惠券。
+type PromoCode struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	Code           string     `gorm:"uniqueIndex;not null" json:"code"`
+	Type           string     `gorm:"not null" json:"type"`
+	Amount         float64    `gorm:"not null" json:"amount"`
+	MaxDiscount    float64    `gorm:"not null;default:0" json:"max_discount"`
+	Models         string     `json:"models"`                                    // 逗号分隔的可用模型，空表示不限
+	MaxRedemptions int        `gorm:"not null;default:0" json:"max_redemptions"` // 总兑换次数上限，0 表示不限
+	Redeemed       int        `gorm:"not null;default:0" json:"redeemed"`
+	PerUserLimit   int        `gorm:"not null;default:1" json:"per_user_limit"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	Active         bool       `gorm:"not null;default:true" json:"active"`
+	CreatedBy      string     `json:"created_by"`
+	Note           string     `json:"note"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// PromoRedemption 兑换记录，用于统计每个用户的兑换次数
+type PromoRedemption struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	PromoCodeID uint      `gorm:"index:idx_promo_redemption_code_user;not null" json:"promo_code_id"`
+	UserID      string    `gorm:"index:idx_promo_redemption_code_user;not null" json:"user_id"`
+	Code        string    `gorm:"not null" json:"code"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// UserCoupon 兑换后发放到用户账户的优惠券，消费时按模型自动抵扣
+type UserCoupon struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    string     `gorm:"index;not null" json:"user_id"`
+	Code      string     `gorm:"not null" json:"code"`
+	Type      string     `gorm:"not null" json:"type"`
+	Percent   float64    `gorm:"not null;default:0" json:"percent"` // percentage 类型的抵扣比例
+	Remaining float64    `gorm:"not null" json:"remaining"`         // 剩余可抵扣金额（元）
+	Models    string     `json:"models"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// RedeemResult 兑换结果
+type RedeemResult struct {
+	Code    string      `json:"code"`
+	Type    string      `json:"type"`
+	Granted float64     `json:"granted"` // 直接到账金额
+	Coupon  *UserCoupon `json:"coupon,omitempty"`
+	Balance float64     `json:"balance"`
+}
+
+// PromoCodeDB 提供兑换码、兑换记录与优惠券的读写方法
+type PromoCodeDB struct {
+	db *gorm.DB
+}
+
+// NewPromoCodeDB 初始化 PromoCodeDB
+func NewPromoCodeDB(db *gorm.DB) *PromoCodeDB {
+	db.AutoMigrate(&PromoCode{}, &PromoRedemption{}, &UserCoupon{})
+	return &PromoCodeDB{db: db}
+}
+
+// NormalizePromoCode 兑换码统一去空格并转大写
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// modelAllowed 判断逗号分隔的模型列表是否包含 model，空列表表示不限
+func modelAllowed(models, model string) bool {
+	if strings.TrimSpace(models) == "" {
+		return true
+	}
+	for _, m := range strings.Split(models, ",") {
+		if strings.TrimSpace(m) == model {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatePromoCode 创建兑换码
+func (p *PromoCodeDB) CreatePromoCode(code *PromoCode) error {
+	code.Code = NormalizePromoCode(code.Code)
+	if code.PerUserLimit <= 0 {
+		code.PerUserLimit = 1
+	}
+	return p.db.Create(code).Error
+}
+
+// GetPromoCode 按兑换码查询
+func (p *PromoCodeDB) GetPromoCode(code string) (*PromoCode, error) {
+	var promo PromoCode
+	if err := p.db.Where("code = ?", NormalizePromoCode(code)).First(&promo).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPromoCodeNotFound
+		}
+		return nil, err
+	}
+	return &promo, nil
+}
+
+// ListPromoCodes 分页列出兑换码
+func (p *PromoCodeDB) ListPromoCodes(page, size int) ([]*PromoCode, int64, error) {
+	var codes []*PromoCode
+	var total int64
+	if err := p.db.Model(&PromoCode{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	offset := (page - 1) * size
+	result := p.db.Order("created_at DESC").Offset(offset).Limit(size).Find(&codes)
+	return codes, total, result.Error
+}
+
+// UpdatePromoCode 保存兑换码的可编辑字段（已兑换次数不受影响）
+func (p *PromoCodeDB) UpdatePromoCode(code *PromoCode) error {
+	return p.db.Model(&PromoCode{}).Where("id = ?", code.ID).Updates(map[string]interface{}{
+		"amount":          code.Amount,
+		"max_discount":    code.MaxDiscount,
+		"models":          code.Models,
+		"max_redemptions": code.MaxRedemptions,
+		"per_user_limit":  code.PerUserLimit,
+		"expires_at":      code.ExpiresAt,
+		"active":          code.Active,
+		"note":            code.Note,
+	}).Error
+}
+
+// DeactivatePromoCode 停用兑换码（保留记录以便对账）
+func (p *PromoCodeDB) DeactivatePromoCode(code string) error {
+	result := p.db.Model(&PromoCode{}).Where("code = ?", NormalizePromoCode(code)).Update("active", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPromoCodeNotFound
+	}
+	return nil
+}
+
+// Redeem 用户兑换兑换码。校验状态、有效期、总次数与单用户次数后，
+// 不限模型的固定金额直接到账并写入余额流水，其余类型发放为优惠券。
+func (p *PromoCodeDB) Redeem(userID, code string) (*RedeemResult, error) {
+	result := &RedeemResult{}
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		var promo PromoCode
+		if err := tx.Where("code = ?", NormalizePromoCode(code)).First(&promo).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPromoCodeNotFound
+			}
+			return err
+		}
+		if !promo.Active {
+			return ErrPromoCodeInactive
+		}
+		if promo.ExpiresAt != nil && time.Now().After(*promo.ExpiresAt) {
+			return ErrPromoCodeExpired
+		}
+
+		var used int64
+		if err := tx.Model(&PromoRedemption{}).
+			Where("promo_code_id = ? AND user_id = ?", promo.ID, userID).
+			Count(&used).Error; err != nil {
+			return err
+		}
+		if promo.PerUserLimit > 0 && used >= int64(promo.PerUserLimit) {
+			return ErrPromoCodeUserLimit
+		}
+
+		// 条件更新防止并发超发
+		update := tx.Model(&PromoCode{}).
+			Where("id = ? AND (max_redemptions = 0 OR redeemed < max_redemptions)", promo.ID).
+			Update("redeemed", gorm.Expr("redeemed + 1"))
+		if update.Error != nil {
+			return update.Error
+		}
+		if update.RowsAffected == 0 {
+			return ErrPromoCodeExhausted
+		}
+
+		if err := tx.Create(&PromoRedemption{PromoCodeID: promo.ID, UserID: userID, Code: promo.Code}).Error; err != nil {
+			return err
+		}
+
+		result.Code = promo.Code
+		result.Type = promo.Type
+		if promo.Type == PromoTypeFixed && strings.TrimSpace(promo.Models) == "" {
+			record, err := grantBalanceTx(tx, userID, promo.Amount, BalanceTypePromo, promo.Code, "兑换码赠送")
+			if err != nil {
+				return err
+			}
+			result.Granted = promo.Amount
+			result.Balance = record.BalanceAfter
+			return nil
+		}
+
+		coupon := &UserCoupon{
+			UserID:    userID,
+			Code:      promo.Code,
+			Type:      promo.Type,
+			Remaining: promo.Amount,
+			Models:    promo.Models,
+			ExpiresAt: promo.ExpiresAt,
+		}
+		if promo.Type == PromoTypePercentage {
+			coupon.Percent = promo.Amount
+			coupon.Remaining = promo.MaxDiscount
+		}
+		if err := tx.Create(coupon).Error; err != nil {
+			return err
+		}
+		result.Coupon = coupon
+
+		var user User
+		if err := tx.Select("balance").Where("id = ?", userID).First(&user).Error; err != nil {
+			return err
+		}
+		result.Balance = user.Balance
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// usableCouponsQuery 返回用户当前仍可用的优惠券查询
+func (p *PromoCodeDB) usableCouponsQuery(tx *gorm.DB, userID string) *gorm.DB {
+	return tx.Where("user_id = ? AND remaining > 0 AND (expires_at IS NULL OR expires_at > ?)", userID, time.Now())
+}
+
+// GetUserCoupons 获取用户仍可用的优惠券
+func (p *PromoCodeDB) GetUserCoupons(userID string) ([]*UserCoupon, error) {
+	var coupons []*UserCoupon
+	err := p.usableCouponsQuery(p.db, userID).Order("created_at DESC").Find(&coupons).Error
+	return coupons, err
+}
+
+// HasUsableCoupon 判断用户是否有可用于该模型的优惠券（用于余额预检查）
+func (p *PromoCodeDB) HasUsableCoupon(userID, model string) bool {
+	coupons, err := p.GetUserCoupons(userID)
+	if err != nil {
+		return false
+	}
+	for _, c := range coupons {
+		if modelAllowed(c.Models, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyCoupons 按到期时间先后使用用户的优惠券抵扣本次消费 cost。
+// 抵扣金额以 coupon 类型流水计入余额，随后由调用方按原价扣费，保证流水与余额一致。
+func (p *PromoCodeDB) ApplyCoupons(userID, model, requestID string, cost float64) (float64, error) {
+	var discount float64
+	err := p.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		discount, err = p.applyCouponsTx(tx, userID, model, requestID, cost)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return discount, nil
+}
+
+// applyCouponsTx 在 tx 中执行 ApplyCoupons。扣减优惠券余额时要求剩余额度仍然足够，
+// 并发请求已用掉该券时跳过它
+func (p *PromoCodeDB) applyCouponsTx(tx *gorm.DB, userID, model, requestID string, cost float64) (float64, error) {
+	if cost <= 0 {
+		return 0, nil
+	}
+	var coupons []*UserCoupon
+	if err := p.usableCouponsQuery(tx, userID).
+		Order("expires_at IS NULL, expires_at ASC, id ASC").
+		Find(&coupons).Error; err != nil {
+		return 0, err
+	}
+
+	var discount float64
+	left := cost
+	for _, c := range coupons {
+		if left <= 0 {
+			break
+		}
+		if !modelAllowed(c.Models, model) {
+			continue
+		}
+		d := left
+		if c.Type == PromoTypePercentage {
+			d = cost * c.Percent / 100
+			if d > left {
+				d = left
+			}
+		}
+		d = math.Min(d, c.Remaining)
+		if d <= 0 {
+			continue
+		}
+		result := tx.Model(&UserCoupon{}).Where("id = ? AND remaining >= ?", c.ID, d).
+			Update("remaining", gorm.Expr("remaining - ?", d))
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		left -= d
+		discount += d
+	}
+	if discount <= 0 {
+		return 0, nil
+	}
+	if _, err := grantBalanceTx(tx, userID, discount, BalanceTypeCoupon, requestID,
+		fmt.Sprintf("优惠券抵扣 %s", model)); err != nil {
+		return 0, err
+	}
+	return discount, nil
+}
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func newPromoTestDB(t *testing.T) (*gorm.DB, *PromoCodeDB, *UserDB) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	userDB := NewUserDB(db)
+	NewBalanceHistoryDB(db)
+	if err := db.Create(&User{ID: "user-1", Email: "u1@example.com", Username: "u1"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return db, NewPromoCodeDB(db), userDB
+}
+
+func TestRedeemFixedPromoCodeEnforcesLimits(t *testing.T) {
+	db, promoDB, userDB := newPromoTestDB(t)
+	if err := promoDB.CreatePromoCode(&PromoCode{
+		Code: "welcome", Type: PromoTypeFixed, Amount: 5, MaxRedemptions: 1, PerUserLimit: 1, Active: true,
+	}); err != nil {
+		t.Fatalf("create promo code: %v", err)
+	}
+
+	result, err := promoDB.Redeem("user-1", " Welcome ")
+	if err != nil {
+		t.Fatalf("redeem: %v", err)
+	}
+	if result.Granted != 5 || result.Balance != 5 {
+		t.Fatalf("redeem result: got granted=%v balance=%v, want 5/5", result.Granted, result.Balance)
+	}
+	if balance, _, _ := userDB.GetBalance("user-1"); balance != 5 {
+		t.Fatalf("balance: got %v, want 5", balance)
+	}
+
+	if _, err := promoDB.Redeem("user-1", "WELCOME"); !errors.Is(err, ErrPromoCodeUserLimit) {
+		t.Fatalf("second redeem: got %v, want ErrPromoCodeUserLimit", err)
+	}
+
+	if err := db.Create(&User{ID: "user-2", Email: "u2@example.com", Username: "u2"}).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if _, err := promoDB.Redeem("user-2", "WELCOME"); !errors.Is(err, ErrPromoCodeExhausted) {
+		t.Fatalf("redeem exhausted code: got %v, want ErrPromoCodeExhausted", err)
+	}
+
+	var records []BalanceRecord
+	db.Where("user_id = ?", "user-1").Find(&records)
+	if len(records) != 1 || records[0].Type != BalanceTypePromo || records[0].BalanceAfter != 5 {
+		t.Fatalf("balance records: got %+v", records)
+	}
+}
+
+func TestApplyPercentageCouponCapsDiscount(t *testing.T) {
+	_, promoDB, userDB := newPromoTestDB(t)
+	if err := promoDB.CreatePromoCode(&PromoCode{
+		Code: "HALF", Type: PromoTypePercentage, Amount: 50, MaxDiscount: 1, Models: "model-a", Active: true,
+	}); err != nil {
+		t.Fatalf("create promo code: %v", err)
+	}
+	if _, err := promoDB.Redeem("user-1", "HALF"); err != nil {
+		t.Fatalf("redeem: %v", err)
+	}
+	if promoDB.HasUsableCoupon("user-1", "model-b") {
+		t.Fatal("coupon restricted to model-a should not apply to model-b")
+	}
+	if !promoDB.HasUsableCoupon("user-1", "model-a") {
+		t.Fatal("expected usable coupon for model-a")
+	}
+
+	discount, err := promoDB.ApplyCoupons("user-1", "model-a", "req-1", 1.2)
+	if err != nil {
+		t.Fatalf("apply coupons: %v", err)
+	}
+	if math.Abs(discount-0.6) > 1e-9 {
+		t.Fatalf("first discount: got %v, want 0.6", discount)
+	}
+	if err := userDB.DeductBalance("user-1", 1.2); err != nil {
+		t.Fatalf("deduct balance: %v", err)
+	}
+
+	// 剩余抵扣额 0.4 封顶
+	discount, err = promoDB.ApplyCoupons("user-1", "model-a", "req-2", 2)
+	if err != nil {
+		t.Fatalf("apply coupons: %v", err)
+	}
+	if math.Abs(discount-0.4) > 1e-9 {
+		t.Fatalf("second discount: got %v, want 0.4", discount)
+	}
+	if promoDB.HasUsableCoupon("user-1", "model-a") {
+		t.Fatal("coupon should be used up")
+	}
+}
+
+func TestCashSpentExcludesFreeCredit(t *testing.T) {
+	db, _, _ := newPromoTestDB(t)
+	history := &BalanceHistoryDB{db: db}
+	for _, grant := range []struct {
+		kind   string
+		amount float64
+	}{{BalanceTypePromo, 10}, {BalanceTypeCoupon, 2}, {BalanceTypeRecharge, 5}} {
+		if _, err := history.Grant("user-1", grant.amount, grant.kind, "", ""); err != nil {
+			t.Fatalf("grant %s: %v", grant.kind, err)
+		}
+	}
+	// 只用赠送额度和优惠券消费的部分不计入
+	if spent, err := history.CashSpent("user-1", 12); err != nil || spent != 0 {
+		t.Fatalf("cash spent = %v, %v, want 0", spent, err)
+	}
+	if spent, _ := history.CashSpent("user-1", 15); spent != 3 {
+		t.Fatalf("cash spent = %v, want 3", spent)
+	}
+	// 不超过累计充值
+	if spent, _ := history.CashSpent("user-1", 30); spent != 5 {
+		t.Fatalf("cash spent = %v, want 5", spent)
+	}
+}
+
+func TestChargeUsageRollsBackWhenDeductionFails(t *testing.T) {
+	db, promoDB, userDB := newPromoTestDB(t)
+	subDB := NewSubscriptionDB(db)
+	server := &Server{DB: db, PromoCodeDB: promoDB}
+	if err := userDB.AddBalance("user-1", 10); err != nil {
+		t.Fatalf("add balance: %v", err)
+	}
+	plan := &Plan{Name: "basic", MonthlyFee: 10, Active: true, Quotas: []PlanQuota{{Model: "qwen*", Tokens: 100}}}
+	if err := subDB.CreatePlan(plan); err != nil {
+		t.Fatalf("create plan: %v", err)
+	}
+	if _, err := subDB.Subscribe("user-1", plan.ID); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if err := promoDB.CreatePromoCode(&PromoCode{
+		Code: "HALF", Type: PromoTypePercentage, Amount: 50, MaxDiscount: 1, Active: true,
+	}); err != nil {
+		t.Fatalf("create promo code: %v", err)
+	}
+	if _, err := promoDB.Redeem("user-1", "HALF"); err != nil {
+		t.Fatalf("redeem: %v", err)
+	}
+
+	// 余额为负时扣费失败，套餐额度和优惠券都不被消耗
+	db.Model(&User{}).Where("id = ?", "user-1").Update("balance", -1)
+	if _, _, err := server.ChargeUsage("user-1", "qwen-7b", "req-1", 200, 2); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("charge with negative balance: err = %v, want ErrInsufficientBalance", err)
+	}
+	var coupon UserCoupon
+	db.Where("user_id = ?", "user-1").First(&coupon)
+	if coupon.Remaining != 1 {
+		t.Fatalf("coupon remaining after failed charge = %v, want 1", coupon.Remaining)
+	}
+	if status, _ := subDB.GetStatus("user-1"); status == nil || status.Quotas[0].Used != 0 {
+		t.Fatalf("allowance used after failed charge: %+v", status)
+	}
+
+	// 额度覆盖 100 tokens，剩余 1 元由优惠券抵扣 0.5
+	db.Model(&User{}).Where("id = ?", "user-1").Update("balance", 5)
+	covered, payable, err := server.ChargeUsage("user-1", "qwen-7b", "req-2", 200, 2)
+	if err != nil || covered != 100 || math.Abs(payable-1) > 1e-9 {
+		t.Fatalf("charge = %d, %v, %v; want 100, 1", covered, payable, err)
+	}
+	if balance, _, _ := userDB.GetBalance("user-1"); math.Abs(balance-4.5) > 1e-9 {
+		t.Fatalf("balance = %v, want 4.5", balance)
+	}
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 邀请状态
+const (
+	ReferralStatusPending  = "pending"
+	ReferralStatusRewarded = "rewarded"
+)
+
+var (
+	ErrReferralCodeNotFound = errors.New("referral code not found")
+	ErrReferralSelf         = errors.New("cannot refer yourself")
+)
+
+// ReferralCode 每个用户唯一的邀请码，首次查询时生成
+type ReferralCode struct {
+	UserID    string    `gorm:"primaryKey" json:"user_id"`
+	Code      string    `gorm:"uniqueIndex;not null" json:"code"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Referral 邀请关系。被邀请人消费或贡献收益达到门槛后，双方各获得一次奖励。
+type Referral struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	ReferrerID string     `gorm:"index;not null" json:"referrer_id"`
+	RefereeID  string     `gorm:"uniqueIndex;not null" json:"referee_id"`
+	Code       string     `gorm:"not null" json:"code"`
+	Status     string     `gorm:"index;not null;default:'pending'" json:"status"`
+	RewardedAt *time.Time `json:"rewarded_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ReferralDB 提供邀请码与邀请关系的读写方法
+type ReferralDB struct {
+	db *gorm.DB
+}
+
+// NewReferralDB 初始化 ReferralDB
+func NewReferralDB(db *gorm.DB) *ReferralDB {
+	db.AutoMigrate(&ReferralCode{}, &Referral{})
+	return &ReferralDB{db: db}
+}
+
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+func newReferralCode() (string, error) {
+	var sb strings.Builder
+	for i := 0; i < 8; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(referralCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(referralCodeAlphabet[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// GetOrCreateCode 返回用户的邀请码，不存在时生成
+func (r *ReferralDB) GetOrCreateCode(userID string) (string, error) {
+	var rc ReferralCode
+	err := r.db.Where("user_id = ?", userID).First(&rc).Error
+	if err == nil {
+		return rc.Code, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+
+	// 极小概率冲突，重试几次
+	for i := 0; i < 5; i++ {
+		code, err := newReferralCode()
+		if err != nil {
+			return "", err
+		}
+		rc = ReferralCode{UserID: userID, Code: code}
+		if err := r.db.Create(&rc).Error; err == nil {
+			return code, nil
+		}
+	}
+	return "", errors.New("generate referral code failed")
+}
+
+// Bind 建立邀请关系（注册时调用）
+func (r *ReferralDB) Bind(refereeID, code string) error {
+	var rc ReferralCode
+	if err := r.db.Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).First(&rc).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrReferralCodeNotFound
+		}
+		return err
+	}
+	if rc.UserID == refereeID {
+		return ErrReferralSelf
+	}
+	return r.db.Create(&Referral{
+		ReferrerID: rc.UserID,
+		RefereeID:  refereeID,
+		Code:       rc.Code,
+		Status:     ReferralStatusPending,
+	}).Error
+}
+
+// GetPendingByReferee 获取被邀请人尚未发放奖励的邀请关系，没有时返回 nil
+func (r *ReferralDB) GetPendingByReferee(refereeID string) (*Referral, error) {
+	var ref Referral
+	err := r.db.Where("referee_id = ? AND status = ?", refereeID, ReferralStatusPending).First(&ref).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+// GetByReferrer 获取某用户邀请的所有人
+func (r *ReferralDB) GetByReferrer(referrerID string) ([]*Referral, error) {
+	var refs []*Referral
+	return refs, r.db.Where("referrer_id = ?", referrerID).Order("created_at DESC").Find(&refs).Error
+}
+
+// Reward 发放邀请奖励：状态由 pending 置为 rewarded 成功后，给双方加余额并记录流水。
+// 条件更新保证同一邀请关系只会奖励一次。
+func (r *ReferralDB) Reward(ref *Referral, referrerReward, refereeReward float64) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		update := tx.Model(&Referral{}).
+			Where("id = ? AND status = ?", ref.ID, ReferralStatusPending).
+			Updates(map[string]interface{}{"status": ReferralStatusRewarded, "rewarded_at": now})
+		if update.Error != nil {
+			return update.Error
+		}
+		if update.RowsAffected == 0 {
+			return nil
+		}
+		if referrerReward > 0 {
+			if _, err := grantBalanceTx(tx, ref.ReferrerID, referrerReward, BalanceTypeReferral,
+				ref.Code, "邀请奖励（邀请人）"); err != nil {
+				return err
+			}
+		}
+		if refereeReward > 0 {
+			if _, err := grantBalanceTx(tx, ref.RefereeID, refereeReward, BalanceTypeReferral,
+				ref.Code, "邀请奖励（被邀请人）"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CheckReferralReward 检查 userID 作为被邀请人是否已满足奖励门槛：
+// 由充值资金支付的累计消费或累计贡献收益任一达到 referral_min_amount 即发放奖励，
+// 赠送余额、优惠券和奖励支付的消费不计入，避免用免费额度刷奖励。
+// 没有待发放的邀请关系时只有一次索引查询，可以在每次计费后调用。
+func (s *Server) CheckReferralReward(userID string) {
+	if s.ReferralDB == nil || userID == "" {
+		return
+	}
+	ref, err := s.ReferralDB.GetPendingByReferee(userID)
+	if err != nil {
+		log.Printf("query pending referral for user %s failed: %v", userID, err)
+		return
+	}
+	if ref == nil {
+		return
+	}
+
+	referrerReward := s.SystemConfigDB.GetFloat(ConfigKeyReferralReferrerReward, 0)
+	refereeReward := s.SystemConfigDB.GetFloat(ConfigKeyReferralRefereeReward, 0)
+	if referrerReward <= 0 && refereeReward <= 0 {
+		return
+	}
+	minAmount := s.SystemConfigDB.GetFloat(ConfigKeyReferralMinAmount, 0)
+
+	_, spent, err := s.UserDB.GetBalance(userID)
+	if err != nil {
+		log.Printf("get balance for referral check failed: %v", err)
+		return
+	}
+	cashSpent := 0.0
+	if s.BalanceHistoryDB != nil {
+		if cashSpent, err = s.BalanceHistoryDB.CashSpent(userID, spent); err != nil {
+			log.Printf("get cash spend for referral check failed: %v", err)
+			return
+		}
+	}
+	reached := cashSpent >= minAmount
+	if !reached {
+		if income, err := s.TokenUsageDB.GetTotalIncomeByUserID(userID, s.ClientDB); err == nil {
+			if v, ok := income.(float64); ok && v >= minAmount {
+				reached = true
+			}
+		}
+	}
+	if !reached {
+		return
+	}
+
+	if err := s.ReferralDB.Reward(ref, referrerReward, refereeReward); err != nil {
+		log.Printf("reward referral %d failed: %v", ref.ID, err)
+		return
+	}
+	log.Printf("referral %d rewarded: referrer=%s +%.2f, referee=%s +%.2f",
+		ref.ID, ref.ReferrerID, referrerReward, ref.RefereeID, refereeReward)
+}
@@ -0,0 +1,201 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 请求结果（TokenUsage.Outcome）
+const (
+	OutcomeCompleted   = "completed"    // 正常完成
+	OutcomeCancelled   = "cancelled"    // 用户中途断开
+	OutcomeClientError = "client_error" // client 返回错误或无法解析的内容
+	OutcomeTruncated   = "truncated"    // 流在正常结束前中断
+)
+
+// 申诉状态
+const (
+	DisputeStatusPending  = "pending"
+	DisputeStatusApproved = "approved"
+	DisputeStatusRejected = "rejected"
+)
+
+var (
+	ErrUsageNotFound     = errors.New("request not found")
+	ErrAlreadyRefunded   = errors.New("request has already been fully refunded")
+	ErrDisputeExists     = errors.New("a dispute for this request already exists")
+	ErrDisputeNotFound   = errors.New("dispute not found")
+	ErrDisputeResolved   = errors.New("dispute has already been resolved")
+	ErrInvalidRefundRate = errors.New("refund ratio must be in (0, 1]")
+)
+
+// Dispute 用户对某次请求计费的申诉，每个请求最多一条
+type Dispute struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	RequestID    string     `gorm:"uniqueIndex;not null" json:"request_id"`
+	UserID       string     `gorm:"index;not null" json:"user_id"`
+	Reason       string     `gorm:"not null" json:"reason"`
+	Status       string     `gorm:"index;not null" json:"status"`
+	Resolution   string     `json:"resolution"`
+	RefundAmount float64    `gorm:"not null;default:0" json:"refund_amount"`
+	ResolvedBy   string     `json:"resolved_by,omitempty"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt    time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// RefundDB 提供退款与申诉的读写方法
+type RefundDB struct {
+	db *gorm.DB
+}
+
+// NewRefundDB 初始化 RefundDB
+func NewRefundDB(db *gorm.DB) *RefundDB {
+	db.AutoMigrate(&Dispute{})
+	return &RefundDB{db: db}
+}
+
+// refundTx 按比例 ratio 退还请求的费用，并从 client 端收益中扣回同比例的金额。
+// 退款以 refund 流水计入用户余额并冲减累计消费；多次退款累计不超过原费用。
+func refundTx(tx *gorm.DB, requestID string, ratio float64, note string) (float64, error) {
+	if ratio <= 0 || ratio > 1 {
+		return 0, ErrInvalidRefundRate
+	}
+	var usage TokenUsage
+	if err := tx.Where("request_id = ?", requestID).Order("id DESC").First(&usage).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrUsageNotFound
+		}
+		return 0, err
+	}
+
+	amount := usage.Cost * ratio
+	if amount > usage.Cost-usage.Refunded {
+		amount = usage.Cost - usage.Refunded
+	}
+	income := usage.GrossIncome()
+	chargeback := income * ratio
+	if chargeback > income-usage.Chargeback {
+		chargeback = income - usage.Chargeback
+	}
+	if amount <= 0 && chargeback <= 0 {
+		return 0, ErrAlreadyRefunded
+	}
+
+	if err := tx.Model(&TokenUsage{}).Where("id = ?", usage.ID).Updates(map[string]interface{}{
+		"refunded":   gorm.Expr("refunded + ?", amount),
+		"chargeback": gorm.Expr("chargeback + ?", chargeback),
+	}).Error; err != nil {
+		return 0, err
+	}
+	if amount <= 0 {
+		return 0, nil
+	}
+	if err := tx.Model(&User{}).Where("id = ?", usage.UserID).
+		Update("total_spent", gorm.Expr("total_spent - ?", amount)).Error; err != nil {
+		return 0, err
+	}
+	if _, err := grantBalanceTx(tx, usage.UserID, amount, BalanceTypeRefund, requestID, note); err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// Refund 按比例退还请求费用（自动退款与申诉通过共用）
+func (r *RefundDB) Refund(requestID string, ratio float64, note string) (float64, error) {
+	var amount float64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		amount, err = refundTx(tx, requestID, ratio, note)
+		return err
+	})
+	return amount, err
+}
+
+// CreateDispute 用户对自己的某次请求提交申诉
+func (r *RefundDB) CreateDispute(userID, requestID, reason string) (*Dispute, error) {
+	var usage TokenUsage
+	if err := r.db.Where("request_id = ? AND user_id = ?", requestID, userID).Order("id").First(&usage).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUsageNotFound
+		}
+		return nil, err
+	}
+	if usage.Cost <= 0 || usage.Refunded >= usage.Cost {
+		return nil, ErrAlreadyRefunded
+	}
+
+	var count int64
+	if err := r.db.Model(&Dispute{}).Where("request_id = ?", requestID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrDisputeExists
+	}
+
+	dispute := &Dispute{
+		RequestID: requestID,
+		UserID:    userID,
+		Reason:    reason,
+		Status:    DisputeStatusPending,
+	}
+	if err := r.db.Create(dispute).Error; err != nil {
+		return nil, err
+	}
+	return dispute, nil
+}
+
+// ListDisputes 分页查询申诉，userID / status 为空表示不过滤
+func (r *RefundDB) ListDisputes(userID, status string, page, size int) ([]*Dispute, int64, error) {
+	var disputes []*Dispute
+	var total int64
+
+	query := r.db.Model(&Dispute{})
+	if userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err := query.Order("created_at DESC").Offset((page - 1) * size).Limit(size).Find(&disputes).Error
+	return disputes, total, err
+}
+
+// ResolveDispute 处理申诉：approve 时按 ratio 退款并扣回 client 收益，否则驳回
+func (r *RefundDB) ResolveDispute(id uint, approve bool, ratio float64, resolution, adminID string) (*Dispute, error) {
+	var dispute Dispute
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&dispute, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrDisputeNotFound
+			}
+			return err
+		}
+		if dispute.Status != DisputeStatusPending {
+			return ErrDisputeResolved
+		}
+
+		dispute.Status = DisputeStatusRejected
+		if approve {
+			amount, err := refundTx(tx, dispute.RequestID, ratio, "申诉退款")
+			if err != nil {
+				return err
+			}
+			dispute.Status = DisputeStatusApproved
+			dispute.RefundAmount = amount
+		}
+		now := time.Now()
+		dispute.Resolution = resolution
+		dispute.ResolvedBy = adminID
+		dispute.ResolvedAt = &now
+		return tx.Save(&dispute).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dispute, nil
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRefundChargesBackProviderIncome(t *testing.T) {
+	db, _, userDB := newPromoTestDB(t)
+	tokenUsageDB := NewTokenUsageDB(db)
+	clientDB := NewClientDB(db)
+	refundDB := NewRefundDB(db)
+
+	if err := db.Create(&Client{ID: "client-1", UserID: "provider"}).Error; err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+	if err := userDB.AddBalance("user-1", 10); err != nil {
+		t.Fatalf("add balance: %v", err)
+	}
+	if err := userDB.DeductBalance("user-1", 2); err != nil {
+		t.Fatalf("deduct balance: %v", err)
+	}
+	usage := &TokenUsage{
+		RequestID: "req-1", UserID: "user-1", ClientID: "client-1", Model: "model-a",
+		InputTokens: 1000000, OutputTokens: 500000, TotalTokens: 1500000,
+		IPPM: 1, OPPM: 2, Cost: 2, Outcome: OutcomeTruncated,
+	}
+	if err := tokenUsageDB.SaveTokenUsage(usage); err != nil {
+		t.Fatalf("save usage: %v", err)
+	}
+
+	amount, err := refundDB.Refund("req-1", 0.5, "test")
+	if err != nil || amount != 1 {
+		t.Fatalf("refund: amount=%v err=%v, want 1", amount, err)
+	}
+	if balance, spent, _ := userDB.GetBalance("user-1"); balance != 9 || spent != 1 {
+		t.Fatalf("after refund: balance=%v spent=%v, want 9/1", balance, spent)
+	}
+	income, _ := tokenUsageDB.GetTotalIncomeByUserID("provider", clientDB)
+	if v, _ := income.(float64); math.Abs(v-1) > 1e-9 {
+		t.Fatalf("provider income after chargeback: got %v, want 1", v)
+	}
+
+	dispute, err := refundDB.CreateDispute("user-1", "req-1", "output was cut off")
+	if err != nil {
+		t.Fatalf("create dispute: %v", err)
+	}
+	if _, err := refundDB.CreateDispute("user-1", "req-1", "again"); !errors.Is(err, ErrDisputeExists) {
+		t.Fatalf("duplicate dispute: got %v, want ErrDisputeExists", err)
+	}
+	resolved, err := refundDB.ResolveDispute(dispute.ID, true, 1, "provider fault", "admin")
+	if err != nil {
+		t.Fatalf("resolve dispute: %v", err)
+	}
+	// 累计退款不超过原费用
+	if resolved.Status != DisputeStatusApproved || resolved.RefundAmount != 1 {
+		t.Fatalf("resolved dispute: status=%s amount=%v, want approved/1", resolved.Status, resolved.RefundAmount)
+	}
+	if _, err := refundDB.Refund("req-1", 1, "test"); !errors.Is(err, ErrAlreadyRefunded) {
+		t.Fatalf("refund after full refund: got %v, want ErrAlreadyRefunded", err)
+	}
+}
+
+func TestUnbilledOutcomesExcludedFromCallStats(t *testing.T) {
+	db, _, _ := newPromoTestDB(t)
+	tokenUsageDB := NewTokenUsageDB(db)
+	now := time.Now()
+	if err := tokenUsageDB.SaveTokenUsage(&TokenUsage{
+		RequestID: "req-1", UserID: "user-1", Model: "model-a", InputTokens: 10, OutputTokens: 5, TotalTokens: 15, Cost: 1, Timestamp: now,
+	}); err != nil {
+		t.Fatalf("save usage: %v", err)
+	}
+	if err := tokenUsageDB.SaveUnbilledOutcome(&TokenUsage{
+		RequestID: "req-2", UserID: "user-1", Model: "model-a", Outcome: OutcomeCancelled, Timestamp: now,
+	}); err != nil {
+		t.Fatalf("save unbilled outcome: %v", err)
+	}
+
+	_, total, err := tokenUsageDB.GetUserTokenUsagePaged("user-1", now.Add(-time.Hour), now.Add(time.Hour), 1, 10)
+	if err != nil || total != 1 {
+		t.Fatalf("billed calls: total=%d err=%v, want 1", total, err)
+	}
+	usage, err := tokenUsageDB.GetUserRequest("user-1", "req-2")
+	if err != nil || usage.Outcome != OutcomeCancelled {
+		t.Fatalf("unbilled request lookup: usage=%+v err=%v", usage, err)
+	}
+}
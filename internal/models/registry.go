@@ -0,0 +1,109 @@
+package models
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// clientRegistry 按模型分片的 client 登记表。每个模型一个 shard，shard 内的 clientID -> client
+// map 由读写锁保护，写入只锁对应模型的 shard 并原地修改，同一模型下有上万个 client 时也不复制整个 map。
+// 读取使用 shard 的只读快照：写入后快照失效，下一次读取时在读锁下重建，之后的读取无锁。
+// 零值可直接使用。
+type clientRegistry struct {
+	shards sync.Map // model -> *modelShard
+}
+
+type modelShard struct {
+	mu       sync.RWMutex
+	clients  map[string]*Client                 // 受 mu 保护
+	snapshot atomic.Pointer[map[string]*Client] // clients 的只读副本，为 nil 时需要重建
+}
+
+// shard 返回 model 的 shard。shard 创建后不会删除（client 全部移除后保留空 map），
+// 避免删除与并发写入竞争导致写入丢失。
+func (r *clientRegistry) shard(model string) *modelShard {
+	if v, ok := r.shards.Load(model); ok {
+		return v.(*modelShard)
+	}
+	v, _ := r.shards.LoadOrStore(model, &modelShard{})
+	return v.(*modelShard)
+}
+
+// read 返回 shard 的只读快照，快照已失效时在读锁下重建
+func (sh *modelShard) read() map[string]*Client {
+	if m := sh.snapshot.Load(); m != nil {
+		return *m
+	}
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	if m := sh.snapshot.Load(); m != nil {
+		return *m
+	}
+	m := make(map[string]*Client, len(sh.clients))
+	for id, c := range sh.clients {
+		m[id] = c
+	}
+	sh.snapshot.Store(&m)
+	return m
+}
+
+// get 返回 model 下 client 的只读快照，没有 client 时返回 nil
+func (r *clientRegistry) get(model string) map[string]*Client {
+	if v, ok := r.shards.Load(model); ok {
+		return v.(*modelShard).read()
+	}
+	return nil
+}
+
+// add 把 client 登记到 model 下，已登记同一个 client 时不做任何写入并返回 false
+func (r *clientRegistry) add(model string, client *Client) bool {
+	sh := r.shard(model)
+	sh.mu.RLock()
+	registered := sh.clients[client.ID] == client
+	sh.mu.RUnlock()
+	if registered {
+		return false
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.clients[client.ID] == client {
+		return false
+	}
+	if sh.clients == nil {
+		sh.clients = make(map[string]*Client)
+	}
+	sh.clients[client.ID] = client
+	sh.snapshot.Store(nil)
+	return true
+}
+
+// remove 从 model 下移除 clientID 并返回被移除的 client；instance 不为 nil 时只在登记的正是
+// 该实例时移除，避免断线清理误删同一 ID 重新注册的新连接
+func (r *clientRegistry) remove(model, clientID string, instance *Client) *Client {
+	v, ok := r.shards.Load(model)
+	if !ok {
+		return nil
+	}
+	sh := v.(*modelShard)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	current := sh.clients[clientID]
+	if current == nil || (instance != nil && current != instance) {
+		return nil
+	}
+	delete(sh.clients, clientID)
+	sh.snapshot.Store(nil)
+	return current
+}
+
+// snapshot 返回所有有 client 的模型的快照，各模型的 map 为只读的 shard 快照
+func (r *clientRegistry) snapshot() map[string]map[string]*Client {
+	all := make(map[string]map[string]*Client)
+	r.shards.Range(func(key, value any) bool {
+		if m := value.(*modelShard).read(); len(m) > 0 {
+			all[key.(string)] = m
+		}
+		return true
+	})
+	return all
+}
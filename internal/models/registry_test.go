@@ -0,0 +1,254 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"star-fire/pkg/public"
+)
+
+// replace 用 all 替换整个登记表，供测试构造 client 集合
+func (r *clientRegistry) replace(all map[string]map[string]*Client) {
+	r.shards.Range(func(key, _ any) bool {
+		r.shards.Delete(key)
+		return true
+	})
+	for model, clients := range all {
+		sh := r.shard(model)
+		sh.mu.Lock()
+		sh.clients = make(map[string]*Client, len(clients))
+		for id, c := range clients {
+			sh.clients[id] = c
+		}
+		sh.snapshot.Store(nil)
+		sh.mu.Unlock()
+	}
+}
+
+func TestRegistryConcurrentAddRemove(t *testing.T) {
+	var r clientRegistry
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &Client{ID: fmt.Sprintf("client-%d", i)}
+			model := fmt.Sprintf("model-%d", i%4)
+			r.add(model, c)
+			if i%2 == 0 {
+				r.remove(model, c.ID, c)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	total := 0
+	for model, clients := range r.snapshot() {
+		for id := range clients {
+			if _, err := fmt.Sscanf(id, "client-%d", new(int)); err != nil {
+				t.Fatalf("unexpected client %s under %s", id, model)
+			}
+		}
+		total += len(clients)
+	}
+	if total != 100 {
+		t.Fatalf("registered clients = %d, want 100", total)
+	}
+
+	// 只移除登记的正是该实例的 client
+	stale := &Client{ID: "client-1"}
+	if r.remove("model-1", "client-1", stale) != nil || r.get("model-1")["client-1"] == nil {
+		t.Fatal("stale instance removed the current registration")
+	}
+}
+
+func TestSyncModelsSkipsUnchangedModelSet(t *testing.T) {
+	server := &Server{}
+	client := &Client{ID: "c1", Models: []*public.Model{{Name: "model-a"}, {Name: "model-b"}}}
+	server.SyncModels(client)
+	if server.GetClientByModel("model-a", "c1") != client || server.GetClientByModel("model-b", "c1") != client {
+		t.Fatal("models not registered")
+	}
+
+	// 模型集合不变时不写入，读取快照不失效
+	server.clients.get("model-a")
+	before := server.clients.shard("model-a").snapshot.Load()
+	server.SyncModels(client)
+	if before == nil || server.clients.shard("model-a").snapshot.Load() != before {
+		t.Fatal("unchanged pong rewrote the model shard")
+	}
+
+	// 不再上报的模型被移除，新增的模型被登记
+	client.Models = []*public.Model{{Name: "model-a"}, {Name: "model-c"}}
+	server.SyncModels(client)
+	if server.GetClientByModel("model-b", "c1") != nil || server.GetClientByModel("model-c", "c1") != client {
+		t.Fatalf("registry after model change: %v", server.clients.snapshot())
+	}
+
+	// 负载均衡清理掉的模型在下次心跳时重新登记
+	server.RemoveClient("model-a", "c1")
+	server.SyncModels(client)
+	if server.GetClientByModel("model-a", "c1") != client {
+		t.Fatal("model removed by cleanup was not re-registered on the next pong")
+	}
+
+	server.UnregisterClient(client)
+	if len(server.clients.snapshot()) != 0 {
+		t.Fatalf("registry after unregister: %v", server.clients.snapshot())
+	}
+}
+
+const (
+	benchRegistryClients = 10000
+	benchRegistryModels  = 100
+)
+
+// benchRegistryClientsList 构造 10k 个各提供 3 个模型的 client，并在 benchmark 期间关闭登记日志
+func benchRegistryClientsList(b *testing.B) []*Client {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+	clients := make([]*Client, benchRegistryClients)
+	for i := range clients {
+		clients[i] = &Client{ID: fmt.Sprintf("client-%d", i)}
+		for j := 0; j < 3; j++ {
+			clients[i].Models = append(clients[i].Models, &public.Model{Name: fmt.Sprintf("model-%d", (i+j)%benchRegistryModels)})
+		}
+	}
+	return clients
+}
+
+// cowRegistry 旧实现：每次登记或移除都在全局锁下复制整个 map[string]map[string]*Client
+type cowRegistry struct {
+	mu sync.Mutex
+	v  atomic.Value
+}
+
+func (r *cowRegistry) load() map[string]map[string]*Client {
+	m, _ := r.v.Load().(map[string]map[string]*Client)
+	return m
+}
+
+func (r *cowRegistry) write(fn func(map[string]map[string]*Client)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.load()
+	next := make(map[string]map[string]*Client, len(old))
+	for model, inner := range old {
+		m := make(map[string]*Client, len(inner))
+		for id, c := range inner {
+			m[id] = c
+		}
+		next[model] = m
+	}
+	fn(next)
+	r.v.Store(next)
+}
+
+func (r *cowRegistry) add(model string, c *Client) {
+	r.write(func(m map[string]map[string]*Client) {
+		if m[model] == nil {
+			m[model] = make(map[string]*Client)
+		}
+		m[model][c.ID] = c
+	})
+}
+
+func (r *cowRegistry) remove(model, id string) {
+	r.write(func(m map[string]map[string]*Client) { delete(m[model], id) })
+}
+
+// BenchmarkRegistryChurnCopyOnWrite 10k 个 client 在线时一个 client 重新连接（移除并重新登记 3 个模型）
+func BenchmarkRegistryChurnCopyOnWrite(b *testing.B) {
+	var r cowRegistry
+	clients := benchRegistryClientsList(b)
+	for _, c := range clients {
+		for _, m := range c.Models {
+			r.add(m.Name, c)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := clients[i%len(clients)]
+		for _, m := range c.Models {
+			r.remove(m.Name, c.ID)
+		}
+		for _, m := range c.Models {
+			r.add(m.Name, c)
+		}
+	}
+}
+
+// BenchmarkRegistryChurnSharded 同上，按模型分片只修改受影响模型的 map
+func BenchmarkRegistryChurnSharded(b *testing.B) {
+	server := &Server{}
+	clients := benchRegistryClientsList(b)
+	for _, c := range clients {
+		server.SyncModels(c)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := clients[i%len(clients)]
+		server.UnregisterClient(c)
+		server.SyncModels(c)
+	}
+}
+
+// BenchmarkRegistryHeartbeat 10k 个 client 在线时处理一次模型集合不变的心跳
+func BenchmarkRegistryHeartbeat(b *testing.B) {
+	server := &Server{}
+	clients := benchRegistryClientsList(b)
+	for _, c := range clients {
+		server.SyncModels(c)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.SyncModels(clients[i%len(clients)])
+	}
+}
+
+// BenchmarkRegistryEligibleRead 10k 个 client 在线时读取一个模型的 client 快照（负载均衡的读路径）
+func BenchmarkRegistryEligibleRead(b *testing.B) {
+	server := &Server{}
+	for _, c := range benchRegistryClientsList(b) {
+		server.SyncModels(c)
+	}
+	names := make([]string, benchRegistryModels)
+	for i := range names {
+		names[i] = fmt.Sprintf("model-%d", i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if len(server.clients.get(names[i%benchRegistryModels])) == 0 {
+				b.Fatal("empty shard")
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkRegistryChurnSingleModel 10k 个 client 都提供同一个模型时一个 client 重新连接后
+// 负载均衡读取一次该模型，分片退化为一个 shard 的最坏情况
+func BenchmarkRegistryChurnSingleModel(b *testing.B) {
+	server := &Server{}
+	clients := benchRegistryClientsList(b)
+	for _, c := range clients {
+		c.Models = []*public.Model{{Name: "model-0"}}
+		server.SyncModels(c)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := clients[i%len(clients)]
+		server.UnregisterClient(c)
+		server.SyncModels(c)
+		if len(server.clients.get("model-0")) != benchRegistryClients {
+			b.Fatal("client missing after reconnect")
+		}
+	}
+}
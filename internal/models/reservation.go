@@ -0,0 +1,424 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 预留状态
+const (
+	ReservationPending   = "pending"   // 等待 provider 接受
+	ReservationAccepted  = "accepted"  // 已接受，窗口内生效
+	ReservationDeclined  = "declined"  // provider 拒绝
+	ReservationCancelled = "cancelled" // 用户在开始前取消
+	ReservationSettled   = "settled"   // 窗口结束并已结算
+	ReservationFailed    = "failed"    // 多次结算失败（余额不足），记为欠费
+)
+
+// MaxSettleAttempts 预留结算失败（余额不足）的最大重试次数，超过后标记为 failed
+const MaxSettleAttempts = 5
+
+// 预留计价方式
+const (
+	// ReservationHourly 按小时计费：接受时预付全部时长费用，窗口内的请求不再按 tokens 计费
+	ReservationHourly = "hourly"
+	// ReservationToken 按约定的 tokens 价格计费，接受时预付最低承诺金额作为押金，
+	// 结束时用量不足承诺金额的部分从押金中收取，其余退还
+	ReservationToken = "token"
+)
+
+// BalanceTypeReservation 预留容量结算（负数）
+const BalanceTypeReservation = "reservation"
+
+// MaxReservationWindow 单次预留的最长时长
+const MaxReservationWindow = 7 * 24 * time.Hour
+
+// Reservation 用户对某个 provider client 的模型在时间窗口内预留的并发容量
+type Reservation struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	UserID         string     `gorm:"index;not null" json:"user_id"`     // 预留方
+	ProviderID     string     `gorm:"index;not null" json:"provider_id"` // client 所属用户
+	ClientID       string     `gorm:"index:idx_reservations_client_window;not null" json:"client_id"`
+	Model          string     `gorm:"not null" json:"model"`
+	Slots          int        `gorm:"not null;default:1" json:"slots"` // 预留的并发数
+	StartAt        time.Time  `gorm:"index:idx_reservations_client_window;not null" json:"start_at"`
+	EndAt          time.Time  `gorm:"index:idx_reservations_client_window;not null" json:"end_at"`
+	PricingType    string     `gorm:"not null" json:"pricing_type"`                   // hourly 或 token
+	HourlyRate     float64    `gorm:"not null;default:0" json:"hourly_rate"`          // 每小时价格（hourly）
+	IPPM           float64    `gorm:"column:ippm;not null;default:0" json:"ippm"`     // 约定输入价格（token）
+	OPPM           float64    `gorm:"column:oppm;not null;default:0" json:"oppm"`     // 约定输出价格（token）
+	MinCommitment  float64    `gorm:"not null;default:0" json:"min_commitment"`       // 最低承诺金额（token）
+	UsedCost       float64    `gorm:"not null;default:0" json:"used_cost"`            // 窗口内按约定价格产生的费用
+	SettledFee     float64    `gorm:"not null;default:0" json:"settled_fee"`          // 结算时额外收取的费用
+	Prepaid        float64    `gorm:"not null;default:0" json:"prepaid"`              // 接受时从预留方余额预付的金额，见 Hold
+	SettleAttempts int        `gorm:"not null;default:0" json:"settle_attempts"`      // 结算失败的次数
+	Status         string     `gorm:"index;not null;default:'pending'" json:"status"` // pending, accepted, declined, cancelled, settled, failed
+	RespondedAt    *time.Time `json:"responded_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// Fee 窗口结束时应额外收取的费用：按小时计费为全部时长费用，按 tokens 计费为未用完的承诺金额
+func (r *Reservation) Fee() float64 {
+	switch r.PricingType {
+	case ReservationHourly:
+		return r.HourlyRate * r.EndAt.Sub(r.StartAt).Hours()
+	case ReservationToken:
+		return max(0, r.MinCommitment-r.UsedCost)
+	}
+	return 0
+}
+
+// Hold 接受预留时预付的金额：按小时计费为全部时长费用，按 tokens 计费为最低承诺金额
+func (r *Reservation) Hold() float64 {
+	switch r.PricingType {
+	case ReservationHourly:
+		return r.Fee()
+	case ReservationToken:
+		return r.MinCommitment
+	}
+	return 0
+}
+
+// Price 返回窗口内请求的计价快照：按小时计费的请求不再计费，按 tokens 计费的请求按约定价格
+func (r *Reservation) Price(p PriceSnapshot) PriceSnapshot {
+	if r.PricingType == ReservationHourly {
+		return PriceSnapshot{At: p.At}
+	}
+	return p.Cleared(r.IPPM, r.OPPM)
+}
+
+// Validate 检查预留参数
+func (r *Reservation) Validate(now time.Time) error {
+	if r.ClientID == "" || r.Model == "" {
+		return errors.New("client_id and model are required")
+	}
+	if r.Slots <= 0 {
+		return errors.New("slots must be positive")
+	}
+	if !r.EndAt.After(r.StartAt) || r.EndAt.Before(now) {
+		return errors.New("invalid reservation window")
+	}
+	if r.EndAt.Sub(r.StartAt) > MaxReservationWindow {
+		return fmt.Errorf("reservation window must not exceed %v", MaxReservationWindow)
+	}
+	switch r.PricingType {
+	case ReservationHourly:
+		if r.HourlyRate <= 0 {
+			return errors.New("hourly_rate must be positive")
+		}
+	case ReservationToken:
+		if r.IPPM < 0 || r.OPPM < 0 || r.MinCommitment < 0 {
+			return errors.New("prices must be non-negative")
+		}
+	default:
+		return errors.New("pricing_type must be hourly or token")
+	}
+	return nil
+}
+
+// Capacity client 可同时处理的请求数：优先使用心跳上报的并发数，其次为注册时上报的，都未上报时按 1 计
+func (c *Client) Capacity() int {
+	if load := c.Load(); load != nil && load.MaxParallel > 0 {
+		return load.MaxParallel
+	}
+	if c.InferenceEngine.NumParallel > 0 {
+		return c.InferenceEngine.NumParallel
+	}
+	return 1
+}
+
+// ReservationDB 提供容量预留的读写方法。已接受的预留缓存在内存中供派发时查询，
+// 创建、接受、取消和结算时失效
+type ReservationDB struct {
+	db *gorm.DB
+
+	mu       sync.RWMutex
+	accepted []*Reservation
+	loaded   bool
+}
+
+// NewReservationDB 初始化 ReservationDB
+func NewReservationDB(db *gorm.DB) *ReservationDB {
+	db.AutoMigrate(&Reservation{})
+	return &ReservationDB{db: db}
+}
+
+// Create 创建预留申请
+func (r *ReservationDB) Create(res *Reservation) error {
+	res.Status = ReservationPending
+	defer r.invalidate()
+	return r.db.Create(res).Error
+}
+
+func (r *ReservationDB) invalidate() {
+	r.mu.Lock()
+	r.accepted, r.loaded = nil, false
+	r.mu.Unlock()
+}
+
+// acceptedReservations 返回缓存的已接受预留，缓存失效时从数据库重新加载
+func (r *ReservationDB) acceptedReservations() ([]*Reservation, error) {
+	r.mu.RLock()
+	list, loaded := r.accepted, r.loaded
+	r.mu.RUnlock()
+	if loaded {
+		return list, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loaded {
+		return r.accepted, nil
+	}
+	if err := r.db.Where("status = ?", ReservationAccepted).Find(&list).Error; err != nil {
+		return nil, err
+	}
+	r.accepted, r.loaded = list, true
+	return list, nil
+}
+
+// releaseHoldTx 退还预付金额，并从累计消费中扣回
+func releaseHoldTx(tx *gorm.DB, userID string, amount float64, refID, note string) error {
+	if err := tx.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"balance":     gorm.Expr("balance + ?", amount),
+		"total_spent": gorm.Expr("total_spent - ?", amount),
+	}).Error; err != nil {
+		return err
+	}
+	_, err := insertBalanceRecordTx(tx, userID, amount, BalanceTypeReservation, refID, note)
+	return err
+}
+
+// Get 按 ID 获取预留
+func (r *ReservationDB) Get(id uint) (*Reservation, error) {
+	var res Reservation
+	if err := r.db.First(&res, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errors.New("reservation not found")
+		}
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListByUser 列出用户发起的预留
+func (r *ReservationDB) ListByUser(userID string) ([]*Reservation, error) {
+	var list []*Reservation
+	err := r.db.Where("user_id = ?", userID).Order("start_at DESC").Find(&list).Error
+	return list, err
+}
+
+// ListByProvider 列出 provider 收到的预留
+func (r *ReservationDB) ListByProvider(providerID string) ([]*Reservation, error) {
+	var list []*Reservation
+	err := r.db.Where("provider_id = ?", providerID).Order("start_at DESC").Find(&list).Error
+	return list, err
+}
+
+// Respond provider 接受或拒绝预留。接受时检查与已接受的预留重叠后并发数不超过 capacity，
+// 并从预留方余额中预付 Hold，余额不足时不能接受。
+func (r *ReservationDB) Respond(providerID string, id uint, accept bool, capacity int) (*Reservation, error) {
+	defer r.invalidate()
+	var res Reservation
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ? AND provider_id = ?", id, providerID).First(&res).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("reservation not found")
+			}
+			return err
+		}
+		if res.Status != ReservationPending {
+			return errors.New("reservation is not pending")
+		}
+		now := time.Now()
+		res.Status = ReservationDeclined
+		if accept {
+			if !res.EndAt.After(now) {
+				return errors.New("reservation window has ended")
+			}
+			var reserved int64
+			if err := tx.Model(&Reservation{}).Select("COALESCE(SUM(slots), 0)").
+				Where("client_id = ? AND status = ? AND start_at < ? AND end_at > ?",
+					res.ClientID, ReservationAccepted, res.EndAt, res.StartAt).
+				Scan(&reserved).Error; err != nil {
+				return err
+			}
+			if int(reserved)+res.Slots > capacity {
+				return fmt.Errorf("not enough capacity: %d of %d slots already reserved", reserved, capacity)
+			}
+			if hold := res.Hold(); hold > 0 {
+				if _, err := chargeBalanceTx(tx, res.UserID, hold, BalanceTypeReservation, fmt.Sprintf("reservation-%d", res.ID),
+					fmt.Sprintf("预留容量预付 %s@%s", res.Model, res.ClientID)); err != nil {
+					if errors.Is(err, ErrInsufficientBalance) {
+						return fmt.Errorf("reserving user cannot prepay %.4f: %w", hold, err)
+					}
+					return err
+				}
+				res.Prepaid = hold
+			}
+			res.Status = ReservationAccepted
+		}
+		res.RespondedAt = &now
+		return tx.Save(&res).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Cancel 用户在窗口开始前取消预留，退还已预付的金额
+func (r *ReservationDB) Cancel(userID string, id uint) error {
+	defer r.invalidate()
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var res Reservation
+		if err := tx.Where("id = ? AND user_id = ? AND status IN ? AND start_at > ?",
+			id, userID, []string{ReservationPending, ReservationAccepted}, time.Now()).First(&res).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("reservation not found or already started")
+			}
+			return err
+		}
+		if res.Prepaid > 0 {
+			if err := releaseHoldTx(tx, userID, res.Prepaid, fmt.Sprintf("reservation-%d", res.ID),
+				fmt.Sprintf("取消预留退还预付 %s@%s", res.Model, res.ClientID)); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&res).Update("status", ReservationCancelled).Error
+	})
+}
+
+// Active 返回在 at 时刻生效的预留（读取内存缓存）
+func (r *ReservationDB) Active(at time.Time) ([]*Reservation, error) {
+	accepted, err := r.acceptedReservations()
+	if err != nil {
+		return nil, err
+	}
+	var list []*Reservation
+	for _, res := range accepted {
+		if !res.StartAt.After(at) && res.EndAt.After(at) {
+			list = append(list, res)
+		}
+	}
+	return list, nil
+}
+
+// AddUsage 累加窗口内按约定价格产生的费用
+func (r *ReservationDB) AddUsage(id uint, cost float64) error {
+	return r.db.Model(&Reservation{}).Where("id = ?", id).
+		Update("used_cost", gorm.Expr("used_cost + ?", cost)).Error
+}
+
+// Settle 结算已结束的预留：按 Fee 与预付金额的差额补扣或退还，并写入一条 reservation 类型的使用记录，
+// 费用通过 fee 列计入 provider 收益。补扣时余额不足的预留保持 accepted 下次再结算，
+// 失败 MaxSettleAttempts 次后标记为 failed（欠费）。
+func (r *ReservationDB) Settle(now time.Time) {
+	var due []*Reservation
+	if err := r.db.Where("status = ? AND end_at <= ?", ReservationAccepted, now).Find(&due).Error; err != nil {
+		log.Printf("query due reservations failed: %v", err)
+		return
+	}
+	if len(due) == 0 {
+		return
+	}
+	defer r.invalidate()
+	for _, res := range due {
+		err := r.db.Transaction(func(tx *gorm.DB) error {
+			fee := res.Fee()
+			refID := fmt.Sprintf("reservation-%d", res.ID)
+			note := fmt.Sprintf("预留容量结算 %s@%s", res.Model, res.ClientID)
+			switch {
+			case fee > res.Prepaid:
+				if _, err := chargeBalanceTx(tx, res.UserID, fee-res.Prepaid, BalanceTypeReservation, refID, note); err != nil {
+					return err
+				}
+			case fee < res.Prepaid:
+				if err := releaseHoldTx(tx, res.UserID, res.Prepaid-fee, refID, note); err != nil {
+					return err
+				}
+			}
+			if fee > 0 {
+				// 用户的扣费已由预付和上面的差额记入余额流水，使用记录只用于计入 provider 收益，
+				// Cost 记为 0，避免对账单把结算费用重复计为请求消费
+				if err := tx.Create(&TokenUsage{
+					RequestID:   refID,
+					UserID:      res.UserID,
+					ClientID:    res.ClientID,
+					Model:       res.Model,
+					RequestType: "reservation",
+					Fee:         fee,
+					Outcome:     OutcomeCompleted,
+					Timestamp:   now,
+				}).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Model(res).Updates(map[string]interface{}{"status": ReservationSettled, "settled_fee": fee}).Error
+		})
+		if err == nil {
+			continue
+		}
+		log.Printf("settle reservation %d failed: %v", res.ID, err)
+		updates := map[string]interface{}{"settle_attempts": gorm.Expr("settle_attempts + 1")}
+		if res.SettleAttempts+1 >= MaxSettleAttempts {
+			updates["status"] = ReservationFailed
+			log.Printf("reservation %d marked failed after %d settlement attempts, user %s owes %.4f",
+				res.ID, res.SettleAttempts+1, res.UserID, res.Fee()-res.Prepaid)
+		}
+		if err := r.db.Model(res).Updates(updates).Error; err != nil {
+			log.Printf("record settlement failure of reservation %d failed: %v", res.ID, err)
+		}
+	}
+}
+
+// reservations 读取当前生效的预留，返回 userID 对 model 预留的 client 及其预留记录，
+// 以及其他用户在各 client 上预留的并发数（client 的并发由所有模型共享）
+func (s *Server) reservations(model, userID string) (map[string]*Reservation, map[string]int) {
+	if s.ReservationDB == nil {
+		return nil, nil
+	}
+	active, err := s.ReservationDB.Active(time.Now())
+	if err != nil {
+		log.Printf("query active reservations failed: %v", err)
+		return nil, nil
+	}
+	own := make(map[string]*Reservation)
+	others := make(map[string]int)
+	for _, res := range active {
+		if userID != "" && res.UserID == userID {
+			if res.Model == model {
+				own[res.ClientID] = res
+			}
+		} else {
+			others[res.ClientID] += res.Slots
+		}
+	}
+	return own, others
+}
+
+// unreserved returns a Predicate that keeps clients off the eligible set when other users have
+// reserved all of their slots.
+func unreserved(reservedByOthers map[string]int) Predicate {
+	return func(c *Client, model string) bool {
+		return reservedByOthers[c.ID] < c.Capacity()
+	}
+}
+
+// ReservationFor 返回 userID 在 clientID 上当前生效的 model 预留，没有时返回 nil
+func (s *Server) ReservationFor(userID, model, clientID string) *Reservation {
+	own, _ := s.reservations(model, userID)
+	return own[clientID]
+}
+
+// HasReservation 判断 userID 当前是否有 model 的生效预留
+func (s *Server) HasReservation(userID, model string) bool {
+	own, _ := s.reservations(model, userID)
+	return len(own) > 0
+}
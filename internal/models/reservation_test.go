@@ -0,0 +1,170 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"star-fire/pkg/public"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReservationRoutingAndSettlement(t *testing.T) {
+	db, _, userDB := newPromoTestDB(t)
+	resDB := NewReservationDB(db)
+	usageDB := NewTokenUsageDB(db)
+	clientDB := NewClientDB(db)
+	if err := userDB.AddBalance("user-1", 100); err != nil {
+		t.Fatalf("add balance: %v", err)
+	}
+	if err := clientDB.SaveClient(&Client{ID: "reserved", UserID: "provider-1"}); err != nil {
+		t.Fatalf("save client: %v", err)
+	}
+
+	server := &Server{ReservationDB: resDB, LoadBalanceAlgorithm: "random"}
+	clients := map[string]*Client{}
+	for id, ippm := range map[string]float64{"reserved": 9, "other": 1} {
+		clients[id] = &Client{
+			ID: id, Status: "online", ControlConn: &websocket.Conn{},
+			Models: []*public.Model{{Name: "model-a", IPPM: ippm, OPPM: ippm}},
+		}
+	}
+	server.clients.replace(map[string]map[string]*Client{"model-a": clients})
+
+	now := time.Now()
+	res := &Reservation{UserID: "user-1", ProviderID: "provider-1", ClientID: "reserved", Model: "model-a", Slots: 1,
+		StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour), PricingType: ReservationHourly, HourlyRate: 5}
+	if err := resDB.Create(res); err != nil {
+		t.Fatalf("create reservation: %v", err)
+	}
+	if server.HasReservation("user-1", "model-a") {
+		t.Fatal("pending reservation is active")
+	}
+	if _, err := resDB.Respond("provider-2", res.ID, true, 1); err == nil {
+		t.Fatal("another provider accepted the reservation")
+	}
+	if _, err := resDB.Respond("provider-1", res.ID, true, 1); err != nil {
+		t.Fatalf("accept reservation: %v", err)
+	}
+	// 接受时预付 2 小时 × 5
+	if balance, _, _ := userDB.GetBalance("user-1"); balance != 90 {
+		t.Fatalf("balance after accept = %v, want 90", balance)
+	}
+
+	// 预留方优先派发到预留的 client；其它用户不能占用已被全部预留的 client
+	for i := 0; i < 5; i++ {
+		if c := server.LoadBalance("model-a", "user-1"); c == nil || c.ID != "reserved" {
+			t.Fatalf("reserver routed to %v, want reserved", c)
+		}
+		if c := server.LoadBalance("model-a", "user-2"); c == nil || c.ID != "other" {
+			t.Fatalf("other user routed to %v, want other", c)
+		}
+	}
+	// 预留的 client 不具备请求所需的能力时回退到其他 client
+	clients["reserved"].Models[0].Capabilities = &public.Capabilities{}
+	clients["other"].Models[0].Capabilities = &public.Capabilities{JSONSchema: true}
+	if c, _ := server.LoadBalanceScored("model-a", "user-1", 0, nil, RouteOptions{Requires: public.Requirements{JSONSchema: true}}); c == nil || c.ID != "other" {
+		t.Fatalf("reserver needing json_schema routed to %v, want other", c)
+	}
+	if r := server.ReservationFor("user-1", "model-a", "reserved"); r == nil || r.Price(PriceSnapshot{IPPM: 9}).Cost(1000, 0, 1000, 0, 0) != 0 {
+		t.Fatalf("hourly reservation should make requests free, got %+v", r)
+	}
+
+	// 重叠的预留超过并发数时不能接受
+	overlap := &Reservation{UserID: "user-2", ProviderID: "provider-1", ClientID: "reserved", Model: "model-a", Slots: 1,
+		StartAt: now, EndAt: now.Add(2 * time.Hour), PricingType: ReservationToken, IPPM: 1, OPPM: 1}
+	if err := resDB.Create(overlap); err != nil {
+		t.Fatalf("create overlap: %v", err)
+	}
+	if _, err := resDB.Respond("provider-1", overlap.ID, true, 1); err == nil {
+		t.Fatal("accepted a reservation beyond capacity")
+	}
+
+	// 窗口结束后按预付的 2 小时 × 5 结算，费用计入 provider 收益
+	resDB.Settle(now.Add(2 * time.Hour))
+	if balance, _, _ := userDB.GetBalance("user-1"); balance != 90 {
+		t.Fatalf("balance after settlement = %v, want 90", balance)
+	}
+	settled, _ := resDB.Get(res.ID)
+	if settled.Status != ReservationSettled || settled.SettledFee != 10 {
+		t.Fatalf("settled reservation = %+v", settled)
+	}
+	if income, _ := usageDB.GetTotalIncomeByUserID("provider-1", clientDB); income.(float64) != 10 {
+		t.Fatalf("provider income = %v, want 10", income)
+	}
+}
+
+func TestTokenReservationBillsUnusedCommitment(t *testing.T) {
+	res := &Reservation{PricingType: ReservationToken, IPPM: 2, OPPM: 4, MinCommitment: 3, UsedCost: 1.25}
+	if fee := res.Fee(); fee != 1.75 {
+		t.Fatalf("fee = %v, want 1.75", fee)
+	}
+	res.UsedCost = 5
+	if fee := res.Fee(); fee != 0 {
+		t.Fatalf("fee = %v, want 0 once commitment is used", fee)
+	}
+	price := res.Price(PriceSnapshot{IPPM: 9, OPPM: 9, CIPPM: 3, RPPM: 9})
+	if price.IPPM != 2 || price.OPPM != 4 || price.CIPPM != 2 {
+		t.Fatalf("reserved price = %+v", price)
+	}
+}
+
+func TestReservationPrepaymentAndSettlementFailure(t *testing.T) {
+	db, _, userDB := newPromoTestDB(t)
+	resDB := NewReservationDB(db)
+	NewTokenUsageDB(db)
+	if err := userDB.AddBalance("user-1", 3); err != nil {
+		t.Fatalf("add balance: %v", err)
+	}
+	now := time.Now()
+
+	// 余额不足以预付时不能接受
+	hourly := &Reservation{UserID: "user-1", ProviderID: "provider-1", ClientID: "c1", Model: "model-a", Slots: 1,
+		StartAt: now.Add(time.Hour), EndAt: now.Add(2 * time.Hour), PricingType: ReservationHourly, HourlyRate: 5}
+	if err := resDB.Create(hourly); err != nil {
+		t.Fatalf("create reservation: %v", err)
+	}
+	if _, err := resDB.Respond("provider-1", hourly.ID, true, 1); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("accept without balance: err = %v, want ErrInsufficientBalance", err)
+	}
+
+	// 按 tokens 计费预付最低承诺金额，用量不足的部分从押金中收取，其余退还
+	token := &Reservation{UserID: "user-1", ProviderID: "provider-1", ClientID: "c1", Model: "model-a", Slots: 1,
+		StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour), PricingType: ReservationToken, IPPM: 1, OPPM: 1, MinCommitment: 2}
+	if err := resDB.Create(token); err != nil {
+		t.Fatalf("create reservation: %v", err)
+	}
+	if _, err := resDB.Respond("provider-1", token.ID, true, 1); err != nil {
+		t.Fatalf("accept token reservation: %v", err)
+	}
+	if active, _ := resDB.Active(now); len(active) != 1 || active[0].ID != token.ID {
+		t.Fatalf("active reservations = %v, want the accepted one", active)
+	}
+	if err := resDB.AddUsage(token.ID, 1.5); err != nil {
+		t.Fatalf("add usage: %v", err)
+	}
+	resDB.Settle(now.Add(2 * time.Hour))
+	if balance, _, _ := userDB.GetBalance("user-1"); math.Abs(balance-2.5) > 1e-9 {
+		t.Fatalf("balance after settlement = %v, want 2.5", balance)
+	}
+	if active, _ := resDB.Active(now); len(active) != 0 {
+		t.Fatalf("settled reservation still active: %v", active)
+	}
+
+	// 未预付的预留结算时余额不足，重试 MaxSettleAttempts 次后记为欠费
+	legacy := &Reservation{UserID: "user-1", ProviderID: "provider-1", ClientID: "c1", Model: "model-a", Slots: 1,
+		StartAt: now.Add(-2 * time.Hour), EndAt: now.Add(-time.Hour), PricingType: ReservationHourly, HourlyRate: 5,
+		Status: ReservationAccepted}
+	if err := db.Create(legacy).Error; err != nil {
+		t.Fatalf("create legacy reservation: %v", err)
+	}
+	for i := 0; i < MaxSettleAttempts; i++ {
+		resDB.Settle(now)
+	}
+	failed, _ := resDB.Get(legacy.ID)
+	if failed.Status != ReservationFailed || failed.SettleAttempts != MaxSettleAttempts {
+		t.Fatalf("legacy reservation = %+v, want failed after %d attempts", failed, MaxSettleAttempts)
+	}
+}
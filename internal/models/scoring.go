@@ -0,0 +1,231 @@
+package models
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 评分维度，同时作为权重配置项 key 的后缀（lb_weight_<metric>）
+const (
+	ScoreLatency  = "latency"  // 心跳延迟，越低越好
+	ScoreTTFT     = "ttft"     // 近期首 token 耗时，越低越好
+	ScoreSpeed    = "speed"    // 近期输出速度 tokens/s，越高越好
+	ScoreErrors   = "errors"   // 近期失败率，越低越好
+	ScoreCapacity = "capacity" // 空闲并发比例，越高越好
+	ScorePrice    = "price"    // 输入+输出价格，越低越好
+)
+
+// ScoreMetrics 参与评分的维度，按固定顺序输出
+var ScoreMetrics = []string{ScoreLatency, ScoreTTFT, ScoreSpeed, ScoreErrors, ScoreCapacity, ScorePrice}
+
+// ConfigKeyLBWeightPrefix 评分权重配置项前缀
+const ConfigKeyLBWeightPrefix = "lb_weight_"
+
+// DefaultScoreWeights 未配置时的评分权重，失败率权重更高
+var DefaultScoreWeights = map[string]float64{
+	ScoreLatency:  1,
+	ScoreTTFT:     1,
+	ScoreSpeed:    1,
+	ScoreErrors:   2,
+	ScoreCapacity: 1,
+	ScorePrice:    1,
+}
+
+// clientStatsAlpha 近期指标的指数移动平均系数
+const clientStatsAlpha = 0.2
+
+// ClientStats client 近期请求表现的指数移动平均
+type ClientStats struct {
+	TTFTMs       float64 `json:"ttft_ms"`
+	TokensPerSec float64 `json:"tokens_per_sec"`
+	ErrorRate    float64 `json:"error_rate"`
+	Samples      int     `json:"samples"`
+}
+
+func ewma(prev, value float64, first bool) float64 {
+	if first {
+		return value
+	}
+	return prev + clientStatsAlpha*(value-prev)
+}
+
+// RecordClientResult 记录一次派发给 client 的请求结果。ttft 与 tokensPerSec 为 0 表示未测得（如失败请求）。
+func (s *Server) RecordClientResult(clientID string, ttft time.Duration, tokensPerSec float64, failed bool) {
+	s.clientStatsMu.Lock()
+	defer s.clientStatsMu.Unlock()
+	if s.clientStats == nil {
+		s.clientStats = make(map[string]*ClientStats)
+	}
+	st, ok := s.clientStats[clientID]
+	if !ok {
+		st = &ClientStats{}
+		s.clientStats[clientID] = st
+	}
+	errValue := 0.0
+	if failed {
+		errValue = 1
+	}
+	st.ErrorRate = ewma(st.ErrorRate, errValue, st.Samples == 0)
+	if ttft > 0 {
+		st.TTFTMs = ewma(st.TTFTMs, float64(ttft.Milliseconds()), st.TTFTMs == 0)
+	}
+	if tokensPerSec > 0 {
+		st.TokensPerSec = ewma(st.TokensPerSec, tokensPerSec, st.TokensPerSec == 0)
+	}
+	st.Samples++
+}
+
+// ClientStatsOf 返回 client 近期表现的副本
+func (s *Server) ClientStatsOf(clientID string) ClientStats {
+	s.clientStatsMu.Lock()
+	defer s.clientStatsMu.Unlock()
+	if st, ok := s.clientStats[clientID]; ok {
+		return *st
+	}
+	return ClientStats{}
+}
+
+// ScoreWeights 读取管理员配置的评分权重，未配置的维度使用默认值。配置在内存中缓存，
+// 管理员修改权重时失效
+func (s *Server) ScoreWeights() map[string]float64 {
+	weights := make(map[string]float64, len(DefaultScoreWeights))
+	for k, v := range DefaultScoreWeights {
+		weights[k] = v
+	}
+	if s.SystemConfigDB == nil {
+		return weights
+	}
+	cfgs, err := s.SystemConfigDB.CachedByPrefix(ConfigKeyLBWeightPrefix)
+	if err != nil {
+		return weights
+	}
+	for metric, value := range cfgs {
+		if _, ok := weights[metric]; !ok {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil && v >= 0 {
+			weights[metric] = v
+		}
+	}
+	return weights
+}
+
+// forgetClientStats client 下线后丢弃其近期表现
+func (s *Server) forgetClientStats(clientID string) {
+	s.clientStatsMu.Lock()
+	delete(s.clientStats, clientID)
+	s.clientStatsMu.Unlock()
+}
+
+// ClientScore 一个 client 的评分明细：各维度归一化到 [0, 1]，Total 为加权平均
+type ClientScore struct {
+	Client  *Client            `json:"-"`
+	Total   float64            `json:"total"`
+	Metrics map[string]float64 `json:"metrics"`
+}
+
+// String 以 "total=0.82;latency=1.00;..." 的形式输出评分明细，用于日志和响应头
+func (cs *ClientScore) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "client=%s;total=%.3f", cs.Client.ID, cs.Total)
+	for _, m := range ScoreMetrics {
+		fmt.Fprintf(&b, ";%s=%.3f", m, cs.Metrics[m])
+	}
+	return b.String()
+}
+
+type clientObservation struct {
+	latency, ttft, speed, errRate, free, price float64
+}
+
+// ScoreClients 对 eligible 中的 client 逐项评分。越低越好的指标按 最优值/自身值 归一化，
+// 越高越好的指标按 自身值/最优值 归一化；还没有数据的 client 该项记为 1，使新 client 也能获得流量。
+func (s *Server) ScoreClients(model string, promptTokens int, eligible []*Client) []*ClientScore {
+	weights := s.ScoreWeights()
+
+	obs := make([]clientObservation, len(eligible))
+	best := clientObservation{}
+	for i, c := range eligible {
+		st := s.ClientStatsOf(c.ID)
+		o := clientObservation{
+			latency: float64(max(c.GetLatency(), 1)),
+			ttft:    st.TTFTMs,
+			speed:   st.TokensPerSec,
+			errRate: st.ErrorRate,
+			free:    float64(max(s.FreeSlots(c), 0)) / float64(c.Capacity()),
+		}
+		if m, ok := c.ModelInfo(model); ok {
+			ippm, oppm, _ := m.PriceFor(promptTokens)
+			o.price = ippm + oppm
+		}
+		obs[i] = o
+		best.latency = lowest(best.latency, o.latency)
+		best.ttft = lowest(best.ttft, o.ttft)
+		best.speed = max(best.speed, o.speed)
+		best.price = lowest(best.price, o.price)
+	}
+
+	scores := make([]*ClientScore, len(eligible))
+	for i, c := range eligible {
+		o := obs[i]
+		metrics := map[string]float64{
+			ScoreLatency:  ratioOrOne(best.latency, o.latency),
+			ScoreTTFT:     ratioOrOne(best.ttft, o.ttft),
+			ScoreSpeed:    ratioOrOne(o.speed, best.speed),
+			ScoreErrors:   1 - o.errRate,
+			ScoreCapacity: o.free,
+			ScorePrice:    ratioOrOne(best.price, o.price),
+		}
+		total, weightSum := 0.0, 0.0
+		for m, v := range metrics {
+			total += weights[m] * v
+			weightSum += weights[m]
+		}
+		if weightSum > 0 {
+			total /= weightSum
+		}
+		scores[i] = &ClientScore{Client: c, Total: total, Metrics: metrics}
+	}
+	return scores
+}
+
+// lowest 返回 cur 与 v 中较小的正数，忽略没有数据（<=0）的值
+func lowest(cur, v float64) float64 {
+	if v > 0 && (cur <= 0 || v < cur) {
+		return v
+	}
+	return cur
+}
+
+// ratioOrOne 返回 num/den，任一项没有数据（<=0）时返回 1
+func ratioOrOne(num, den float64) float64 {
+	if num <= 0 || den <= 0 {
+		return 1
+	}
+	return num / den
+}
+
+// pickWeighted 按评分占比随机选择 client；所有评分都为 0 时等概率选择
+func pickWeighted(scores []*ClientScore) *ClientScore {
+	if len(scores) == 0 {
+		return nil
+	}
+	sum := 0.0
+	for _, sc := range scores {
+		sum += sc.Total
+	}
+	if sum <= 0 {
+		return scores[rand.Intn(len(scores))]
+	}
+	r := rand.Float64() * sum
+	for _, sc := range scores {
+		r -= sc.Total
+		if r < 0 {
+			return sc
+		}
+	}
+	return scores[len(scores)-1]
+}
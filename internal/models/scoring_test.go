@@ -0,0 +1,73 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"star-fire/pkg/public"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+func TestScoreClientsAndWeightedPick(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	server := &Server{SystemConfigDB: NewSystemConfigDB(db), LoadBalanceAlgorithm: "weighted"}
+	fast := &Client{ID: "fast", Status: "online", ControlConn: &websocket.Conn{}, Latency: 10,
+		Models: []*public.Model{{Name: "model-a", IPPM: 1, OPPM: 1}}}
+	slow := &Client{ID: "slow", Status: "online", ControlConn: &websocket.Conn{}, Latency: 40,
+		Models: []*public.Model{{Name: "model-a", IPPM: 2, OPPM: 2}}}
+	server.clients.replace(map[string]map[string]*Client{"model-a": {"fast": fast, "slow": slow}})
+
+	server.RecordClientResult("fast", 200*time.Millisecond, 50, false)
+	server.RecordClientResult("slow", 800*time.Millisecond, 25, false)
+	server.RecordClientResult("slow", 0, 0, true)
+
+	// 只看价格：slow 的价格是 fast 的两倍
+	for _, metric := range ScoreMetrics {
+		if err := server.SystemConfigDB.Set(ConfigKeyLBWeightPrefix+metric, "0"); err != nil {
+			t.Fatalf("set weight: %v", err)
+		}
+	}
+	server.SystemConfigDB.Set(ConfigKeyLBWeightPrefix+ScorePrice, "1")
+	scores := server.ScoreClients("model-a", 0, []*Client{fast, slow})
+	if scores[0].Total != 1 || scores[1].Total != 0.5 {
+		t.Fatalf("price-only scores = %v, %v, want 1, 0.5", scores[0], scores[1])
+	}
+
+	server.SystemConfigDB.Set(ConfigKeyLBWeightPrefix+ScoreLatency, "1")
+	server.SystemConfigDB.Set(ConfigKeyLBWeightPrefix+ScoreTTFT, "1")
+	server.SystemConfigDB.Set(ConfigKeyLBWeightPrefix+ScoreSpeed, "1")
+	server.SystemConfigDB.Set(ConfigKeyLBWeightPrefix+ScoreErrors, "1")
+	scores = server.ScoreClients("model-a", 0, []*Client{fast, slow})
+	m := scores[1].Metrics
+	// slow 的失败率 EWMA：0 -> 0.2
+	if m[ScoreLatency] != 0.25 || m[ScoreTTFT] != 0.25 || m[ScoreSpeed] != 0.5 || math.Abs(m[ScoreErrors]-0.8) > 1e-9 || m[ScoreCapacity] != 1 {
+		t.Fatalf("slow metrics = %v", m)
+	}
+
+	// 按评分占比抽样
+	picks := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		c, score := server.LoadBalanceScored("model-a", "", 0, nil, RouteOptions{})
+		if score == nil || score.Client != c {
+			t.Fatal("weighted pick returned no score breakdown")
+		}
+		picks[c.ID]++
+	}
+	want := scores[0].Total / (scores[0].Total + scores[1].Total)
+	if got := float64(picks["fast"]) / 4000; math.Abs(got-want) > 0.05 {
+		t.Fatalf("fast picked %.3f of the time, want about %.3f", got, want)
+	}
+
+	// 下线的 client 不再保留近期表现
+	server.UnregisterClient(slow)
+	if st := server.ClientStatsOf("slow"); st.Samples != 0 {
+		t.Fatalf("stats of unregistered client kept: %+v", st)
+	}
+}
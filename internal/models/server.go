@@ -12,11 +12,9 @@ import (
 	"star-fire/pkg/public"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/glebarez/sqlite"
-	"github.com/gorilla/websocket"
 	"github.com/sashabaranov/go-openai"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -31,14 +29,19 @@ type MailService struct {
 }
 
 type Server struct {
-	clientsMu sync.Mutex
-	clients   atomic.Value // stores map[string]map[string]*Client
+	clients clientRegistry // model -> clientID -> client, sharded by model
 
 	clientRBMu            sync.RWMutex
 	clientRoundRobinIndex map[string]int // for round-robin load balancing
 
+	clientStatsMu sync.Mutex
+	clientStats   map[string]*ClientStats // recent per-client TTFT, speed and error rate for weighted scoring
+
+	inflight sync.Map // clientID -> *inflightCounter, requests currently dispatched to each client
+
 	respClientsMu sync.RWMutex
-	RespClients   map[string]*websocket.Conn
+	RespClients   map[string]ResponseStream
+	muxStreams    sync.Map // fingerprint -> *muxStream，派发时登记、尚未关闭的复用响应流
 
 	respClientReadyChans   map[string]chan struct{}
 	respClientReadyChansMu sync.Mutex
@@ -56,6 +59,18 @@ type Server struct {
 	RechargeDB          *RechargeDB
 	UserPriceCapDB      *UserPriceCapDB
 	SystemConfigDB      *SystemConfigDB
+	BalanceHistoryDB    *BalanceHistoryDB
+	PromoCodeDB         *PromoCodeDB
+	ReferralDB          *ReferralDB
+	SubscriptionDB      *SubscriptionDB
+	RefundDB            *RefundDB
+	StatementDB         *StatementDB
+	SpendLimitDB        *SpendLimitDB
+	DiscountDB          *DiscountDB
+	PriceHistoryDB      *PriceHistoryDB
+	ReservationDB       *ReservationDB
+	ModelCatalogDB      *ModelCatalogDB
+	ModelGroupDB        *ModelGroupDB
 
 	LoadBalanceAlgorithm string // Load balancing algorithm, e.g., "round-robin", "random", etc.
 
@@ -107,6 +122,18 @@ func NewServer() *Server {
 	userPriceCapDB := NewUserPriceCapDB(gormDB)
 	rechargeDB := NewRechargeDB(gormDB)
 	systemConfigDB := NewSystemConfigDB(gormDB)
+	balanceHistoryDB := NewBalanceHistoryDB(gormDB)
+	promoCodeDB := NewPromoCodeDB(gormDB)
+	referralDB := NewReferralDB(gormDB)
+	subscriptionDB := NewSubscriptionDB(gormDB)
+	refundDB := NewRefundDB(gormDB)
+	statementDB := NewStatementDB(gormDB)
+	spendLimitDB := NewSpendLimitDB(gormDB)
+	discountDB := NewDiscountDB(gormDB)
+	priceHistoryDB := NewPriceHistoryDB(gormDB)
+	reservationDB := NewReservationDB(gormDB)
+	modelCatalogDB := NewModelCatalogDB(gormDB)
+	modelGroupDB := NewModelGroupDB(gormDB)
 
 	// 初始化默认用户
 	err = userDB.InitDefaultUsers()
@@ -114,14 +141,11 @@ func NewServer() *Server {
 		log.Printf("init default user failed: %v", err)
 	}
 
-	clientsVal := new(atomic.Value)
-	clientsVal.Store(make(map[string]map[string]*Client))
-
 	server := &Server{
-		clients:               *clientsVal,
 		Port:                  configs.Config.ServerPort,
-		RespClients:           make(map[string]*websocket.Conn),
+		RespClients:           make(map[string]ResponseStream),
 		clientRoundRobinIndex: make(map[string]int),
+		clientStats:           make(map[string]*ClientStats),
 		respClientReadyChans:  make(map[string]chan struct{}),
 
 		DB:                   gormDB,
@@ -135,6 +159,18 @@ func NewServer() *Server {
 		UserPriceCapDB:       userPriceCapDB,
 		RechargeDB:           rechargeDB,
 		SystemConfigDB:       systemConfigDB,
+		BalanceHistoryDB:     balanceHistoryDB,
+		PromoCodeDB:          promoCodeDB,
+		ReferralDB:           referralDB,
+		SubscriptionDB:       subscriptionDB,
+		RefundDB:             refundDB,
+		StatementDB:          statementDB,
+		SpendLimitDB:         spendLimitDB,
+		DiscountDB:           discountDB,
+		PriceHistoryDB:       priceHistoryDB,
+		ReservationDB:        reservationDB,
+		ModelCatalogDB:       modelCatalogDB,
+		ModelGroupDB:         modelGroupDB,
 		LoadBalanceAlgorithm: configs.Config.LBA, // default load balancing algorithm
 		MailService: &MailService{
 			SMTPServer:   configs.Config.EmailHost,
@@ -145,6 +181,7 @@ func NewServer() *Server {
 		},
 		Conf: &configs.Config,
 	}
+	server.migrateCanonicalRuleModels()
 
 	go func() {
 		ticker := time.NewTicker(1 * time.Hour)
@@ -152,6 +189,9 @@ func NewServer() *Server {
 
 		for range ticker.C {
 			server.RegisterTokenStore.CleanupExpiredTokens()
+			server.SubscriptionDB.RenewDue()
+			server.CloseLastMonth()
+			server.ReservationDB.Settle(time.Now())
 		}
 	}()
 	return server
@@ -164,52 +204,124 @@ type Predicate func(c *Client, model string) bool
 // clientHealthy returns true when the client is online, connected, and has acceptable latency.
 // Used both as a Predicate and to identify dead clients for cleanup.
 func clientHealthy(c *Client, model string) bool {
-	for _, m := range c.Models {
-		if m.Name == model {
-			return c.Status == "online" && c.ControlConn != nil && c.GetLatency() < public.MAXLATENCE
-		}
+	if _, ok := c.ModelInfo(model); !ok {
+		return false
 	}
-	return false
+	return c.Status == "online" && c.ControlConn != nil && c.GetLatency() < public.MAXLATENCE
 }
 
-// priceEligible returns a Predicate that passes only clients whose model price is within
-// the user-configured caps. math.MaxFloat64 caps mean "no restriction".
-func priceEligible(maxIPPM, maxOPPM float64) Predicate {
+// priceEligible returns a Predicate that passes only clients whose model price, at the price
+// tier matching promptTokens, is within the user-configured caps. math.MaxFloat64 caps mean
+// "no restriction".
+func priceEligible(maxIPPM, maxOPPM float64, promptTokens int) Predicate {
 	return func(c *Client, model string) bool {
-		for _, m := range c.Models {
-			if m.Name == model {
-				return m.IPPM <= maxIPPM && m.OPPM <= maxOPPM
-			}
+		m, ok := c.ModelInfo(model)
+		if !ok {
+			return false
 		}
-		return false
+		ippm, oppm, _ := m.PriceFor(promptTokens)
+		return ippm <= maxIPPM && oppm <= maxOPPM
 	}
 }
 
 // LoadBalance selects a client for model+user using a Predicate → (Score) → Pick pipeline.
 // userID is used to look up per-user price caps; pass an empty string to skip price filtering.
 func (s *Server) LoadBalance(model, userID string) *Client {
-	return s.LoadBalanceExcluding(model, userID, nil)
+	return s.LoadBalanceExcluding(model, userID, 0, nil)
 }
 
 // LoadBalanceExcluding 与 LoadBalance 相同，但会排除 excludeIDs 中已失败的 client，
-// 避免重试时反复 pick 到同一个失效 client。
-func (s *Server) LoadBalanceExcluding(model, userID string, excludeIDs map[string]bool) *Client {
+// 避免重试时反复 pick 到同一个失效 client。promptTokens 为估算的提示长度，用于匹配阶梯价格。
+func (s *Server) LoadBalanceExcluding(model, userID string, promptTokens int, excludeIDs map[string]bool) *Client {
+	client, _ := s.LoadBalanceScored(model, userID, promptTokens, excludeIDs, RouteOptions{})
+	return client
+}
+
+// LoadBalanceScored 与 LoadBalanceExcluding 相同，但可以通过 opts 按请求选择算法；
+// 使用 weighted 算法时额外返回选中 client 的评分明细（其它算法返回 nil），供调试日志和响应头使用。
+func (s *Server) LoadBalanceScored(model, userID string, promptTokens int, excludeIDs map[string]bool, opts RouteOptions) (*Client, *ClientScore) {
+	eligible, dead := s.eligibleClients(model, userID, promptTokens, excludeIDs, opts)
+
+	for _, id := range dead {
+		s.RemoveClient(model, id)
+	}
+
+	if len(eligible) == 0 {
+		log.Println("no eligible client for model:", model)
+		return nil, nil
+	}
+
+	algorithm := s.LoadBalanceAlgorithm
+	if opts.Algorithm != "" {
+		algorithm = opts.Algorithm
+	}
+	return s.pickScored(model, userID, promptTokens, algorithm, eligible, opts)
+}
+
+// pickScored runs the Score → Pick phases over eligible. Only the weighted algorithm uses
+// explicit scores and returns the picked client's breakdown; the cheapest algorithms price the
+// request for userID at promptTokens/opts.OutputTokens; the others are handled by pick.
+func (s *Server) pickScored(model, userID string, promptTokens int, algorithm string, eligible []*Client, opts RouteOptions) (*Client, *ClientScore) {
+	switch algorithm {
+	case LBWeighted:
+		scores := s.ScoreClients(model, promptTokens, eligible)
+		picked := pickWeighted(scores)
+		if configs.Config.LBDebug {
+			for _, sc := range scores {
+				log.Printf("lb score model=%s %s", model, sc)
+			}
+		}
+		return picked.Client, picked
+	case LBCheapest:
+		return s.pickCheapest(model, userID, promptTokens, opts.OutputTokens, eligible, 0), nil
+	case LBCheapestWithBudget:
+		budget := opts.LatencyBudget
+		if budget <= 0 {
+			budget = time.Duration(configs.Config.LBLatencyBudget) * time.Millisecond
+		}
+		return s.pickCheapest(model, userID, promptTokens, opts.OutputTokens, eligible, budget), nil
+	}
+
+	// Pick phase.
+	return s.pick(model, algorithm, eligible), nil
+}
+
+// EligibleClients returns the clients that would be considered for model+user by LoadBalance,
+// without picking one or cleaning up dead clients.
+func (s *Server) EligibleClients(model, userID string, promptTokens int) []*Client {
+	eligible, _ := s.eligibleClients(model, userID, promptTokens, nil, RouteOptions{})
+	return eligible
+}
+
+// eligibleClients runs the Predicate phase and returns the eligible clients and the IDs of
+// unhealthy clients found in the snapshot. Clients must meet opts.Requires and the price limits
+// of both the user and opts (a model group). Healthy clients reserved by userID that meet them
+// are the only eligible clients; when there is none, the reserved clients compete with the pool
+// under the usual predicates.
+func (s *Server) eligibleClients(model, userID string, promptTokens int, excludeIDs map[string]bool, opts RouteOptions) ([]*Client, []string) {
 	// Resolve price cap (math.MaxFloat64 = no cap configured, i.e. unlimited).
 	maxIPPM, maxOPPM := math.MaxFloat64, math.MaxFloat64
 	if s.UserPriceCapDB != nil && userID != "" {
 		maxIPPM, maxOPPM, _ = s.UserPriceCapDB.GetPriceCap(userID, model)
 	}
+	if opts.MaxIPPM > 0 {
+		maxIPPM = min(maxIPPM, opts.MaxIPPM)
+	}
+	if opts.MaxOPPM > 0 {
+		maxOPPM = min(maxOPPM, opts.MaxOPPM)
+	}
+	req := opts.Requires
 
-	// Load the immutable snapshot (lock-free).
-	allClients := s.clients.Load().(map[string]map[string]*Client)
-	snapshot := allClients[model]
+	// Load the immutable snapshot of the model's shard (lock-free).
+	snapshot := s.clients.get(model)
 
 	// Predicate phase.
 	// Health is checked first and also identifies dead clients for background cleanup.
 	// Additional predicates (price, capacity, geo …) are applied to the survivors.
-	extraPredicates := []Predicate{priceEligible(maxIPPM, maxOPPM)}
+	own, reservedByOthers := s.reservations(model, userID)
+	extraPredicates := []Predicate{unreserved(reservedByOthers), priceEligible(maxIPPM, maxOPPM, promptTokens), capable(req)}
 
-	var eligible []*Client
+	var eligible, reserved, saturated []*Client
 	var dead []string
 	for id, c := range snapshot {
 		if excludeIDs != nil && excludeIDs[id] {
@@ -219,6 +331,10 @@ func (s *Server) LoadBalanceExcluding(model, userID string, excludeIDs map[strin
 			dead = append(dead, id)
 			continue
 		}
+		if res := own[id]; res != nil && capable(req)(c, model) && res.IPPM <= maxIPPM && res.OPPM <= maxOPPM {
+			reserved = append(reserved, c)
+			continue
+		}
 		pass := true
 		for _, pred := range extraPredicates {
 			if !pred(c, model) {
@@ -226,29 +342,30 @@ func (s *Server) LoadBalanceExcluding(model, userID string, excludeIDs map[strin
 				break
 			}
 		}
-		if pass {
-			eligible = append(eligible, c)
+		if !pass {
+			continue
+		}
+		if !notSaturated(c, model) {
+			saturated = append(saturated, c)
+			continue
 		}
+		eligible = append(eligible, c)
 	}
-
-	for _, id := range dead {
-		s.RemoveClient(model, id)
+	if len(reserved) > 0 {
+		return reserved, dead
 	}
-
 	if len(eligible) == 0 {
-		log.Println("no eligible client for model:", model)
-		return nil
+		// 所有 client 都在排队时仍然派发，由 client 端排队处理
+		return saturated, dead
 	}
-
-	// Score phase: currently implicit in the pick algorithm (future: weighted scoring).
-	// Pick phase.
-	return s.pick(model, eligible)
+	return eligible, dead
 }
 
-// pick selects one client from eligible using the configured load-balance algorithm.
-func (s *Server) pick(model string, eligible []*Client) *Client {
-	switch s.LoadBalanceAlgorithm {
-	case "round-robin":
+// pick selects one client from eligible using an algorithm that needs neither scores nor the
+// request's price (see pickScored).
+func (s *Server) pick(model, algorithm string, eligible []*Client) *Client {
+	switch algorithm {
+	case LBRoundRobin:
 		// Sort by ID for a stable, deterministic order across goroutines.
 		sort.Slice(eligible, func(i, j int) bool { return eligible[i].ID < eligible[j].ID })
 		s.clientRBMu.Lock()
@@ -260,85 +377,91 @@ func (s *Server) pick(model string, eligible []*Client) *Client {
 		s.clientRoundRobinIndex[model] = index + 1
 		return eligible[index]
 
-	case "random":
+	case LBRandom:
 		return eligible[rand.Intn(len(eligible))]
 
-	case "min-conn":
-		clientIDs := make([]string, 0, len(eligible))
-		eligibleMap := make(map[string]*Client, len(eligible))
-		for _, c := range eligible {
-			clientIDs = append(clientIDs, c.ID)
-			eligibleMap[c.ID] = c
-		}
-		chatConnections, err := s.ClientFingerprintDB.GetClientChatConnections(clientIDs)
-		if err != nil {
-			log.Println("get client chat connections error:", err)
-			return nil
-		}
-		selectedID := ""
-		minIdleCount := 65535
-		for _, result := range chatConnections {
-			c, ok := eligibleMap[result.ClientID]
-			if !ok {
-				continue
-			}
-			var idle int
-			if c.InferenceEngine.Name == "ollama" && c.InferenceEngine.NumParallel > 0 {
-				idle = c.InferenceEngine.NumParallel - result.Count
-			} else {
-				idle = 1 - result.Count
-			}
-			if idle < minIdleCount {
-				minIdleCount = idle
-				selectedID = result.ClientID
-			}
-		}
-		if selectedID != "" {
-			log.Println("found client:", selectedID, "for model:", model)
-			return eligibleMap[selectedID]
-		}
-		return nil
+	case LBMinConn:
+		return s.pickMinConn(eligible)
 	}
-	log.Println("unknown load balance algorithm:", s.LoadBalanceAlgorithm)
+	log.Println("unknown load balance algorithm:", algorithm)
 	return nil
 }
 
-func copyClientsMap(src map[string]map[string]*Client) map[string]map[string]*Client {
-	dst := make(map[string]map[string]*Client, len(src))
-	for modelName, inner := range src {
-		newInner := make(map[string]*Client, len(inner))
-		for id, c := range inner {
-			newInner[id] = c
-		}
-		dst[modelName] = newInner
-	}
-	return dst
+// RegisterModel 把 client 登记到 model 下，model.Name 应为规范 ID（见 CanonicalizeModels）
+func (s *Server) RegisterModel(model *public.Model, client *Client) {
+	s.recordPrice(model, client)
+
+	client.registryMu.Lock()
+	defer client.registryMu.Unlock()
+	s.registerLocked(model.Name, client)
 }
 
-func (s *Server) RegisterModel(model *public.Model, client *Client) {
-	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
+// registerLocked 登记 client 的一个模型，调用方持有 client.registryMu
+func (s *Server) registerLocked(name string, client *Client) {
+	if client.registered == nil {
+		client.registered = make(map[string]bool)
+	}
+	client.registered[name] = true
+	if !s.clients.add(name, client) {
+		return
+	}
+	log.Println("register model:", name, "for client:", client.ID)
+}
 
-	oldMap := s.clients.Load().(map[string]map[string]*Client)
-	if inner, exists := oldMap[model.Name]; exists {
-		if current, exists := inner[client.ID]; exists && current == client {
-			log.Println("model:", model.Name, "already registered for client:", client.ID)
+// SyncModels 按 client 心跳上报的 client.Models 更新登记：记录报价；模型集合与已登记的相同时
+// 不改动登记表，否则登记新增的模型并移除不再提供的模型
+func (s *Server) SyncModels(client *Client) {
+	models := client.ModelsSnapshot()
+	names := make(map[string]bool, len(models))
+	for i := range models {
+		s.recordPrice(&models[i], client)
+		names[models[i].Name] = true
+	}
+
+	client.registryMu.Lock()
+	defer client.registryMu.Unlock()
+	if len(names) == len(client.registered) {
+		same := true
+		for name := range names {
+			if !client.registered[name] {
+				same = false
+				break
+			}
+		}
+		if same {
 			return
 		}
 	}
+	for name := range client.registered {
+		if !names[name] {
+			s.clients.remove(name, client.ID, client)
+			log.Println("unregister model:", name, "for client:", client.ID)
+		}
+	}
+	client.registered = make(map[string]bool, len(names))
+	for name := range names {
+		s.registerLocked(name, client)
+	}
+}
 
-	newMap := copyClientsMap(oldMap)
-	if _, exists := newMap[model.Name]; !exists {
-		newMap[model.Name] = make(map[string]*Client)
+// UnregisterClient 连接断开时移除 client 登记的所有模型
+func (s *Server) UnregisterClient(client *Client) {
+	client.registryMu.Lock()
+	defer client.registryMu.Unlock()
+	for name := range client.registered {
+		s.clients.remove(name, client.ID, client)
 	}
-	newMap[model.Name][client.ID] = client
-	s.clients.Store(newMap)
-	log.Println("register model:", model.Name, "for client:", client.ID)
+	for _, m := range client.ModelsSnapshot() {
+		s.clients.remove(m.Name, client.ID, client)
+	}
+	client.registered = nil
+	s.recordOffline(client)
+	s.forgetClientStats(client.ID)
 }
 
 // for model marketplace
 func (s *Server) GetAllModels() []*MarketplaceModel {
-	allClients := s.clients.Load().(map[string]map[string]*Client)
+	allClients := s.clients.snapshot()
 
 	var marketplaceModels []*MarketplaceModel
 	var toRemove []struct{ model, client string }
@@ -356,7 +479,9 @@ func (s *Server) GetAllModels() []*MarketplaceModel {
 
 		for clientID, client := range clientMaps {
 			existModel := false
-			for _, m := range client.Models {
+			models := client.ModelsSnapshot()
+			for i := range models {
+				m := &models[i]
 				if m.Name == modelName && client.Status == "online" && client.ControlConn != nil && client.GetLatency() < public.MAXLATENCE {
 					existModel = true
 					model.Size = m.Size
@@ -382,14 +507,14 @@ func (s *Server) GetAllModels() []*MarketplaceModel {
 
 // for openAI api compatibility
 func (s *Server) GetModels() map[string]interface{} {
-	allClients := s.clients.Load().(map[string]map[string]*Client)
+	allClients := s.clients.snapshot()
 
 	var models []*public.Model
 	var toRemove []struct{ model, client string }
 	for modelName, clientMaps := range allClients {
 		for clientID, client := range clientMaps {
 			existModel := false
-			for _, m := range client.Models {
+			for _, m := range client.ModelsSnapshot() {
 				if m.Name == modelName && client.Status == "online" && client.ControlConn != nil && client.GetLatency() < public.MAXLATENCE {
 					existModel = true
 					models = append(models, &public.Model{
@@ -442,14 +567,14 @@ func (s *Server) GetModels() map[string]interface{} {
 	return result
 }
 
-func (s *Server) AddRespClient(id string, conn *websocket.Conn) {
+func (s *Server) AddRespClient(id string, conn ResponseStream) {
 	s.respClientsMu.Lock()
 	defer s.respClientsMu.Unlock()
 
 	s.RespClients[id] = conn
 }
 
-func (s *Server) GetRespClient(id string) (*websocket.Conn, bool) {
+func (s *Server) GetRespClient(id string) (ResponseStream, bool) {
 	s.respClientsMu.RLock()
 	defer s.respClientsMu.RUnlock()
 
@@ -457,11 +582,15 @@ func (s *Server) GetRespClient(id string) (*websocket.Conn, bool) {
 	return conn, ok
 }
 
+// RemoveRespClient 移除请求的响应连接，并关闭派发时登记的复用响应流
 func (s *Server) RemoveRespClient(id string) {
 	s.respClientsMu.Lock()
-	defer s.respClientsMu.Unlock()
-
 	delete(s.RespClients, id)
+	s.respClientsMu.Unlock()
+
+	if v, ok := s.muxStreams.Load(id); ok {
+		_ = v.(*muxStream).Close()
+	}
 }
 
 // AddRespClientChan 注册一个 channel 通知 handleChatResponse conn 已就绪
@@ -491,66 +620,50 @@ func (s *Server) NotifyRespClientReady(fingerPrint string) {
 	s.respClientReadyChansMu.Unlock()
 }
 
+// RemoveClient 从 model 下移除 clientID（不健康的 client 由负载均衡在后台清理）。
+// client 下次心跳仍上报该模型时会重新登记。
 func (s *Server) RemoveClient(modelName string, clientID string) {
-	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
-
-	oldMap := s.clients.Load().(map[string]map[string]*Client)
-	inner, exists := oldMap[modelName]
-	if !exists || inner[clientID] == nil {
-		return
-	}
-
-	newMap := copyClientsMap(oldMap)
-	delete(newMap[modelName], clientID)
-	if len(newMap[modelName]) == 0 {
-		delete(newMap, modelName)
+	if removed := s.clients.remove(modelName, clientID, nil); removed != nil {
+		removed.forgetModel(modelName)
 	}
-	s.clients.Store(newMap)
 }
 
+// RemoveClientInstance 与 RemoveClient 相同，但只在登记的正是 client 这个实例时移除
 func (s *Server) RemoveClientInstance(modelName string, client *Client) {
-	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
-
-	oldMap := s.clients.Load().(map[string]map[string]*Client)
-	inner, exists := oldMap[modelName]
-	if !exists || inner[client.ID] != client {
-		return
-	}
-
-	newMap := copyClientsMap(oldMap)
-	delete(newMap[modelName], client.ID)
-	if len(newMap[modelName]) == 0 {
-		delete(newMap, modelName)
+	if s.clients.remove(modelName, client.ID, client) != nil {
+		client.forgetModel(modelName)
 	}
-	s.clients.Store(newMap)
 }
 
 func (s *Server) GetClientByModel(model, clientID string) *Client {
-	allClients := s.clients.Load().(map[string]map[string]*Client)
-	modelClients := allClients[model]
-	if modelClients == nil {
-		return nil
-	}
-	return modelClients[clientID]
+	return s.clients.get(model)[clientID]
 }
 
 // UserModelInfo represents a model provided by the current user with its price info.
 type UserModelInfo struct {
-	ModelName string  `json:"model_name"`
-	Engine    string  `json:"engine"`
-	IPPM      float64 `json:"ippm"`
-	OPPM      float64 `json:"oppm"`
-	CIPPM     float64 `json:"cippm"`
-	ClientID  string  `json:"client_id"`
-	ClientIP  string  `json:"client_ip"`
-	Online    bool    `json:"online"`
+	ModelName  string             `json:"model_name"`
+	Engine     string             `json:"engine"`
+	IPPM       float64            `json:"ippm"`
+	OPPM       float64            `json:"oppm"`
+	CIPPM      float64            `json:"cippm"`
+	RPPM       float64            `json:"rppm"`
+	PPI        float64            `json:"ppi"`
+	PriceTiers []public.PriceTier `json:"price_tiers,omitempty"`
+	ClientID   string             `json:"client_id"`
+	ClientIP   string             `json:"client_ip"`
+	Online     bool               `json:"online"`
+
+	// 负载：Load 为 client 心跳上报的该模型负载，InFlight 为本服务器派发给该 client 的进行中请求数
+	Load        *public.ModelLoad `json:"load,omitempty"`
+	InFlight    int               `json:"in_flight"`
+	MaxParallel int               `json:"max_parallel"`
+	CPUPercent  float64           `json:"cpu_percent"`
+	MemPercent  float64           `json:"mem_percent"`
 }
 
 // GetUserModels returns all models provided by a specific user's connected clients.
 func (s *Server) GetUserModels(userID string) []*UserModelInfo {
-	allClients := s.clients.Load().(map[string]map[string]*Client)
+	allClients := s.clients.snapshot()
 
 	seen := make(map[string]bool) // clientID+modelName dedup
 	var result []*UserModelInfo
@@ -559,7 +672,7 @@ func (s *Server) GetUserModels(userID string) []*UserModelInfo {
 			if client.UserID != userID {
 				continue
 			}
-			for _, m := range client.Models {
+			for _, m := range client.ModelsSnapshot() {
 				if m.Name != modelName {
 					continue
 				}
@@ -568,31 +681,44 @@ func (s *Server) GetUserModels(userID string) []*UserModelInfo {
 					continue
 				}
 				seen[key] = true
-				result = append(result, &UserModelInfo{
-					ModelName: modelName,
-					Engine:    m.Engine,
-					IPPM:      m.IPPM,
-					OPPM:      m.OPPM,
-					CIPPM:     m.CIPPM,
-					ClientID:  client.ID,
-					ClientIP:  client.IP,
-					Online:    client.Status == "online" && client.ControlConn != nil && client.GetLatency() < public.MAXLATENCE,
-				})
+				info := &UserModelInfo{
+					ModelName:  modelName,
+					Engine:     m.Engine,
+					IPPM:       m.IPPM,
+					OPPM:       m.OPPM,
+					CIPPM:      m.CIPPM,
+					RPPM:       m.RPPM,
+					PPI:        m.PPI,
+					PriceTiers: m.PriceTiers,
+					ClientID:   client.ID,
+					ClientIP:   client.IP,
+					Online:     client.Status == "online" && client.ControlConn != nil && client.GetLatency() < public.MAXLATENCE,
+				}
+				info.InFlight = s.InFlightModel(client.ID, modelName)
+				info.MaxParallel = client.Capacity()
+				if load := client.Load(); load != nil {
+					info.CPUPercent, info.MemPercent = load.CPUPercent, load.MemPercent
+					if ml, ok := load.Model(modelName); ok {
+						info.Load = &ml
+					}
+				}
+				result = append(result, info)
 			}
 		}
 	}
 	return result
 }
 
-// UpdateModelPrice updates IPPM/OPPM/CIPPM for a model across all of a user's clients.
-func (s *Server) UpdateModelPrice(userID, modelName string, ippm, oppm, cippm float64) (int, error) {
-	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
+// UpdateModelPrice updates IPPM/OPPM/CIPPM/RPPM/PPI and price tiers for price.Name across all of a user's clients.
+// Prices above the platform ceilings are clamped in place; clamped reports whether any price was lowered.
+func (s *Server) UpdateModelPrice(userID string, price *public.Model) (count int, clamped bool, err error) {
+	price.Name, _ = s.CanonicalModel(price.Name)
+	clamped = s.ClampModelPrice(price)
+	modelName := price.Name
 
-	oldMap := s.clients.Load().(map[string]map[string]*Client)
-	clients, exists := oldMap[modelName]
-	if !exists {
-		return 0, fmt.Errorf("model %s not found", modelName)
+	clients := s.clients.get(modelName)
+	if len(clients) == 0 {
+		return 0, clamped, fmt.Errorf("model %s not found", modelName)
 	}
 
 	var updated []*Client
@@ -600,45 +726,35 @@ func (s *Server) UpdateModelPrice(userID, modelName string, ippm, oppm, cippm fl
 		if client.UserID != userID {
 			continue
 		}
+		client.modelsMu.Lock()
 		for _, m := range client.Models {
 			if m.Name == modelName {
-				m.IPPM = ippm
-				m.OPPM = oppm
-				m.CIPPM = cippm
+				m.IPPM = price.IPPM
+				m.OPPM = price.OPPM
+				m.CIPPM = price.CIPPM
+				m.RPPM = price.RPPM
+				m.PPI = price.PPI
+				m.PriceTiers = price.PriceTiers
 			}
 		}
+		client.modelsMu.Unlock()
 		updated = append(updated, client)
 	}
 
 	if len(updated) == 0 {
-		return 0, fmt.Errorf("no client found for model %s", modelName)
+		return 0, clamped, fmt.Errorf("no client found for model %s", modelName)
 	}
 
 	// Persist to DB
 	for _, client := range updated {
-		if err := s.ClientDB.SaveClient(client); err != nil {
+		s.recordPrice(price, client)
+		if err := s.ClientDB.SaveModels(client.ID, client.ModelsSnapshot()); err != nil {
 			log.Printf("save client %s price to db failed: %v", client.ID, err)
 		}
-
-		client.ControlConnMutex.Lock()
-		if client.ControlConn != nil {
-			message := public.WSMessage{
-				Type: public.MODEL_PRICE_UPDATE,
-				Content: public.ModelPriceUpdate{
-					Model: modelName,
-					IPPM:  ippm,
-					OPPM:  oppm,
-					CIPPM: cippm,
-				},
-			}
-			if err := client.ControlConn.WriteJSON(message); err != nil {
-				log.Printf("push model price update to client %s failed: %v", client.ID, err)
-			}
-		}
-		client.ControlConnMutex.Unlock()
+		PushModelPrice(client, price)
 	}
 
-	return len(updated), nil
+	return len(updated), clamped, nil
 }
 
 func (s *Server) GetTrends(startDate, endDate string) []*Trend {
@@ -706,7 +822,7 @@ func (s *Server) LoadBalanceEmbedding(model, userID string) *Client {
 		maxIPPM, maxOPPM, _ = s.UserPriceCapDB.GetPriceCap(userID, model)
 	}
 
-	allClients := s.clients.Load().(map[string]map[string]*Client)
+	allClients := s.clients.snapshot()
 
 	// 收集所有支持指定embedding模型的在线客户端
 	var availableClients []*Client
@@ -719,13 +835,10 @@ func (s *Server) LoadBalanceEmbedding(model, userID string) *Client {
 				if !clientHealthy(client, model) {
 					continue
 				}
-				for _, m := range client.Models {
-					if m.Name == modelName && isEmbeddingModelName(modelName) &&
-						m.IPPM <= maxIPPM && m.OPPM <= maxOPPM {
-						log.Printf("Found online client for embedding model: %s, client: %s", modelName, client.ID)
-						availableClients = append(availableClients, client)
-						break
-					}
+				if m, ok := client.ModelInfo(modelName); ok && isEmbeddingModelName(modelName) &&
+					m.IPPM <= maxIPPM && m.OPPM <= maxOPPM {
+					log.Printf("Found online client for embedding model: %s, client: %s", modelName, client.ID)
+					availableClients = append(availableClients, client)
 				}
 			}
 		}
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	configs "star-fire/config"
 	"star-fire/pkg/public"
 
 	"github.com/glebarez/sqlite"
@@ -45,11 +46,11 @@ func TestUpdateModelPricePushesUpdateToConnectedClient(t *testing.T) {
 		Models: []*public.Model{{Name: "model-a", Engine: "ollama", IPPM: 1}},
 	}
 	server := &Server{ClientDB: clientDB}
-	server.clients.Store(map[string]map[string]*Client{
+	server.clients.replace(map[string]map[string]*Client{
 		"model-a": {"client-1": connectedClient},
 	})
 
-	updated, err := server.UpdateModelPrice("user-1", "model-a", 4.2, 8.4, 1.2)
+	updated, _, err := server.UpdateModelPrice("user-1", &public.Model{Name: "model-a", IPPM: 4.2, OPPM: 8.4, CIPPM: 1.2})
 	if err != nil {
 		t.Fatalf("update model price: %v", err)
 	}
@@ -75,7 +76,7 @@ func TestUpdateModelPricePushesUpdateToConnectedClient(t *testing.T) {
 
 func TestRegisterModelReplacesReconnectedClientInstance(t *testing.T) {
 	server := &Server{}
-	server.clients.Store(map[string]map[string]*Client{})
+	server.clients.replace(map[string]map[string]*Client{})
 	oldClient := &Client{ID: "same-client", Models: []*public.Model{{Name: "model-a", OPPM: 8.3}}}
 	newClient := &Client{ID: "same-client", Models: []*public.Model{{Name: "model-a", OPPM: 4}}}
 	model := &public.Model{Name: "model-a"}
@@ -91,3 +92,75 @@ func TestRegisterModelReplacesReconnectedClientInstance(t *testing.T) {
 		t.Fatalf("old connection cleanup removed replacement: got %p, want %p", got, newClient)
 	}
 }
+
+func TestClampModelPriceUsesPerModelCeilings(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	configDB := NewSystemConfigDB(db)
+	server := &Server{SystemConfigDB: configDB, Conf: &configs.Configuration{
+		AllModelInputMaxPrice: 10, AllModelOutPutMaxPrice: 20, AllModelCachedInputMaxPrice: 5,
+	}}
+
+	m := &public.Model{Name: "model-a", IPPM: 12, OPPM: 15, CIPPM: 6}
+	if !server.ClampModelPrice(m) || m.IPPM != 10 || m.OPPM != 15 || m.CIPPM != 5 {
+		t.Fatalf("default ceilings not applied: %+v", m)
+	}
+
+	// 单模型上限只设置了 OPPM，其余项回退到 "*" 和环境变量
+	if err := configDB.SetPriceCeiling(PriceCeiling{Model: "model-a", MaxOPPM: 8}); err != nil {
+		t.Fatalf("set model ceiling: %v", err)
+	}
+	if err := configDB.SetPriceCeiling(PriceCeiling{Model: PriceCeilingAllModels, MaxIPPM: 30}); err != nil {
+		t.Fatalf("set global ceiling: %v", err)
+	}
+	m = &public.Model{Name: "model-a", IPPM: 12, OPPM: 15, CIPPM: 1}
+	if !server.ClampModelPrice(m) || m.IPPM != 12 || m.OPPM != 8 || m.CIPPM != 1 {
+		t.Fatalf("per-model ceilings not applied: %+v", m)
+	}
+	if server.ClampModelPrice(m) {
+		t.Fatal("already clamped price reported as clamped again")
+	}
+
+	ceilings, err := configDB.ListPriceCeilings()
+	if err != nil || len(ceilings) != 2 {
+		t.Fatalf("list ceilings: %v %v", ceilings, err)
+	}
+}
+
+func TestUpdateModelPriceDoesNotRaceWithRouting(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	c := &Client{
+		ID: "client-1", UserID: "user-1", Status: "online",
+		Models: []*public.Model{{Name: "model-a", IPPM: 1, OPPM: 2}},
+	}
+	server := &Server{ClientDB: NewClientDB(db)}
+	server.clients.replace(map[string]map[string]*Client{
+		"model-a": {"client-1": c},
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			price := &public.Model{Name: "model-a", IPPM: float64(i), OPPM: float64(i),
+				PriceTiers: []public.PriceTier{{MinPromptTokens: 1000, IPPM: float64(i)}}}
+			if _, _, err := server.UpdateModelPrice("user-1", price); err != nil {
+				t.Errorf("update model price: %v", err)
+				return
+			}
+		}
+	}()
+	eligible := priceEligible(100, 100, 2000)
+	for i := 0; i < 50; i++ {
+		if !eligible(c, "model-a") {
+			t.Fatal("client priced within caps filtered out")
+		}
+		server.EstimateCost("model-a", "", 2000, 100)
+	}
+	<-done
+}
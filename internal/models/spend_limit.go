@@ -0,0 +1,251 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"star-fire/pkg/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 花费告警类型
+const (
+	SpendAlertDaily        = "daily_alert"
+	SpendAlertMonthly      = "monthly_alert"
+	SpendAlertDailyLimit   = "daily_limit"
+	SpendAlertMonthlyLimit = "monthly_limit"
+)
+
+// SpendLimit 用户花费上限与告警阈值（元），0 表示不限制 / 不告警
+type SpendLimit struct {
+	UserID       string    `gorm:"primaryKey" json:"user_id"`
+	DailyLimit   float64   `gorm:"not null;default:0" json:"daily_limit"`
+	MonthlyLimit float64   `gorm:"not null;default:0" json:"monthly_limit"`
+	DailyAlert   float64   `gorm:"not null;default:0" json:"daily_alert"`
+	MonthlyAlert float64   `gorm:"not null;default:0" json:"monthly_alert"`
+	AlertEmail   bool      `gorm:"not null" json:"alert_email"`
+	WebhookURL   string    `json:"webhook_url"`
+	UpdatedAt    time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// SpendAlert 已发送的告警；同一用户同一类型在同一窗口（日/月）内只发一次
+type SpendAlert struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    string    `gorm:"uniqueIndex:idx_spend_alert_window;not null" json:"user_id"`
+	Kind      string    `gorm:"uniqueIndex:idx_spend_alert_window;not null" json:"kind"`
+	Window    string    `gorm:"uniqueIndex:idx_spend_alert_window;not null" json:"window"` // 2026-10-19 或 2026-10
+	Threshold float64   `gorm:"not null" json:"threshold"`
+	Spent     float64   `gorm:"not null" json:"spent"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// SpendLimitDB 提供花费上限、告警的读写方法
+type SpendLimitDB struct {
+	db *gorm.DB
+}
+
+// NewSpendLimitDB 初始化 SpendLimitDB
+func NewSpendLimitDB(db *gorm.DB) *SpendLimitDB {
+	db.AutoMigrate(&SpendLimit{}, &SpendAlert{})
+	return &SpendLimitDB{db: db}
+}
+
+// GetLimit 获取用户的花费设置，未设置时返回 nil
+func (s *SpendLimitDB) GetLimit(userID string) (*SpendLimit, error) {
+	var limit SpendLimit
+	if err := s.db.Where("user_id = ?", userID).First(&limit).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &limit, nil
+}
+
+// SaveLimit 保存用户的花费设置
+func (s *SpendLimitDB) SaveLimit(limit *SpendLimit) error {
+	return s.db.Save(limit).Error
+}
+
+// spendWindows 返回当前日、月窗口的起始时间
+func spendWindows(now time.Time) (time.Time, time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return day, month
+}
+
+// spentSince 统计用户自 since 起的请求花费（扣除退款），走 (user_id, timestamp) 索引
+func (s *SpendLimitDB) spentSince(userID string, since time.Time) (float64, error) {
+	var total float64
+	err := s.db.Model(&TokenUsage{}).
+		Select("COALESCE(SUM(cost - refunded), 0)").
+		Where("user_id = ? AND timestamp >= ?", userID, since).
+		Scan(&total).Error
+	return total, err
+}
+
+// GetSpend 返回用户今日与本月的花费
+func (s *SpendLimitDB) GetSpend(userID string) (float64, float64, error) {
+	day, month := spendWindows(time.Now())
+	daily, err := s.spentSince(userID, day)
+	if err != nil {
+		return 0, 0, err
+	}
+	monthly, err := s.spentSince(userID, month)
+	return daily, monthly, err
+}
+
+// ExceededLimit 检查用户是否已达到日/月硬上限，返回达到的告警类型，未达到时返回空字符串
+func (s *SpendLimitDB) ExceededLimit(userID string) string {
+	limit, err := s.GetLimit(userID)
+	if err != nil || limit == nil || (limit.DailyLimit <= 0 && limit.MonthlyLimit <= 0) {
+		return ""
+	}
+	daily, monthly, err := s.GetSpend(userID)
+	if err != nil {
+		return ""
+	}
+	if limit.DailyLimit > 0 && daily >= limit.DailyLimit {
+		return SpendAlertDailyLimit
+	}
+	if limit.MonthlyLimit > 0 && monthly >= limit.MonthlyLimit {
+		return SpendAlertMonthlyLimit
+	}
+	return ""
+}
+
+// recordAlert 记录告警，本窗口内已发送过时返回 false
+func (s *SpendLimitDB) recordAlert(alert *SpendAlert) (bool, error) {
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(alert)
+	return result.RowsAffected == 1, result.Error
+}
+
+// GetAlerts 获取用户最近的告警记录
+func (s *SpendLimitDB) GetAlerts(userID string, limit int) ([]*SpendAlert, error) {
+	var alerts []*SpendAlert
+	err := s.db.Where("user_id = ?", userID).Order("created_at DESC").Limit(limit).Find(&alerts).Error
+	return alerts, err
+}
+
+// CheckSpendAlerts 在计费后检查用户花费是否越过告警阈值或硬上限，
+// 越过时通过邮件和用户配置的 webhook 通知，每个窗口每类只通知一次。
+func (s *Server) CheckSpendAlerts(userID string) {
+	if s.SpendLimitDB == nil || userID == "" {
+		return
+	}
+	limit, err := s.SpendLimitDB.GetLimit(userID)
+	if err != nil || limit == nil {
+		return
+	}
+	now := time.Now()
+	daily, monthly, err := s.SpendLimitDB.GetSpend(userID)
+	if err != nil {
+		log.Printf("query spend for alerts failed user=%s: %v", userID, err)
+		return
+	}
+
+	dayWindow := now.Format("2006-01-02")
+	monthWindow := now.Format(StatementPeriodLayout)
+	checks := []struct {
+		kind      string
+		window    string
+		threshold float64
+		spent     float64
+	}{
+		{SpendAlertDaily, dayWindow, limit.DailyAlert, daily},
+		{SpendAlertMonthly, monthWindow, limit.MonthlyAlert, monthly},
+		{SpendAlertDailyLimit, dayWindow, limit.DailyLimit, daily},
+		{SpendAlertMonthlyLimit, monthWindow, limit.MonthlyLimit, monthly},
+	}
+	for _, ch := range checks {
+		if ch.threshold <= 0 || ch.spent < ch.threshold {
+			continue
+		}
+		alert := &SpendAlert{UserID: userID, Kind: ch.kind, Window: ch.window, Threshold: ch.threshold, Spent: ch.spent}
+		fresh, err := s.SpendLimitDB.recordAlert(alert)
+		if err != nil {
+			log.Printf("record spend alert failed user=%s: %v", userID, err)
+			continue
+		}
+		if fresh {
+			s.sendSpendAlert(limit, alert)
+		}
+	}
+}
+
+// sendSpendAlert 通过邮件和 webhook 发送告警（尽力而为，失败只记录日志）
+func (s *Server) sendSpendAlert(limit *SpendLimit, alert *SpendAlert) {
+	if limit.AlertEmail && s.MailService != nil {
+		user, err := s.UserDB.GetUserByID(alert.UserID)
+		if err == nil && user.Email != "" {
+			subject := "星火算力计划 - 花费提醒"
+			body := fmt.Sprintf("<p>您好，</p><p>您的账户花费已达到设置的阈值（%s）：当前 %.4f 元 / 阈值 %.4f 元（%s）。</p>",
+				alert.Kind, alert.Spent, alert.Threshold, alert.Window)
+			if alert.Kind == SpendAlertDailyLimit || alert.Kind == SpendAlertMonthlyLimit {
+				body += "<p>已达到硬上限，新的请求将被拒绝，直到窗口结束或调整上限。</p>"
+			}
+			if err := utils.SendEmail(user.Email, subject, body, s.MailService.FromAddress,
+				s.MailService.SMTPServer, s.MailService.SMTPUsername, s.MailService.SMTPPassword,
+				s.MailService.SMTPPort); err != nil {
+				log.Printf("send spend alert email failed user=%s: %v", alert.UserID, err)
+			}
+		}
+	}
+
+	if limit.WebhookURL != "" {
+		payload, _ := json.Marshal(map[string]interface{}{
+			"event":     "spend_alert",
+			"user_id":   alert.UserID,
+			"kind":      alert.Kind,
+			"window":    alert.Window,
+			"threshold": alert.Threshold,
+			"spent":     alert.Spent,
+			"timestamp": alert.CreatedAt.Unix(),
+		})
+		resp, err := webhookClient.Post(limit.WebhookURL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Printf("send spend alert webhook failed user=%s: %v", alert.UserID, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("spend alert webhook user=%s returned %d", alert.UserID, resp.StatusCode)
+		}
+	}
+}
+
+// webhookClient 发送用户配置的 webhook。在建立连接时检查解析出的地址（可防御 DNS rebinding），
+// 拒绝内网、回环和链路本地地址，且不跟随重定向
+var webhookClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: dialPublicOnly}).DialContext,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var errWebhookAddress = errors.New("webhook address is not a public address")
+
+func dialPublicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return errWebhookAddress
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpendLimitAndAlerts(t *testing.T) {
+	db, _, userDB := newPromoTestDB(t)
+	tokenUsageDB := NewTokenUsageDB(db)
+	spendLimitDB := NewSpendLimitDB(db)
+	server := &Server{UserDB: userDB, SpendLimitDB: spendLimitDB}
+
+	var mu sync.Mutex
+	var kinds []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		kinds = append(kinds, payload["kind"].(string))
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	// 测试 webhook 监听在回环地址上
+	defaultClient := webhookClient
+	webhookClient = hook.Client()
+	defer func() { webhookClient = defaultClient }()
+
+	if err := spendLimitDB.SaveLimit(&SpendLimit{
+		UserID: "user-1", DailyLimit: 5, DailyAlert: 3, WebhookURL: hook.URL,
+	}); err != nil {
+		t.Fatalf("save limit: %v", err)
+	}
+
+	record := func(id string, cost float64) {
+		usage := &TokenUsage{RequestID: id, UserID: "user-1", Model: "model-a", Cost: cost, Timestamp: time.Now()}
+		if err := tokenUsageDB.SaveTokenUsage(usage); err != nil {
+			t.Fatalf("save usage: %v", err)
+		}
+		server.CheckSpendAlerts("user-1")
+	}
+
+	record("req-1", 2)
+	if kind := spendLimitDB.ExceededLimit("user-1"); kind != "" {
+		t.Fatalf("limit exceeded too early: %s", kind)
+	}
+	record("req-2", 1.5)
+	record("req-3", 0.5) // 阈值已越过，不再重复告警
+	if kind := spendLimitDB.ExceededLimit("user-1"); kind != "" {
+		t.Fatalf("limit exceeded too early: %s", kind)
+	}
+	record("req-4", 1)
+	if kind := spendLimitDB.ExceededLimit("user-1"); kind != SpendAlertDailyLimit {
+		t.Fatalf("exceeded = %q, want %q", kind, SpendAlertDailyLimit)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(kinds) != 2 || kinds[0] != SpendAlertDaily || kinds[1] != SpendAlertDailyLimit {
+		t.Fatalf("webhook kinds = %v, want [daily_alert daily_limit]", kinds)
+	}
+	alerts, _ := spendLimitDB.GetAlerts("user-1", 10)
+	if len(alerts) != 2 {
+		t.Fatalf("alerts = %d, want 2", len(alerts))
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hook.Close()
+	if _, err := webhookClient.Get(hook.URL); !errors.Is(err, errWebhookAddress) {
+		t.Fatalf("loopback webhook: err = %v, want errWebhookAddress", err)
+	}
+	for _, addr := range []string{"10.0.0.1:80", "169.254.169.254:80", "[::1]:443", "[fe80::1]:80"} {
+		if err := dialPublicOnly("tcp", addr, nil); err == nil {
+			t.Fatalf("%s allowed", addr)
+		}
+	}
+	if err := dialPublicOnly("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Fatalf("public address refused: %v", err)
+	}
+}
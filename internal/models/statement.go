@@ -0,0 +1,359 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 对账单类型
+const (
+	StatementKindBilling  = "billing"  // 用户消费对账单
+	StatementKindEarnings = "earnings" // provider 收益对账单
+)
+
+// StatementPeriodLayout 对账周期格式（自然月）
+const StatementPeriodLayout = "2006-01"
+
+var ErrStatementNotFound = errors.New("statement not found")
+
+// StatementLine 对账单按模型的明细行
+type StatementLine struct {
+	Model        string  `json:"model"`
+	Calls        int64   `json:"calls"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	TotalTokens  int64   `json:"total_tokens"`
+	Amount       float64 `json:"amount"` // billing 为消费金额，earnings 为净收益
+}
+
+// Statement 月度对账单，生成后不再修改。
+// billing: Closing = Opening + Recharges + Bonuses + CouponCredits + Refunds - SubscriptionFees - Reservations - UsageSpend
+// earnings: Earnings = GrossEarnings - Chargebacks
+type Statement struct {
+	ID               uint      `gorm:"primaryKey" json:"id"`
+	UserID           string    `gorm:"uniqueIndex:idx_statement_user_period_kind;not null" json:"user_id"`
+	Period           string    `gorm:"uniqueIndex:idx_statement_user_period_kind;not null" json:"period"`
+	Kind             string    `gorm:"uniqueIndex:idx_statement_user_period_kind;not null" json:"kind"`
+	PeriodStart      time.Time `gorm:"not null" json:"period_start"`
+	PeriodEnd        time.Time `gorm:"not null" json:"period_end"`
+	OpeningBalance   float64   `json:"opening_balance"`
+	Recharges        float64   `json:"recharges"`
+	Bonuses          float64   `json:"bonuses"` // 注册赠送、兑换码、邀请奖励
+	CouponCredits    float64   `json:"coupon_credits"`
+	Refunds          float64   `json:"refunds"`
+	SubscriptionFees float64   `json:"subscription_fees"`
+	Reservations     float64   `json:"reservations"` // 预留容量的预付与结算差额（退还为负）
+	UsageSpend       float64   `json:"usage_spend"`
+	ClosingBalance   float64   `json:"closing_balance"`
+	GrossEarnings    float64   `json:"gross_earnings"`
+	Chargebacks      float64   `json:"chargebacks"`
+	Earnings         float64   `json:"earnings"`
+	LinesJSON        string    `gorm:"column:lines;type:text" json:"-"`
+	CreatedAt        time.Time `gorm:"autoCreateTime" json:"created_at"`
+
+	Lines []StatementLine `gorm:"-" json:"lines"`
+}
+
+// AfterFind 解析明细行
+func (s *Statement) AfterFind(tx *gorm.DB) error {
+	if s.LinesJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(s.LinesJSON), &s.Lines)
+}
+
+// StatementDB 提供月度对账单的生成与查询
+type StatementDB struct {
+	db *gorm.DB
+}
+
+// NewStatementDB 初始化 StatementDB
+func NewStatementDB(db *gorm.DB) *StatementDB {
+	db.AutoMigrate(&Statement{})
+	return &StatementDB{db: db}
+}
+
+// periodRange 返回 period（如 "2026-09"）对应的 [start, end) 时间范围
+func periodRange(period string) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation(StatementPeriodLayout, period, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q", period)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// sumLedger 汇总 [start, end) 内按类型分组的余额流水
+func (s *StatementDB) sumLedger(userID string, start, end time.Time) (map[string]float64, error) {
+	var rows []struct {
+		Type   string
+		Amount float64
+	}
+	err := s.db.Model(&BalanceRecord{}).
+		Select("type, SUM(amount) as amount").
+		Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, start, end).
+		Group("type").
+		Scan(&rows).Error
+	sums := make(map[string]float64, len(rows))
+	for _, r := range rows {
+		sums[r.Type] = r.Amount
+	}
+	return sums, err
+}
+
+// sumUsageCost 汇总 [start, end) 内的请求扣费（按请求时的原始扣费，退款单独以 refund 流水计）
+func (s *StatementDB) sumUsageCost(userID string, start, end time.Time) (float64, error) {
+	var total float64
+	err := s.db.Model(&TokenUsage{}).
+		Select("COALESCE(SUM(cost), 0)").
+		Where("user_id = ? AND timestamp >= ? AND timestamp < ?", userID, start, end).
+		Scan(&total).Error
+	return total, err
+}
+
+// openingBalance 期初余额：优先取上期对账单期末余额，否则由当前余额倒推
+func (s *StatementDB) openingBalance(userID, period string, start time.Time) (float64, error) {
+	var prev Statement
+	prevPeriod := start.AddDate(0, -1, 0).Format(StatementPeriodLayout)
+	err := s.db.Where("user_id = ? AND period = ? AND kind = ?", userID, prevPeriod, StatementKindBilling).
+		First(&prev).Error
+	if err == nil {
+		return prev.ClosingBalance, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+
+	var user User
+	if err := s.db.Select("balance").Where("id = ?", userID).First(&user).Error; err != nil {
+		return 0, err
+	}
+	far := time.Now().AddDate(100, 0, 0)
+	ledger, err := s.sumLedger(userID, start, far)
+	if err != nil {
+		return 0, err
+	}
+	spend, err := s.sumUsageCost(userID, start, far)
+	if err != nil {
+		return 0, err
+	}
+	balance := user.Balance + spend
+	for _, amount := range ledger {
+		balance -= amount
+	}
+	return balance, nil
+}
+
+// buildBillingStatement 计算用户在 period 的消费对账单，无任何余额或活动时返回 nil
+func (s *StatementDB) buildBillingStatement(userID, period string, start, end time.Time) (*Statement, error) {
+	opening, err := s.openingBalance(userID, period, start)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := s.sumLedger(userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []StatementLine
+	if err := s.db.Model(&TokenUsage{}).
+		Select(`
+			model,
+			COUNT(*) as calls,
+			SUM(input_tokens) as input_tokens,
+			SUM(output_tokens) as output_tokens,
+			SUM(total_tokens) as total_tokens,
+			SUM(cost) as amount
+		`).
+		Where("user_id = ? AND timestamp >= ? AND timestamp < ? AND request_type <> ?", userID, start, end, "reservation").
+		Group("model").
+		Order("amount DESC").
+		Scan(&lines).Error; err != nil {
+		return nil, err
+	}
+	var spend float64
+	for _, l := range lines {
+		spend += l.Amount
+	}
+
+	st := &Statement{
+		UserID:           userID,
+		Period:           period,
+		Kind:             StatementKindBilling,
+		PeriodStart:      start,
+		PeriodEnd:        end,
+		OpeningBalance:   opening,
+		Recharges:        ledger[BalanceTypeRecharge],
+		Bonuses:          ledger[BalanceTypeRegisterBonus] + ledger[BalanceTypePromo] + ledger[BalanceTypeReferral],
+		CouponCredits:    ledger[BalanceTypeCoupon],
+		Refunds:          ledger[BalanceTypeRefund],
+		SubscriptionFees: -ledger[BalanceTypeSubscription],
+		Reservations:     -ledger[BalanceTypeReservation],
+		UsageSpend:       spend,
+		Lines:            lines,
+	}
+	st.ClosingBalance = st.OpeningBalance + st.Recharges + st.Bonuses + st.CouponCredits + st.Refunds -
+		st.SubscriptionFees - st.Reservations - st.UsageSpend
+	if st.OpeningBalance == 0 && len(ledger) == 0 && len(lines) == 0 {
+		return nil, nil
+	}
+	return st, nil
+}
+
+// buildEarningsStatement 计算 provider 在 period 的收益对账单，没有收益记录时返回 nil。
+// 扣回（chargeback）按被退款请求的时间归属，结账后发生的扣回不会改动已生成的对账单。
+func (s *StatementDB) buildEarningsStatement(userID, period string, start, end time.Time) (*Statement, error) {
+	var clientIDs []string
+	if err := s.db.Model(&Client{}).Where("user_id = ?", userID).Pluck("id", &clientIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(clientIDs) == 0 {
+		return nil, nil
+	}
+
+	var lines []StatementLine
+	if err := s.db.Model(&TokenUsage{}).
+		Select(`
+			model,
+			COUNT(*) as calls,
+			SUM(input_tokens) as input_tokens,
+			SUM(output_tokens) as output_tokens,
+			SUM(total_tokens) as total_tokens,
+			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm) / 1000000.0 + image_count * ppi + fee - chargeback) as amount
+		`).
+		Where("client_id IN ? AND timestamp >= ? AND timestamp < ?", clientIDs, start, end).
+		Group("model").
+		Order("amount DESC").
+		Scan(&lines).Error; err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	var chargebacks float64
+	if err := s.db.Model(&TokenUsage{}).
+		Select("COALESCE(SUM(chargeback), 0)").
+		Where("client_id IN ? AND timestamp >= ? AND timestamp < ?", clientIDs, start, end).
+		Scan(&chargebacks).Error; err != nil {
+		return nil, err
+	}
+	st := &Statement{
+		UserID:      userID,
+		Period:      period,
+		Kind:        StatementKindEarnings,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Chargebacks: chargebacks,
+		Lines:       lines,
+	}
+	for _, l := range lines {
+		st.Earnings += l.Amount
+	}
+	st.GrossEarnings = st.Earnings + chargebacks
+	return st, nil
+}
+
+// save 保存对账单；同一用户同一周期同一类型已存在时保持原记录不变
+func (s *StatementDB) save(st *Statement) error {
+	lines, err := json.Marshal(st.Lines)
+	if err != nil {
+		return err
+	}
+	st.LinesJSON = string(lines)
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(st).Error
+}
+
+// CloseUserPeriod 为单个用户生成 period 的对账单（已生成的不会覆盖）
+func (s *StatementDB) CloseUserPeriod(userID, period string) error {
+	start, end, err := periodRange(period)
+	if err != nil {
+		return err
+	}
+	if !time.Now().After(end) {
+		return fmt.Errorf("period %s has not ended yet", period)
+	}
+	for _, build := range []func(string, string, time.Time, time.Time) (*Statement, error){
+		s.buildBillingStatement, s.buildEarningsStatement,
+	} {
+		st, err := build(userID, period, start, end)
+		if err != nil {
+			return err
+		}
+		if st == nil {
+			continue
+		}
+		if err := s.save(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClosePeriod 为所有用户生成 period 的对账单，返回处理失败的用户数
+func (s *StatementDB) ClosePeriod(period string) (int, error) {
+	var userIDs []string
+	if err := s.db.Model(&User{}).Order("id").Pluck("id", &userIDs).Error; err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, id := range userIDs {
+		if err := s.CloseUserPeriod(id, period); err != nil {
+			log.Printf("close statement period=%s user=%s failed: %v", period, id, err)
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// GetUserStatements 列出用户的对账单，kind 为空表示全部类型
+func (s *StatementDB) GetUserStatements(userID, kind string) ([]*Statement, error) {
+	var statements []*Statement
+	query := s.db.Where("user_id = ?", userID)
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	err := query.Order("period DESC, kind ASC").Find(&statements).Error
+	return statements, err
+}
+
+// GetUserStatement 获取用户的某张对账单
+func (s *StatementDB) GetUserStatement(userID string, id uint) (*Statement, error) {
+	var st Statement
+	if err := s.db.Where("id = ? AND user_id = ?", id, userID).First(&st).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrStatementNotFound
+		}
+		return nil, err
+	}
+	return &st, nil
+}
+
+// CloseLastMonth 定时任务入口：上个自然月尚未结账时为所有用户生成对账单。
+// 已结账的周期记录在系统配置中，避免每次定时任务都遍历所有用户。
+func (s *Server) CloseLastMonth() {
+	now := time.Now()
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	period := thisMonth.AddDate(0, -1, 0).Format(StatementPeriodLayout)
+	if s.SystemConfigDB.GetString(ConfigKeyStatementsClosedPeriod, "") >= period {
+		return
+	}
+	failed, err := s.StatementDB.ClosePeriod(period)
+	if err != nil {
+		log.Printf("close statements for %s failed: %v", period, err)
+		return
+	}
+	if failed > 0 {
+		// 下次定时任务重试失败的用户
+		return
+	}
+	if err := s.SystemConfigDB.Set(ConfigKeyStatementsClosedPeriod, period); err != nil {
+		log.Printf("save closed statement period failed: %v", err)
+	}
+	log.Printf("monthly statements closed for %s", period)
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCloseUserPeriodReconcilesBalance(t *testing.T) {
+	db, _, userDB := newPromoTestDB(t)
+	statementDB := NewStatementDB(db)
+	tokenUsageDB := NewTokenUsageDB(db)
+	history := NewBalanceHistoryDB(db)
+	NewClientDB(db)
+
+	now := time.Now()
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	lastMonth := thisMonth.AddDate(0, -1, 0)
+	period := lastMonth.Format(StatementPeriodLayout)
+
+	// 上月：充值 10，消费 3，退款 1
+	if _, err := history.Grant("user-1", 10, BalanceTypeRecharge, "RC1", ""); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	if err := userDB.DeductBalance("user-1", 3); err != nil {
+		t.Fatalf("deduct: %v", err)
+	}
+	if err := tokenUsageDB.SaveTokenUsage(&TokenUsage{
+		RequestID: "req-1", UserID: "user-1", Model: "model-a", TotalTokens: 100, Cost: 3,
+		Timestamp: lastMonth.Add(48 * time.Hour),
+	}); err != nil {
+		t.Fatalf("save usage: %v", err)
+	}
+	if _, err := history.Grant("user-1", 1, BalanceTypeRefund, "req-1", ""); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	db.Model(&BalanceRecord{}).Where("user_id = ?", "user-1").Update("created_at", lastMonth.Add(24*time.Hour))
+
+	// 本月：消费 2（不计入上月对账单）
+	if err := userDB.DeductBalance("user-1", 2); err != nil {
+		t.Fatalf("deduct: %v", err)
+	}
+	if err := tokenUsageDB.SaveTokenUsage(&TokenUsage{
+		RequestID: "req-2", UserID: "user-1", Model: "model-a", TotalTokens: 50, Cost: 2, Timestamp: now,
+	}); err != nil {
+		t.Fatalf("save usage: %v", err)
+	}
+
+	if err := statementDB.CloseUserPeriod("user-1", period); err != nil {
+		t.Fatalf("close period: %v", err)
+	}
+	statements, err := statementDB.GetUserStatements("user-1", StatementKindBilling)
+	if err != nil || len(statements) != 1 {
+		t.Fatalf("statements: %v %v", statements, err)
+	}
+	st := statements[0]
+	if st.OpeningBalance != 0 || st.Recharges != 10 || st.Refunds != 1 || st.UsageSpend != 3 ||
+		math.Abs(st.ClosingBalance-8) > 1e-9 {
+		t.Fatalf("statement: %+v", st)
+	}
+	if len(st.Lines) != 1 || st.Lines[0].Model != "model-a" || st.Lines[0].Calls != 1 {
+		t.Fatalf("statement lines: %+v", st.Lines)
+	}
+
+	// 已生成的对账单不会被覆盖
+	if _, err := history.Grant("user-1", 5, BalanceTypeRecharge, "RC2", ""); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	db.Model(&BalanceRecord{}).Where("ref_id = ?", "RC2").Update("created_at", lastMonth.Add(72*time.Hour))
+	if err := statementDB.CloseUserPeriod("user-1", period); err != nil {
+		t.Fatalf("close period again: %v", err)
+	}
+	again, _ := statementDB.GetUserStatement("user-1", st.ID)
+	if again.Recharges != 10 {
+		t.Fatalf("statement was modified: recharges=%v", again.Recharges)
+	}
+}
+
+func TestStatementsReconcileReservationAcrossMonths(t *testing.T) {
+	db, _, userDB := newPromoTestDB(t)
+	statementDB := NewStatementDB(db)
+	tokenUsageDB := NewTokenUsageDB(db)
+	history := NewBalanceHistoryDB(db)
+	resDB := NewReservationDB(db)
+	NewClientDB(db)
+
+	now := time.Now()
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	lastMonth := thisMonth.AddDate(0, -1, 0)
+	prepaidMonth := lastMonth.AddDate(0, -1, 0)
+
+	// 前月：充值 100，接受按 tokens 计费的预留并预付最低承诺 4，预留期间的请求消费 1
+	if _, err := history.Grant("user-1", 100, BalanceTypeRecharge, "RC1", ""); err != nil {
+		t.Fatalf("grant: %v", err)
+	}
+	res := &Reservation{UserID: "user-1", ProviderID: "provider-1", ClientID: "c1", Model: "model-a", Slots: 1,
+		StartAt: prepaidMonth.Add(24 * time.Hour), EndAt: now.Add(time.Hour),
+		PricingType: ReservationToken, IPPM: 1, OPPM: 1, MinCommitment: 4}
+	if err := resDB.Create(res); err != nil {
+		t.Fatalf("create reservation: %v", err)
+	}
+	if _, err := resDB.Respond("provider-1", res.ID, true, 1); err != nil {
+		t.Fatalf("accept reservation: %v", err)
+	}
+	if err := userDB.DeductBalance("user-1", 1); err != nil {
+		t.Fatalf("deduct: %v", err)
+	}
+	if err := tokenUsageDB.SaveTokenUsage(&TokenUsage{
+		RequestID: "req-1", UserID: "user-1", Model: "model-a", TotalTokens: 100, Cost: 1,
+		Timestamp: prepaidMonth.Add(48 * time.Hour),
+	}); err != nil {
+		t.Fatalf("save usage: %v", err)
+	}
+	if err := resDB.AddUsage(res.ID, 1); err != nil {
+		t.Fatalf("add usage: %v", err)
+	}
+	db.Model(&BalanceRecord{}).Where("user_id = ?", "user-1").Update("created_at", prepaidMonth.Add(24*time.Hour))
+
+	// 上月：窗口结束后结算费用 3，退还多预付的 1
+	db.Model(res).Update("end_at", lastMonth.Add(24*time.Hour))
+	resDB.Settle(lastMonth.Add(48 * time.Hour))
+	db.Model(&BalanceRecord{}).Where("user_id = ? AND amount = ?", "user-1", 1.0).Update("created_at", lastMonth.Add(48*time.Hour))
+	if balance, _, _ := userDB.GetBalance("user-1"); math.Abs(balance-96) > 1e-9 {
+		t.Fatalf("balance after settlement = %v, want 96", balance)
+	}
+
+	// 先结上月：没有前月对账单，期初余额由当前余额倒推
+	if err := statementDB.CloseUserPeriod("user-1", lastMonth.Format(StatementPeriodLayout)); err != nil {
+		t.Fatalf("close last month: %v", err)
+	}
+	if err := statementDB.CloseUserPeriod("user-1", prepaidMonth.Format(StatementPeriodLayout)); err != nil {
+		t.Fatalf("close prepaid month: %v", err)
+	}
+	statements, err := statementDB.GetUserStatements("user-1", StatementKindBilling)
+	if err != nil || len(statements) != 2 {
+		t.Fatalf("statements: %v %v", statements, err)
+	}
+	settled, prepaid := statements[0], statements[1]
+	if prepaid.Recharges != 100 || prepaid.Reservations != 4 || prepaid.UsageSpend != 1 ||
+		math.Abs(prepaid.ClosingBalance-95) > 1e-9 {
+		t.Fatalf("prepaid month statement: %+v", prepaid)
+	}
+	if math.Abs(settled.OpeningBalance-95) > 1e-9 || settled.Reservations != -1 || settled.UsageSpend != 0 ||
+		math.Abs(settled.ClosingBalance-96) > 1e-9 || len(settled.Lines) != 0 {
+		t.Fatalf("settled month statement: %+v", settled)
+	}
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"star-fire/pkg/public"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrStreamClosed = errors.New("response stream closed")
+	ErrStreamEnded  = errors.New("response stream ended by client")
+)
+
+// ResponseStream 一个请求的响应流：client 为请求建立的 /response 连接（*websocket.Conn），
+// 或控制连接上按 fingerprint 复用的流
+type ResponseStream interface {
+	ReadJSON(v interface{}) error
+	Close() error
+}
+
+// muxStream 控制连接上复用的响应流。控制连接的读取 goroutine 把帧放入 frames，
+// client 未确认的帧最多 STREAM_WINDOW_SIZE 个，frames 不会写满，一个流消费慢不会阻塞其他流。
+type muxStream struct {
+	server      *Server
+	client      *Client
+	fingerprint string
+	frames      chan json.RawMessage // 只由控制连接的读取 goroutine 写入和关闭
+	done        chan struct{}        // server 关闭流
+	closeOnce   sync.Once
+	opened      atomic.Bool
+	ended       atomic.Bool // client 已结束流或控制连接已断开
+	consumed    int         // 上次追加窗口后读取的帧数，只在读取方 goroutine 中访问
+}
+
+// OpenStream 为派发给 client 的请求登记复用的响应流。client 发送 STREAM_OPEN 后该流作为请求的响应连接，
+// 旧版本 client 仍建立 /response 连接，流在请求结束时随 RemoveRespClient 关闭。
+func (s *Server) OpenStream(client *Client, fingerprint string) {
+	s.muxStreams.Store(fingerprint, &muxStream{
+		server:      s,
+		client:      client,
+		fingerprint: fingerprint,
+		frames:      make(chan json.RawMessage, public.STREAM_WINDOW_SIZE),
+		done:        make(chan struct{}),
+	})
+}
+
+// HandleStreamMessage 处理 client 控制连接上的响应流消息，只能写入派发给该 client 的流
+func (s *Server) HandleStreamMessage(client *Client, message public.WSMessage) {
+	v, ok := s.muxStreams.Load(message.FingerPrint)
+	if !ok {
+		return // 流已关闭，丢弃剩余的帧
+	}
+	st := v.(*muxStream)
+	if st.client != client {
+		log.Printf("client %s wrote to stream %s of another client, ignored", client.ID, message.FingerPrint)
+		return
+	}
+	switch message.Type {
+	case public.STREAM_OPEN:
+		if st.opened.CompareAndSwap(false, true) {
+			s.AddRespClient(message.FingerPrint, st)
+			s.NotifyRespClientReady(message.FingerPrint)
+		}
+	case public.STREAM_FRAME:
+		st.deliver(message.Frame)
+	case public.STREAM_END:
+		st.end()
+	}
+}
+
+// CloseClientStreams 控制连接断开时结束 client 的所有响应流，正在读取的请求返回错误
+func (s *Server) CloseClientStreams(client *Client) {
+	s.muxStreams.Range(func(_, v any) bool {
+		if st := v.(*muxStream); st.client == client {
+			st.end()
+		}
+		return true
+	})
+}
+
+func (st *muxStream) deliver(frame json.RawMessage) {
+	if st.ended.Load() {
+		return
+	}
+	select {
+	case st.frames <- frame:
+	default:
+		// client 超出了发送窗口
+		log.Printf("client %s overflowed the window of stream %s, closing it", st.client.ID, st.fingerprint)
+		st.end()
+	}
+}
+
+func (st *muxStream) end() {
+	if st.ended.CompareAndSwap(false, true) {
+		close(st.frames)
+	}
+}
+
+// ReadJSON 读取下一帧，每消费半个窗口的帧为 client 追加一次发送窗口
+func (st *muxStream) ReadJSON(v interface{}) error {
+	select {
+	case frame, ok := <-st.frames:
+		if !ok {
+			return ErrStreamEnded
+		}
+		st.consumed++
+		if st.consumed >= public.STREAM_WINDOW_SIZE/2 {
+			if err := st.client.WriteMessage(public.WSMessage{
+				Type:        public.STREAM_WINDOW,
+				FingerPrint: st.fingerprint,
+				Window:      st.consumed,
+			}); err != nil {
+				log.Printf("update window of stream %s failed: %v", st.fingerprint, err)
+			}
+			st.consumed = 0
+		}
+		return json.Unmarshal(frame, v)
+	case <-st.done:
+		return ErrStreamClosed
+	}
+}
+
+// Close 关闭流；client 尚未结束流时通知其停止发送。读完最后一帧时 client 的 STREAM_END 可能还未到达，
+// 此时的通知在 client 端是空操作
+func (st *muxStream) Close() error {
+	st.closeOnce.Do(func() {
+		close(st.done)
+		st.server.muxStreams.CompareAndDelete(st.fingerprint, st)
+		if st.opened.Load() && !st.ended.Load() {
+			_ = st.client.WriteMessage(public.WSMessage{
+				Type:        public.CLOSE,
+				Content:     public.ABORT,
+				FingerPrint: st.fingerprint,
+			})
+		}
+	})
+	return nil
+}
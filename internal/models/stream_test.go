@@ -0,0 +1,150 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"star-fire/pkg/public"
+
+	"github.com/gorilla/websocket"
+)
+
+func newStreamTestServer() *Server {
+	return &Server{
+		RespClients:          make(map[string]ResponseStream),
+		respClientReadyChans: make(map[string]chan struct{}),
+	}
+}
+
+func streamFrame(t *testing.T, fingerprint, content string) public.WSMessage {
+	t.Helper()
+	frame, err := json.Marshal(public.WSMessage{Type: public.MESSAGE_STREAM, Content: content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public.WSMessage{Type: public.STREAM_FRAME, FingerPrint: fingerprint, Frame: frame}
+}
+
+func TestMuxStreamOpensAndDeliversFrames(t *testing.T) {
+	server := newStreamTestServer()
+	client, other := &Client{ID: "c1"}, &Client{ID: "c2"}
+	server.OpenStream(client, "fp")
+	ready := server.AddRespClientChan("fp")
+
+	// 其他 client 不能写入该流
+	server.HandleStreamMessage(other, public.WSMessage{Type: public.STREAM_OPEN, FingerPrint: "fp"})
+	select {
+	case <-ready:
+		t.Fatal("stream opened by another client")
+	default:
+	}
+
+	server.HandleStreamMessage(client, public.WSMessage{Type: public.STREAM_OPEN, FingerPrint: "fp"})
+	<-ready
+	stream, ok := server.GetRespClient("fp")
+	if !ok {
+		t.Fatal("opened stream not registered as response connection")
+	}
+	server.HandleStreamMessage(client, streamFrame(t, "fp", "hello"))
+	server.HandleStreamMessage(client, public.WSMessage{Type: public.STREAM_END, FingerPrint: "fp"})
+
+	// 结束前已收到的帧仍可读取
+	var message public.WSMessage
+	if err := stream.ReadJSON(&message); err != nil || message.Type != public.MESSAGE_STREAM || message.Content != "hello" {
+		t.Fatalf("frame = %+v, err = %v", message, err)
+	}
+	if err := stream.ReadJSON(&message); !errors.Is(err, ErrStreamEnded) {
+		t.Fatalf("read after end = %v, want ErrStreamEnded", err)
+	}
+
+	server.RemoveRespClient("fp")
+	if _, ok := server.muxStreams.Load("fp"); ok {
+		t.Fatal("stream not released after request cleanup")
+	}
+}
+
+func TestMuxStreamClosesOnOverflowAndDisconnect(t *testing.T) {
+	server := newStreamTestServer()
+	client := &Client{ID: "c1"}
+	server.OpenStream(client, "overflow")
+	server.OpenStream(client, "pending")
+	for i := 0; i <= public.STREAM_WINDOW_SIZE; i++ {
+		server.HandleStreamMessage(client, streamFrame(t, "overflow", "x"))
+	}
+	v, _ := server.muxStreams.Load("overflow")
+	if !v.(*muxStream).ended.Load() {
+		t.Fatal("stream exceeding its window was not closed")
+	}
+
+	v, _ = server.muxStreams.Load("pending")
+	done := make(chan error, 1)
+	go func() {
+		var message public.WSMessage
+		done <- v.(*muxStream).ReadJSON(&message)
+	}()
+	server.CloseClientStreams(client)
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrStreamEnded) {
+			t.Fatalf("read after disconnect = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnect did not unblock the reader")
+	}
+}
+
+func TestMuxStreamGrantsWindowAsFramesAreConsumed(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	windows := make(chan public.WSMessage, 4)
+	peer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		conn, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			t.Errorf("upgrade websocket: %v", err)
+			return
+		}
+		defer conn.Close()
+		for {
+			var message public.WSMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			windows <- message
+		}
+	}))
+	defer peer.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(peer.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer conn.Close()
+
+	server := newStreamTestServer()
+	client := &Client{ID: "c1", ControlConn: conn}
+	server.OpenStream(client, "fp")
+	server.HandleStreamMessage(client, public.WSMessage{Type: public.STREAM_OPEN, FingerPrint: "fp"})
+	stream, _ := server.GetRespClient("fp")
+	for i := 0; i < public.STREAM_WINDOW_SIZE; i++ {
+		server.HandleStreamMessage(client, streamFrame(t, "fp", "x"))
+	}
+	var message public.WSMessage
+	for i := 0; i < public.STREAM_WINDOW_SIZE/2; i++ {
+		if err := stream.ReadJSON(&message); err != nil {
+			t.Fatalf("read frame %d: %v", i, err)
+		}
+	}
+	got := <-windows
+	if got.Type != public.STREAM_WINDOW || got.FingerPrint != "fp" || got.Window != public.STREAM_WINDOW_SIZE/2 {
+		t.Fatalf("window update = %+v", got)
+	}
+
+	// server 提前关闭未结束的流时通知 client 停止发送
+	_ = stream.Close()
+	if got := <-windows; got.Type != public.CLOSE || got.Content != public.ABORT || got.FingerPrint != "fp" {
+		t.Fatalf("abort = %+v", got)
+	}
+}
@@ -0,0 +1,447 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 订阅状态
+const (
+	SubscriptionStatusActive  = "active"
+	SubscriptionStatusExpired = "expired"
+)
+
+var (
+	ErrPlanNotFound         = errors.New("plan not found")
+	ErrPlanInactive         = errors.New("plan is inactive")
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrAlreadySubscribed    = errors.New("already subscribed to this plan")
+)
+
+// Plan 订阅套餐：按月收取固定月费，包含若干模型的 token 额度，超出部分按 OverageRate 倍率计费
+type Plan struct {
+	ID          uint        `gorm:"primaryKey" json:"id"`
+	Name        string      `gorm:"uniqueIndex;not null" json:"name"`
+	Description string      `json:"description"`
+	MonthlyFee  float64     `gorm:"not null" json:"monthly_fee"`            // 月费（元）
+	OverageRate float64     `gorm:"not null;default:1" json:"overage_rate"` // 超额部分相对模型标价的倍率，1 表示按原价
+	Active      bool        `gorm:"not null" json:"active"`
+	Quotas      []PlanQuota `gorm:"foreignKey:PlanID" json:"quotas"`
+	CreatedAt   time.Time   `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time   `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// PlanQuota 套餐内某个模型（或一类模型）的每月 token 额度。
+// Model 为精确模型名，或以 * 结尾的前缀（如 "qwen*"），单独的 "*" 匹配所有模型。
+type PlanQuota struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	PlanID uint   `gorm:"index;not null" json:"plan_id"`
+	Model  string `gorm:"not null" json:"model"`
+	Tokens int64  `gorm:"not null" json:"tokens"`
+}
+
+// Subscription 用户当前订阅，每个用户最多一条
+type Subscription struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      string    `gorm:"uniqueIndex;not null" json:"user_id"`
+	PlanID      uint      `gorm:"index;not null" json:"plan_id"`
+	Status      string    `gorm:"index;not null" json:"status"`
+	AutoRenew   bool      `gorm:"not null" json:"auto_renew"`
+	PeriodStart time.Time `gorm:"not null" json:"period_start"`
+	PeriodEnd   time.Time `gorm:"index;not null" json:"period_end"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// SubscriptionUsage 订阅在某个计费周期内对某条额度的已用 token 数
+type SubscriptionUsage struct {
+	ID             uint      `gorm:"primaryKey"`
+	SubscriptionID uint      `gorm:"uniqueIndex:idx_subscription_usage_period;not null"`
+	PeriodStart    time.Time `gorm:"uniqueIndex:idx_subscription_usage_period;not null"`
+	QuotaID        uint      `gorm:"uniqueIndex:idx_subscription_usage_period;not null"`
+	UsedTokens     int64     `gorm:"not null;default:0"`
+}
+
+// QuotaStatus 当前周期内某条额度的使用情况
+type QuotaStatus struct {
+	Model     string `json:"model"`
+	Tokens    int64  `json:"tokens"`
+	Used      int64  `json:"used"`
+	Remaining int64  `json:"remaining"`
+}
+
+// SubscriptionStatus 订阅及当前周期的额度使用情况
+type SubscriptionStatus struct {
+	Subscription *Subscription `json:"subscription"`
+	Plan         *Plan         `json:"plan"`
+	Quotas       []QuotaStatus `json:"quotas"`
+}
+
+// SubscriptionDB 提供套餐与订阅的读写方法
+type SubscriptionDB struct {
+	db *gorm.DB
+}
+
+// NewSubscriptionDB 初始化 SubscriptionDB
+func NewSubscriptionDB(db *gorm.DB) *SubscriptionDB {
+	db.AutoMigrate(&Plan{}, &PlanQuota{}, &Subscription{}, &SubscriptionUsage{})
+	return &SubscriptionDB{db: db}
+}
+
+// quotaMatches 判断额度规则是否匹配模型，返回匹配的具体程度（越大越具体，-1 表示不匹配）
+func quotaMatches(pattern, model string) int {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == model {
+		return len(pattern) + 1
+	}
+	if strings.HasSuffix(pattern, "*") && strings.HasPrefix(model, strings.TrimSuffix(pattern, "*")) {
+		return len(pattern) - 1
+	}
+	return -1
+}
+
+// matchQuota 从套餐额度中挑选与模型最具体匹配的一条
+func matchQuota(quotas []PlanQuota, model string) *PlanQuota {
+	var best *PlanQuota
+	bestScore := -1
+	for i := range quotas {
+		if score := quotaMatches(quotas[i].Model, model); score > bestScore {
+			best, bestScore = &quotas[i], score
+		}
+	}
+	return best
+}
+
+// CreatePlan 创建套餐（含额度）
+func (s *SubscriptionDB) CreatePlan(plan *Plan) error {
+	return s.db.Create(plan).Error
+}
+
+// GetPlan 获取套餐及其额度
+func (s *SubscriptionDB) GetPlan(id uint) (*Plan, error) {
+	var plan Plan
+	if err := s.db.Preload("Quotas").First(&plan, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPlanNotFound
+		}
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// ListPlans 列出套餐，activeOnly 为 true 时只返回可订阅的套餐
+func (s *SubscriptionDB) ListPlans(activeOnly bool) ([]*Plan, error) {
+	var plans []*Plan
+	query := s.db.Preload("Quotas").Order("monthly_fee ASC")
+	if activeOnly {
+		query = query.Where("active = ?", true)
+	}
+	err := query.Find(&plans).Error
+	return plans, err
+}
+
+// UpdatePlan 更新套餐基本信息并整体替换额度列表。已订阅用户从下一次用量起按新额度计算。
+func (s *SubscriptionDB) UpdatePlan(plan *Plan) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Plan{}).Where("id = ?", plan.ID).Updates(map[string]interface{}{
+			"name":         plan.Name,
+			"description":  plan.Description,
+			"monthly_fee":  plan.MonthlyFee,
+			"overage_rate": plan.OverageRate,
+			"active":       plan.Active,
+		}).Error; err != nil {
+			return err
+		}
+		// 用量按 quota ID 记录，保留 ID 不变的额度，避免更新套餐时清零当期用量
+		keep := make([]uint, 0, len(plan.Quotas))
+		for i := range plan.Quotas {
+			q := &plan.Quotas[i]
+			q.PlanID = plan.ID
+			if err := tx.Save(q).Error; err != nil {
+				return err
+			}
+			keep = append(keep, q.ID)
+		}
+		query := tx.Where("plan_id = ?", plan.ID)
+		if len(keep) > 0 {
+			query = query.Where("id NOT IN ?", keep)
+		}
+		return query.Delete(&PlanQuota{}).Error
+	})
+}
+
+// Subscribe 订阅套餐：从余额中扣除首月月费，新周期从当前时间开始。
+// 已有其他套餐的有效订阅时直接切换，不按比例退款。
+func (s *SubscriptionDB) Subscribe(userID string, planID uint) (*Subscription, error) {
+	var sub Subscription
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var plan Plan
+		if err := tx.First(&plan, planID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPlanNotFound
+			}
+			return err
+		}
+		if !plan.Active {
+			return ErrPlanInactive
+		}
+
+		err := tx.Where("user_id = ?", userID).First(&sub).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		now := time.Now()
+		if err == nil && sub.Status == SubscriptionStatusActive && sub.PlanID == planID && now.Before(sub.PeriodEnd) {
+			if sub.AutoRenew {
+				return ErrAlreadySubscribed
+			}
+			sub.AutoRenew = true
+			return tx.Save(&sub).Error
+		}
+
+		if plan.MonthlyFee > 0 {
+			if _, err := chargeBalanceTx(tx, userID, plan.MonthlyFee, BalanceTypeSubscription,
+				fmt.Sprintf("plan-%d", plan.ID), "订阅套餐 "+plan.Name); err != nil {
+				return err
+			}
+		}
+		sub.UserID = userID
+		sub.PlanID = planID
+		sub.Status = SubscriptionStatusActive
+		sub.AutoRenew = true
+		sub.PeriodStart = now
+		sub.PeriodEnd = now.AddDate(0, 1, 0)
+		return tx.Save(&sub).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// CancelAutoRenew 取消自动续费，当前周期结束后订阅失效
+func (s *SubscriptionDB) CancelAutoRenew(userID string) error {
+	result := s.db.Model(&Subscription{}).
+		Where("user_id = ? AND status = ?", userID, SubscriptionStatusActive).
+		Update("auto_renew", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// renewTx 处理已到期的订阅：开启自动续费且余额足够时扣费进入下一周期，否则置为过期。
+// 长期未续费（超过一个周期）的订阅从当前时间重新开始计周期，不补扣历史月费。
+func renewTx(tx *gorm.DB, sub *Subscription, now time.Time) error {
+	if sub.Status != SubscriptionStatusActive || now.Before(sub.PeriodEnd) {
+		return nil
+	}
+	var plan Plan
+	err := tx.First(&plan, sub.PlanID).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if err != nil || !sub.AutoRenew || !plan.Active {
+		sub.Status = SubscriptionStatusExpired
+		return tx.Save(sub).Error
+	}
+
+	if plan.MonthlyFee > 0 {
+		_, err := chargeBalanceTx(tx, sub.UserID, plan.MonthlyFee, BalanceTypeSubscription,
+			fmt.Sprintf("plan-%d", plan.ID), "套餐续费 "+plan.Name)
+		if errors.Is(err, ErrInsufficientBalance) {
+			sub.Status = SubscriptionStatusExpired
+			return tx.Save(sub).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	start := sub.PeriodEnd
+	if now.After(start.AddDate(0, 1, 0)) {
+		start = now
+	}
+	sub.PeriodStart = start
+	sub.PeriodEnd = start.AddDate(0, 1, 0)
+	return tx.Save(sub).Error
+}
+
+// RenewDue 续费所有已到期的有效订阅，由后台定时任务调用
+func (s *SubscriptionDB) RenewDue() {
+	var subs []*Subscription
+	now := time.Now()
+	if err := s.db.Where("status = ? AND period_end <= ?", SubscriptionStatusActive, now).
+		Find(&subs).Error; err != nil {
+		return
+	}
+	for _, sub := range subs {
+		_ = s.db.Transaction(func(tx *gorm.DB) error {
+			return renewTx(tx, sub, now)
+		})
+	}
+}
+
+// activeSubscriptionTx 获取用户有效订阅（到期时先续费），没有有效订阅时返回 nil
+func activeSubscriptionTx(tx *gorm.DB, userID string) (*Subscription, *Plan, error) {
+	return subscriptionTx(tx, userID, true)
+}
+
+// subscriptionTx 读取用户有效订阅及套餐；renew 为 false 时只读，已到期的订阅原样返回
+func subscriptionTx(tx *gorm.DB, userID string, renew bool) (*Subscription, *Plan, error) {
+	var sub Subscription
+	if err := tx.Where("user_id = ?", userID).First(&sub).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	if renew {
+		if err := renewTx(tx, &sub, time.Now()); err != nil {
+			return nil, nil, err
+		}
+	}
+	if sub.Status != SubscriptionStatusActive {
+		return nil, nil, nil
+	}
+	var plan Plan
+	if err := tx.Preload("Quotas").First(&plan, sub.PlanID).Error; err != nil {
+		return nil, nil, err
+	}
+	return &sub, &plan, nil
+}
+
+// renewableTx 判断已到期的订阅能否续费（与 renewTx 的条件一致），只读
+func renewableTx(tx *gorm.DB, sub *Subscription, plan *Plan) bool {
+	if !sub.AutoRenew || !plan.Active {
+		return false
+	}
+	if plan.MonthlyFee <= 0 {
+		return true
+	}
+	var count int64
+	err := tx.Model(&User{}).Where("id = ? AND balance >= ?", sub.UserID, plan.MonthlyFee).Count(&count).Error
+	return err == nil && count > 0
+}
+
+// usedTokensTx 查询订阅在当前周期内某条额度的已用 token 数
+func usedTokensTx(tx *gorm.DB, sub *Subscription, quotaID uint) (int64, error) {
+	var usage SubscriptionUsage
+	err := tx.Where("subscription_id = ? AND period_start = ? AND quota_id = ?", sub.ID, sub.PeriodStart, quotaID).
+		First(&usage).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return usage.UsedTokens, err
+}
+
+// ConsumeAllowance 从用户当前周期的套餐额度中扣除本次请求的 tokens。
+// 返回额度覆盖的 token 数，以及剩余部分的计费倍率（无匹配套餐时为 1）。
+func (s *SubscriptionDB) ConsumeAllowance(userID, model string, tokens int) (int, float64, error) {
+	covered, rate := 0, 1.0
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		covered, rate, err = consumeAllowanceTx(tx, userID, model, tokens)
+		return err
+	})
+	if err != nil {
+		return 0, 1, err
+	}
+	return covered, rate, nil
+}
+
+// consumeAllowanceTx 在 tx 中执行 ConsumeAllowance
+func consumeAllowanceTx(tx *gorm.DB, userID, model string, tokens int) (int, float64, error) {
+	rate := 1.0
+	sub, plan, err := activeSubscriptionTx(tx, userID)
+	if err != nil || sub == nil {
+		return 0, rate, err
+	}
+	quota := matchQuota(plan.Quotas, model)
+	if quota == nil {
+		return 0, rate, nil
+	}
+	if plan.OverageRate > 0 {
+		rate = plan.OverageRate
+	}
+	if tokens <= 0 {
+		return 0, rate, nil
+	}
+	used, err := usedTokensTx(tx, sub, quota.ID)
+	if err != nil {
+		return 0, rate, err
+	}
+	remaining := quota.Tokens - used
+	if remaining <= 0 {
+		return 0, rate, nil
+	}
+	covered := tokens
+	if int64(covered) > remaining {
+		covered = int(remaining)
+	}
+	usage := SubscriptionUsage{
+		SubscriptionID: sub.ID,
+		PeriodStart:    sub.PeriodStart,
+		QuotaID:        quota.ID,
+		UsedTokens:     int64(covered),
+	}
+	err = tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "subscription_id"}, {Name: "period_start"}, {Name: "quota_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"used_tokens": gorm.Expr("used_tokens + ?", covered)}),
+	}).Create(&usage).Error
+	return covered, rate, err
+}
+
+// HasAllowance 判断用户是否还有可用于该模型的套餐额度（用于余额预检查）。只读：周期已到期的
+// 订阅不在这里续费，能续费时按新周期的完整额度判断，续费由 ConsumeAllowance 或 RenewDue 完成
+func (s *SubscriptionDB) HasAllowance(userID, model string) bool {
+	sub, plan, err := subscriptionTx(s.db, userID, false)
+	if err != nil || sub == nil {
+		return false
+	}
+	quota := matchQuota(plan.Quotas, model)
+	if quota == nil || quota.Tokens <= 0 {
+		return false
+	}
+	if !time.Now().Before(sub.PeriodEnd) {
+		return renewableTx(s.db, sub, plan)
+	}
+	used, err := usedTokensTx(s.db, sub, quota.ID)
+	return err == nil && used < quota.Tokens
+}
+
+// GetStatus 获取用户订阅及当前周期额度使用情况，没有有效订阅时返回 nil。只读，到期续费由
+// RenewDue 或下一次 ConsumeAllowance 完成
+func (s *SubscriptionDB) GetStatus(userID string) (*SubscriptionStatus, error) {
+	var status *SubscriptionStatus
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		sub, plan, err := subscriptionTx(tx, userID, false)
+		if err != nil || sub == nil {
+			return err
+		}
+		status = &SubscriptionStatus{Subscription: sub, Plan: plan}
+		for _, q := range plan.Quotas {
+			used, err := usedTokensTx(tx, sub, q.ID)
+			if err != nil {
+				return err
+			}
+			remaining := q.Tokens - used
+			if remaining < 0 {
+				remaining = 0
+			}
+			status.Quotas = append(status.Quotas, QuotaStatus{
+				Model: q.Model, Tokens: q.Tokens, Used: used, Remaining: remaining,
+			})
+		}
+		return nil
+	})
+	return status, err
+}
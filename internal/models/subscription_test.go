@@ -0,0 +1,125 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionAllowanceAndRenewal(t *testing.T) {
+	db, _, userDB := newPromoTestDB(t)
+	subDB := NewSubscriptionDB(db)
+	if err := userDB.AddBalance("user-1", 25); err != nil {
+		t.Fatalf("add balance: %v", err)
+	}
+
+	plan := &Plan{Name: "basic", MonthlyFee: 10, OverageRate: 0.5, Active: true, Quotas: []PlanQuota{
+		{Model: "qwen*", Tokens: 1000},
+		{Model: "qwen-max", Tokens: 100},
+	}}
+	if err := subDB.CreatePlan(plan); err != nil {
+		t.Fatalf("create plan: %v", err)
+	}
+	sub, err := subDB.Subscribe("user-1", plan.ID)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if balance, spent, _ := userDB.GetBalance("user-1"); balance != 15 || spent != 10 {
+		t.Fatalf("after subscribe: balance=%v spent=%v, want 15/10", balance, spent)
+	}
+
+	// 精确匹配优先于前缀匹配
+	covered, rate, err := subDB.ConsumeAllowance("user-1", "qwen-max", 150)
+	if err != nil || covered != 100 || rate != 0.5 {
+		t.Fatalf("consume qwen-max: covered=%d rate=%v err=%v, want 100/0.5", covered, rate, err)
+	}
+	covered, _, _ = subDB.ConsumeAllowance("user-1", "qwen-7b", 600)
+	if covered != 600 {
+		t.Fatalf("consume qwen-7b: covered=%d, want 600", covered)
+	}
+	covered, rate, _ = subDB.ConsumeAllowance("user-1", "llama3", 10)
+	if covered != 0 || rate != 1 {
+		t.Fatalf("consume unmatched model: covered=%d rate=%v, want 0/1", covered, rate)
+	}
+	if subDB.HasAllowance("user-1", "qwen-max") {
+		t.Fatal("qwen-max allowance should be used up")
+	}
+
+	// 到期后自动续费，额度重置
+	db.Model(&Subscription{}).Where("id = ?", sub.ID).
+		Update("period_end", time.Now().Add(-time.Minute))
+	subDB.RenewDue()
+	status, err := subDB.GetStatus("user-1")
+	if err != nil || status == nil {
+		t.Fatalf("status after renewal: %v %v", status, err)
+	}
+	for _, q := range status.Quotas {
+		if q.Used != 0 {
+			t.Fatalf("quota %s not reset after renewal: used=%d", q.Model, q.Used)
+		}
+	}
+	if balance, _, _ := userDB.GetBalance("user-1"); balance != 5 {
+		t.Fatalf("balance after renewal: got %v, want 5", balance)
+	}
+
+	// 余额不足时到期失效
+	db.Model(&Subscription{}).Where("id = ?", sub.ID).
+		Update("period_end", time.Now().Add(-time.Minute))
+	subDB.RenewDue()
+	if status, _ := subDB.GetStatus("user-1"); status != nil {
+		t.Fatal("subscription should expire when balance is insufficient")
+	}
+	if _, err := subDB.Subscribe("user-1", plan.ID); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("resubscribe: got %v, want ErrInsufficientBalance", err)
+	}
+}
+
+func TestHasAllowanceDoesNotRenew(t *testing.T) {
+	db, _, userDB := newPromoTestDB(t)
+	subDB := NewSubscriptionDB(db)
+	if err := userDB.AddBalance("user-1", 25); err != nil {
+		t.Fatalf("add balance: %v", err)
+	}
+	plan := &Plan{Name: "basic", MonthlyFee: 10, Active: true, Quotas: []PlanQuota{{Model: "qwen*", Tokens: 100}}}
+	if err := subDB.CreatePlan(plan); err != nil {
+		t.Fatalf("create plan: %v", err)
+	}
+	sub, err := subDB.Subscribe("user-1", plan.ID)
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if covered, _, _ := subDB.ConsumeAllowance("user-1", "qwen-7b", 100); covered != 100 {
+		t.Fatalf("consume allowance: covered=%d, want 100", covered)
+	}
+	if subDB.HasAllowance("user-1", "qwen-7b") {
+		t.Fatal("allowance should be used up")
+	}
+
+	// 到期后预检查按续费后的额度判断，但不扣月费、不进入新周期
+	db.Model(&Subscription{}).Where("id = ?", sub.ID).
+		Update("period_end", time.Now().Add(-time.Minute))
+	if !subDB.HasAllowance("user-1", "qwen-7b") {
+		t.Fatal("renewable subscription should report allowance")
+	}
+	if status, _ := subDB.GetStatus("user-1"); status == nil || !status.Subscription.PeriodEnd.Before(time.Now()) {
+		t.Fatalf("status renewed the subscription: %+v", status)
+	}
+	if balance, _, _ := userDB.GetBalance("user-1"); balance != 15 {
+		t.Fatalf("balance after pre-check: got %v, want 15", balance)
+	}
+
+	// 实际扣额度时才续费
+	if covered, _, _ := subDB.ConsumeAllowance("user-1", "qwen-7b", 30); covered != 30 {
+		t.Fatalf("consume after renewal: covered=%d, want 30", covered)
+	}
+	if balance, _, _ := userDB.GetBalance("user-1"); balance != 5 {
+		t.Fatalf("balance after renewal: got %v, want 5", balance)
+	}
+
+	// 余额不足以续费时预检查不再认为有额度
+	db.Model(&Subscription{}).Where("id = ?", sub.ID).
+		Update("period_end", time.Now().Add(-time.Minute))
+	if subDB.HasAllowance("user-1", "qwen-7b") {
+		t.Fatal("subscription that cannot renew should not report allowance")
+	}
+}
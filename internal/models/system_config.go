@@ -2,6 +2,8 @@ package models
 
 import (
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"gorm.io/gorm"
@@ -14,9 +16,14 @@ type SystemConfig struct {
 	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
 }
 
-// SystemConfigDB 提供系统配置项的读写方法
+// SystemConfigDB 提供系统配置项的读写方法。请求路径上按前缀读取的配置（价格上限、负载均衡权重）
+// 缓存在内存中，经 Set/Delete 写入时失效
 type SystemConfigDB struct {
 	db *gorm.DB
+
+	mu          sync.RWMutex
+	prefixCache map[string]map[string]string // prefix → 去掉前缀的 key → value
+	generation  uint64                       // 每次写入递增，避免把写入前读到的旧值放入缓存
 }
 
 // NewSystemConfigDB 初始化 SystemConfigDB
@@ -29,6 +36,20 @@ func NewSystemConfigDB(db *gorm.DB) *SystemConfigDB {
 const (
 	// ConfigKeyRegisterBonus 新注册会员赠送余额（元），0 表示不赠送
 	ConfigKeyRegisterBonus = "register_bonus_balance"
+	// ConfigKeyReferralMinAmount 被邀请人累计消费或贡献收益达到该金额（元）后发放邀请奖励
+	ConfigKeyReferralMinAmount = "referral_min_amount"
+	// ConfigKeyReferralReferrerReward 邀请人奖励（元），0 表示不奖励
+	ConfigKeyReferralReferrerReward = "referral_referrer_reward"
+	// ConfigKeyReferralRefereeReward 被邀请人奖励（元），0 表示不奖励
+	ConfigKeyReferralRefereeReward = "referral_referee_reward"
+	// ConfigKeyTruncatedRefundRatio 流被截断（provider 侧中断）时自动退还费用的比例，默认 0.5
+	ConfigKeyTruncatedRefundRatio = "truncated_refund_ratio"
+	// ConfigKeyStatementsClosedPeriod 最近一次已完成月结的周期（如 2026-09），由月结任务维护
+	ConfigKeyStatementsClosedPeriod = "statements_closed_period"
+	// ConfigKeyAuctionRule 拍卖撮合的成交规则：pay-as-bid 或 second-price（默认）
+	ConfigKeyAuctionRule = "auction_rule"
+	// ConfigKeyCanonicalRulesMigrated 价格上限、折扣规则的模型名已改写为规范 ID 的时间，由启动时的一次性迁移写入
+	ConfigKeyCanonicalRulesMigrated = "canonical_rules_migrated"
 )
 
 // GetFloat 读取配置项并解析为 float64，不存在或解析失败返回默认值
@@ -44,8 +65,73 @@ func (s *SystemConfigDB) GetFloat(key string, defaultVal float64) float64 {
 	return val
 }
 
+// GetString 读取字符串配置项，不存在返回默认值
+func (s *SystemConfigDB) GetString(key, defaultVal string) string {
+	var cfg SystemConfig
+	if err := s.db.Where("key = ?", key).First(&cfg).Error; err != nil {
+		return defaultVal
+	}
+	return cfg.Value
+}
+
+// ListByPrefix 列出 key 以 prefix 开头的配置项
+func (s *SystemConfigDB) ListByPrefix(prefix string) ([]*SystemConfig, error) {
+	var cfgs []*SystemConfig
+	err := s.db.Where("substr(key, 1, ?) = ?", len(prefix), prefix).Order("key").Find(&cfgs).Error
+	return cfgs, err
+}
+
+// CachedByPrefix 返回 key 以 prefix 开头的配置项（key 去掉前缀），结果缓存到相关配置项被写入为止
+func (s *SystemConfigDB) CachedByPrefix(prefix string) (map[string]string, error) {
+	s.mu.RLock()
+	values, ok := s.prefixCache[prefix]
+	generation := s.generation
+	s.mu.RUnlock()
+	if ok {
+		return values, nil
+	}
+
+	cfgs, err := s.ListByPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	values = make(map[string]string, len(cfgs))
+	for _, cfg := range cfgs {
+		values[strings.TrimPrefix(cfg.Key, prefix)] = cfg.Value
+	}
+	s.mu.Lock()
+	if s.generation == generation {
+		if s.prefixCache == nil {
+			s.prefixCache = make(map[string]map[string]string)
+		}
+		s.prefixCache[prefix] = values
+	}
+	s.mu.Unlock()
+	return values, nil
+}
+
+// invalidate 使包含 key 的前缀缓存失效
+func (s *SystemConfigDB) invalidate(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	for prefix := range s.prefixCache {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.prefixCache, prefix)
+		}
+	}
+}
+
+// Delete 删除配置项，返回是否存在
+func (s *SystemConfigDB) Delete(key string) (bool, error) {
+	defer s.invalidate(key)
+	result := s.db.Where("key = ?", key).Delete(&SystemConfig{})
+	return result.RowsAffected > 0, result.Error
+}
+
 // Set 写入配置项（主键存在则更新，不存在则插入）
 func (s *SystemConfigDB) Set(key, value string) error {
+	defer s.invalidate(key)
 	cfg := SystemConfig{Key: key, Value: value}
 	return s.db.Save(&cfg).Error
 }
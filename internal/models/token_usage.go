@@ -1,6 +1,7 @@
 package models
 
 import (
+	"errors"
 	"sort"
 	"strings"
 	"time"
@@ -10,36 +11,68 @@ import (
 
 // TokenUsage
 type TokenUsage struct {
-	ID           uint   `gorm:"primaryKey"`
-	RequestID    string `gorm:"index;not null"`
-	UserID       string `gorm:"index;not null"`
-	APIKey       string `gorm:"index"`
-	ClientID     string `gorm:"index"`
-	ClientIP     string
-	Model        string    `gorm:"not null"`
-	IPPM         float64   `gorm:"column:ip_pm;not null"`           // 输入tokens价格 - 数据库列名是 ip_pm
-	OPPM         float64   `gorm:"column:oppm;not null"`            // 输出tokens价格 - 数据库列名是 oppm
-	CIPPM        float64   `gorm:"column:cippm;not null;default:0"` // 缓存命中输入tokens价格
-	InputTokens  int       `gorm:"not null"`
-	OutputTokens int       `gorm:"not null"`
-	CachedTokens int       `gorm:"not null;default:0"` // 缓存命中的输入tokens数
-	TotalTokens  int       `gorm:"not null"`
-	RequestType  string    `gorm:"not null;default:'chat'"` // 请求类型: chat, embedding
-	Revenue      float64   `gorm:"not null;default:0"`      // 收益（client端收入）
-	Cost         float64   `gorm:"not null;default:0"`      // 费用（user端支出）
-	Fingerprint  string    `gorm:"index"`                   // 请求指纹
-	Timestamp    time.Time `gorm:"index;not null"`
-	CreatedAt    time.Time `gorm:"autoCreateTime"`
-}
-
-// 声明一个模型的unitprice表，包含模型名、输入token单价、输出token单价，用户折扣率，用户id
-type ModelPrice struct {
-	ModelName        string  `gorm:"primaryKey;not null"`
-	InputTokenPrice  float64 `gorm:"not null"`       // 输入token单价
-	OutputTokenPrice float64 `gorm:"not null"`       // 输出token单价
-	UserDiscountRate float64 `gorm:"not null"`       // 用户折扣率
-	UserID           string  `gorm:"index;not null"` // 用户ID
-}
+	ID              uint   `gorm:"primaryKey"`
+	RequestID       string `gorm:"index;not null"`
+	UserID          string `gorm:"index;not null"`
+	APIKey          string `gorm:"index"`
+	ClientID        string `gorm:"index"`
+	ClientIP        string
+	Model           string    `gorm:"not null"`
+	IPPM            float64   `gorm:"column:ip_pm;not null"`                // 输入tokens价格（provider 折扣后的结算价，用户扣费见 Cost）- 数据库列名是 ip_pm
+	OPPM            float64   `gorm:"column:oppm;not null"`                 // 输出tokens价格（折扣后的成交价）- 数据库列名是 oppm
+	CIPPM           float64   `gorm:"column:cippm;not null;default:0"`      // 缓存命中输入tokens价格（折扣后的成交价）
+	ListIPPM        float64   `gorm:"column:list_ippm;not null;default:0"`  // client 标价（折扣前）
+	ListOPPM        float64   `gorm:"column:list_oppm;not null;default:0"`  // client 标价（折扣前）
+	ListCIPPM       float64   `gorm:"column:list_cippm;not null;default:0"` // client 标价（折扣前）
+	ListRPPM        float64   `gorm:"column:list_rppm;not null;default:0"`  // client 标价（折扣前）
+	ListPPI         float64   `gorm:"column:list_ppi;not null;default:0"`   // client 标价（折扣前）
+	RPPM            float64   `gorm:"column:rppm;not null;default:0"`       // 推理tokens价格（折扣后的成交价）
+	PPI             float64   `gorm:"column:ppi;not null;default:0"`        // 每张输入图片价格（折扣后的成交价）
+	Fee             float64   `gorm:"not null;default:0"`                   // 不按 tokens 计价的固定费用，如预留容量结算
+	ReservationID   uint      `gorm:"index;not null;default:0"`             // 按预留条款计费的请求所属预留
+	DiscountRate    float64   `gorm:"not null;default:0"`                   // 用户扣费应用的折扣率，0.2 表示按标价 8 折扣费
+	AuctionRule     string    `gorm:"not null;default:''"`                  // 拍卖撮合的成交规则，非拍卖请求为空；成交价记录在 List* 中
+	BidIPPM         float64   `gorm:"column:bid_ippm;not null;default:0"`   // 用户出价
+	BidOPPM         float64   `gorm:"column:bid_oppm;not null;default:0"`   // 用户出价
+	AskIPPM         float64   `gorm:"column:ask_ippm;not null;default:0"`   // 中标 client 报价
+	AskOPPM         float64   `gorm:"column:ask_oppm;not null;default:0"`   // 中标 client 报价
+	InputTokens     int       `gorm:"not null"`
+	OutputTokens    int       `gorm:"not null"`
+	CachedTokens    int       `gorm:"not null;default:0"` // 缓存命中的输入tokens数
+	ReasoningTokens int       `gorm:"not null;default:0"` // 推理tokens数（包含在 OutputTokens 中）
+	ImageCount      int       `gorm:"not null;default:0"` // 请求中的输入图片数
+	ImageBytes      int64     `gorm:"not null;default:0"` // 内联（base64）输入图片的总字节数
+	TotalTokens     int       `gorm:"not null"`
+	PlanTokens      int       `gorm:"not null;default:0"`                 // 由订阅套餐额度覆盖（不计费）的tokens数
+	RequestType     string    `gorm:"not null;default:'chat'"`            // 请求类型: chat, embedding
+	Revenue         float64   `gorm:"not null;default:0"`                 // 收益（client端收入）
+	Cost            float64   `gorm:"not null;default:0"`                 // 费用（user端支出）
+	Outcome         string    `gorm:"index;not null;default:'completed'"` // 请求结果: completed, cancelled, client_error, truncated
+	Refunded        float64   `gorm:"not null;default:0"`                 // 已退还给用户的金额
+	Chargeback      float64   `gorm:"not null;default:0"`                 // 从 client 端收益中扣回的金额
+	Fingerprint     string    `gorm:"index"`                              // 请求指纹
+	LatencyMs       int64     `gorm:"not null;default:0"`                 // 从收到请求到计费完成的耗时（毫秒）
+	TTFTMs          int64     `gorm:"column:ttft_ms;not null;default:0"`  // 首个 token 的耗时（毫秒）
+	PricedAt        time.Time // 派发请求时读取 client 报价的时间，计费按该时刻的价格快照
+	Timestamp       time.Time `gorm:"index;not null"`
+	CreatedAt       time.Time `gorm:"autoCreateTime"`
+}
+
+// GrossIncome 计算该记录对应的 client 端收益（未扣除 chargeback），与收益统计 SQL 口径一致
+func (u *TokenUsage) GrossIncome() float64 {
+	return (float64(u.InputTokens-u.CachedTokens)*u.IPPM+float64(u.CachedTokens)*u.CIPPM+
+		float64(u.OutputTokens-u.ReasoningTokens)*u.OPPM+float64(u.ReasoningTokens)*u.RPPM)/1000000 +
+		float64(u.ImageCount)*u.PPI + u.Fee
+}
+
+// NetCost 用户为该请求实际支付的金额（扣除退款）
+func (u *TokenUsage) NetCost() float64 {
+	return u.Cost - u.Refunded
+}
+
+// unbilledRequestsTable 未计费就结束的请求（用户断开、client 在返回 usage 前失败）单独存放，
+// 不计入 token_usages 上的调用次数统计
+const unbilledRequestsTable = "unbilled_requests"
 
 // TokenUsageDB
 type TokenUsageDB struct {
@@ -50,11 +83,20 @@ type TokenUsageDB struct {
 func NewTokenUsageDB(db *gorm.DB) *TokenUsageDB {
 	// AutoMigrate will create the table if it doesn't exist
 	err := db.AutoMigrate(&TokenUsage{})
-	// and ModelPrice{}
-	err = db.AutoMigrate(&ModelPrice{})
 	if err != nil {
 		return nil
 	}
+	if err := db.Table(unbilledRequestsTable).AutoMigrate(&TokenUsage{}); err != nil {
+		return nil
+	}
+	// 迁移早先写入 token_usages 的未计费记录
+	db.Transaction(func(tx *gorm.DB) error {
+		unbilled := "outcome <> 'completed' AND cost = 0 AND revenue = 0 AND fee = 0 AND total_tokens = 0"
+		if err := tx.Exec("INSERT INTO " + unbilledRequestsTable + " SELECT * FROM token_usages WHERE " + unbilled).Error; err != nil {
+			return err
+		}
+		return tx.Exec("DELETE FROM token_usages WHERE " + unbilled).Error
+	})
 
 	// 创建复合索引以大幅提升大表查询性能
 	// (user_id, timestamp) — 使用量详单/统计/趋势查询
@@ -79,6 +121,29 @@ func (tdb *TokenUsageDB) RecordTokenUsage(usage TokenUsage) error {
 	return tdb.db.Create(&usage).Error
 }
 
+// SaveUnbilledOutcome 记录未计费就结束的请求
+func (tdb *TokenUsageDB) SaveUnbilledOutcome(usage *TokenUsage) error {
+	return tdb.db.Table(unbilledRequestsTable).Create(usage).Error
+}
+
+// GetUserRequest 按 RequestID 查询用户自己的请求记录，同一请求有多条时取最新一条；
+// 没有计费记录时返回未计费请求的结果
+func (tdb *TokenUsageDB) GetUserRequest(userID, requestID string) (*TokenUsage, error) {
+	var usage TokenUsage
+	err := tdb.db.Where("request_id = ? AND user_id = ?", requestID, userID).Order("id DESC").First(&usage).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = tdb.db.Table(unbilledRequestsTable).
+			Where("request_id = ? AND user_id = ?", requestID, userID).Order("id DESC").First(&usage).Error
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUsageNotFound
+		}
+		return nil, err
+	}
+	return &usage, nil
+}
+
 // GetUserTokenUsage
 func (tdb *TokenUsageDB) GetUserTokenUsage(userID string, startTime, endTime time.Time) ([]*TokenUsage, error) {
 	var usages []*TokenUsage
@@ -133,33 +198,6 @@ func (tdb *TokenUsageDB) GetUserTokenStats(userID string, startTime, endTime tim
 	}, nil
 }
 
-// GetModelPrice
-func (tdb *TokenUsageDB) GetModelPrice(modelName string, userID string) (*ModelPrice, error) {
-	var price ModelPrice
-	result := tdb.db.Where("model_name = ? AND user_id = ?", modelName, userID).First(&price)
-
-	if result.Error != nil {
-		return nil, result.Error
-	}
-
-	return &price, nil
-}
-
-// SaveModelPrice
-func (tdb *TokenUsageDB) SaveModelPrice(price *ModelPrice) error {
-	return tdb.db.Save(price).Error
-}
-
-// DeleteModelPrice
-func (tdb *TokenUsageDB) DeleteModelPrice(modelName string, userID string) error {
-	return tdb.db.Where("model_name = ? AND user_id = ?", modelName, userID).Delete(&ModelPrice{}).Error
-}
-
-// update ModelPrice
-func (tdb *TokenUsageDB) UpdateModelPrice(price *ModelPrice) error {
-	return tdb.db.Save(price).Error
-}
-
 // GetTokenUsageByRequestType 根据请求类型获取token使用情况
 func (tdb *TokenUsageDB) GetTokenUsageByRequestType(userID string, requestType string, startTime, endTime time.Time) ([]*TokenUsage, error) {
 	var usages []*TokenUsage
@@ -230,14 +268,16 @@ func (tdb *TokenUsageDB) GetTotalIncomeByUserID(id string, clientDB *ClientDB) (
 	// 查询这些客户端的总收益（支持缓存命中分离计费）
 	// non_cached_income = (input_tokens - cached_tokens) * ippm
 	// cached_income = cached_tokens * cippm
-	// output_income = output_tokens * oppm
+	// output_income = (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm
+	// image_income = image_count * ppi
+	// fee_income = fee（预留容量结算等固定费用）
 	type Result struct {
 		TotalIncome float64
 	}
 
 	var result Result
 	err = tdb.db.Model(&TokenUsage{}).
-		Select("SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + output_tokens * oppm) / 1000000.0) as total_income").
+		Select("SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm) / 1000000.0 + image_count * ppi + fee - chargeback) as total_income").
 		Where("client_id IN ?", clientIDs).
 		Scan(&result).Error
 
@@ -291,7 +331,7 @@ func (tdb *TokenUsageDB) GetTotalIncomeStatsByUserID(userID string, clientDB *Cl
 	var result Result
 	err = tdb.db.Model(&TokenUsage{}).
 		Select(`
-			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + output_tokens * oppm) / 1000000.0) as total_income,
+			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm) / 1000000.0 + image_count * ppi + fee - chargeback) as total_income,
 			COUNT(*) as total_calls,
 			SUM(input_tokens) as input_tokens,
 			SUM(output_tokens) as output_tokens,
@@ -349,7 +389,7 @@ func (tdb *TokenUsageDB) GetIncomeStatsByTimeRange(clientIDs []string, startTime
 	var result Result
 	err := tdb.db.Model(&TokenUsage{}).
 		Select(`
-			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + output_tokens * oppm) / 1000000.0) as total_income,
+			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm) / 1000000.0 + image_count * ppi + fee - chargeback) as total_income,
 			COUNT(*) as total_calls,
 			SUM(input_tokens) as input_tokens,
 			SUM(output_tokens) as output_tokens,
@@ -409,7 +449,7 @@ func (tdb *TokenUsageDB) GetIncomeTrendByDay(clientIDs []string, startTime, endT
 	err := tdb.db.Model(&TokenUsage{}).
 		Select(`
 			DATE(timestamp) as date,
-			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + output_tokens * oppm) / 1000000.0) as income,
+			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm) / 1000000.0 + image_count * ppi + fee - chargeback) as income,
 			COUNT(*) as calls
 		`).
 		Where("client_id IN ? AND timestamp BETWEEN ? AND ?", clientIDs, startTime, endTime).
@@ -446,7 +486,7 @@ func (tdb *TokenUsageDB) GetIncomeStatsByModel(clientIDs []string, startTime, en
 			SUM(output_tokens) as output_tokens,
 			SUM(cached_tokens) as cached_tokens,
 			SUM(total_tokens) as total_tokens,
-			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + output_tokens * oppm) / 1000000.0) as income,
+			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm) / 1000000.0 + image_count * ppi + fee - chargeback) as income,
 			COUNT(*) as calls,
 			COUNT(DISTINCT client_id) as client_count
 		`).
@@ -485,7 +525,7 @@ func (tdb *TokenUsageDB) GetUsageTotalStatsByUserID(userID string) (map[string]f
 			SUM(output_tokens) as output_tokens,
 			SUM(cached_tokens) as cached_tokens,
 			SUM(total_tokens) as total_tokens,
-			SUM(cost) as total_cost,
+			SUM(cost - refunded) as total_cost,
 			COUNT(DISTINCT client_id) as client_count,
 			COUNT(DISTINCT model) as model_count
 		`).
@@ -529,7 +569,7 @@ func (tdb *TokenUsageDB) GetUsageStatsByUserID(userID string, startTime, endTime
 			SUM(output_tokens) as output_tokens,
 			SUM(cached_tokens) as cached_tokens,
 			SUM(total_tokens) as total_tokens,
-			SUM(cost) as total_cost,
+			SUM(cost - refunded) as total_cost,
 			COUNT(DISTINCT client_id) as client_count,
 			COUNT(DISTINCT model) as model_count
 		`).
@@ -628,7 +668,7 @@ func (tdb *TokenUsageDB) GetUsageStatsByModel(userID string, startTime, endTime
 			SUM(output_tokens) as output_tokens,
 			SUM(cached_tokens) as cached_tokens,
 			SUM(total_tokens) as total_tokens,
-			SUM(cost) as total_cost,
+			SUM(cost - refunded) as total_cost,
 			COUNT(*) as calls,
 			COUNT(DISTINCT client_id) as client_count,
 			MAX(timestamp) as last_used
@@ -645,6 +685,49 @@ func (tdb *TokenUsageDB) GetUsageStatsByModel(userID string, startTime, endTime
 	return stats, nil
 }
 
+// APIKeyUsageStat 按 API Key 使用统计
+type APIKeyUsageStat struct {
+	APIKey       string  `json:"api_key"`
+	Name         string  `json:"name"`
+	Prefix       string  `json:"prefix"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	CachedTokens int64   `json:"cached_tokens"`
+	TotalTokens  int64   `json:"total_tokens"`
+	TotalCost    float64 `json:"total_cost"`
+	Calls        int64   `json:"calls"`
+	LastUsed     string  `json:"last_used"`
+}
+
+// GetUsageStatsByAPIKey 按 API Key 聚合使用统计（已删除的 key 名称为空）
+func (tdb *TokenUsageDB) GetUsageStatsByAPIKey(userID string, startTime, endTime time.Time) ([]APIKeyUsageStat, error) {
+	var stats []APIKeyUsageStat
+	err := tdb.db.Table("token_usages").
+		Select(`
+			token_usages.api_key as api_key,
+			MAX(api_keys.name) as name,
+			MAX(api_keys.prefix) as prefix,
+			SUM(input_tokens) as input_tokens,
+			SUM(output_tokens) as output_tokens,
+			SUM(cached_tokens) as cached_tokens,
+			SUM(total_tokens) as total_tokens,
+			SUM(cost - refunded) as total_cost,
+			COUNT(*) as calls,
+			MAX(timestamp) as last_used
+		`).
+		Joins("LEFT JOIN api_keys ON api_keys.id = token_usages.api_key").
+		Where("token_usages.user_id = ? AND timestamp BETWEEN ? AND ?", userID, startTime, endTime).
+		Group("token_usages.api_key").
+		Order("total_cost DESC").
+		Scan(&stats).Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
 // GetUserTokenUsageByModelPaged 分页获取某模型的使用详单
 func (tdb *TokenUsageDB) GetUserTokenUsageByModelPaged(userID, model string, startTime, endTime time.Time, page, size int) ([]*TokenUsage, int64, error) {
 	var usages []*TokenUsage
@@ -750,7 +833,8 @@ func (tdb *TokenUsageDB) GetModelRank() ([]ModelRankEntry, error) {
 }
 
 // GetContributorRank 获取贡献者收益排名（前10，按总收益降序，单位 $）。
-// 收益按 client 端收入口径计算：((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + output_tokens * oppm) / 1e6。
+// 收益按 client 端收入口径计算：((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm +
+// (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm) / 1e6 + image_count * ppi + fee - chargeback。
 // 通过 client 关联到其所属 user，并对用户名做脱敏处理。
 func (tdb *TokenUsageDB) GetContributorRank(limit int, clientDB *ClientDB, userDB *UserDB) ([]ContributorRankEntry, error) {
 	if limit <= 0 {
@@ -765,7 +849,7 @@ func (tdb *TokenUsageDB) GetContributorRank(limit int, clientDB *ClientDB, userD
 	err := tdb.db.Model(&TokenUsage{}).
 		Select(`
 			client_id,
-			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + output_tokens * oppm) / 1000000.0) as income
+			SUM(((input_tokens - cached_tokens) * ip_pm + cached_tokens * cippm + (output_tokens - reasoning_tokens) * oppm + reasoning_tokens * rppm) / 1000000.0 + image_count * ppi + fee - chargeback) as income
 		`).
 		Group("client_id").
 		Scan(&rows).Error
@@ -835,7 +919,7 @@ func (tdb *TokenUsageDB) GetPublicHomepageStats(clientDB *ClientDB, userDB *User
 		Select(`
 			COALESCE(SUM(total_tokens), 0) as total_tokens,
 			COUNT(*) as total_calls,
-			COALESCE(SUM(cost), 0) as total_value,
+			COALESCE(SUM(cost - refunded), 0) as total_value,
 			COUNT(DISTINCT user_id) as active_users
 		`).
 		Scan(&totals).Error; err != nil {
@@ -852,7 +936,7 @@ func (tdb *TokenUsageDB) GetPublicHomepageStats(clientDB *ClientDB, userDB *User
 		Select(`
 			DATE(timestamp) as date,
 			COALESCE(SUM(total_tokens), 0) as total_tokens,
-			COALESCE(SUM(cost), 0) as total_value
+			COALESCE(SUM(cost - refunded), 0) as total_value
 		`).
 		Where("timestamp BETWEEN ? AND ?", startTime, endTime).
 		Group("DATE(timestamp)").
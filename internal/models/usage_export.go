@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// streamUsages 逐行读取查询结果并回调 fn，不把整个结果集加载到内存，适合导出大时间范围的详单
+func (tdb *TokenUsageDB) streamUsages(query *gorm.DB, fn func(*TokenUsage) error) error {
+	rows, err := query.Order("timestamp ASC").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var usage TokenUsage
+	for rows.Next() {
+		usage = TokenUsage{}
+		if err := tdb.db.ScanRows(rows, &usage); err != nil {
+			return err
+		}
+		if err := fn(&usage); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// StreamUserUsage 按时间顺序流式读取用户使用详单（走 (user_id, timestamp) 索引）
+func (tdb *TokenUsageDB) StreamUserUsage(userID string, startTime, endTime time.Time, fn func(*TokenUsage) error) error {
+	query := tdb.db.Model(&TokenUsage{}).
+		Where("user_id = ? AND timestamp BETWEEN ? AND ?", userID, startTime, endTime)
+	return tdb.streamUsages(query, fn)
+}
+
+// StreamIncomeUsage 按时间顺序流式读取 client 收益详单（走 (client_id, timestamp) 索引）
+func (tdb *TokenUsageDB) StreamIncomeUsage(clientIDs []string, startTime, endTime time.Time, fn func(*TokenUsage) error) error {
+	query := tdb.db.Model(&TokenUsage{}).
+		Where("client_id IN ? AND timestamp BETWEEN ? AND ?", clientIDs, startTime, endTime)
+	return tdb.streamUsages(query, fn)
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+func TestStreamUserUsageAndAPIKeyStats(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	tokenUsageDB := NewTokenUsageDB(db)
+	NewAPIKeyDB(db)
+	if err := db.Create(&APIKey{ID: "key-1", UserID: "user-1", Name: "prod", Key: "sk-1", Prefix: "sk-1"}).Error; err != nil {
+		t.Fatalf("create api key: %v", err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		key := "key-1"
+		if i%2 == 1 {
+			key = "key-2"
+		}
+		if err := tokenUsageDB.SaveTokenUsage(&TokenUsage{
+			RequestID: "req", UserID: "user-1", APIKey: key, Model: "model-a",
+			TotalTokens: 10, Cost: 1, Timestamp: now.Add(time.Duration(-i) * time.Minute),
+		}); err != nil {
+			t.Fatalf("save usage: %v", err)
+		}
+	}
+
+	var last time.Time
+	rows := 0
+	err = tokenUsageDB.StreamUserUsage("user-1", now.Add(-time.Hour), now.Add(time.Minute), func(u *TokenUsage) error {
+		if u.Timestamp.Before(last) {
+			t.Fatalf("rows not in timestamp order")
+		}
+		last = u.Timestamp
+		rows++
+		return nil
+	})
+	if err != nil || rows != 5 {
+		t.Fatalf("stream usage: rows=%d err=%v, want 5", rows, err)
+	}
+
+	stats, err := tokenUsageDB.GetUsageStatsByAPIKey("user-1", now.Add(-time.Hour), now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("api key stats: %v", err)
+	}
+	if len(stats) != 2 || stats[0].APIKey != "key-1" || stats[0].Name != "prod" || stats[0].Calls != 3 {
+		t.Fatalf("api key stats: got %+v", stats)
+	}
+}
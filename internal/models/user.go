@@ -15,6 +15,7 @@ type User struct {
 	Password   string    `gorm:"not null" json:"-"`
 	Email      string    `gorm:"index" json:"email"`
 	Role       string    `gorm:"default:user;not null" json:"role"`
+	Tier       string    `gorm:"index;not null;default:''" json:"tier"` // 用户等级，用于匹配管理员设置的等级折扣
 	Balance    float64   `gorm:"default:0;not null" json:"balance"`     // 账户余额（元）
 	TotalSpent float64   `gorm:"default:0;not null" json:"total_spent"` // 累计消费（元）
 	CreatedAt  time.Time `gorm:"not null" json:"created_at"`
@@ -108,6 +109,18 @@ func (udb *UserDB) GetUserByID(id string) (*User, error) {
 	return &user, nil
 }
 
+// SetTier 设置用户等级，空字符串表示普通用户
+func (udb *UserDB) SetTier(id, tier string) error {
+	result := udb.db.Model(&User{}).Where("id = ?", id).Update("tier", tier)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+	return nil
+}
+
 // UpdateUser
 func (udb *UserDB) UpdateUser(user *User) error {
 	user.UpdatedAt = time.Now()
@@ -194,17 +207,22 @@ func (udb *UserDB) GetMaxUserID() (int, error) {
 
 // DeductBalance deducts amount from user balance. Allows balance going negative as long as it was > 0 before deduction.
 func (udb *UserDB) DeductBalance(userID string, amount float64) error {
-	var user User
-	if err := udb.db.Where("id = ?", userID).First(&user).Error; err != nil {
-		return err
+	return deductBalanceTx(udb.db, userID, amount)
+}
+
+// deductBalanceTx 在 tx 中执行 DeductBalance，余额检查与扣减在同一条语句中完成
+func deductBalanceTx(tx *gorm.DB, userID string, amount float64) error {
+	result := tx.Model(&User{}).Where("id = ? AND balance > 0", userID).Updates(map[string]interface{}{
+		"balance":     gorm.Expr("balance - ?", amount),
+		"total_spent": gorm.Expr("total_spent + ?", amount),
+	})
+	if result.Error != nil {
+		return result.Error
 	}
-	if user.Balance <= 0 {
-		return errors.New("insufficient balance")
+	if result.RowsAffected == 0 {
+		return ErrInsufficientBalance
 	}
-	return udb.db.Model(&User{}).Where("id = ?", userID).Updates(map[string]interface{}{
-		"balance":     user.Balance - amount,
-		"total_spent": user.TotalSpent + amount,
-	}).Error
+	return nil
 }
 
 // AddBalance adds amount to user balance
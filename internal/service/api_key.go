@@ -144,3 +144,32 @@ func (s *APIKeyService) DeleteAPIKey(userID, keyID string) error {
 
 	return nil
 }
+
+// SetMaxBidRequest 设置 API Key 默认最高出价的请求，两项都为 0 表示取消拍卖撮合
+type SetMaxBidRequest struct {
+	MaxBidIPPM float64 `json:"max_bid_ippm" binding:"min=0"`
+	MaxBidOPPM float64 `json:"max_bid_oppm" binding:"min=0"`
+}
+
+// 设置 API Key 的默认最高出价
+func (s *APIKeyService) SetMaxBid(userID, keyID string, req *SetMaxBidRequest) error {
+	bid := models.Bid{IPPM: req.MaxBidIPPM, OPPM: req.MaxBidOPPM}
+	if (bid.IPPM > 0 || bid.OPPM > 0) && !bid.Valid() {
+		return errors.New("出价的输入、输出价格需同时设置")
+	}
+	return s.apiKeyDB.SetMaxBid(userID, keyID, bid.IPPM, bid.OPPM)
+}
+
+// SetRoutingRequest 设置 API Key 默认路由策略的请求，strategy 为空表示使用平台默认算法
+type SetRoutingRequest struct {
+	Strategy        string `json:"strategy"`
+	LatencyBudgetMs int    `json:"latency_budget_ms" binding:"min=0"`
+}
+
+// 设置 API Key 默认的负载均衡算法与延迟预算
+func (s *APIKeyService) SetRouting(userID, keyID string, req *SetRoutingRequest) error {
+	if req.Strategy != "" && !models.ValidLoadBalanceAlgorithm(req.Strategy) {
+		return errors.New("不支持的负载均衡算法: " + req.Strategy)
+	}
+	return s.apiKeyDB.SetRouting(userID, keyID, req.Strategy, req.LatencyBudgetMs)
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"star-fire/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// HeaderMaxBid 调用方对本次请求的最高出价，格式 "<ippm>,<oppm>"（每百万 tokens）
+const HeaderMaxBid = "X-Starfire-Max-Bid"
+
+const (
+	bidKey     = "auction_bid"
+	auctionKey = "auction_result"
+)
+
+// requestBid 读取请求的最高出价：优先使用请求头，其次使用 API Key 上设置的默认出价。
+// 没有出价时返回 false，请求按普通负载均衡派发。
+func requestBid(c *gin.Context, server *models.Server) (models.Bid, bool, error) {
+	if header := c.GetHeader(HeaderMaxBid); header != "" {
+		bid, err := models.ParseBid(header)
+		if err != nil {
+			return models.Bid{}, false, err
+		}
+		return bid, true, nil
+	}
+	key := requestAPIKey(c, server)
+	if key == nil {
+		return models.Bid{}, false, nil
+	}
+	bid := models.Bid{IPPM: key.MaxBidIPPM, OPPM: key.MaxBidOPPM}
+	return bid, bid.Valid(), nil
+}
+
+// expectedOutputTokens 拍卖撮合与按价格选择 client 时预估的输出长度，取请求的 max_tokens
+func expectedOutputTokens(request openai.ChatCompletionRequest) int {
+	if request.MaxCompletionTokens > 0 {
+		return request.MaxCompletionTokens
+	}
+	return request.MaxTokens
+}
+
+// applyAuction 把撮合结果（出价、报价、成交规则）记录到使用记录中，成交价即 List* 价格
+func applyAuction(c *gin.Context, usage *models.TokenUsage) {
+	v, ok := c.Get(auctionKey)
+	if !ok {
+		return
+	}
+	match := v.(*models.AuctionResult)
+	usage.AuctionRule = match.Rule
+	usage.BidIPPM, usage.BidOPPM = match.Bid.IPPM, match.Bid.OPPM
+	usage.AskIPPM, usage.AskOPPM = match.AskIPPM, match.AskOPPM
+}
@@ -2,6 +2,7 @@ package service
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"star-fire/internal/models"
@@ -12,12 +13,12 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 	"github.com/sashabaranov/go-openai"
 )
 
 // handle user chat request
 func HandleChatRequest(c *gin.Context, server *models.Server) {
+	c.Set(requestStartKey, time.Now())
 	//扩展结构体（在 go-openai 标准请求之上承载 thinking / enable_thinking）
 	var extendedRequest public.ExtendedChatRequest
 	err := c.ShouldBindJSON(&extendedRequest)
@@ -25,6 +26,25 @@ func HandleChatRequest(c *gin.Context, server *models.Server) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	userID, _ := c.Get("user_id")
+	userIDStr, _ := userID.(string)
+
+	candidates, group := server.ModelCandidates(userIDStr, extendedRequest.Model)
+	if group != nil {
+		// model 为路由分组（或 auto）：依次尝试分组的候选模型，响应中报告实际服务的模型
+		if len(candidates) == 0 {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No model in group " + extendedRequest.Model + " is available"})
+			return
+		}
+		c.Set(routeGroupKey, extendedRequest.Model)
+		c.Set(modelGroupKey, group)
+		c.Set(modelCandidatesKey, candidates)
+		extendedRequest.Model = candidates[0]
+	} else {
+		// 请求可以使用任意引擎的模型名（qwen3:8b、Qwen/Qwen3-8B），统一按规范 ID 匹配 client
+		extendedRequest.Model, _ = server.CanonicalModel(extendedRequest.Model)
+		candidates = []string{extendedRequest.Model}
+	}
 
 	// 仅在用户未显式提供 reasoning_effort 时才填充默认值，
 	// 避免覆盖调用方（如 hermes/opencode）自带的值。
@@ -42,13 +62,14 @@ func HandleChatRequest(c *gin.Context, server *models.Server) {
 	}
 
 	request := extendedRequest.ChatCompletionRequest
+	imageCount, imageBytes := countImageInputs(request.Messages)
+	c.Set(imageCountKey, imageCount)
+	c.Set(imageBytesKey, imageBytes)
 
-	userID, _ := c.Get("user_id")
-	userIDStr, _ := userID.(string)
-
-	// Balance pre-check: reject if balance insufficient (OpenAI-compatible error)
+	// Balance pre-check: reject if balance insufficient (OpenAI-compatible error).
+	// 路由分组的任一候选模型有优惠券或套餐额度即可放行
 	balance, _, _ := server.UserDB.GetBalance(userIDStr)
-	if balance <= 0 {
+	if balance <= 0 && !hasPrepaidAllowance(server, userIDStr, candidates) {
 		c.JSON(http.StatusPaymentRequired, gin.H{
 			"error": gin.H{
 				"message": "You exceeded your current quota, please check your plan and billing details. For more information on this error, see https://platform.openai.com/docs/guides/error-codes/api-errors.",
@@ -60,6 +81,33 @@ func HandleChatRequest(c *gin.Context, server *models.Server) {
 		return
 	}
 
+	// Spend limit check: reject once the user's daily/monthly hard limit is reached
+	if kind := server.SpendLimitDB.ExceededLimit(userIDStr); kind != "" {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": gin.H{
+				"message": "You have reached your " + strings.TrimSuffix(kind, "_limit") + " spend limit. Raise the limit in your account settings or wait for the next period.",
+				"type":    "insufficient_quota",
+				"param":   nil,
+				"code":    "spend_limit_exceeded",
+			},
+		})
+		return
+	}
+
+	// 带最高出价的请求按拍卖撮合派发
+	if bid, ok, err := requestBid(c, server); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + HeaderMaxBid + " header: " + err.Error()})
+		return
+	} else if ok {
+		c.Set(bidKey, bid)
+	}
+	routeOpts, err := requestRouteOptions(c, server)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(routeOptionsKey, routeOpts)
+
 	if request.Stream {
 		c.Writer.Header().Set("Content-Type", "text/event-stream")
 		c.Writer.Header().Set("Cache-Control", "no-cache")
@@ -69,40 +117,138 @@ func HandleChatRequest(c *gin.Context, server *models.Server) {
 	handleChatWithRetry(c, server, extendedRequest, userIDStr)
 }
 
-// handleChatWithRetry 在"第一个 token 前"对失败的请求进行自动重试。
+// hasPrepaidAllowance 判断用户是否有可用于 candidates 中任一模型的优惠券或套餐额度
+func hasPrepaidAllowance(server *models.Server, userID string, candidates []string) bool {
+	for _, model := range candidates {
+		if server.PromoCodeDB.HasUsableCoupon(userID, model) || server.SubscriptionDB.HasAllowance(userID, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleChatWithRetry 依次尝试请求的候选模型：普通请求只有一个，路由分组按分组顺序，
+// 当前模型没有可用 client（或都失败）时换下一个模型。
+func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest public.ExtendedChatRequest, userIDStr string) {
+	candidates, _ := c.Value(modelCandidatesKey).([]string)
+	if len(candidates) == 0 {
+		candidates = []string{extendedRequest.Model}
+	}
+	start := time.Now()
+	promptTokens := countPromptTokens(extendedRequest.ChatCompletionRequest) // 用于匹配长上下文阶梯价格
+	routeOpts, _ := c.Value(routeOptionsKey).(models.RouteOptions)
+	routeOpts.OutputTokens = expectedOutputTokens(extendedRequest.ChatCompletionRequest)
+	routeOpts.Requires = extendedRequest.Requirements(promptTokens)
+	if group, ok := c.Value(modelGroupKey).(*models.ModelGroup); ok {
+		// 分组的价格上限和能力要求对每个候选模型的派发同样生效
+		routeOpts = group.Constrain(routeOpts)
+	}
+
+	var missing []string
+	dispatched, noBid := false, true
+	for _, model := range candidates {
+		// 全局超时检查，避免极端情况下重试耗时过长
+		if time.Since(start) > public.CHAT_RETRY_TOTAL_TIMEOUT*time.Second {
+			break
+		}
+		// 跳过没有 client 具备请求所需能力（tools、图片、JSON 格式、思考、上下文长度）的模型，
+		// 避免派发后收到难以理解的 MODEL_ERROR
+		if m := server.MissingCapabilities(model, routeOpts.Requires); len(m) > 0 {
+			if missing == nil {
+				missing = m
+			}
+			continue
+		}
+		extendedRequest.Model = model
+		result := dispatchChat(c, server, extendedRequest, userIDStr, start, promptTokens, routeOpts)
+		if result == chatServed {
+			return
+		}
+		if len(candidates) > 1 {
+			log.Printf("model %s of group %s unavailable, trying next candidate", model, c.GetString(routeGroupKey))
+		}
+		dispatched = true
+		noBid = noBid && result == chatNoBid
+	}
+
+	switch {
+	case !dispatched && missing != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No provider for model %s supports: %s", candidates[0], strings.Join(missing, ", "))})
+	case dispatched && noBid:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No provider ask is within your max bid"})
+	default:
+		// 重试耗尽，返回明确错误
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "All clients failed, please retry"})
+	}
+}
+
+// dispatchChat 的结果
+const (
+	chatServed = iota // 已读到第一条消息并完成响应
+	chatFailed        // 没有可用 client 或重试耗尽
+	chatNoBid         // 带出价的请求没有报价在出价以内的 client
+)
+
+// dispatchChat 把请求派发给 extendedRequest.Model 的 client，在"第一个 token 前"对失败的请求进行自动重试。
 // 每次重试重新 LoadBalance（排除已失败的 client）、重新生成 fingerprint、
 // 重新建立响应通道。一旦读到第一条消息（MESSAGE/MESSAGE_STREAM），
 // 即进入正常处理流程，不再重试（此时用户可能已收到内容）。
-func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest public.ExtendedChatRequest, userIDStr string) {
+func dispatchChat(c *gin.Context, server *models.Server, extendedRequest public.ExtendedChatRequest, userIDStr string, start time.Time, promptTokens int, routeOpts models.RouteOptions) int {
 	request := extendedRequest.ChatCompletionRequest
 	failedClients := map[string]bool{}
-	start := time.Now()
+	bid, auction := c.Get(bidKey)
+	if auction && server.HasReservation(userIDStr, request.Model) {
+		auction = false // 已预留容量的请求按预留条款派发，不参与拍卖
+	}
+	rule := server.AuctionRule()
+
+	// 派发给 client 期间占用其一个并发槽位，重试前释放上一次的槽位，请求结束时释放最后一个
+	release := func() {}
+	defer func() { release() }()
 
 	for attempt := 0; attempt < public.MAX_CHAT_RETRY; attempt++ {
+		release()
 		// 全局超时检查，避免极端情况下重试耗时过长
 		if time.Since(start) > public.CHAT_RETRY_TOTAL_TIMEOUT*time.Second {
 			break
 		}
 
-		// 1. 选 client（排除已失败的）
-		client := server.LoadBalanceExcluding(request.Model, userIDStr, failedClients)
+		// 1. 选 client（排除已失败的）：带出价时按拍卖撮合，否则按负载均衡
+		var client *models.Client
+		var match *models.AuctionResult
+		if auction {
+			match = server.MatchAuction(request.Model, userIDStr, promptTokens, expectedOutputTokens(request), bid.(models.Bid), rule, failedClients, routeOpts)
+			if match == nil && attempt == 0 {
+				return chatNoBid
+			}
+			if match != nil {
+				client = match.Client
+			}
+		} else {
+			var score *models.ClientScore
+			client, score = server.LoadBalanceScored(request.Model, userIDStr, promptTokens, failedClients, routeOpts)
+			if score != nil {
+				c.Writer.Header().Set(HeaderScore, score.String())
+			}
+		}
 		if client == nil {
 			break
 		}
 		failedClients[client.ID] = true
+		release = server.AcquireSlot(client.ID, request.Model)
 
-		// 2. 从该 client 提取价格（计费使用实际服务的 client 价格）
-		ippm := 9.0  // 输入tokens价格（未命中缓存部分）
-		oppm := 9.0  // 输出tokens价格
-		cippm := 0.0 // 缓存命中输入tokens价格
-		for _, m := range client.Models {
-			if m.Name == request.Model {
-				ippm = m.IPPM
-				oppm = m.OPPM
-				cippm = m.CIPPM
-				break
-			}
+		// 2. 派发时对该 client 的报价做快照，整个请求（包括流式响应）都按快照计费，
+		// 响应过程中 client 改价不影响本次请求
+		price, ok := client.PriceSnapshot(request.Model)
+		if !ok {
+			// 未找到报价时的默认价格：输入/输出 9.0，缓存命中 0
+			price.IPPM, price.OPPM, price.RPPM = 9.0, 9.0, 9.0
 		}
+		if price, ok = reservedPrice(c, server, userIDStr, request.Model, client.ID, price); !ok && match != nil {
+			price = price.Cleared(match.ClearIPPM, match.ClearOPPM)
+			c.Set(auctionKey, match)
+		}
+		c.Set(pricedAtKey, price.At)
 
 		// 3. 生成新 fingerprint（每次重试必须重新生成）
 		fingerPrint := uuid.NewString()
@@ -111,27 +257,35 @@ func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest
 			log.Printf("save fingerprint and client relation failed: %v", err)
 		}
 
-		log.Println("Client ID:", client.ID, "Model:", request.Model, "IPPM:", ippm, "OPPM:", oppm, "CIPPM:", cippm)
+		log.Println("Client ID:", client.ID, "Model:", request.Model, "IPPM:", price.IPPM, "OPPM:", price.OPPM, "CIPPM:", price.CIPPM, "RPPM:", price.RPPM, "PPI:", price.PPI)
 
-		// 4. 发送请求到 client
-		if err := client.ControlConn.WriteJSON(public.WSMessage{
+		// 4. 发送请求到 client。先登记复用的响应流和就绪通知，client 可能在发送返回前就开始响应；
+		// Window 非 0 时新版本 client 在控制连接上返回响应，旧版本 client 仍建立 /response 连接
+		server.OpenStream(client, fingerPrint)
+		readyCh := server.AddRespClientChan(fingerPrint)
+		if err := client.WriteMessage(public.WSMessage{
 			Type:        public.MESSAGE,
 			Content:     extendedRequest,
 			FingerPrint: fingerPrint,
+			Window:      public.STREAM_WINDOW_SIZE,
 		}); err != nil {
 			log.Printf("attempt %d: send to client %s failed: %v", attempt, client.ID, err)
+			server.RecordClientResult(client.ID, 0, 0, true)
+			server.RemoveRespClientChan(fingerPrint)
+			server.RemoveRespClient(fingerPrint)
 			server.ClientFingerprintDB.DeleteFingerprint(fingerPrint)
 			time.Sleep(backoff(attempt))
 			continue
 		}
 
 		// 5. 等待响应连接就绪（替代自旋），最多等 CHAT_MAX_TIME
-		readyCh := server.AddRespClientChan(fingerPrint)
 		select {
 		case <-readyCh:
 		case <-time.After(public.CHAT_MAX_TIME * time.Second):
 			server.RemoveRespClientChan(fingerPrint)
+			server.RemoveRespClient(fingerPrint)
 			log.Printf("attempt %d: response conn timeout for client %s", attempt, client.ID)
+			server.RecordClientResult(client.ID, 0, 0, true)
 			abortClientRequest(client, fingerPrint)
 			server.ClientFingerprintDB.DeleteFingerprint(fingerPrint)
 			time.Sleep(backoff(attempt))
@@ -141,6 +295,8 @@ func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest
 		// 6. 获取响应连接
 		respConn, ok := server.GetRespClient(fingerPrint)
 		if !ok {
+			server.RecordClientResult(client.ID, 0, 0, true)
+			server.RemoveRespClient(fingerPrint)
 			abortClientRequest(client, fingerPrint)
 			server.ClientFingerprintDB.DeleteFingerprint(fingerPrint)
 			time.Sleep(backoff(attempt))
@@ -162,6 +318,7 @@ func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest
 		var response public.WSMessage
 		if err := respConn.ReadJSON(&response); err != nil {
 			log.Printf("attempt %d: read first msg from client %s failed: %v", attempt, client.ID, err)
+			server.RecordClientResult(client.ID, 0, 0, true)
 			respConn.Close()
 			server.RemoveRespClient(fingerPrint)
 			abortClientRequest(client, fingerPrint)
@@ -174,10 +331,14 @@ func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest
 		switch response.Type {
 		case public.MESSAGE, public.MESSAGE_STREAM:
 			// 成功！进入正常处理流程
-			handleChatResponseWithFirst(c, server, fingerPrint, time.Now(), client.ID, ippm, oppm, cippm, request.Model, response, respConn)
-			return
+			c.Set(firstTokenAtKey, time.Now())
+			setRequestMetaHeaders(c, fingerPrint, client.ID, price, response.Type == public.MESSAGE_STREAM)
+			c.Writer.Header().Set(HeaderModel, request.Model)
+			handleChatResponseWithFirst(c, server, fingerPrint, time.Now(), client.ID, price, request.Model, response, respConn)
+			return chatServed
 		case public.CLOSE:
 			log.Printf("attempt %d: client %s closed before first token", attempt, client.ID)
+			server.RecordClientResult(client.ID, 0, 0, true)
 			respConn.Close()
 			server.RemoveRespClient(fingerPrint)
 			server.ClientFingerprintDB.DeleteFingerprint(fingerPrint)
@@ -185,6 +346,7 @@ func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest
 			continue
 		case public.MODEL_ERROR:
 			log.Printf("attempt %d: model error from client %s: %v", attempt, client.ID, response.Content)
+			server.RecordClientResult(client.ID, 0, 0, true)
 			respConn.Close()
 			server.RemoveRespClient(fingerPrint)
 			server.ClientFingerprintDB.DeleteFingerprint(fingerPrint)
@@ -192,6 +354,7 @@ func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest
 			continue
 		default:
 			log.Printf("attempt %d: unexpected first msg type %s from client %s", attempt, response.Type, client.ID)
+			server.RecordClientResult(client.ID, 0, 0, true)
 			respConn.Close()
 			server.RemoveRespClient(fingerPrint)
 			server.ClientFingerprintDB.DeleteFingerprint(fingerPrint)
@@ -199,9 +362,7 @@ func handleChatWithRetry(c *gin.Context, server *models.Server, extendedRequest
 			continue
 		}
 	}
-
-	// 重试耗尽，返回明确错误
-	c.JSON(http.StatusServiceUnavailable, gin.H{"error": "All clients failed, please retry"})
+	return chatFailed
 }
 
 // backoff 指数退避：attempt=0 -> 100ms, 1 -> 200ms, 2 -> 400ms
@@ -212,12 +373,10 @@ func backoff(attempt int) time.Duration {
 // abortClientRequest 通知 client 停止处理指定 fingerprint 的请求（尽力而为）。
 // 用于 server 放弃某 client 时，避免 client 继续生成孤儿 token 浪费算力。
 func abortClientRequest(client *models.Client, fingerPrint string) {
-	if client == nil || client.ControlConn == nil {
+	if client == nil {
 		return
 	}
-	client.ControlConnMutex.Lock()
-	defer client.ControlConnMutex.Unlock()
-	if err := client.ControlConn.WriteJSON(public.WSMessage{
+	if err := client.WriteMessage(public.WSMessage{
 		Type:        public.CLOSE,
 		Content:     public.ABORT,
 		FingerPrint: fingerPrint,
@@ -229,7 +388,7 @@ func abortClientRequest(client *models.Client, fingerPrint string) {
 // cleanupChatRequest 统一清理 chat 请求资源：关闭响应连接、移除 RespClient、
 // 并将 fingerprint 状态更新为 completed（避免 transmitting 记录泄漏）。
 // 所有 chat 请求结束路径都应调用此函数，确保 fingerprint 不会永久停留在 transmitting。
-func cleanupChatRequest(server *models.Server, fingerPrint, clientID string, respConn *websocket.Conn) {
+func cleanupChatRequest(server *models.Server, fingerPrint, clientID string, respConn models.ResponseStream) {
 	if respConn != nil {
 		_ = respConn.Close()
 	}
@@ -241,19 +400,19 @@ func cleanupChatRequest(server *models.Server, fingerPrint, clientID string, res
 
 // handleChatResponseWithFirst 处理已读取的第一条响应消息（不再重复 ReadJSON）。
 // 由 handleChatWithRetry 在成功读到第一条消息后调用。
-func handleChatResponseWithFirst(c *gin.Context, server *models.Server, fingerPrint string, waitStart time.Time, clientID string, ippm, oppm, cippm float64, reqModel string, response public.WSMessage, respConn *websocket.Conn) {
+func handleChatResponseWithFirst(c *gin.Context, server *models.Server, fingerPrint string, waitStart time.Time, clientID string, price models.PriceSnapshot, reqModel string, response public.WSMessage, respConn models.ResponseStream) {
 	switch response.Type {
 	case public.MESSAGE:
-		handleStandardChatResponse(c, server, fingerPrint, response, clientID, ippm, oppm, cippm, reqModel, respConn)
+		handleStandardChatResponse(c, server, fingerPrint, response, clientID, price, reqModel, respConn)
 		return
 
 	case public.MESSAGE_STREAM:
-		finished := handleStreamChatResponse(c, server, fingerPrint, response, clientID, ippm, oppm, cippm, reqModel, respConn)
+		finished := handleStreamChatResponse(c, server, fingerPrint, response, clientID, price, reqModel, respConn)
 		if finished {
 			return
 		}
 		// continue reading stream
-		readStreamLoop(c, server, fingerPrint, respConn, waitStart, clientID, ippm, oppm, cippm, reqModel)
+		readStreamLoop(c, server, fingerPrint, respConn, waitStart, clientID, price, reqModel)
 		return
 
 	case public.CLOSE:
@@ -281,18 +440,19 @@ func handleChatResponseWithFirst(c *gin.Context, server *models.Server, fingerPr
 }
 
 // readStreamLoop 持续读取 stream 消息
-func readStreamLoop(c *gin.Context, server *models.Server, fingerPrint string, respConn *websocket.Conn, waitStart time.Time, clientID string, ippm, oppm, cippm float64, reqModel string) {
+func readStreamLoop(c *gin.Context, server *models.Server, fingerPrint string, respConn models.ResponseStream, waitStart time.Time, clientID string, price models.PriceSnapshot, reqModel string) {
 	for {
 		var response public.WSMessage
 		err := respConn.ReadJSON(&response)
 		if err != nil {
 			log.Println("Error while reading json from client:", err)
+			recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeTruncated)
 			cleanupChatRequest(server, fingerPrint, clientID, respConn)
 			return
 		}
 		switch response.Type {
 		case public.MESSAGE_STREAM:
-			finished := handleStreamChatResponse(c, server, fingerPrint, response, clientID, ippm, oppm, cippm, reqModel, respConn)
+			finished := handleStreamChatResponse(c, server, fingerPrint, response, clientID, price, reqModel, respConn)
 			if finished {
 				return
 			}
@@ -302,19 +462,26 @@ func readStreamLoop(c *gin.Context, server *models.Server, fingerPrint string, r
 				_, _ = c.Writer.Write([]byte("data: [DONE]\n\n"))
 				c.Writer.Flush()
 			}
+			// 未收到 finish_reason 就被关闭视为截断
+			if c.GetString(streamFinishReasonKey) == "" {
+				recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeTruncated)
+			}
 			cleanupChatRequest(server, fingerPrint, clientID, respConn)
 			return
 		case public.MODEL_ERROR:
 			log.Println("Model error:", response.Content)
+			recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeClientError)
 			cleanupChatRequest(server, fingerPrint, clientID, respConn)
 			return
 		default:
 			log.Println("Unknown message type:", response.Type)
+			recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeClientError)
 			cleanupChatRequest(server, fingerPrint, clientID, respConn)
 			return
 		}
 		if time.Since(waitStart) > public.CHAT_MAX_TIME*time.Second {
 			log.Println("Chat timeout")
+			recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeTruncated)
 			cleanupChatRequest(server, fingerPrint, clientID, respConn)
 			return
 		}
@@ -322,8 +489,9 @@ func readStreamLoop(c *gin.Context, server *models.Server, fingerPrint string, r
 }
 
 // handle standard chat response
-func handleStandardChatResponse(c *gin.Context, server *models.Server, fingerPrint string, response public.WSMessage, clientID string, ippm, oppm, cippm float64, reqModel string, conn *websocket.Conn) {
+func handleStandardChatResponse(c *gin.Context, server *models.Server, fingerPrint string, response public.WSMessage, clientID string, price models.PriceSnapshot, reqModel string, conn models.ResponseStream) {
 	if content, ok := response.Content.(map[string]interface{}); ok {
+		reportServedModel(c, content, reqModel)
 		jsonData, err := json.Marshal(content)
 		if err != nil {
 			log.Println("Error marshaling content:", err)
@@ -335,31 +503,30 @@ func handleStandardChatResponse(c *gin.Context, server *models.Server, fingerPri
 		err = json.Unmarshal(jsonData, &chatResponse)
 		if err != nil {
 			log.Println("Error unmarshaling content into ChatResponse struct:", err)
+			recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeClientError)
 			cleanupChatRequest(server, fingerPrint, clientID, conn)
 			return
 		}
 
-		c.JSON(http.StatusOK, content)
-
-		// 提取缓存命中tokens
-		cachedTokens := 0
-		if chatResponse.Usage.PromptTokensDetails != nil && chatResponse.Usage.PromptTokensDetails.CachedTokens > 0 {
-			cachedTokens = chatResponse.Usage.PromptTokensDetails.CachedTokens
-		}
+		// 先计费再返回，以便在响应头和 usage 中带上本次费用
+		usage := recordTokenUsage(c, server, fingerPrint, reqModel, chatResponse.Usage, clientID, price,
+			chatResponseOutcome(chatResponse))
+		setCostHeader(c, usage)
+		attachRequestMeta(c, content, usage)
 
-		recordTokenUsage(c, server, fingerPrint, reqModel,
-			chatResponse.Usage.PromptTokens, chatResponse.Usage.CompletionTokens,
-			chatResponse.Usage.TotalTokens, cachedTokens, clientID, ippm, oppm, cippm)
+		c.JSON(http.StatusOK, content)
 		cleanupChatRequest(server, fingerPrint, clientID, conn)
 	} else {
 		log.Println("Invalid message content format")
+		recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeClientError)
 		cleanupChatRequest(server, fingerPrint, clientID, conn)
 	}
 }
 
 // handle stream chat response
-func handleStreamChatResponse(c *gin.Context, server *models.Server, fingerPrint string, response public.WSMessage, clientID string, ippm, oppm, cippm float64, reqModel string, conn *websocket.Conn) bool {
+func handleStreamChatResponse(c *gin.Context, server *models.Server, fingerPrint string, response public.WSMessage, clientID string, price models.PriceSnapshot, reqModel string, conn models.ResponseStream) bool {
 	if content, ok := response.Content.(map[string]interface{}); ok {
+		reportServedModel(c, content, reqModel)
 		jsonData, err := json.Marshal(content)
 		if err != nil {
 			log.Println("Error marshaling content:", err)
@@ -371,96 +538,201 @@ func handleStreamChatResponse(c *gin.Context, server *models.Server, fingerPrint
 		err = json.Unmarshal(jsonData, &chatResponse)
 		if err != nil {
 			log.Println("Error unmarshaling content into ChatResponse struct:", err)
+			recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeClientError)
 			cleanupChatRequest(server, fingerPrint, clientID, conn)
 			return true
 		}
+		trackStreamChunk(c, chatResponse)
 
-		if chatResponse.Usage != nil {
-			log.Printf("chatResponse: usage prompt=%d, completion=%d, total=%d",
-				chatResponse.Usage.PromptTokens, chatResponse.Usage.CompletionTokens, chatResponse.Usage.TotalTokens)
+		// 带 usage 的数据块（可能在 finish_reason 之后单独发送）：先计费，
+		// 再把 starfire 对象写入该块的 usage，发送后以 [DONE] 结束
+		tokens, hasUsage := streamChunkUsage(chatResponse, content)
+		var usage *models.TokenUsage
+		if hasUsage {
+			log.Printf("Recording usage: prompt=%d, completion=%d, total=%d",
+				tokens.PromptTokens, tokens.CompletionTokens, tokens.TotalTokens)
+			usage = recordTokenUsage(c, server, fingerPrint, reqModel, tokens, clientID, price,
+				streamOutcome(c, tokens.CompletionTokens))
+			if usage != nil && wantsRequestMeta(c) {
+				attachRequestMeta(c, content, usage)
+				if data, err := json.Marshal(content); err == nil {
+					jsonData = data
+				}
+			}
 		}
 
 		// 发送数据到客户端
 		_, err = c.Writer.Write([]byte("data: " + string(jsonData) + "\n\n"))
 		if err != nil {
 			log.Println("Error while writing response:", err)
+			if !hasUsage {
+				recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeCancelled)
+			}
 			cleanupChatRequest(server, fingerPrint, clientID, conn)
 			return true
 		}
 		c.Writer.Flush()
 
-		// 检查是否有 usage 信息（可能在 finish_reason 之后的单独数据块中）
-		if chatResponse.Usage != nil && chatResponse.Usage.TotalTokens > 0 {
-			log.Printf("Recording usage: prompt=%d, completion=%d, total=%d",
-				chatResponse.Usage.PromptTokens, chatResponse.Usage.CompletionTokens, chatResponse.Usage.TotalTokens)
-
-			// 提取缓存命中tokens
-			cachedTokens := 0
-			if chatResponse.Usage.PromptTokensDetails != nil && chatResponse.Usage.PromptTokensDetails.CachedTokens > 0 {
-				cachedTokens = chatResponse.Usage.PromptTokensDetails.CachedTokens
-			}
-
-			recordTokenUsage(c, server, fingerPrint, reqModel,
-				chatResponse.Usage.PromptTokens, chatResponse.Usage.CompletionTokens,
-				chatResponse.Usage.TotalTokens, cachedTokens, clientID, ippm, oppm, cippm)
-
-			// 收到 usage 后发送 [DONE] 并结束
-			_, err = c.Writer.Write([]byte("data: [DONE]\n\n"))
+		if hasUsage {
+			_, _ = c.Writer.Write([]byte("data: [DONE]\n\n"))
+			setCostHeader(c, usage)
 			c.Writer.Flush()
 			cleanupChatRequest(server, fingerPrint, clientID, conn)
 			return true
 		}
 
-		// 检查是否完成（finish_reason 为 stop、tool_calls 或 length）
 		if len(chatResponse.Choices) > 0 && chatResponse.Choices[0].FinishReason != "" {
-			log.Printf("Received finish_reason: %s", chatResponse.Choices[0].FinishReason)
-			// 如果这个数据块中已经有 usage，直接处理
-			if usage, hasUsage := content["usage"].(map[string]interface{}); hasUsage {
-				promptTokens := int(usage["prompt_tokens"].(float64))
-				completionTokens := int(usage["completion_tokens"].(float64))
-				totalTokens := int(usage["total_tokens"].(float64))
-
-				// 从 prompt_tokens_details 中提取 cached_tokens
-				cachedTokens := 0
-				if ptd, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
-					if ct, ok := ptd["cached_tokens"].(float64); ok && ct > 0 {
-						cachedTokens = int(ct)
-					}
-				}
-
-				log.Printf("Recording usage from finish block: prompt=%d, completion=%d, total=%d, cached=%d",
-					promptTokens, completionTokens, totalTokens, cachedTokens)
-
-				recordTokenUsage(c, server, fingerPrint, reqModel,
-					promptTokens, completionTokens, totalTokens, cachedTokens, clientID, ippm, oppm, cippm)
-
-				_, err = c.Writer.Write([]byte("data: [DONE]\n\n"))
-				c.Writer.Flush()
-				cleanupChatRequest(server, fingerPrint, clientID, conn)
-				return true
-			}
 			// 如果没有 usage，继续等待下一个可能包含 usage 的数据块
-			log.Printf("Finish reason received but no usage yet, waiting for usage block...")
+			log.Printf("Received finish_reason: %s, waiting for usage block...", chatResponse.Choices[0].FinishReason)
 		}
 
 		return false
 	} else {
 		log.Println("Invalid message content format")
+		recordUnbilledOutcome(c, server, fingerPrint, reqModel, clientID, models.OutcomeClientError)
 		cleanupChatRequest(server, fingerPrint, clientID, conn)
 		return true
 	}
 }
 
-func recordTokenUsage(c *gin.Context, server *models.Server, requestID string, model string, inputTokens, outputTokens, totalTokens, cachedTokens int, clientID string, ippm, oppm, cippm float64) {
+// streamChunkUsage 提取数据块中的 usage。usage 可能单独成块（total_tokens > 0），
+// 也可能与 finish_reason 同块发送；cached_tokens 取自 prompt_tokens_details，
+// reasoning_tokens 取自 completion_tokens_details
+func streamChunkUsage(chunk openai.ChatCompletionStreamResponse, content map[string]interface{}) (openai.Usage, bool) {
+	if chunk.Usage != nil && chunk.Usage.TotalTokens > 0 {
+		return *chunk.Usage, true
+	}
+	if len(chunk.Choices) == 0 || chunk.Choices[0].FinishReason == "" {
+		return openai.Usage{}, false
+	}
+	usage, hasUsage := content["usage"].(map[string]interface{})
+	if !hasUsage {
+		return openai.Usage{}, false
+	}
+	p, _ := usage["prompt_tokens"].(float64)
+	c, _ := usage["completion_tokens"].(float64)
+	t, _ := usage["total_tokens"].(float64)
+	tokens := openai.Usage{PromptTokens: int(p), CompletionTokens: int(c), TotalTokens: int(t)}
+	if ptd, ok := usage["prompt_tokens_details"].(map[string]interface{}); ok {
+		if ct, ok := ptd["cached_tokens"].(float64); ok && ct > 0 {
+			tokens.PromptTokensDetails = &openai.PromptTokensDetails{CachedTokens: int(ct)}
+		}
+	}
+	if ctd, ok := usage["completion_tokens_details"].(map[string]interface{}); ok {
+		if rt, ok := ctd["reasoning_tokens"].(float64); ok && rt > 0 {
+			tokens.CompletionTokensDetails = &openai.CompletionTokensDetails{ReasoningTokens: int(rt)}
+		}
+	}
+	return tokens, true
+}
+
+// gin.Context 中记录流式响应状态的 key，收到 usage 时据此判定请求结果
+const (
+	streamFinishReasonKey = "stream_finish_reason"
+	streamHasContentKey   = "stream_has_content"
+)
+
+// trackStreamChunk 记录流式响应是否已产出内容以及 finish_reason
+func trackStreamChunk(c *gin.Context, chunk openai.ChatCompletionStreamResponse) {
+	for _, choice := range chunk.Choices {
+		delta := choice.Delta
+		if delta.Content != "" || delta.ReasoningContent != "" || len(delta.ToolCalls) > 0 || delta.FunctionCall != nil {
+			c.Set(streamHasContentKey, true)
+		}
+		if choice.FinishReason != "" {
+			c.Set(streamFinishReasonKey, string(choice.FinishReason))
+		}
+	}
+}
+
+// streamOutcome 判定流式请求结果：报告了输出 tokens 却没有任何内容视为 client_error，
+// 没有 finish_reason 视为 truncated
+func streamOutcome(c *gin.Context, completionTokens int) string {
+	if completionTokens > 0 && !c.GetBool(streamHasContentKey) {
+		return models.OutcomeClientError
+	}
+	if c.GetString(streamFinishReasonKey) == "" {
+		return models.OutcomeTruncated
+	}
+	return models.OutcomeCompleted
+}
+
+// chatResponseOutcome 判定非流式请求结果，规则与 streamOutcome 一致
+func chatResponseOutcome(resp openai.ChatCompletionResponse) string {
+	if len(resp.Choices) == 0 {
+		return models.OutcomeClientError
+	}
+	choice := resp.Choices[0]
+	msg := choice.Message
+	empty := msg.Content == "" && msg.ReasoningContent == "" && len(msg.MultiContent) == 0 &&
+		len(msg.ToolCalls) == 0 && msg.FunctionCall == nil
+	if resp.Usage.CompletionTokens > 0 && empty {
+		return models.OutcomeClientError
+	}
+	if choice.FinishReason == "" {
+		return models.OutcomeTruncated
+	}
+	return models.OutcomeCompleted
+}
+
+// recordUnbilledOutcome 记录未计费就结束的请求（用户断开、client 在返回 usage 前失败），
+// 便于按 RequestID 追溯请求结果。这些记录不写入 token_usages，不计入调用次数统计
+func recordUnbilledOutcome(c *gin.Context, server *models.Server, requestID, model, clientID, outcome string) {
 	if server.TokenUsageDB == nil {
-		log.Println("Token usage database not initialized")
 		return
 	}
+	usage := &models.TokenUsage{
+		RequestID: requestID,
+		UserID:    c.GetString("user_id"),
+		APIKey:    c.GetString("api_key_id"),
+		ClientIP:  c.ClientIP(),
+		ClientID:  clientID,
+		Model:     model,
+		Outcome:   outcome,
+		Timestamp: time.Now(),
+	}
+	applyTimings(c, usage)
+	if err := server.TokenUsageDB.SaveUnbilledOutcome(usage); err != nil {
+		log.Printf("记录请求结果失败: request=%s, outcome=%s, error=%v", requestID, outcome, err)
+	}
+}
+
+// autoRefund 对 provider 侧失败的请求自动退款并按同比例扣回 client 收益，返回退款比例和退款金额
+func autoRefund(server *models.Server, requestID, outcome string) (float64, float64) {
+	var ratio float64
+	switch outcome {
+	case models.OutcomeClientError:
+		ratio = 1
+	case models.OutcomeTruncated:
+		ratio = server.SystemConfigDB.GetFloat(models.ConfigKeyTruncatedRefundRatio, 0.5)
+	}
+	if ratio <= 0 {
+		return 0, 0
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	amount, err := server.RefundDB.Refund(requestID, ratio, "自动退款: "+outcome)
+	if err != nil {
+		log.Printf("自动退款失败: request=%s, outcome=%s, error=%v", requestID, outcome, err)
+		return 0, 0
+	}
+	log.Printf("自动退款: request=%s, outcome=%s, ratio=%.2f, amount=%.6f", requestID, outcome, ratio, amount)
+	return ratio, amount
+}
+
+// recordTokenUsage 计费并保存使用记录，返回保存的记录（失败时返回 nil）。
+// price 为派发时的报价快照；推理tokens与输入图片按各自的价格计费。
+func recordTokenUsage(c *gin.Context, server *models.Server, requestID string, model string, tokens openai.Usage, clientID string, price models.PriceSnapshot, outcome string) *models.TokenUsage {
+	if server.TokenUsageDB == nil {
+		log.Println("Token usage database not initialized")
+		return nil
+	}
 
 	userID, exists := c.Get("user_id")
 	if !exists {
 		log.Println("User ID not found in context")
-		return
+		return nil
 	}
 
 	apiKeyID := ""
@@ -468,74 +740,109 @@ func recordTokenUsage(c *gin.Context, server *models.Server, requestID string, m
 		apiKeyID = id.(string)
 	}
 
+	inputTokens, outputTokens, totalTokens := tokens.PromptTokens, tokens.CompletionTokens, tokens.TotalTokens
+	cachedTokens, reasoningTokens := 0, 0
+	if tokens.PromptTokensDetails != nil && tokens.PromptTokensDetails.CachedTokens > 0 {
+		cachedTokens = tokens.PromptTokensDetails.CachedTokens
+	}
+	if tokens.CompletionTokensDetails != nil && tokens.CompletionTokensDetails.ReasoningTokens > 0 {
+		reasoningTokens = min(tokens.CompletionTokensDetails.ReasoningTokens, outputTokens)
+	}
+	imageCount, imageBytes := c.GetInt(imageCountKey), c.GetInt64(imageBytesKey)
+
+	// 按实际提示长度匹配阶梯价格；折扣：用户按 provider 折扣与用户等级折扣中的最大值扣费，
+	// provider 只按自己设置的折扣结算收益，等级折扣由平台承担。按预留条款计价的请求不再打折。
+	price = price.ForPrompt(inputTokens)
+	list := price
+	reservationID := c.GetUint(reservationKey)
+	providerDiscount, discount := 0.0, 0.0
+	if reservationID == 0 {
+		providerDiscount, discount = server.DiscountRates(userID.(string), model, clientID)
+	}
+	charged := price.Discounted(discount)
+	price = price.Discounted(providerDiscount)
+
 	clientIP := c.ClientIP()
 	usage := &models.TokenUsage{
-		RequestID:    requestID,
-		UserID:       userID.(string),
-		APIKey:       apiKeyID,
-		ClientIP:     clientIP,
-		ClientID:     clientID,
-		Model:        model,
-		InputTokens:  inputTokens,
-		OutputTokens: outputTokens,
-		CachedTokens: cachedTokens,
-		TotalTokens:  totalTokens,
-		IPPM:         ippm,
-		OPPM:         oppm,
-		CIPPM:        cippm,
-		Timestamp:    time.Now(),
-	}
-
-	// Calculate cost: (non-cached input * ippm + cached input * cippm + output * oppm) / 1e6
-	cost := (float64(inputTokens-cachedTokens)*ippm + float64(cachedTokens)*cippm + float64(outputTokens)*oppm) / 1000000
-	if cost < 0 {
-		cost = 0
-	}
-	usage.Cost = cost
-
-	// Check and deduct balance before saving usage
+		RequestID:       requestID,
+		UserID:          userID.(string),
+		APIKey:          apiKeyID,
+		ClientIP:        clientIP,
+		ClientID:        clientID,
+		Model:           model,
+		InputTokens:     inputTokens,
+		OutputTokens:    outputTokens,
+		CachedTokens:    cachedTokens,
+		ReasoningTokens: reasoningTokens,
+		ImageCount:      imageCount,
+		ImageBytes:      imageBytes,
+		TotalTokens:     totalTokens,
+		IPPM:            price.IPPM,
+		OPPM:            price.OPPM,
+		CIPPM:           price.CIPPM,
+		RPPM:            price.RPPM,
+		PPI:             price.PPI,
+		ListIPPM:        list.IPPM,
+		ListOPPM:        list.OPPM,
+		ListCIPPM:       list.CIPPM,
+		ListRPPM:        list.RPPM,
+		ListPPI:         list.PPI,
+		DiscountRate:    discount,
+		ReservationID:   reservationID,
+		Outcome:         outcome,
+		Timestamp:       time.Now(),
+	}
+
+	// Calculate cost: (non-cached input * ippm + cached input * cippm + non-reasoning output * oppm
+	// + reasoning * rppm) / 1e6 + images * ppi
+	cost := charged.Cost(inputTokens, cachedTokens, outputTokens, reasoningTokens, imageCount)
 	userIDStr := userID.(string)
-	if err := server.UserDB.DeductBalance(userIDStr, cost); err != nil {
-		log.Printf("余额扣费失败: user=%s, cost=%.6f, error=%v", userIDStr, cost, err)
-		// Return OpenAI-compatible insufficient balance error
+
+	// 套餐额度、优惠券抵扣（抵扣额以 coupon 流水计入余额）和余额扣费在同一事务中完成，
+	// 完全由套餐额度覆盖的请求无需扣费（余额可能为 0）
+	covered, payable, err := server.ChargeUsage(userIDStr, model, requestID, totalTokens, cost)
+	if err != nil {
 		// We can't set HTTP status here since this is called after streaming starts,
 		// so we log and continue. The balance check should happen before sending to client.
-		// For non-stream requests we return error; for stream it's best-effort.
-		return
+		log.Printf("扣费失败: user=%s, cost=%.6f, error=%v", userIDStr, cost, err)
+		return nil
 	}
+	usage.PlanTokens = covered
+	usage.Cost = payable
 
-	err := server.TokenUsageDB.SaveTokenUsage(usage)
+	applyTimings(c, usage)
+	applyAuction(c, usage)
+	err = server.TokenUsageDB.SaveTokenUsage(usage)
 	if err != nil {
 		log.Printf("保存token使用记录失败: %v", err)
-		return
+		return nil
 	}
 	log.Printf("记录用户 %s 使用 %s 模型，消耗 %d tokens", userID, model, totalTokens)
+	addReservationUsage(server, usage)
+	recordClientResult(server, usage)
+	refundRatio, refunded := autoRefund(server, requestID, outcome)
+	usage.Refunded = refunded
+	go server.CheckReferralReward(userIDStr)
+	go server.CheckSpendAlerts(userIDStr)
 
 	// 根据client的用户userid 获取最新的总收入（异步执行，避免阻塞聊天请求）
 	chatClient := server.GetClientByModel(model, clientID)
 	if chatClient == nil {
 		log.Printf("client %s not found for model %s", clientID, model)
-		return
-	}
-
-	chatClient.ControlConnMutex.Lock()
-	conn := chatClient.ControlConn
-	chatClient.ControlConnMutex.Unlock()
-
-	if conn == nil {
-		log.Printf("client %s ControlConn is nil", clientID)
-		return
+		return usage
 	}
 
 	// 异步通知 client 收益更新，避免全表扫描阻塞聊天响应
 	go func(clientID, model string, income float64, inputTokens, outputTokens, totalTokens, cachedTokens int) {
+		server.CheckReferralReward(chatClient.User.ID)
 		totalIncomeResult, totalErr := server.TokenUsageDB.GetTotalIncomeByUserID(chatClient.User.ID, server.ClientDB)
 		if totalErr != nil {
 			log.Printf("获取用户 %s 总收入失败: %v", chatClient.User.ID, totalErr)
 			return
 		}
 		totalIncome, _ := totalIncomeResult.(float64)
-		_ = conn.WriteJSON(public.WSMessage{
+		// 控制连接上同时有派发和心跳的写入，必须经 WriteMessage 加锁写入
+		if err := chatClient.WriteMessage(public.WSMessage{
 			Type: public.INCOME,
 			Content: map[string]interface{}{
 				"model": model,
@@ -549,8 +856,11 @@ func recordTokenUsage(c *gin.Context, server *models.Server, requestID string, m
 				"total_income": totalIncome,
 				"timestamp":    strconv.Itoa(int(time.Now().Unix())),
 			},
-		})
+		}); err != nil {
+			log.Printf("notify client %s of income failed: %v", clientID, err)
+		}
 	}(clientID, model,
-		(ippm*float64(inputTokens-cachedTokens)+cippm*float64(cachedTokens)+oppm*float64(outputTokens))/1000000,
+		price.Cost(inputTokens, cachedTokens, outputTokens, reasoningTokens, imageCount)*(1-refundRatio),
 		inputTokens, outputTokens, totalTokens, cachedTokens)
+	return usage
 }
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/ollama/ollama/api"
 )
 
@@ -26,10 +27,9 @@ func HandleClientConnection(client *models.Client, server *models.Server) {
 	}()
 	handleClientMessages(client, server)
 
-	// 连接断开，主动清理该 client 注册的所有模型
-	for _, m := range client.Models {
-		server.RemoveClientInstance(m.Name, client)
-	}
+	// 连接断开，主动清理该 client 注册的所有模型，并结束其控制连接上的响应流
+	server.UnregisterClient(client)
+	server.CloseClientStreams(client)
 }
 
 func keepAliveClient(client *models.Client, server *models.Server) {
@@ -41,6 +41,12 @@ func keepAliveClient(client *models.Client, server *models.Server) {
 	for {
 		select {
 		case <-ticker.C:
+			if client.GetLatency() > public.MAXLATENCE {
+				log.Println("Client latency is too high, closing connection")
+				closeControlConn(client)
+				client.Status = "offline"
+				return
+			}
 			// 如果客户端连接断开，则关闭连接
 			client.ControlConnMutex.Lock()
 			if client.ControlConn == nil {
@@ -49,15 +55,21 @@ func keepAliveClient(client *models.Client, server *models.Server) {
 				client.Status = "offline"
 				return
 			}
-			pingTime := time.Now().UnixMilli()
-			client.LastPingTime = pingTime
-			err := client.ControlConn.WriteJSON(public.WSMessage{
-				Type: public.KEEPALIVE,
-				Content: public.PPMessage{
-					Type:      public.PING,
-					Timestamp: strconv.Itoa(int(pingTime)),
-				},
-			})
+			// WebSocket ping 帧携带发送时间，用于存活检测和测量延迟；KEEPALIVE 消息带上已收到的
+			// 模型集合版本，client 只在版本变化时回复完整的模型列表
+			now := time.Now()
+			pingTime := strconv.FormatInt(now.UnixMilli(), 10)
+			err := client.ControlConn.WriteControl(websocket.PingMessage, []byte(pingTime), now.Add(public.KEEPALIVE_TIME*time.Second))
+			if err == nil {
+				err = client.ControlConn.WriteJSON(public.WSMessage{
+					Type: public.KEEPALIVE,
+					Content: public.PPMessage{
+						Type:          public.PING,
+						Timestamp:     pingTime,
+						ModelsVersion: client.ModelsVersion,
+					},
+				})
+			}
 			client.ControlConnMutex.Unlock()
 			if err != nil {
 				log.Println("Error while writing ping message:", err)
@@ -66,71 +78,92 @@ func keepAliveClient(client *models.Client, server *models.Server) {
 			}
 
 		case pong := <-client.PongChan:
-			fmt.Println("<UNK>:", pong)
 			if pong == nil {
 				log.Println("Client pong message is nil")
 				client.Status = "offline"
 				return
 			}
-
-			latency, isHeartbeatResponse := heartbeatLatency(client, pong)
-			if isHeartbeatResponse {
-				client.SetLatency(int(latency))
-				fmt.Println("Client latency (ms):", client.GetLatency())
-			}
-
-			if isHeartbeatResponse && latency > public.MAXLATENCE {
-				log.Println("Client latency is too high, closing connection")
-				client.ControlConnMutex.Lock()
-				if client.ControlConn != nil {
-					client.ControlConn.Close()
-				}
-				client.ControlConnMutex.Unlock()
-				client.Status = "offline"
-				return
-			}
-
-			client.Models = pong.AvailableModels
-			var trends []*models.Trend
-			for _, m := range client.Models {
-				if m.OPPM > server.Conf.AllModelOutPutMaxPrice {
-					log.Printf("warning: model %s OPPM %.6f exceeds platform limit %.6f", m.Name, m.OPPM, server.Conf.AllModelOutPutMaxPrice)
-				}
-				if m.IPPM > server.Conf.AllModelInputMaxPrice {
-					log.Printf("warning: model %s IPPM %.6f exceeds platform limit %.6f", m.Name, m.IPPM, server.Conf.AllModelInputMaxPrice)
-				}
-				server.RegisterModel(m, client)
-				fmt.Println("Client available model:", m.Name, m)
-				// add trend for client keep alive
-				trends = append(trends, &models.Trend{
-					Name:        fmt.Sprintf("%s_%s", client.User.Username, "keep alive model: "+m.Name),
-					Description: "用户 " + client.User.Username + " 保持模型: " + m.Name + " 在线",
-					CreatedAt:   time.Now().Format("2006-01-02 15:04:05"),
-					UpdatedAt:   "",
-					DeletedAt:   "",
-					Active:      true,
-					User:        client.User,
-				})
-			}
+			handlePong(client, server, pong)
 			// batch save all trends in a single transaction (throttled: every 60s)
-			if time.Since(lastTrendSave) >= 60*time.Second && len(trends) > 0 {
-				if err := server.TrendDB.SaveTrends(trends); err != nil {
-					log.Println("Error saving trends:", err)
-				} else {
-					log.Printf("Trends saved successfully: %d records", len(trends))
+			if time.Since(lastTrendSave) >= 60*time.Second {
+				if trends := keepAliveTrends(client); len(trends) > 0 {
+					if err := server.TrendDB.SaveTrends(trends); err != nil {
+						log.Println("Error saving trends:", err)
+					} else {
+						log.Printf("Trends saved successfully: %d records", len(trends))
+					}
+					lastTrendSave = time.Now()
 				}
-				lastTrendSave = time.Now()
 			}
 			client.Status = "online"
 		}
 	}
 }
 
-func heartbeatLatency(client *models.Client, pong *public.PPMessage) (int64, bool) {
-	if client.LastPingTime <= 0 || pong.Timestamp != strconv.FormatInt(client.LastPingTime, 10) {
-		return 0, false
+// handlePong 处理心跳回复：携带模型列表时按快照重新登记，否则只更新负载
+func handlePong(client *models.Client, server *models.Server, pong *public.PPMessage) {
+	if pong.AvailableModels != nil {
+		snapshot, local := server.CanonicalizeModels(pong.AvailableModels)
+		models.PushModelAliases(client, local)
+		for _, m := range snapshot {
+			// 超过平台上限的价格按上限计费，并把下调后的价格推回 client
+			if server.ClampModelPrice(m) {
+				models.PushModelPrice(client, m)
+			}
+		}
+		client.SetModels(snapshot)
+		if pong.ModelsVersion != client.ModelsVersion {
+			log.Printf("client %s models version %d: %d models", client.ID, pong.ModelsVersion, len(client.Models))
+		}
+		client.ModelsVersion = pong.ModelsVersion
+	} else if pong.ModelsVersion != client.ModelsVersion {
+		log.Printf("client %s reported models version %d without snapshot, have %d", client.ID, pong.ModelsVersion, client.ModelsVersion)
+	}
+	// 每次心跳都按 client.Models 同步登记：模型集合与已登记的相同时不改动登记表，
+	// 负载均衡清理掉的模型在这里重新登记（版本未变的心跳不携带模型列表）
+	server.SyncModels(client)
+	if pong.Load != nil {
+		client.SetLoad(models.CanonicalizeLoad(pong.Load, client.Models))
+	}
+}
+
+// keepAliveTrends client 在线模型的动态记录
+func keepAliveTrends(client *models.Client) []*models.Trend {
+	var trends []*models.Trend
+	for _, m := range client.Models {
+		trends = append(trends, &models.Trend{
+			Name:        fmt.Sprintf("%s_%s", client.User.Username, "keep alive model: "+m.Name),
+			Description: "用户 " + client.User.Username + " 保持模型: " + m.Name + " 在线",
+			CreatedAt:   time.Now().Format("2006-01-02 15:04:05"),
+			UpdatedAt:   "",
+			DeletedAt:   "",
+			Active:      true,
+			User:        client.User,
+		})
+	}
+	return trends
+}
+
+// watchLiveness 超过 HEARTBEAT_TIMEOUT 未收到 client 的任何帧时读取超时断开连接；
+// client 回复的 pong 帧带回 ping 的发送时间，用于测量延迟
+func watchLiveness(client *models.Client, conn *websocket.Conn) {
+	timeout := public.HEARTBEAT_TIMEOUT * time.Second
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(data string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(timeout))
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			client.SetLatency(int(time.Now().UnixMilli() - sent))
+		}
+		return nil
+	})
+}
+
+func closeControlConn(client *models.Client) {
+	client.ControlConnMutex.Lock()
+	if client.ControlConn != nil {
+		client.ControlConn.Close()
 	}
-	return time.Now().UnixMilli() - client.LastPingTime, true
+	client.ControlConnMutex.Unlock()
 }
 
 // handle client messages
@@ -141,17 +174,21 @@ func handleClientMessages(client *models.Client, server *models.Server) {
 			client.Status = "offline"
 		}
 	}()
+	conn := client.ControlConn
+	watchLiveness(client, conn)
 	for {
 		var message public.WSMessage
-		err := client.ControlConn.ReadJSON(&message)
+		err := conn.ReadJSON(&message)
 		if err != nil {
 			log.Println("Error while reading message:", err)
 			client.ControlConnMutex.Lock()
+			conn.Close()
 			client.ControlConn = nil
 			client.ControlConnMutex.Unlock()
 			client.Status = "offline"
 			return
 		}
+		_ = conn.SetReadDeadline(time.Now().Add(public.HEARTBEAT_TIMEOUT * time.Second))
 
 		switch message.Type {
 		case public.KEEPALIVE:
@@ -163,6 +200,9 @@ func handleClientMessages(client *models.Client, server *models.Server) {
 		case public.MESSAGE:
 			handleChatMessage(client, message)
 
+		case public.STREAM_OPEN, public.STREAM_FRAME, public.STREAM_END:
+			server.HandleStreamMessage(client, message)
+
 		case public.MODEL_ERROR:
 			if content, ok := message.Content.(string); ok {
 				client.ErrChan <- fmt.Errorf("model error: %s", content)
@@ -204,30 +244,36 @@ func handleRegisterMessage(client *models.Client, server *models.Server, message
 		client.ID = registerInfo.ID
 		client.IP = registerInfo.IP
 		client.Token = registerInfo.Token
-		client.Models = registerInfo.Models
+		// 模型登记在规范 ID 下，并告诉 client 如何改回本地名称
+		registered, local := server.CanonicalizeModels(registerInfo.Models)
+		client.SetModels(registered)
+		models.PushModelAliases(client, local)
+		client.InferenceEngine = registerInfo.InferenceEngine
 		client.Status = "online"
 		client.RegisterTime = time.Now()
 
 		var trends []*models.Trend
 		for _, m := range client.Models {
-			fmt.Println("Registering model:", m.Name, "Type:", m.Type, "IPPM:", m.IPPM, "OPPM:", m.OPPM, server.Conf.AllModelOutPutMaxPrice, server.Conf.AllModelInputMaxPrice)
-			if m.OPPM > server.Conf.AllModelOutPutMaxPrice {
-				log.Printf("warning: model %s OPPM %.6f exceeds platform limit %.6f", m.Name, m.OPPM, server.Conf.AllModelOutPutMaxPrice)
-			}
-			if m.IPPM > server.Conf.AllModelInputMaxPrice {
-				log.Printf("warning: model %s IPPM %.6f exceeds platform limit %.6f", m.Name, m.IPPM, server.Conf.AllModelInputMaxPrice)
-			}
+			clamped := server.ClampModelPrice(m)
 			model := public.Model{
-				Name:  m.Name,
-				Type:  m.Type,
-				Size:  m.Size,
-				Arch:  m.Arch,
-				IPPM:  m.IPPM,  // 确保传递IPPM价格
-				OPPM:  m.OPPM,  // 确保传递OPPM价格
-				CIPPM: m.CIPPM, // 确保传递CIPPM价格
+				Name:         m.Name,
+				Type:         m.Type,
+				Size:         m.Size,
+				Arch:         m.Arch,
+				IPPM:         m.IPPM,  // 确保传递IPPM价格
+				OPPM:         m.OPPM,  // 确保传递OPPM价格
+				CIPPM:        m.CIPPM, // 确保传递CIPPM价格
+				RPPM:         m.RPPM,
+				PPI:          m.PPI,
+				PriceTiers:   m.PriceTiers,
+				Capabilities: m.Capabilities,
+				LocalName:    m.LocalName,
+				Quantization: m.Quantization,
 			}
-			fmt.Println("model is", model, m.OPPM, m.IPPM)
 			server.RegisterModel(&model, client)
+			if clamped {
+				models.PushModelPrice(client, &model)
+			}
 
 			// 为embedding模型添加特殊的trend记录
 			var description string
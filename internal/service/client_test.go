@@ -1,29 +1,107 @@
 package service
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"star-fire/internal/models"
 	"star-fire/pkg/public"
+
+	"github.com/gorilla/websocket"
 )
 
-func TestHeartbeatLatencyIgnoresUnsolicitedModelUpdate(t *testing.T) {
+func TestWatchLivenessMeasuresLatencyFromPong(t *testing.T) {
+	upgrader := websocket.Upgrader{}
 	client := &models.Client{}
-	pong := &public.PPMessage{Timestamp: strconv.FormatInt(time.Now().UnixMilli(), 10)}
+	measured := make(chan int, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		conn, err := upgrader.Upgrade(writer, request, nil)
+		if err != nil {
+			t.Errorf("upgrade websocket: %v", err)
+			return
+		}
+		defer conn.Close()
+		watchLiveness(client, conn)
+		sent := strconv.FormatInt(time.Now().Add(-10*time.Millisecond).UnixMilli(), 10)
+		if err := conn.WriteControl(websocket.PingMessage, []byte(sent), time.Now().Add(time.Second)); err != nil {
+			t.Errorf("write ping: %v", err)
+			return
+		}
+		// pong 帧在读取数据帧时由 pong handler 处理
+		var message public.WSMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			t.Errorf("read message: %v", err)
+		}
+		measured <- client.GetLatency()
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer conn.Close()
+	// 默认的 ping handler 原样回复 pong，读取时才会处理控制帧
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.WriteJSON(public.WSMessage{Type: public.KEEPALIVE}); err != nil {
+		t.Fatalf("write message: %v", err)
+	}
+
+	if latency := <-measured; latency < 10 || latency > 1000 {
+		t.Fatalf("latency = %dms, want measured from pong frame", latency)
+	}
+}
+
+func TestHandlePongAppliesSnapshotOnlyWhenPresent(t *testing.T) {
+	server := &models.Server{}
+	client := &models.Client{ID: "c1"}
+	handlePong(client, server, &public.PPMessage{
+		ModelsVersion:   3,
+		AvailableModels: []*public.Model{{Name: "qwen3:8b"}},
+	})
+	if client.ModelsVersion != 3 || server.GetClientByModel("qwen3-8b", "c1") != client {
+		t.Fatalf("snapshot not applied: version=%d models=%v", client.ModelsVersion, client.Models)
+	}
 
-	if latency, matched := heartbeatLatency(client, pong); matched || latency != 0 {
-		t.Fatalf("unsolicited model update matched heartbeat: latency=%d matched=%v", latency, matched)
+	// 只带负载的心跳沿用已有的模型列表，负载按规范 ID 记录
+	handlePong(client, server, &public.PPMessage{
+		ModelsVersion: 3,
+		Load:          &public.ClientLoad{Models: []public.ModelLoad{{Model: "qwen3:8b", Queued: 2}}},
+	})
+	if len(client.Models) != 1 || server.GetClientByModel("qwen3-8b", "c1") != client {
+		t.Fatalf("load-only pong changed models: %v", client.Models)
+	}
+	if ml, ok := client.Load().Model("qwen3-8b"); !ok || ml.Queued != 2 {
+		t.Fatalf("load not keyed by canonical id: %+v", client.Load())
 	}
 }
 
-func TestHeartbeatLatencyMatchesCurrentPing(t *testing.T) {
-	client := &models.Client{LastPingTime: time.Now().Add(-10 * time.Millisecond).UnixMilli()}
-	pong := &public.PPMessage{Timestamp: strconv.FormatInt(client.LastPingTime, 10)}
+func TestPongReregistersModelRemovedByCleanup(t *testing.T) {
+	server := &models.Server{}
+	client := &models.Client{ID: "c1"}
+	handlePong(client, server, &public.PPMessage{ModelsVersion: 1, AvailableModels: []*public.Model{{Name: "qwen3-8b"}}})
+	if server.GetClientByModel("qwen3-8b", "c1") != client {
+		t.Fatal("model not registered from the snapshot pong")
+	}
 
-	latency, matched := heartbeatLatency(client, pong)
-	if !matched || latency < 0 || latency > 1000 {
-		t.Fatalf("current heartbeat not matched: latency=%d matched=%v", latency, matched)
+	// 负载均衡清理后，版本未变、不携带模型列表的心跳重新登记该模型
+	server.RemoveClient("qwen3-8b", "c1")
+	if server.GetClientByModel("qwen3-8b", "c1") != nil {
+		t.Fatal("client still registered after cleanup")
+	}
+	handlePong(client, server, &public.PPMessage{ModelsVersion: 1})
+	if server.GetClientByModel("qwen3-8b", "c1") != client {
+		t.Fatal("client not routable again after the next heartbeat")
 	}
 }
@@ -19,16 +19,33 @@ import (
 func HandleEmbeddingRequest(c *gin.Context, server *models.Server) {
 	var request openai.EmbeddingRequest
 	fingerPrint := uuid.NewString()
+	c.Set(requestStartKey, time.Now())
 
 	err := c.ShouldBindJSON(&request)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	canonical, _ := server.CanonicalModel(string(request.Model))
+	request.Model = openai.EmbeddingModel(canonical)
 
-	// 使用专门的embedding负载均衡器
 	userID, _ := c.Get("user_id")
 	userIDStr, _ := userID.(string)
+
+	// Spend limit check: reject once the user's daily/monthly hard limit is reached
+	if kind := server.SpendLimitDB.ExceededLimit(userIDStr); kind != "" {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": gin.H{
+				"message": "You have reached your " + strings.TrimSuffix(kind, "_limit") + " spend limit. Raise the limit in your account settings or wait for the next period.",
+				"type":    "insufficient_quota",
+				"param":   nil,
+				"code":    "spend_limit_exceeded",
+			},
+		})
+		return
+	}
+
+	// 使用专门的embedding负载均衡器
 	client := server.LoadBalanceEmbedding(string(request.Model), userIDStr)
 	if client == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No available client for embedding model"})
@@ -43,7 +60,7 @@ func HandleEmbeddingRequest(c *gin.Context, server *models.Server) {
 
 	// Balance pre-check: reject if balance insufficient (OpenAI-compatible error)
 	balance, _, _ := server.UserDB.GetBalance(userIDStr)
-	if balance <= 0 {
+	if balance <= 0 && !server.PromoCodeDB.HasUsableCoupon(userIDStr, string(request.Model)) {
 		c.JSON(http.StatusPaymentRequired, gin.H{
 			"error": gin.H{
 				"message": "You exceeded your current quota, please check your plan and billing details. For more information on this error, see https://platform.openai.com/docs/guides/error-codes/api-errors.",
@@ -57,61 +74,80 @@ func HandleEmbeddingRequest(c *gin.Context, server *models.Server) {
 
 	// 获取embedding模型的定价 (只有输入tokens，没有输出tokens)
 	ippm := 0.1 // 默认embedding输入tokens价格
-	for _, m := range client.Models {
-		if m.Name == string(request.Model) {
-			ippm = m.IPPM
-			break
-		}
+	snapshot, ok := client.PriceSnapshot(string(request.Model))
+	if ok {
+		ippm = snapshot.IPPM
 	}
+	c.Set(pricedAtKey, snapshot.At)
 
 	log.Println("Client ID:", client.ID, "Embedding Model:", request.Model, "IPPM:", ippm)
 
+	// 请求结束前占用 client 的一个并发槽位
+	defer server.AcquireSlot(client.ID, string(request.Model))()
+
 	// 保存fingerprint和客户端关系
 	if err := server.ClientFingerprintDB.SaveFingerprint(fingerPrint, client.ID, "preparing"); err != nil {
 		log.Printf("save fingerprint and client relation failed: %v", err)
 	}
 
-	// 发送embedding请求到客户端
-	err = client.ControlConn.WriteJSON(public.WSMessage{
+	// 发送embedding请求到客户端，响应走控制连接上复用的流或旧版本 client 建立的 /response 连接
+	server.OpenStream(client, fingerPrint)
+	readyCh := server.AddRespClientChan(fingerPrint)
+	err = client.WriteMessage(public.WSMessage{
 		Type:        public.EMBEDDING_REQUEST,
 		Content:     request,
 		FingerPrint: fingerPrint,
+		Window:      public.STREAM_WINDOW_SIZE,
 	})
 	if err != nil {
+		server.RemoveRespClientChan(fingerPrint)
+		server.RemoveRespClient(fingerPrint)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error while writing json to client:" + err.Error()})
 		return
 	}
+	select {
+	case <-readyCh:
+	case <-time.After(public.CHAT_MAX_TIME * time.Second):
+		server.RemoveRespClientChan(fingerPrint)
+		server.RemoveRespClient(fingerPrint)
+		abortClientRequest(client, fingerPrint)
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Timeout waiting for client response"})
+		return
+	}
 
 	waitStart := time.Now()
-	handleEmbeddingResponse(c, server, fingerPrint, waitStart, client.ID, ippm)
+	handleEmbeddingResponse(c, server, fingerPrint, waitStart, client.ID, string(request.Model), ippm)
 }
 
 // handleEmbeddingResponse 处理embedding响应
-func handleEmbeddingResponse(c *gin.Context, server *models.Server, fingerPrint string, waitStart time.Time, clientID string, ippm float64) {
-	for {
-		if server.RespClients[fingerPrint] == nil {
-			time.Sleep(1 * time.Millisecond)
-			continue
-		}
+func handleEmbeddingResponse(c *gin.Context, server *models.Server, fingerPrint string, waitStart time.Time, clientID, model string, ippm float64) {
+	respConn, ok := server.GetRespClient(fingerPrint)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Response connection not found"})
+		cleanupEmbeddingRequest(server, fingerPrint)
+		return
+	}
 
-		// 更新fingerprint状态
-		if err := server.ClientFingerprintDB.UpdateFingerprint(fingerPrint, clientID, "transmitting"); err != nil {
-			log.Printf("update fingerprint failed: %v", err)
-			_ = server.RespClients[fingerPrint].Close()
-			server.RemoveRespClient(fingerPrint)
-			return
-		}
+	// 更新fingerprint状态
+	if err := server.ClientFingerprintDB.UpdateFingerprint(fingerPrint, clientID, "transmitting"); err != nil {
+		log.Printf("update fingerprint failed: %v", err)
+		_ = respConn.Close()
+		server.RemoveRespClient(fingerPrint)
+		return
+	}
 
+	for {
 		var response public.WSMessage
-		err := server.RespClients[fingerPrint].ReadJSON(&response)
+		err := respConn.ReadJSON(&response)
 		if err != nil {
 			log.Println("Error while reading json from client:", err)
+			cleanupEmbeddingRequest(server, fingerPrint)
 			return
 		}
 
 		switch response.Type {
 		case public.EMBEDDING_RESPONSE:
-			handleStandardEmbeddingResponse(c, server, fingerPrint, response, clientID, ippm)
+			handleStandardEmbeddingResponse(c, server, fingerPrint, response, clientID, model, ippm)
 			return
 
 		case public.MODEL_ERROR:
@@ -131,8 +167,9 @@ func handleEmbeddingResponse(c *gin.Context, server *models.Server, fingerPrint
 	}
 }
 
-// handleStandardEmbeddingResponse 处理标准embedding响应
-func handleStandardEmbeddingResponse(c *gin.Context, server *models.Server, fingerPrint string, response public.WSMessage, clientID string, ippm float64) {
+// handleStandardEmbeddingResponse 处理标准embedding响应。model 为请求的规范 ID，响应中的模型名是
+// client 引擎的本地名称，折扣、优惠券和使用记录都按规范 ID 匹配
+func handleStandardEmbeddingResponse(c *gin.Context, server *models.Server, fingerPrint string, response public.WSMessage, clientID, model string, ippm float64) {
 	// 将响应内容转换为OpenAI embedding响应格式
 	responseBytes, err := json.Marshal(response.Content)
 	if err != nil {
@@ -151,6 +188,12 @@ func handleStandardEmbeddingResponse(c *gin.Context, server *models.Server, fing
 		return
 	}
 
+	// 折扣后的成交价（与 chat 相同规则：等级折扣只降低用户扣费）
+	listIPPM := ippm
+	providerDiscount, discount := server.DiscountRates(c.GetString("user_id"), model, clientID)
+	chargedIPPM := ippm * (1 - discount)
+	ippm *= 1 - providerDiscount
+
 	// 计算token使用量和收益
 	inputTokens := calculateEmbeddingTokens(embeddingResp)
 	revenue := float64(inputTokens) * ippm / 1000000 // embedding只有输入tokens
@@ -163,17 +206,18 @@ func handleStandardEmbeddingResponse(c *gin.Context, server *models.Server, fing
 	requestID := fmt.Sprintf("emb_%s_%d", fingerPrint, time.Now().Unix())
 
 	// 记录token使用情况
-	cost := float64(inputTokens) * ippm / 1000000 // embedding只有输入tokens
+	cost := float64(inputTokens) * chargedIPPM / 1000000 // embedding只有输入tokens
 	if cost < 0 {
 		cost = 0
 	}
 
-	// Deduct balance
+	// 优惠券抵扣与余额扣费在同一事务中完成，embedding 不使用套餐额度
 	userIDStr := userID.(string)
-	if err := server.UserDB.DeductBalance(userIDStr, cost); err != nil {
-		log.Printf("余额扣费失败(embedding): user=%s, cost=%.6f, error=%v", userIDStr, cost, err)
+	if _, _, err := server.ChargeUsage(userIDStr, model, requestID, 0, cost); err != nil {
+		log.Printf("扣费失败(embedding): user=%s, cost=%.6f, error=%v", userIDStr, cost, err)
 		// Continue recording usage even if deduction fails
 	}
+	go server.CheckReferralReward(userIDStr)
 
 	tokenUsage := models.TokenUsage{
 		RequestID:    requestID,
@@ -181,8 +225,10 @@ func handleStandardEmbeddingResponse(c *gin.Context, server *models.Server, fing
 		APIKey:       apiKey.(string),
 		ClientID:     clientID,
 		ClientIP:     c.ClientIP(),
-		Model:        string(embeddingResp.Model),
+		Model:        model,
 		IPPM:         ippm,
+		ListIPPM:     listIPPM,
+		DiscountRate: discount,
 		OPPM:         0.0, // embedding没有输出tokens
 		InputTokens:  inputTokens,
 		OutputTokens: 0, // embedding没有输出tokens
@@ -194,6 +240,7 @@ func handleStandardEmbeddingResponse(c *gin.Context, server *models.Server, fing
 		Timestamp:    time.Now(),
 		CreatedAt:    time.Now(),
 	}
+	applyTimings(c, &tokenUsage)
 
 	err = server.TokenUsageDB.RecordTokenUsage(tokenUsage)
 	if err != nil {
@@ -201,13 +248,16 @@ func handleStandardEmbeddingResponse(c *gin.Context, server *models.Server, fing
 		// 即使记录失败，也继续返回响应
 	} else {
 		log.Printf("Embedding usage recorded - User: %s, Model: %s, Tokens: %d, Revenue: %.6f",
-			userID, embeddingResp.Model, inputTokens, revenue)
+			userID, model, inputTokens, revenue)
+		go server.CheckSpendAlerts(userIDStr)
 	}
 
 	log.Printf("Embedding completed - Fingerprint: %s, Input Tokens: %d, Revenue: %.6f",
 		fingerPrint, inputTokens, revenue)
 
 	// 返回embedding响应
+	setRequestMetaHeaders(c, requestID, clientID, models.PriceSnapshot{IPPM: listIPPM}, false)
+	setCostHeader(c, &tokenUsage)
 	c.JSON(http.StatusOK, embeddingResp)
 	cleanupEmbeddingRequest(server, fingerPrint)
 }
@@ -239,13 +289,11 @@ func calculateEmbeddingTokens(response openai.EmbeddingResponse) int {
 // isEmbeddingModelSupported 检查模型是否支持embedding
 func isEmbeddingModelSupported(client *models.Client, modelName openai.EmbeddingModel) bool {
 	// 检查客户端是否有这个模型
-	for _, model := range client.Models {
-		if model.Name == string(modelName) {
-			// 检查是否为embedding模型
-			return isEmbeddingModel(string(modelName))
-		}
+	if _, ok := client.ModelInfo(string(modelName)); !ok {
+		return false
 	}
-	return false
+	// 检查是否为embedding模型
+	return isEmbeddingModel(string(modelName))
 }
 
 // isEmbeddingModel 判断模型名称是否为embedding模型
@@ -357,10 +405,10 @@ func findSubstring(s, substr string) bool {
 
 // cleanupEmbeddingRequest 清理embedding请求资源
 func cleanupEmbeddingRequest(server *models.Server, fingerPrint string) {
-	if server.RespClients[fingerPrint] != nil {
-		_ = server.RespClients[fingerPrint].Close()
-		server.RemoveRespClient(fingerPrint)
+	if respConn, ok := server.GetRespClient(fingerPrint); ok {
+		_ = respConn.Close()
 	}
+	server.RemoveRespClient(fingerPrint)
 
 	// 更新fingerprint状态为完成
 	if err := server.ClientFingerprintDB.UpdateFingerprint(fingerPrint, "", "completed"); err != nil {
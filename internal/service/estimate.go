@@ -0,0 +1,54 @@
+package service
+
+import (
+	"net/http"
+	"star-fire/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+// HandleChatEstimate 估算一次 chat 请求的费用，不会向任何 client 派发请求。
+// 请求体与 /v1/chat/completions 相同；输出 tokens 取 max_completion_tokens 或 max_tokens。
+func HandleChatEstimate(c *gin.Context, server *models.Server) {
+	var request openai.ChatCompletionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if request.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		return
+	}
+
+	outputTokens := request.MaxCompletionTokens
+	if outputTokens == 0 {
+		outputTokens = request.MaxTokens
+	}
+
+	userIDStr := c.GetString("user_id")
+	// 路由分组按第一个有可用 client 的候选模型估算
+	candidates, group := server.ModelCandidates(userIDStr, request.Model)
+	if group == nil {
+		canonical, _ := server.CanonicalModel(request.Model)
+		candidates = []string{canonical}
+	}
+	est := &models.CostEstimate{Model: request.Model}
+	for _, model := range candidates {
+		if est = server.EstimateCost(model, userIDStr, countPromptTokens(request), outputTokens); est.EligibleClients > 0 {
+			break
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":           "chat.completion.estimate",
+		"model":            est.Model,
+		"prompt_tokens":    est.PromptTokens,
+		"output_tokens":    est.OutputTokens,
+		"eligible_clients": est.EligibleClients,
+		"cost": gin.H{
+			"min":    est.MinCost,
+			"median": est.MedianCost,
+			"max":    est.MaxCost,
+		},
+	})
+}
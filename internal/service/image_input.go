@@ -0,0 +1,41 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// gin.Context 中记录请求输入图片的 key，计费时写入使用记录
+const (
+	imageCountKey = "image_count"
+	imageBytesKey = "image_bytes"
+)
+
+// countImageInputs 统计请求消息中的输入图片数量，以及内联（data URL）图片解码后的总字节数。
+// 远程 URL 图片只计数，大小未知。
+func countImageInputs(messages []openai.ChatCompletionMessage) (count int, bytes int64) {
+	for _, msg := range messages {
+		for _, part := range msg.MultiContent {
+			if part.Type != openai.ChatMessagePartTypeImageURL || part.ImageURL == nil {
+				continue
+			}
+			count++
+			bytes += dataURLSize(part.ImageURL.URL)
+		}
+	}
+	return count, bytes
+}
+
+// dataURLSize 返回 base64 data URL 解码后的字节数，非 data URL 返回 0
+func dataURLSize(url string) int64 {
+	if !strings.HasPrefix(url, "data:") {
+		return 0
+	}
+	i := strings.Index(url, ";base64,")
+	if i < 0 {
+		return 0
+	}
+	payload := strings.TrimRight(url[i+len(";base64,"):], "=")
+	return int64(len(payload)) * 3 / 4
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestCountImageInputs(t *testing.T) {
+	messages := []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "you are helpful"},
+		{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: "compare these"},
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/a.png"}},
+			// "hello!" 的 base64
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/png;base64,aGVsbG8h"}},
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/png;base64,aGk="}},
+		}},
+	}
+	count, bytes := countImageInputs(messages)
+	if count != 3 || bytes != 6+2 {
+		t.Fatalf("got count=%d bytes=%d, want 3 and 8", count, bytes)
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"fmt"
+	"star-fire/internal/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 返回给调用方的请求元数据响应头
+const (
+	HeaderRequestID = "X-Starfire-Request-Id"
+	HeaderCost      = "X-Starfire-Cost"
+	HeaderProvider  = "X-Starfire-Provider"
+	HeaderPrice     = "X-Starfire-Price"
+	// HeaderModel 实际服务请求的模型，请求的 model 为路由分组时与请求不同
+	HeaderModel = "X-Starfire-Model"
+	// HeaderScore 使用 weighted 负载均衡时，选中 client 的评分明细
+	HeaderScore = "X-Starfire-Score"
+
+	// HeaderIncludeMetadata 调用方设置为 true 时，在 usage 中附带 starfire 对象
+	HeaderIncludeMetadata = "X-Starfire-Metadata"
+)
+
+// gin.Context 中记录请求耗时的 key
+const (
+	requestStartKey = "request_start"
+	firstTokenAtKey = "first_token_at"
+	pricedAtKey     = "priced_at"
+)
+
+// formatPrice 格式化单价响应头，token 单价为每百万 tokens，ppi 为每张输入图片
+func formatPrice(price models.PriceSnapshot) string {
+	return fmt.Sprintf("ippm=%s; cippm=%s; oppm=%s; rppm=%s; ppi=%s",
+		strconv.FormatFloat(price.IPPM, 'f', -1, 64),
+		strconv.FormatFloat(price.CIPPM, 'f', -1, 64),
+		strconv.FormatFloat(price.OPPM, 'f', -1, 64),
+		strconv.FormatFloat(price.RPPM, 'f', -1, 64),
+		strconv.FormatFloat(price.PPI, 'f', -1, 64))
+}
+
+// setRequestMetaHeaders 在写出响应前设置请求 ID、服务方和单价响应头。
+// 流式响应在开始时还不知道费用，X-Starfire-Cost 以 trailer 形式在结束时发送。
+func setRequestMetaHeaders(c *gin.Context, requestID, clientID string, price models.PriceSnapshot, stream bool) {
+	h := c.Writer.Header()
+	h.Set(HeaderRequestID, requestID)
+	h.Set(HeaderProvider, clientID)
+	h.Set(HeaderPrice, formatPrice(price))
+	if stream {
+		h.Set("Trailer", HeaderCost)
+	}
+}
+
+// setCostHeader 设置费用响应头（流式响应中作为 trailer）
+func setCostHeader(c *gin.Context, usage *models.TokenUsage) {
+	if usage == nil {
+		return
+	}
+	c.Writer.Header().Set(HeaderCost, strconv.FormatFloat(usage.NetCost(), 'f', -1, 64))
+}
+
+// wantsRequestMeta 调用方是否要求在 usage 中附带 starfire 对象
+func wantsRequestMeta(c *gin.Context) bool {
+	v := strings.ToLower(c.GetHeader(HeaderIncludeMetadata))
+	return v == "true" || v == "1"
+}
+
+// requestMeta 生成 usage.starfire 对象
+func requestMeta(usage *models.TokenUsage) map[string]interface{} {
+	return map[string]interface{}{
+		"request_id":  usage.RequestID,
+		"model":       usage.Model,
+		"provider":    usage.ClientID,
+		"cost":        usage.NetCost(),
+		"refunded":    usage.Refunded,
+		"plan_tokens": usage.PlanTokens,
+		"price": map[string]float64{
+			"ippm":  usage.IPPM,
+			"cippm": usage.CIPPM,
+			"oppm":  usage.OPPM,
+			"rppm":  usage.RPPM,
+			"ppi":   usage.PPI,
+		},
+		"list_price": map[string]float64{
+			"ippm":  usage.ListIPPM,
+			"cippm": usage.ListCIPPM,
+			"oppm":  usage.ListOPPM,
+			"rppm":  usage.ListRPPM,
+			"ppi":   usage.ListPPI,
+		},
+		"discount_rate": usage.DiscountRate,
+		"latency_ms":    usage.LatencyMs,
+		"ttft_ms":       usage.TTFTMs,
+		"outcome":       usage.Outcome,
+	}
+}
+
+// reportServedModel 请求的 model 为路由分组时，把响应中的 model 改为实际服务的模型
+func reportServedModel(c *gin.Context, content map[string]interface{}, model string) {
+	if c.GetString(routeGroupKey) != "" {
+		content["model"] = model
+	}
+}
+
+// attachRequestMeta 按需将 starfire 对象写入响应体的 usage 中
+func attachRequestMeta(c *gin.Context, content map[string]interface{}, usage *models.TokenUsage) {
+	if usage == nil || !wantsRequestMeta(c) {
+		return
+	}
+	if u, ok := content["usage"].(map[string]interface{}); ok {
+		u["starfire"] = requestMeta(usage)
+	}
+}
+
+// applyTimings 根据 context 中记录的时间点填充请求耗时与首 token 耗时
+func applyTimings(c *gin.Context, usage *models.TokenUsage) {
+	usage.PricedAt = c.GetTime(pricedAtKey)
+	start := c.GetTime(requestStartKey)
+	if start.IsZero() {
+		return
+	}
+	usage.LatencyMs = time.Since(start).Milliseconds()
+	if first := c.GetTime(firstTokenAtKey); !first.IsZero() {
+		usage.TTFTMs = first.Sub(start).Milliseconds()
+	}
+}
+
+// recordClientResult 把请求的首 token 耗时、输出速度和结果反馈给负载均衡评分
+func recordClientResult(server *models.Server, usage *models.TokenUsage) {
+	var tokensPerSec float64
+	if gen := usage.LatencyMs - usage.TTFTMs; usage.OutputTokens > 0 && usage.TTFTMs > 0 && gen > 0 {
+		tokensPerSec = float64(usage.OutputTokens) / (float64(gen) / 1000)
+	}
+	failed := usage.Outcome == models.OutcomeClientError || usage.Outcome == models.OutcomeTruncated
+	server.RecordClientResult(usage.ClientID, time.Duration(usage.TTFTMs)*time.Millisecond, tokensPerSec, failed)
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"star-fire/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestStreamChunkUsageFromFinishBlock(t *testing.T) {
+	chunk := openai.ChatCompletionStreamResponse{
+		Choices: []openai.ChatCompletionStreamChoice{{FinishReason: openai.FinishReasonStop}},
+	}
+	content := map[string]interface{}{
+		"usage": map[string]interface{}{
+			"prompt_tokens":             float64(10),
+			"completion_tokens":         float64(5),
+			"prompt_tokens_details":     map[string]interface{}{"cached_tokens": float64(4)},
+			"completion_tokens_details": map[string]interface{}{"reasoning_tokens": float64(3)},
+		},
+	}
+	tokens, ok := streamChunkUsage(chunk, content)
+	if !ok || tokens.PromptTokens != 10 || tokens.CompletionTokens != 5 || tokens.TotalTokens != 0 ||
+		tokens.PromptTokensDetails == nil || tokens.PromptTokensDetails.CachedTokens != 4 ||
+		tokens.CompletionTokensDetails == nil || tokens.CompletionTokensDetails.ReasoningTokens != 3 {
+		t.Fatalf("got %+v ok=%v", tokens, ok)
+	}
+
+	if _, ok := streamChunkUsage(openai.ChatCompletionStreamResponse{}, content); ok {
+		t.Fatal("chunk without finish_reason or usage should not report usage")
+	}
+}
+
+func TestAttachRequestMetaRequiresOptIn(t *testing.T) {
+	usage := &models.TokenUsage{RequestID: "req-1", ClientID: "client-1", Cost: 2, Refunded: 0.5}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+	content := map[string]interface{}{"usage": map[string]interface{}{}}
+	attachRequestMeta(c, content, usage)
+	if _, ok := content["usage"].(map[string]interface{})["starfire"]; ok {
+		t.Fatal("starfire metadata attached without opt-in")
+	}
+
+	c.Request.Header.Set(HeaderIncludeMetadata, "true")
+	attachRequestMeta(c, content, usage)
+	meta, ok := content["usage"].(map[string]interface{})["starfire"].(map[string]interface{})
+	if !ok || meta["cost"] != 1.5 || meta["provider"] != "client-1" {
+		t.Fatalf("unexpected starfire metadata: %v", meta)
+	}
+}
+
+func TestReportServedModelOnlyForRoutingGroups(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	content := map[string]interface{}{"model": "qwen3:8b"}
+	reportServedModel(c, content, "qwen3-8b")
+	if content["model"] != "qwen3:8b" {
+		t.Fatalf("model rewritten for a plain request: %v", content["model"])
+	}
+
+	c.Set(routeGroupKey, "auto")
+	reportServedModel(c, content, "qwen3-8b")
+	if content["model"] != "qwen3-8b" {
+		t.Fatalf("model = %v, want the served model", content["model"])
+	}
+}
+
+func TestPriceHeaderIncludesReasoningAndImagePrices(t *testing.T) {
+	got := formatPrice(models.PriceSnapshot{IPPM: 1, CIPPM: 0.5, OPPM: 2, RPPM: 8, PPI: 0.01})
+	if want := "ippm=1; cippm=0.5; oppm=2; rppm=8; ppi=0.01"; got != want {
+		t.Fatalf("price header = %q, want %q", got, want)
+	}
+}
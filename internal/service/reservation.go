@@ -0,0 +1,31 @@
+package service
+
+import (
+	"log"
+	"star-fire/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const reservationKey = "reservation_id"
+
+// reservedPrice 请求派发到用户预留的 client 时按预留条款计价，并记录预留 ID 供计费时累计用量
+func reservedPrice(c *gin.Context, server *models.Server, userID, model, clientID string, price models.PriceSnapshot) (models.PriceSnapshot, bool) {
+	res := server.ReservationFor(userID, model, clientID)
+	if res == nil {
+		c.Set(reservationKey, uint(0))
+		return price, false
+	}
+	c.Set(reservationKey, res.ID)
+	return res.Price(price), true
+}
+
+// addReservationUsage 累计预留窗口内按约定价格产生的费用，用于结算最低承诺金额
+func addReservationUsage(server *models.Server, usage *models.TokenUsage) {
+	if usage.ReservationID == 0 || server.ReservationDB == nil {
+		return
+	}
+	if err := server.ReservationDB.AddUsage(usage.ReservationID, usage.Cost); err != nil {
+		log.Printf("add reservation %d usage failed: %v", usage.ReservationID, err)
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"errors"
+	"star-fire/internal/models"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 调用方按请求选择路由策略的请求头
+const (
+	// HeaderLBStrategy 本次请求使用的负载均衡算法，如 cheapest
+	HeaderLBStrategy = "X-Starfire-LB-Strategy"
+	// HeaderLatencyBudget cheapest-within-latency-budget 的延迟预算（毫秒）
+	HeaderLatencyBudget = "X-Starfire-Latency-Budget"
+)
+
+const (
+	routeOptionsKey = "route_options"
+	apiKeyRecordKey = "api_key_record"
+	// 请求的 model 为路由分组时，分组名、分组定义和依次尝试的候选模型
+	routeGroupKey      = "route_group"
+	modelGroupKey      = "model_group"
+	modelCandidatesKey = "model_candidates"
+)
+
+// requestAPIKey 读取本次请求使用的 API Key 记录（同一请求只查询一次），JWT 认证的请求返回 nil
+func requestAPIKey(c *gin.Context, server *models.Server) *models.APIKey {
+	if v, ok := c.Get(apiKeyRecordKey); ok {
+		return v.(*models.APIKey)
+	}
+	var key *models.APIKey
+	if keyID := c.GetString("api_key_id"); keyID != "" && server.APIKeyDB != nil {
+		key, _ = server.APIKeyDB.GetAPIKeyByID(keyID)
+	}
+	c.Set(apiKeyRecordKey, key)
+	return key
+}
+
+// requestRouteOptions 读取调用方的路由策略：请求头优先，其次为 API Key 上的设置，都没有时使用平台默认
+func requestRouteOptions(c *gin.Context, server *models.Server) (models.RouteOptions, error) {
+	var opts models.RouteOptions
+	if key := requestAPIKey(c, server); key != nil {
+		opts.Algorithm = key.LBStrategy
+		opts.LatencyBudget = time.Duration(key.LatencyBudgetMs) * time.Millisecond
+	}
+	if strategy := c.GetHeader(HeaderLBStrategy); strategy != "" {
+		if !models.ValidLoadBalanceAlgorithm(strategy) {
+			return opts, errors.New("unsupported " + HeaderLBStrategy + ": " + strategy)
+		}
+		opts.Algorithm = strategy
+	}
+	if budget := c.GetHeader(HeaderLatencyBudget); budget != "" {
+		ms, err := strconv.Atoi(budget)
+		if err != nil || ms <= 0 {
+			return opts, errors.New("invalid " + HeaderLatencyBudget + ": must be a positive number of milliseconds")
+		}
+		opts.LatencyBudget = time.Duration(ms) * time.Millisecond
+	}
+	return opts, nil
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"unicode/utf8"
+
+	tiktoken "github.com/pkoukk/tiktoken-go"
+	"github.com/sashabaranov/go-openai"
+)
+
+// 服务端估算 prompt tokens 使用通用的 cl100k_base 编码。各 client 上的开源模型分词器不同，
+// 这里只求量级准确；编码文件首次使用时需要下载，加载完成前按字节数粗略估算。
+var (
+	tokenizerOnce sync.Once
+	tokenizerMu   sync.RWMutex
+	tokenizer     *tiktoken.Tiktoken
+)
+
+func loadTokenizer() {
+	tokenizerOnce.Do(func() {
+		go func() {
+			tkm, err := tiktoken.GetEncoding("cl100k_base")
+			if err != nil {
+				log.Printf("load tokenizer failed, falling back to byte estimate: %v", err)
+				return
+			}
+			tokenizerMu.Lock()
+			tokenizer = tkm
+			tokenizerMu.Unlock()
+		}()
+	})
+}
+
+// countTokens 计算文本的 token 数；分词器不可用时按约 4 字节 / token（中文约 1 字 / token）估算
+func countTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	loadTokenizer()
+	tokenizerMu.RLock()
+	tkm := tokenizer
+	tokenizerMu.RUnlock()
+	if tkm != nil {
+		return len(tkm.EncodeOrdinary(text))
+	}
+	runes := utf8.RuneCountInString(text)
+	if est := len(text) / 4; est > runes {
+		return est
+	}
+	return runes
+}
+
+// countPromptTokens 按 OpenAI cookbook 的规则估算 chat 请求的 prompt tokens：
+// 每条消息额外 3 个 token，name 额外 1 个，回复前缀 3 个
+func countPromptTokens(req openai.ChatCompletionRequest) int {
+	n := 3
+	for _, msg := range req.Messages {
+		n += 3
+		n += countTokens(msg.Role)
+		n += countTokens(msg.Content)
+		for _, part := range msg.MultiContent {
+			n += countTokens(part.Text)
+		}
+		if msg.Name != "" {
+			n += countTokens(msg.Name) + 1
+		}
+		for _, call := range msg.ToolCalls {
+			n += countTokens(call.Function.Name) + countTokens(call.Function.Arguments)
+		}
+	}
+	for _, tool := range req.Tools {
+		if tool.Function != nil {
+			n += countTokens(tool.Function.Name) + countTokens(tool.Function.Description)
+			if params, err := json.Marshal(tool.Function.Parameters); err == nil {
+				n += countTokens(string(params))
+			}
+		}
+	}
+	return n
+}
@@ -56,3 +56,36 @@ func (r *ExtendedChatRequest) BuildRequestBody() ([]byte, error) {
 	}
 	return json.Marshal(merged)
 }
+
+// Requirements 根据请求内容推断所需的模型能力：tools/functions、图片输入、
+// JSON 输出格式、思考参数以及上下文长度（promptTokens 加请求的最大输出 tokens）。
+func (r *ExtendedChatRequest) Requirements(promptTokens int) Requirements {
+	req := Requirements{
+		Tools:         len(r.Tools) > 0 || len(r.Functions) > 0,
+		ContextTokens: promptTokens + max(r.MaxCompletionTokens, r.MaxTokens),
+	}
+	for _, msg := range r.Messages {
+		for _, part := range msg.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				req.Vision = true
+			}
+		}
+	}
+	if f := r.ResponseFormat; f != nil {
+		req.JSONSchema = f.Type == openai.ChatCompletionResponseFormatTypeJSONSchema ||
+			f.Type == openai.ChatCompletionResponseFormatTypeJSONObject
+	}
+	switch {
+	case r.EnableThinking != nil:
+		req.Reasoning = *r.EnableThinking
+	case len(r.Thinking) > 0:
+		var thinking struct {
+			Type string `json:"type"`
+		}
+		_ = json.Unmarshal(r.Thinking, &thinking)
+		req.Reasoning = thinking.Type != "disabled"
+	default:
+		req.Reasoning = r.ReasoningEffort != "" && r.ReasoningEffort != "none"
+	}
+	return req
+}
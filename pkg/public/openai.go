@@ -46,8 +46,108 @@ type Model struct {
 	Size        string       `json:"size"`
 	Arch        string       `json:"arch"`
 	Engine      string       `json:"engine"`
-	IPPM        float64      `json:"ippm"`  // 输入tokens价格（未命中缓存部分）
-	OPPM        float64      `json:"oppm"`  // 输出tokens价格
-	CIPPM       float64      `json:"cippm"` // 缓存命中输入tokens价格 (cached input price per million)
+	IPPM        float64      `json:"ippm"`                  // 输入tokens价格（未命中缓存部分）
+	OPPM        float64      `json:"oppm"`                  // 输出tokens价格
+	CIPPM       float64      `json:"cippm"`                 // 缓存命中输入tokens价格 (cached input price per million)
+	RPPM        float64      `json:"rppm"`                  // 推理tokens价格，0 表示按输出tokens价格计费
+	PPI         float64      `json:"ppi"`                   // 每张输入图片的额外价格，0 表示不单独收费
+	PriceTiers  []PriceTier  `json:"price_tiers,omitempty"` // 长上下文阶梯价格
 	OpenAIModel openai.Model `json:"openai_model"`
+
+	Capabilities *Capabilities `json:"capabilities,omitempty"` // 引擎声明的能力，nil 表示未声明（旧版本 client）
+
+	// 服务端把模型登记在规范 ID（Name）下，LocalName 为 client 引擎中的原名称
+	LocalName    string `json:"local_name,omitempty"`
+	Quantization string `json:"quantization,omitempty"` // 量化版本，如 q4_k_m
+}
+
+// PriceTier 长上下文阶梯价格：提示 tokens 数 >= MinPromptTokens 时整个请求按该档计价，
+// 价格为 0 的项沿用基础价格
+type PriceTier struct {
+	MinPromptTokens int     `json:"min_prompt_tokens"`
+	IPPM            float64 `json:"ippm"`
+	OPPM            float64 `json:"oppm"`
+	CIPPM           float64 `json:"cippm"`
+}
+
+// MatchPriceTier 返回 promptTokens 适用的阶梯（门槛最高的一档），没有匹配时返回 nil
+func MatchPriceTier(tiers []PriceTier, promptTokens int) *PriceTier {
+	var matched *PriceTier
+	for i := range tiers {
+		t := &tiers[i]
+		if t.MinPromptTokens <= promptTokens && (matched == nil || t.MinPromptTokens > matched.MinPromptTokens) {
+			matched = t
+		}
+	}
+	return matched
+}
+
+// PriceFor 返回提示长度为 promptTokens 时的输入/输出/缓存命中价格
+func (m *Model) PriceFor(promptTokens int) (ippm, oppm, cippm float64) {
+	ippm, oppm, cippm = m.IPPM, m.OPPM, m.CIPPM
+	if t := MatchPriceTier(m.PriceTiers, promptTokens); t != nil {
+		if t.IPPM > 0 {
+			ippm = t.IPPM
+		}
+		if t.OPPM > 0 {
+			oppm = t.OPPM
+		}
+		if t.CIPPM > 0 {
+			cippm = t.CIPPM
+		}
+	}
+	return ippm, oppm, cippm
+}
+
+// 模型能力名称，用于能力声明与缺失提示
+const (
+	CapabilityTools      = "tools"
+	CapabilityVision     = "vision"
+	CapabilityJSONSchema = "json_schema"
+	CapabilityReasoning  = "reasoning"
+	CapabilityContext    = "context_length"
+)
+
+// Capabilities 模型声明支持的能力
+type Capabilities struct {
+	Tools      bool `json:"tools"`
+	Vision     bool `json:"vision"`
+	JSONSchema bool `json:"json_schema"`
+	Reasoning  bool `json:"reasoning"`
+	MaxContext int  `json:"max_context,omitempty"` // 最大上下文 tokens，0 表示未知
+}
+
+// Requirements 一次请求需要模型具备的能力
+type Requirements struct {
+	Tools         bool
+	Vision        bool
+	JSONSchema    bool
+	Reasoning     bool
+	ContextTokens int // 提示 tokens + 请求的最大输出 tokens
+}
+
+// Missing 返回模型不具备的请求能力。未声明能力的模型视为全部支持，
+// 上下文长度未知时不做检查。
+func (m *Model) Missing(req Requirements) []string {
+	c := m.Capabilities
+	if c == nil {
+		return nil
+	}
+	var missing []string
+	if req.Tools && !c.Tools {
+		missing = append(missing, CapabilityTools)
+	}
+	if req.Vision && !c.Vision {
+		missing = append(missing, CapabilityVision)
+	}
+	if req.JSONSchema && !c.JSONSchema {
+		missing = append(missing, CapabilityJSONSchema)
+	}
+	if req.Reasoning && !c.Reasoning {
+		missing = append(missing, CapabilityReasoning)
+	}
+	if c.MaxContext > 0 && req.ContextTokens > c.MaxContext {
+		missing = append(missing, CapabilityContext)
+	}
+	return missing
 }
@@ -1,5 +1,7 @@
 package public
 
+import "encoding/json"
+
 const KEEPALIVE = "keepalive"
 const REGISTER = "register"
 const MESSAGE = "message"
@@ -11,11 +13,21 @@ const MODEL_ERROR = "model_error"
 const EMBEDDING_RESPONSE = "embedding_response"
 const EMBEDDING_REQUEST = "embedding_request"
 const MODEL_PRICE_UPDATE = "model_price_update"
+const MODEL_ALIASES = "model_aliases" // server -> client：规范模型 ID 到 client 本地名称的映射
+
+// 控制连接上按 fingerprint 复用的响应流，替代为每个请求建立的 /response 连接。
+// server 派发请求时在 Window 中声明初始发送窗口；旧版本 server 不声明，client 仍为请求建立 /response 连接
+const STREAM_OPEN = "stream_open"     // client -> server：开始响应流
+const STREAM_FRAME = "stream_frame"   // client -> server：响应流中的一帧，Frame 为原本写入 /response 连接的消息，占用一个窗口
+const STREAM_END = "stream_end"       // client -> server：响应流结束
+const STREAM_WINDOW = "stream_window" // server -> client：消费帧后为响应流追加 Window 个发送窗口
+const STREAM_WINDOW_SIZE = 64         // 每个响应流的初始发送窗口（帧），也是 server 为每个流缓冲的帧数
 
 const PING = "ping"
 const PONG = "pong"
 const MAXLATENCE = 30000
 const KEEPALIVE_TIME = 5
+const HEARTBEAT_TIMEOUT = 3 * KEEPALIVE_TIME // 秒，超过该时间未收到对端任何帧（含 WebSocket ping/pong）视为断线
 const CHAT_MAX_TIME = 180
 
 const MAX_CHAT_RETRY = 3            // 最大重试次数
@@ -25,22 +37,60 @@ const CHAT_RETRY_TOTAL_TIMEOUT = 10 // 重试总超时(秒)
 const ABORT = "abort" // 取消消息标记：server 放弃某请求时通知 client 停止处理
 
 type WSMessage struct {
-	Type        string      `json:"type"`
-	Content     interface{} `json:"content"`
-	FingerPrint string      `json:"fingerprint"`
+	Type        string          `json:"type"`
+	Content     interface{}     `json:"content"`
+	FingerPrint string          `json:"fingerprint"`
+	Window      int             `json:"window,omitempty"` // MESSAGE/EMBEDDING_REQUEST 中为初始发送窗口，STREAM_WINDOW 中为追加的窗口
+	Frame       json.RawMessage `json:"frame,omitempty"`  // STREAM_FRAME 承载的响应消息
 }
 
 type PPMessage struct {
-	Type            string   `json:"type"`
-	Timestamp       string   `json:"timestamp"`
-	AvailableModels []*Model `json:"update_model"`
+	Type            string      `json:"type"`
+	Timestamp       string      `json:"timestamp"`
+	AvailableModels []*Model    `json:"update_model"`
+	Load            *ClientLoad `json:"load,omitempty"` // client 当前负载，旧版本 client 不上报
+	// ping 中为 server 已收到的模型集合版本；pong 中为 client 当前的版本，
+	// 与 server 已知的版本不同时才携带完整的 AvailableModels。旧版本为 0，每次都携带
+	ModelsVersion uint64 `json:"models_version,omitempty"`
+}
+
+// ModelLoad 单个模型在 client 上的负载
+type ModelLoad struct {
+	Model    string `json:"model"`
+	Active   int    `json:"active"`              // 正在生成的请求数
+	Queued   int    `json:"queued"`              // 已接收、等待推理引擎空闲的请求数
+	Loaded   bool   `json:"loaded"`              // 是否已加载到内存（Ollama /api/ps），远程 API 模型始终为 true
+	SizeVRAM int64  `json:"size_vram,omitempty"` // 已加载模型占用的显存
+}
+
+// ClientLoad client 在心跳中上报的负载
+type ClientLoad struct {
+	MaxParallel int         `json:"max_parallel"` // 推理引擎可同时处理的请求数
+	Active      int         `json:"active"`
+	Queued      int         `json:"queued"`
+	CPUPercent  float64     `json:"cpu_percent"` // 两次心跳之间的 CPU 使用率，无法获取时为 0
+	MemPercent  float64     `json:"mem_percent"`
+	Models      []ModelLoad `json:"models"`
+}
+
+// Model 返回 model 的负载，未上报时返回 false
+func (l *ClientLoad) Model(name string) (ModelLoad, bool) {
+	for _, m := range l.Models {
+		if m.Model == name {
+			return m, true
+		}
+	}
+	return ModelLoad{}, false
 }
 
 type ModelPriceUpdate struct {
-	Model string  `json:"model"`
-	IPPM  float64 `json:"ippm"`
-	OPPM  float64 `json:"oppm"`
-	CIPPM float64 `json:"cippm"`
+	Model string      `json:"model"`
+	IPPM  float64     `json:"ippm"`
+	OPPM  float64     `json:"oppm"`
+	CIPPM float64     `json:"cippm"`
+	RPPM  float64     `json:"rppm"`
+	PPI   float64     `json:"ppi"`
+	Tiers []PriceTier `json:"price_tiers,omitempty"`
 }
 
 func ISStrINArray(str string, arr []string) bool {
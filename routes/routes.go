@@ -17,7 +17,7 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 
 	authHandler := user_handlers.NewAuthHandler(authService)
 	apiKeyHandler := user_handlers.NewAPIKeyHandler(apiKeyService)
-	priceCapHandler := user_handlers.NewPriceCapHandler(server.UserPriceCapDB)
+	priceCapHandler := user_handlers.NewPriceCapHandler(server)
 	modelPriceHandler := user_handlers.NewModelPriceHandler(server)
 
 	clientHandler := client_handlers.NewClientHandler(server, registerTokenService)
@@ -26,6 +26,19 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 	marketHandler := user_handlers.NewMarketHandler(server)
 	userHandler := user_handlers.NewUserHandler(server)
 	balanceHandler := user_handlers.NewBalanceHandler(server)
+	promoHandler := user_handlers.NewPromoHandler(server)
+	referralHandler := user_handlers.NewReferralHandler(server)
+	auctionHandler := user_handlers.NewAuctionHandler(server)
+	reservationHandler := user_handlers.NewReservationHandler(server)
+	loadBalanceHandler := user_handlers.NewLoadBalanceHandler(server)
+	subscriptionHandler := user_handlers.NewSubscriptionHandler(server)
+	disputeHandler := user_handlers.NewDisputeHandler(server)
+	statementHandler := user_handlers.NewStatementHandler(server)
+	spendLimitHandler := user_handlers.NewSpendLimitHandler(server)
+	discountHandler := user_handlers.NewDiscountHandler(server)
+	priceCeilingHandler := user_handlers.NewPriceCeilingHandler(server)
+	modelCatalogHandler := user_handlers.NewModelCatalogHandler(server)
+	modelGroupHandler := user_handlers.NewModelGroupHandler(server)
 
 	// 登录和注册路由
 	r.POST("/api/login", authHandler.Login)
@@ -47,6 +60,8 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 		marketAPI.GET("/models", marketHandler.ModelsHandler)
 		marketAPI.GET("/models/stats", marketHandler.ModelStatsHandler)
 		marketAPI.GET("/trends", marketHandler.TrendsHandler)
+		marketAPI.GET("/price-history", marketHandler.PriceHistoryHandler)
+		marketAPI.GET("/clearing-prices", auctionHandler.ClearingPrices)
 		// marketAPI.POST("/messages", apiKeyHandler.CreateAPIKey)
 	}
 
@@ -60,6 +75,8 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 		userAPI.GET("/keys", apiKeyHandler.GetAPIKeys)
 		userAPI.PUT("/keys/:id", apiKeyHandler.RevokeAPIKey)
 		userAPI.DELETE("/keys/:id", apiKeyHandler.DeleteAPIKey)
+		userAPI.PUT("/keys/:id/bid", apiKeyHandler.SetMaxBid)
+		userAPI.PUT("/keys/:id/routing", apiKeyHandler.SetRouting)
 
 		userAPI.GET("/token-usage", tokenUsageHandler.GetUserTokenUsage)
 		userAPI.GET("/usage/total", tokenUsageHandler.GetUserUsageTotal)
@@ -67,17 +84,45 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 		userAPI.GET("/usage/trend", tokenUsageHandler.GetUserUsageTrend)
 		userAPI.GET("/usage/models", tokenUsageHandler.GetUserUsageModels)
 		userAPI.GET("/usage/models/:model", tokenUsageHandler.GetUserUsageModelDetail)
+		userAPI.GET("/usage/keys", tokenUsageHandler.GetUserUsageKeys)
+		userAPI.GET("/usage/export", tokenUsageHandler.ExportUserUsage)
 		userAPI.GET("/income", tokenUsageHandler.GetUserIncome)
 		userAPI.GET("/income/total", tokenUsageHandler.GetUserIncomeTotal)
 		userAPI.GET("/income/stats", tokenUsageHandler.GetUserIncomeStats)
 		userAPI.GET("/income/trend", tokenUsageHandler.GetUserIncomeTrend)
 		userAPI.GET("/income/models", tokenUsageHandler.GetUserIncomeModels)
+		userAPI.GET("/income/export", tokenUsageHandler.ExportUserIncome)
 
 		// Balance and recharge
 		userAPI.GET("/balance", balanceHandler.GetBalance)
 		userAPI.POST("/recharge", balanceHandler.CreateRechargeOrder)
 		userAPI.POST("/recharge/confirm", balanceHandler.ConfirmRecharge)
 		userAPI.GET("/recharge/history", balanceHandler.GetRechargeHistory)
+		userAPI.GET("/balance/history", balanceHandler.GetBalanceHistory)
+
+		// Promo codes, coupons and referral
+		userAPI.POST("/promo-codes/redeem", promoHandler.RedeemPromoCode)
+		userAPI.GET("/coupons", promoHandler.ListCoupons)
+		userAPI.GET("/referral", referralHandler.GetReferral)
+
+		// Subscription plans
+		userAPI.GET("/plans", subscriptionHandler.ListPlans)
+		userAPI.GET("/subscription", subscriptionHandler.GetSubscription)
+		userAPI.POST("/subscription", subscriptionHandler.Subscribe)
+		userAPI.DELETE("/subscription", subscriptionHandler.CancelSubscription)
+
+		// Billing disputes
+		userAPI.POST("/disputes", disputeHandler.CreateDispute)
+		userAPI.GET("/disputes", disputeHandler.ListMyDisputes)
+
+		// Monthly statements
+		userAPI.GET("/statements", statementHandler.ListStatements)
+		userAPI.GET("/statements/:id", statementHandler.GetStatement)
+
+		// Spend limits and alerts
+		userAPI.GET("/spend-limits", spendLimitHandler.GetSpendLimit)
+		userAPI.PUT("/spend-limits", spendLimitHandler.UpdateSpendLimit)
+		userAPI.GET("/spend-limits/alerts", spendLimitHandler.ListSpendAlerts)
 
 		// Price cap configuration: userID is taken from JWT, not from the request body.
 		userAPI.GET("/price-caps", priceCapHandler.ListPriceCaps)
@@ -87,6 +132,24 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 		// Model price management: set prices for your own provided models.
 		userAPI.GET("/my-models", modelPriceHandler.ListMyModels)
 		userAPI.PUT("/model-price/:model", modelPriceHandler.UpdateModelPrice)
+
+		// Capacity reservations: reserve a provider's client, or respond to reservations on your own clients.
+		userAPI.POST("/reservations", reservationHandler.CreateReservation)
+		userAPI.GET("/reservations", reservationHandler.ListMyReservations)
+		userAPI.DELETE("/reservations/:id", reservationHandler.CancelReservation)
+		userAPI.GET("/reservations/incoming", reservationHandler.ListIncomingReservations)
+		userAPI.PUT("/reservations/:id/respond", reservationHandler.RespondReservation)
+
+		// Discounts offered to specific users on your own clients.
+		userAPI.GET("/discounts", discountHandler.ListMyDiscounts)
+		userAPI.POST("/discounts", discountHandler.SaveMyDiscount)
+		userAPI.PUT("/discounts/:id", discountHandler.UpdateMyDiscount)
+		userAPI.DELETE("/discounts/:id", discountHandler.DeleteMyDiscount)
+
+		// Routing groups: virtual model names that fall back across models or match a capability query.
+		userAPI.GET("/model-groups", modelGroupHandler.ListMyModelGroups)
+		userAPI.PUT("/model-groups/:name", modelGroupHandler.SaveMyModelGroup)
+		userAPI.DELETE("/model-groups/:name", modelGroupHandler.DeleteMyModelGroup)
 	}
 
 	api := r.Group("/v1")
@@ -96,6 +159,9 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 		api.POST("/chat/completions", func(c *gin.Context) {
 			service.HandleChatRequest(c, server)
 		})
+		api.POST("/chat/completions/estimate", func(c *gin.Context) {
+			service.HandleChatEstimate(c, server)
+		})
 		// Embedding
 		api.POST("/embeddings", func(c *gin.Context) {
 			service.HandleEmbeddingRequest(c, server)
@@ -104,6 +170,8 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 		api.GET("/models", func(c *gin.Context) {
 			user_handlers.ModelsHandler(c, server)
 		})
+		// 单次请求的计费与服务信息
+		api.GET("/requests/:id", tokenUsageHandler.GetRequest)
 	}
 
 	// 管理员路由
@@ -111,5 +179,34 @@ func SetupRoutes(r *gin.Engine, server *models.Server) {
 	admin.Use(middleware.JWTAuth(server.UserDB), middleware.AdminRequired())
 	{
 		// 管理员处理器
+		admin.POST("/promo-codes", promoHandler.CreatePromoCode)
+		admin.GET("/promo-codes", promoHandler.ListPromoCodes)
+		admin.PUT("/promo-codes/:code", promoHandler.UpdatePromoCode)
+		admin.DELETE("/promo-codes/:code", promoHandler.DeactivatePromoCode)
+		admin.PUT("/referral-config", referralHandler.SetReferralConfig)
+		admin.POST("/plans", subscriptionHandler.CreatePlan)
+		admin.GET("/plans", subscriptionHandler.ListAllPlans)
+		admin.PUT("/plans/:id", subscriptionHandler.UpdatePlan)
+		admin.GET("/disputes", disputeHandler.ListDisputes)
+		admin.PUT("/disputes/:id", disputeHandler.ResolveDispute)
+		admin.POST("/statements/close", statementHandler.CloseStatements)
+		admin.GET("/discounts", discountHandler.ListTierDiscounts)
+		admin.POST("/discounts", discountHandler.SaveTierDiscount)
+		admin.PUT("/discounts/:id", discountHandler.UpdateTierDiscount)
+		admin.DELETE("/discounts/:id", discountHandler.DeleteTierDiscount)
+		admin.PUT("/users/:id/tier", discountHandler.SetUserTier)
+		admin.GET("/price-ceilings", priceCeilingHandler.ListPriceCeilings)
+		admin.PUT("/price-ceilings/:model", priceCeilingHandler.SetPriceCeiling)
+		admin.DELETE("/price-ceilings/:model", priceCeilingHandler.DeletePriceCeiling)
+		admin.GET("/model-aliases", modelCatalogHandler.ListModelAliases)
+		admin.PUT("/model-aliases", modelCatalogHandler.SaveModelAlias)
+		admin.DELETE("/model-aliases/*alias", modelCatalogHandler.DeleteModelAlias)
+		admin.GET("/model-groups", modelGroupHandler.ListModelGroups)
+		admin.PUT("/model-groups/:name", modelGroupHandler.SaveModelGroup)
+		admin.DELETE("/model-groups/:name", modelGroupHandler.DeleteModelGroup)
+		admin.GET("/auction-config", auctionHandler.GetAuctionConfig)
+		admin.PUT("/auction-config", auctionHandler.SetAuctionConfig)
+		admin.GET("/lb-weights", loadBalanceHandler.GetScoreWeights)
+		admin.PUT("/lb-weights", loadBalanceHandler.SetScoreWeights)
 	}
 }